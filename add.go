@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// addFlags are the flags of add.
+type addFlags struct {
+	match   string
+	command string
+	name    string
+	desc    string
+	to      string
+}
+
+func (f *addFlags) define(fs *flag.FlagSet) {
+	fs.StringVar(&f.match, "match", "", "Regex matched against the input")
+	fs.StringVar(&f.command, "cmd", "", "Command to run, split like a shell would")
+	fs.StringVar(&f.name, "name", "", "Name of the rule")
+	fs.StringVar(&f.desc, "description", "", "Label of the rule")
+	fs.StringVar(&f.to, "to", "nearest", "Config to add to: user, nearest or a path")
+}
+
+// addCommand appends a rule to a config. The file is only appended to, so its
+// comments and formatting are kept.
+func addCommand(ctx context.Context, args []string, opts options) int {
+	var given addFlags
+	flags := commandFlags("add", given.define)
+	flags.Parse(args)
+
+	if given.match == "" || given.command == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	if _, err := regexp.Compile(given.match); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Invalid regex %q: %v", given.match, err))
+		return 1
+	}
+	argv, err := shellSplit(given.command)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Invalid command %q: %v", given.command, err))
+		return 1
+	}
+
+	path, err := addTarget(given.to, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := appendRule(path, given.name, given.match, given.desc, argv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(opts.Engine.trf("Added rule to %s", path))
+	return 0
+}
+
+// appendRule writes a rule at the end of a config, creating it if needed.
+func appendRule(path, name, match, desc string, argv []string) error {
+	var rule strings.Builder
+	rule.WriteString("[[rule]]\n")
+	if name != "" {
+		rule.WriteString("name = " + formatString(name) + "\n")
+	}
+	rule.WriteString("match = " + formatString(match) + "\n")
+	if desc != "" {
+		rule.WriteString("description = " + formatString(desc) + "\n")
+	}
+	apporte := make([]interface{}, len(argv))
+	for i, arg := range argv {
+		apporte[i] = arg
+	}
+	value, _ := formatAny(apporte, true, 0)
+	rule.WriteString("apporte = " + value + "\n")
+
+	src, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	updated := string(src)
+	if updated != "" {
+		updated = strings.TrimRight(updated, "\n") + "\n\n"
+	}
+	updated += rule.String()
+
+	var check interface{}
+	if _, err := toml.Decode(updated, &check); err != nil {
+		return fmt.Errorf("not adding to %s, it isn't valid TOML: %w", path, err)
+	}
+	// the user's own addition doesn't make the config less trustworthy
+	err = keepTrust(path, func() error {
+		return os.WriteFile(path, []byte(updated), 0o644)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// addTarget resolves the config named by --to. Without any config in the
+// crawl path, the nearest one is created in the current directory.
+func addTarget(to string, opts options) (string, error) {
+	switch to {
+	case "user":
+		userConfDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("no user config directory: %w", err)
+		}
+		return filepath.Join(userConfDir, ".apporte.toml"), nil
+	case "nearest":
+		cwd, _ := os.Getwd()
+		startDir, err := crawlStart(cwd, opts.Physical)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: %v", err))
+		}
+		if path := nearestConfig(startDir, []string{opts.Config}); path != "" {
+			return path, nil
+		}
+		return ".apporte.toml", nil
+	}
+	return to, nil
+}
+
+// shellSplit splits a command line into arguments the way a POSIX shell
+// would, honoring quotes and backslashes but nothing else.
+func shellSplit(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ageSuffix marks configs encrypted with age, as in .apporte.toml.age.
+const ageSuffix = ".age"
+
+// decryptedConfigs caches decrypted configs for the life of the process, so
+// that watching a directory doesn't decrypt them on every event. A config
+// that changes is decrypted again. The plaintext never touches the disk.
+type decryptedConfigs struct {
+	sync.Mutex
+	byKey map[string][]byte
+}
+
+// readConfigFile reads a config of at most limit bytes. A config that
+// exists but can't be read is reported with unreadableConfig, one that
+// doesn't exist with an fs.ErrNotExist error.
+func readConfigFile(path string, limit int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, unreadableConfig(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, unreadableConfig(err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("config is larger than %d bytes, see --max-config-size", limit)
+	}
+	return data, nil
+}
+
+// decryptConfig returns the contents of a config as read from path,
+// decrypted with the identity file if it is encrypted.
+func (e *engine) decryptConfig(ctx context.Context, path string, data []byte, identity string) ([]byte, error) {
+	if !strings.HasSuffix(path, ageSuffix) {
+		return data, nil
+	}
+	if identity == "" {
+		return nil, errors.New("config is encrypted, but no config sets age_identity")
+	}
+	key := path + "\x00" + identity + "\x00" + configHash(data)
+
+	decrypted := &e.decrypted
+	decrypted.Lock()
+	defer decrypted.Unlock()
+	if data, ok := decrypted.byKey[key]; ok {
+		return data, nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "age", "--decrypt", "--identity", identity)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	plain, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if decrypted.byKey == nil {
+		decrypted.byKey = map[string][]byte{}
+	}
+	decrypted.byKey[key] = plain
+	return plain, nil
+}
+
+// ageIdentity returns the identity file for the encrypted configs among
+// paths: the age_identity of the first of the user's own configs setting
+// one, those given with -c then the user config, resolved from its
+// directory. A crawled config can't choose the key the user's configs are
+// decrypted with. Configs are only read for it if there is any encrypted
+// config to load.
+func (e *engine) ageIdentity(ctx context.Context, paths []string, prioritizedConfigPath []string, limits crawlLimits) string {
+	encrypted := false
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil && strings.HasSuffix(path, ageSuffix) {
+			encrypted = true
+			break
+		}
+	}
+	if !encrypted {
+		return ""
+	}
+
+	for _, path := range append(slices.Clone(prioritizedConfigPath), userConfigPath()) {
+		if path == "" || strings.HasSuffix(path, ageSuffix) {
+			continue
+		}
+		// problems with the config are reported as it's loaded
+		tc, _, err := e.decodeOwnConfig(ctx, path, limits)
+		if err != nil || tc.AgeIdentity == "" {
+			continue
+		}
+		identity := tc.AgeIdentity
+		if rest, ok := strings.CutPrefix(identity, "~/"); ok {
+			if home, err := os.UserHomeDir(); err == nil {
+				identity = filepath.Join(home, rest)
+			}
+		}
+		if !filepath.IsAbs(identity) {
+			identity = filepath.Join(filepath.Dir(path), identity)
+		}
+		return identity
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// commandPolicy is the user's allow and deny lists of commands, applying to
+// the dispatches of every config.
+type commandPolicy struct {
+	Allow []string `toml:"allow"` // only these run, if set
+	Deny  []string `toml:"deny"`
+	path  string
+}
+
+// policyPath returns the file with the user's command policy.
+func policyPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apporte", "policy.toml"), nil
+}
+
+// readPolicy reads the command policy, which the engine does once. Without a
+// policy file every command is allowed, with one that fails to parse none
+// is.
+func readPolicy() (commandPolicy, error) {
+	p, err := policyPath()
+	if err != nil {
+		return commandPolicy{}, nil
+	}
+	policy := commandPolicy{path: p}
+	if _, err := toml.DecodeFile(p, &policy); err != nil {
+		if os.IsNotExist(err) {
+			return commandPolicy{}, nil
+		}
+		return policy, fmt.Errorf("invalid command policy %s: %w", p, err)
+	}
+	return policy, nil
+}
+
+// unsafeEnv are the variables that change which program a command runs, or
+// what it loads, which the rules of configs with allow_commands can't set.
+var unsafeEnv = []string{
+	"PATH", "LD_*", "DYLD_*", "BASH_ENV", "ENV", "PYTHONPATH", "PYTHONSTARTUP",
+	"PERL5LIB", "PERL5OPT", "RUBYLIB", "RUBYOPT", "NODE_OPTIONS", "GCONV_PATH",
+}
+
+// commandMatches reports whether a command is one of a list of names, such
+// as "mpv" or "python3*", or absolute paths. Names only match commands
+// given by name, which are looked up in $PATH, not a program of that name
+// anywhere else.
+func commandMatches(command string, list []string) bool {
+	if runtime.GOOS == "windows" {
+		command = strings.TrimSuffix(strings.ToLower(command), ".exe")
+	}
+	named := !strings.ContainsAny(command, `/\`)
+	for _, entry := range list {
+		if runtime.GOOS == "windows" {
+			entry = strings.ToLower(entry)
+		}
+		if strings.ContainsAny(entry, `/\`) {
+			if filepath.Clean(entry) == filepath.Clean(command) {
+				return true
+			}
+		} else if ok, _ := path.Match(entry, command); ok && named {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicy checks commands against the user's command policy.
+func (e *engine) checkPolicy(commands ...[]string) error {
+	policy, err := e.policy()
+	if err != nil {
+		return err
+	}
+	for _, argv := range commands {
+		if len(argv) == 0 {
+			continue
+		}
+		// denied programs are denied wherever they are
+		if commandMatches(argv[0], policy.Deny) || commandMatches(filepath.Base(argv[0]), policy.Deny) {
+			return fmt.Errorf("command %s is denied by %s", argv[0], policy.path)
+		}
+		if policy.Allow != nil && !commandMatches(argv[0], policy.Allow) {
+			return fmt.Errorf("command %s isn't allowed by %s", argv[0], policy.path)
+		}
+	}
+	return nil
+}
+
+// checkAllowCommands checks commands against the allow_commands of a config,
+// if it has one.
+func checkAllowCommands(allowed []string, commands ...[]string) error {
+	if allowed == nil {
+		return nil
+	}
+	for _, argv := range commands {
+		if len(argv) > 0 && !commandMatches(argv[0], allowed) {
+			return fmt.Errorf("command %s isn't in allow_commands", argv[0])
+		}
+	}
+	return nil
+}
+
+// checkAllowedRule checks a rule of a config with allow_commands as written:
+// its commands must name their program without a placeholder, and its
+// environment can't change what the program is or loads.
+func checkAllowedRule(rule Rule) error {
+	if rule.Allowed == nil {
+		return nil
+	}
+	own := append(append(append([][]string{}, rule.Steps...), rule.Apporte), rule.OrElse...)
+	own = append(append(own, rule.Pre...), rule.Post...)
+	for _, argv := range own {
+		if len(argv) > 0 && placeholderRe.MatchString(argv[0]) {
+			return fmt.Errorf("command %s has a placeholder, which allow_commands doesn't allow", argv[0])
+		}
+	}
+	if err := checkAllowCommands(rule.Allowed, own...); err != nil {
+		return err
+	}
+	for _, name := range append(slices.Sorted(maps.Keys(rule.Env)), slices.Sorted(maps.Keys(rule.Secrets))...) {
+		for _, pattern := range unsafeEnv {
+			if ok, _ := path.Match(pattern, strings.ToUpper(name)); ok {
+				return fmt.Errorf("env %s isn't allowed with allow_commands", name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkConfigCommands checks the commands a config defines besides its
+// rules, which run for the rules of any config, against its allow_commands.
+func checkConfigCommands(conf Config, allowed []string) error {
+	commands := append(append([][]string{conf.Container}, conf.Pre...), conf.Post...)
+	for _, table := range []map[string][]string{conf.Sandboxes, conf.Labelers, conf.Providers} {
+		for _, argv := range table {
+			commands = append(commands, argv)
+		}
+	}
+	return checkAllowCommands(allowed, commands...)
+}
+
+// allowsDispatch checks the expanded commands of a rule against the command
+// policy, and those of the rule itself against the allow_commands of its
+// config. The hooks of the configs were checked against theirs as they
+// were loaded.
+func (c Config) allowsDispatch(e *engine, rule Rule) error {
+	commands := append(rule.commands(), rule.Wrapper, rule.Runner, rule.Confiner)
+	if err := e.checkPolicy(commands...); err != nil {
+		return err
+	}
+	own := append(append([][]string{}, rule.Steps...), rule.Apporte)
+	own = append(own, rule.OrElse...)
+	own = append(own, rule.Pre[len(c.Pre):]...)
+	own = append(own, rule.Post[:len(rule.Post)-len(c.Post)]...)
+	if err := checkAllowCommands(rule.Allowed, own...); err != nil {
+		return fmt.Errorf("%w of %s", err, rule.Source)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// applyFlags are the flags of apply.
+type applyFlags struct {
+	recursive      bool
+	shortRecursive bool
+	printCmd       bool
+	limit          int
+}
+
+func (f *applyFlags) define(fs *flag.FlagSet) {
+	fs.BoolVar(&f.recursive, "recursive", false, "Descend into subdirectories")
+	fs.BoolVar(&f.shortRecursive, "r", false, "Descend into subdirectories")
+	fs.BoolVar(&f.printCmd, "print-cmd", false, "Print the commands instead of running them")
+	fs.IntVar(&f.limit, "limit", 0, "Dispatch at most N files")
+}
+
+// applyCommand dispatches every file in the given directories, crawling the
+// configs from each file's own directory.
+func applyCommand(ctx context.Context, args []string, opts options) int {
+	var given applyFlags
+	flags := commandFlags("apply", given.define)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	opts.PrintCmd = given.printCmd
+
+	// files are grouped by directory so each config tree is crawled once
+	var dirs []string
+	files := map[string][]string{}
+	status := 0
+	for _, root := range flags.Args() {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Invalid directory: %v", err))
+			status = 1
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: %v", err))
+				return nil
+			}
+			if d.IsDir() {
+				if path != root && !(given.recursive || given.shortRecursive) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			dir := filepath.Dir(path)
+			if _, ok := files[dir]; !ok {
+				dirs = append(dirs, dir)
+			}
+			files[dir] = append(files[dir], path)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to walk %s: %v", root, err))
+			status = 1
+		}
+	}
+
+	type job struct {
+		conf   Config
+		result matchResult
+	}
+	var jobs []job
+	var warned []matchResult
+	for _, dir := range dirs {
+		conf, err := loadConfig(ctx, dir, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Errors while loading rules for %s:\n%s", dir, err))
+			return 1
+		}
+		for _, result := range matchInputs(ctx, files[dir], conf.Rules, opts) {
+			if result.Err != nil {
+				warned = append(warned, result)
+			}
+			result.Err = nil
+			// most files in a tree aren't meant for any rule
+			if len(result.Matched) == 0 {
+				continue
+			}
+			if given.limit > 0 && len(jobs) == given.limit {
+				break
+			}
+			jobs = append(jobs, job{conf, result})
+		}
+	}
+	printWarnings(os.Stderr, "Warnings while matching rules", matchWarnings(warned), opts)
+
+	// printed output would interleave, only real dispatches run in parallel
+	if opts.PrintCmd || opts.Explain || opts.Jobs < 2 {
+		for _, j := range jobs {
+			if s := dispatchResults(ctx, j.conf, []matchResult{j.result}, opts, true); s != 0 {
+				status = s
+			}
+		}
+		return status
+	}
+
+	var mu sync.Mutex
+	queue := newDispatchQueue(opts.Jobs)
+	if err := queue.publishAs("apply " + strings.Join(flags.Args(), " ")); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: failed to publish the queue: %v", err))
+	}
+	for _, j := range jobs {
+		queue.submit(j.result.Matched[0], []string{j.result.Input}, func() {
+			if s := dispatchResults(ctx, j.conf, []matchResult{j.result}, opts, true); s != 0 {
+				mu.Lock()
+				status = s
+				mu.Unlock()
+			}
+		})
+	}
+	queue.wait()
+	return status
+}
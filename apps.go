@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// resolveCommand rewrites argv when its command isn't on $PATH but is
+// installed as a Snap, Flatpak or AppImage. Lookups are cached in the user
+// cache directory and revalidated on use.
+func resolveCommand(argv []string) []string {
+	if runtime.GOOS != "linux" || len(argv) == 0 || strings.ContainsRune(argv[0], os.PathSeparator) {
+		return argv
+	}
+	if _, err := exec.LookPath(argv[0]); err == nil {
+		return argv
+	}
+
+	cache := loadAppCache()
+	prefix, ok := cache[argv[0]]
+	if !ok || !appInstalled(prefix) {
+		prefix = findApp(argv[0])
+		if prefix == nil {
+			return argv
+		}
+		cache[argv[0]] = prefix
+		saveAppCache(cache)
+	}
+	return join(prefix, argv[1:])
+}
+
+// findApp looks for an app by name, returning the argv that starts it.
+func findApp(name string) []string {
+	if path := filepath.Join("/snap/bin", name); isExecutable(path) {
+		return []string{path}
+	}
+	if id := findFlatpak(name); id != "" {
+		return []string{"flatpak", "run", id}
+	}
+	if path := findAppImage(name); path != "" {
+		return []string{path}
+	}
+	return nil
+}
+
+// findFlatpak matches name against the last component of installed app IDs,
+// so that "mpv" finds io.mpv.Mpv.
+func findFlatpak(name string) string {
+	out, err := exec.Command("flatpak", "list", "--app", "--columns=application").Output()
+	if err != nil {
+		return ""
+	}
+	for _, id := range strings.Fields(string(out)) {
+		last := id[strings.LastIndex(id, ".")+1:]
+		if strings.EqualFold(id, name) || strings.EqualFold(last, name) {
+			return id
+		}
+	}
+	return ""
+}
+
+// findAppImage looks for NAME*.AppImage in the usual download locations.
+func findAppImage(name string) string {
+	var dirs []string
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs,
+			filepath.Join(home, "Applications"),
+			filepath.Join(home, ".local", "bin"),
+			filepath.Join(home, "bin"),
+		)
+	}
+	dirs = append(dirs, "/opt")
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			file := strings.ToLower(entry.Name())
+			if strings.HasPrefix(file, strings.ToLower(name)) && strings.HasSuffix(file, ".appimage") {
+				if path := filepath.Join(dir, entry.Name()); isExecutable(path) {
+					return path
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// appInstalled checks that a cached lookup still points at an installed app.
+func appInstalled(prefix []string) bool {
+	if len(prefix) == 3 && prefix[0] == "flatpak" {
+		out, err := exec.Command("flatpak", "info", "--show-ref", prefix[2]).Output()
+		return err == nil && len(out) > 0
+	}
+	return len(prefix) == 1 && isExecutable(prefix[0])
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0o111 != 0
+}
+
+func appCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apporte", "apps.json"), nil
+}
+
+func loadAppCache() map[string][]string {
+	cache := map[string][]string{}
+	if path, err := appCachePath(); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			_ = json.Unmarshal(data, &cache)
+		}
+	}
+	return cache
+}
+
+// saveAppCache writes the cache, silently giving up on failure: it only
+// saves lookups and is rebuilt as needed.
+func saveAppCache(cache map[string][]string) {
+	path, err := appCachePath()
+	if err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+		_ = os.WriteFile(path, data, 0o644)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveExts are the archives whose members can be named as
+// ARCHIVE!/MEMBER, the way file managers browsing archives do.
+var archiveExts = []string{".zip", ".jar", ".tar", ".tar.gz", ".tgz"}
+
+// splitArchivePath splits an input naming a member of an archive. Only the
+// name is looked at, the archive may not exist.
+func splitArchivePath(input string) (archive, member string, ok bool) {
+	for i := strings.Index(input, "!/"); i >= 0; {
+		archive, member = input[:i], input[i+2:]
+		for _, ext := range archiveExts {
+			if strings.HasSuffix(strings.ToLower(archive), ext) && member != "" {
+				return archive, member, true
+			}
+		}
+		next := strings.Index(input[i+2:], "!/")
+		if next < 0 {
+			break
+		}
+		i += 2 + next
+	}
+	return "", "", false
+}
+
+// extractMember copies a member of an archive into a new temporary
+// directory, under its own base name so that programs recognize its type.
+func extractMember(archive, member string) (dir, path string, err error) {
+	member = strings.TrimPrefix(member, "/")
+	dir, err = os.MkdirTemp("", "apporte-")
+	if err != nil {
+		return "", "", err
+	}
+	path = filepath.Join(dir, filepath.Base(member))
+
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") || strings.HasSuffix(strings.ToLower(archive), ".jar") {
+		err = extractZipMember(archive, member, path)
+	} else {
+		err = extractTarMember(archive, member, path)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("extracting %s from %s: %w", member, archive, err)
+	}
+	return dir, path, nil
+}
+
+func extractZipMember(archive, member, path string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != member || f.FileInfo().IsDir() {
+			continue
+		}
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		return writeMember(path, src, f.Mode())
+	}
+	return fs.ErrNotExist
+}
+
+func extractTarMember(archive, member, path string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(strings.ToLower(archive), ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fs.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if strings.TrimPrefix(hdr.Name, "./") == member && hdr.Typeflag == tar.TypeReg {
+			return writeMember(path, tr, hdr.FileInfo().Mode())
+		}
+	}
+}
+
+func writeMember(path string, src io.Reader, mode fs.FileMode) error {
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()&0o755|0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,15 @@
+package main
+
+// associationRule is used when no rule matches on platforms with an
+// association fallback.
+func (e *engine) associationRule(input string) Rule {
+	return Rule{
+		Match:   &lazyRegexp{},
+		Desc:    "Default application",
+		Apporte: e.platform.Association(),
+		Source:  "(file association)",
+		Rank:    rank{Tier: tierBuiltin},
+		Input:   input,
+		Groups:  []string{input},
+	}
+}
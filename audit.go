@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// shellInterpreters map the shells apporte may run to the flag taking a
+// script.
+var shellInterpreters = map[string]string{
+	"sh":         "-c",
+	"bash":       "-c",
+	"dash":       "-c",
+	"zsh":        "-c",
+	"ksh":        "-c",
+	"fish":       "-c",
+	"cmd":        "/c",
+	"powershell": "-command",
+	"pwsh":       "-command",
+}
+
+// networkCommands are the commands known to reach other machines.
+var networkCommands = map[string]bool{
+	"curl": true, "wget": true, "aria2c": true, "http": true, "https": true, "xh": true,
+	"ssh": true, "scp": true, "sftp": true, "rsync": true, "ftp": true, "telnet": true,
+	"nc": true, "ncat": true, "netcat": true, "socat": true, "yt-dlp": true, "youtube-dl": true,
+}
+
+// auditedCommand is a command a config can run, with what stands out in it.
+type auditedCommand struct {
+	kind  string // where the command comes from, e.g. "run" or "pre"
+	argv  []string
+	flags []string
+}
+
+// auditCommand lists every command a config can run without dispatching
+// anything, flagging the ones to read twice before trusting the config.
+func auditCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) != 1 {
+		commandUsage("audit")
+		return 2
+	}
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Invalid config path: %v", err))
+		return 1
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read the config: %v", err))
+		return 1
+	}
+
+	// the config is only read, so it needn't be signed or trusted yet
+	keys := opts.Engine.findCrawlKeys(ctx, []string{path, userConfigPath()}, []string{path}, opts.Limits)
+	conf, err := opts.Engine.loadRulesFromFile(ctx, path, rank{}, newRegexCache(opts.Limits.RegexTimeout), keys, opts.Limits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to load the config: %v", err))
+		return 1
+	}
+
+	total, flagged := 0, 0
+	report := func(title string, commands []auditedCommand) {
+		if len(commands) == 0 {
+			return
+		}
+		fmt.Println(title)
+		for _, c := range commands {
+			fmt.Printf("  %-8s %s\n", c.kind, shellJoin(c.argv))
+			for _, flag := range c.flags {
+				fmt.Printf("    ! %s\n", flag)
+			}
+			total++
+			if len(c.flags) > 0 {
+				flagged++
+			}
+		}
+	}
+
+	var hooks []auditedCommand
+	for _, argv := range conf.Pre {
+		hooks = append(hooks, auditArgv("pre", argv))
+	}
+	for _, argv := range conf.Post {
+		hooks = append(hooks, auditArgv("post", argv))
+	}
+	report(path+": hooks", hooks)
+	for _, rule := range conf.Rules {
+		title := rule.location()
+		if rule.Name != "" {
+			title += fmt.Sprintf(" (%s)", rule.Name)
+		}
+		report(title, auditRule(rule))
+	}
+
+	fmt.Println(opts.Engine.trf("%d commands, %d flagged", total, flagged))
+	if flagged > 0 {
+		return 1
+	}
+	return 0
+}
+
+// auditRule lists the commands a rule can run, in the order they would.
+func auditRule(rule Rule) []auditedCommand {
+	var commands []auditedCommand
+	names := make([]string, 0, len(rule.Secrets))
+	for name := range rule.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if argv, err := secretCommand(rule.Secrets[name]); err == nil {
+			commands = append(commands, auditArgv("secret", argv))
+		}
+	}
+	for _, argv := range rule.Pre {
+		commands = append(commands, auditArgv("pre", argv))
+	}
+	for _, argv := range rule.Steps {
+		commands = append(commands, auditArgv("step", argv))
+	}
+	if rule.DBus != "" {
+		commands = append(commands, auditedCommand{kind: "dbus", argv: []string{rule.DBus, "{input}"}})
+	} else {
+		run := auditArgv("run", rule.Apporte)
+		if rule.Host != "" {
+			run.flags = append(run.flags, fmt.Sprintf("network: runs on %s over ssh", rule.Host))
+		}
+		commands = append(commands, run)
+	}
+	for _, argv := range rule.OrElse {
+		commands = append(commands, auditArgv("or_else", argv))
+	}
+	for _, argv := range rule.Post {
+		commands = append(commands, auditArgv("post", argv))
+	}
+	return commands
+}
+
+// auditArgv flags the shell scripts, network access and unquoted placeholders
+// of a command.
+func auditArgv(kind string, argv []string) auditedCommand {
+	c := auditedCommand{kind: kind, argv: argv}
+	if len(argv) == 0 {
+		return c
+	}
+	if placeholderRe.MatchString(argv[0]) {
+		c.flags = append(c.flags, fmt.Sprintf("the program %s is chosen by the input", argv[0]))
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(argv[0]), ".exe"))
+	if networkCommands[name] {
+		c.flags = append(c.flags, "network: "+name)
+	}
+	scriptFlag, isShell := shellInterpreters[name]
+	if !isShell {
+		return c
+	}
+	for i, arg := range argv[1:] {
+		if strings.ToLower(arg) != scriptFlag || i+2 >= len(argv) {
+			continue
+		}
+		script := argv[i+2]
+		c.flags = append(c.flags, "shell: "+name+" runs a script")
+		for _, word := range strings.Fields(script) {
+			if networkCommands[strings.ToLower(filepath.Base(word))] {
+				c.flags = append(c.flags, "network: "+word+" in the script")
+			}
+		}
+		for _, placeholder := range unquotedPlaceholders(script) {
+			c.flags = append(c.flags, fmt.Sprintf("unquoted placeholder %s in the script, inputs can inject commands", placeholder))
+		}
+		break
+	}
+	return c
+}
+
+// unquotedPlaceholders returns the placeholders of a shell script that are
+// outside single and double quotes, where the shell splits and expands the
+// substituted input.
+func unquotedPlaceholders(script string) []string {
+	var found []string
+	var quote byte
+	for i := 0; i < len(script); i++ {
+		switch ch := script[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else if ch == '\\' && quote == '"' {
+				i++
+			}
+		case ch == '\\':
+			i++
+		case ch == '\'' || ch == '"':
+			quote = ch
+		default:
+			if loc := placeholderRe.FindStringIndex(script[i:]); loc != nil && loc[0] == 0 {
+				found = append(found, script[i:i+loc[1]])
+				i += loc[1] - 1
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sensitiveEnvRe matches the names of environment variables whose values a
+// debug bundle leaves out.
+var sensitiveEnvRe = regexp.MustCompile(`(?i)token|secret|passw|key|credential|auth|cookie|session|private`)
+
+// redacted stands in for the values a debug bundle leaves out.
+const redacted = "<redacted>"
+
+// writeDebugBundle writes what went into an invocation to a gzipped tarball
+// for bug reports: the command line, the environment and the configs without
+// their secrets, the merged rules, the inputs, how each rule fared against
+// each input, and the commands the winners would run. Only the user can read
+// it.
+func writeDebugBundle(ctx context.Context, path, dir string, inputs []string, conf Config, results []matchResult, opts options) error {
+	files := map[string][]byte{}
+	names := []string{}
+	add := func(name string, data []byte) {
+		files[name] = data
+		names = append(names, name)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "args: %s\n", shellJoin(redactArgs(os.Args)))
+	fmt.Fprintf(&b, "dir: %s\n", dir)
+	fmt.Fprintf(&b, "time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "os: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "go: %s\n", runtime.Version())
+	add("invocation.txt", b.Bytes())
+	add("environment.txt", sanitizedEnviron())
+	add("inputs.txt", []byte(strings.Join(inputs, "\n")+"\n"))
+
+	if opts.Snapshot == "" {
+		startDir, _ := crawlStart(dir, opts.Physical)
+		var list bytes.Buffer
+		for i, config := range configPaths(startDir, []string{opts.Config}) {
+			if config == "" {
+				continue
+			}
+			data, err := os.ReadFile(config)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				continue
+			case err != nil:
+				fmt.Fprintf(&list, "%s: %v\n", config, err)
+			case strings.HasSuffix(config, ageSuffix):
+				fmt.Fprintf(&list, "%s: encrypted, left out\n", config)
+			default:
+				name := fmt.Sprintf("configs/%02d-%s", i, filepath.Base(config))
+				fmt.Fprintf(&list, "%s: %s\n", config, name)
+				add(name, []byte(redactEnvValues(string(data))))
+			}
+		}
+		add("configs.txt", list.Bytes())
+	}
+
+	rules, err := formatSnapshot(redactRules(conf))
+	if err != nil {
+		rules = []byte(fmt.Sprintf("# failed to write the rules: %v\n", err))
+	}
+	add("rules.toml", rules)
+
+	var warnings bytes.Buffer
+	for _, w := range append(conf.Warnings, matchWarnings(results)...) {
+		fmt.Fprintln(&warnings, w)
+	}
+	add("warnings.txt", warnings.Bytes())
+	add("trace.txt", traceMatches(ctx, conf, results, opts))
+
+	return writeTarball(path, names, files)
+}
+
+// sanitizedEnviron lists the environment, sorted, with the values of the
+// variables that may hold secrets replaced.
+func sanitizedEnviron() []byte {
+	env := os.Environ()
+	sort.Strings(env)
+	var b bytes.Buffer
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if sensitiveEnvRe.MatchString(name) {
+			kv = name + "=" + redacted
+		}
+		fmt.Fprintln(&b, kv)
+	}
+	return b.Bytes()
+}
+
+// redactArgs returns args with the answers given with --set left out.
+func redactArgs(args []string) []string {
+	args = slices.Clone(args)
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if arg == "-set" || arg == "--set" {
+			if i+1 < len(args) {
+				i++
+				name, _, _ := strings.Cut(args[i], "=")
+				args[i] = name + "=" + redacted
+			}
+			continue
+		}
+		for _, flag := range []string{"-set=", "--set="} {
+			if value, ok := strings.CutPrefix(arg, flag); ok {
+				name, _, _ := strings.Cut(value, "=")
+				args[i] = flag + name + "=" + redacted
+			}
+		}
+	}
+	return args
+}
+
+// redactRules returns conf with the values of the env tables of its rules
+// left out.
+func redactRules(conf Config) Config {
+	conf.Rules = slices.Clone(conf.Rules)
+	for i, rule := range conf.Rules {
+		if len(rule.Toml.Env) == 0 {
+			continue
+		}
+		env := map[string]string{}
+		for name := range rule.Toml.Env {
+			env[name] = redacted
+		}
+		conf.Rules[i].Toml.Env = env
+	}
+	return conf
+}
+
+// redactEnvValues leaves the values of the env tables of a config out, in
+// [*.env] tables, env = { ... } and env.NAME = keys alike. Lines are kept,
+// so that the lines of rules in the trace still point at them.
+func redactEnvValues(src string) string {
+	lines := strings.Split(src, "\n")
+	var scanner tomlScanner
+	var values stringRedactor
+	inTable, inValue := false, false
+	for n, line := range lines {
+		if scanner.done() {
+			code, _ := scanner.scan(line)
+			code = strings.TrimSpace(code)
+			if strings.HasPrefix(code, "[") {
+				header := strings.Split(strings.Trim(code, "[] "), ".")
+				inTable = isEnvKey(header[len(header)-1])
+				inValue = false
+			} else if key, _, ok := strings.Cut(code, "="); ok {
+				inValue = inTable || slices.ContainsFunc(strings.Split(key, "."), isEnvKey)
+			}
+		} else {
+			scanner.scan(line)
+		}
+		if inValue {
+			lines[n] = values.redact(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isEnvKey(part string) bool {
+	return strings.Trim(strings.TrimSpace(part), `"'`) == "env"
+}
+
+// A stringRedactor replaces the strings that are values, those after an =,
+// carrying multi-line ones over to the following lines, which it empties.
+type stringRedactor struct {
+	multiline string // delimiter of the open multi-line string
+}
+
+func (r *stringRedactor) redact(line string) string {
+	var out strings.Builder
+	value := false
+	for i := 0; i < len(line); i++ {
+		if r.multiline != "" {
+			if r.multiline == `"""` && line[i] == '\\' {
+				i++
+			} else if strings.HasPrefix(line[i:], r.multiline) {
+				i += len(r.multiline) - 1
+				r.multiline = ""
+			}
+			continue
+		}
+
+		switch c := line[i]; c {
+		case '#':
+			return out.String() + line[i:]
+		case '=':
+			value = true
+			out.WriteByte(c)
+		case ' ', '\t':
+			out.WriteByte(c)
+		case '"', '\'':
+			start := i
+			delim := line[i : i+1]
+			if strings.HasPrefix(line[i:], strings.Repeat(delim, 3)) {
+				r.multiline = strings.Repeat(delim, 3)
+				i += 2
+			} else {
+				for i++; i < len(line) && line[i] != c; i++ {
+					if c == '"' && line[i] == '\\' {
+						i++
+					}
+				}
+			}
+			if value {
+				out.WriteString(`"` + redacted + `"`)
+			} else {
+				out.WriteString(line[start:min(i+1, len(line))])
+			}
+			value = false
+		default:
+			value = false
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+// traceMatches tells, for each input, how every rule fared against it in
+// rank order, and what the winner would run.
+func traceMatches(ctx context.Context, conf Config, results []matchResult, opts options) []byte {
+	var b bytes.Buffer
+	for _, result := range results {
+		fmt.Fprintf(&b, "input: %s\n", result.Input)
+		subject := result.Input
+		if _, member, ok := splitArchivePath(result.Input); ok {
+			subject = member
+		}
+		for _, rule := range conf.Rules {
+			var outcome string
+			re, err := rule.Match.Compile()
+			if err != nil {
+				outcome = fmt.Sprintf("invalid regex: %v", err)
+			} else if groups, err := re.Submatch(normalizeUnicode(subject, rule.Unicode)); err != nil {
+				outcome = err.Error()
+			} else if groups == nil {
+				outcome = "pattern doesn't match"
+			} else if _, ok, _ := matchRule(ctx, result.Input, rule, opts); ok {
+				outcome = "matches"
+			} else {
+				outcome = "pattern matches, but kind, mime or when doesn't"
+			}
+			fmt.Fprintf(&b, "  %s %s, %s: %s\n", rule.Rank, rule.location(), rule.Match, outcome)
+		}
+
+		matched := append([]Rule(nil), result.Matched...)
+		if opts.Score || conf.Score {
+			sortByScore(matched)
+		}
+		if len(matched) == 0 {
+			fmt.Fprintf(&b, "winner: none\n\n")
+			continue
+		}
+		winner := expandRule(matched[0])
+		fmt.Fprintf(&b, "winner: %s\n", winner.location())
+		for _, step := range winner.Steps {
+			fmt.Fprintf(&b, "step: %s\n", shellJoin(step))
+		}
+		fmt.Fprintf(&b, "command: %s\n\n", shellJoin(winner.Apporte))
+	}
+	return b.Bytes()
+}
+
+// writeTarball writes files to a gzipped tarball at path, in the order of
+// names.
+func writeTarball(path string, names []string, files map[string][]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// an existing file keeps its mode otherwise
+	if err := f.Chmod(0o600); err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, name := range names {
+		hdr := &tar.Header{Name: "apporte-debug/" + name, Mode: 0o600, Size: int64(len(files[name])), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
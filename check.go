@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"time"
+)
+
+// checkFlags are the flags of check.
+type checkFlags struct {
+	fix bool
+}
+
+func (f *checkFlags) define(fs *flag.FlagSet) {
+	fs.BoolVar(&f.fix, "fix", false, "Escape the dots of extensions in patterns")
+}
+
+// checkCommand loads the configs that apply to a directory and reports every
+// problem found in them.
+func checkCommand(ctx context.Context, args []string, opts options) int {
+	var given checkFlags
+	flags := commandFlags("check", given.define)
+	flags.Parse(args)
+
+	dir := "."
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		dir = flags.Arg(0)
+	default:
+		flags.Usage()
+		return 2
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Invalid directory: %v", err))
+		return 1
+	}
+
+	startDir, err := crawlStart(dir, opts.Physical)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: %v", err))
+	}
+	conf, err := opts.Engine.crawlConfigTree(ctx, startDir, []string{opts.Config}, opts.Limits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if given.fix {
+		fixed, err := fixDots(conf.Rules)
+		paths := make([]string, 0, len(fixed))
+		for path := range fixed {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Println(opts.Engine.trf("Fixed %d patterns in %s", fixed[path], path))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(fixed) > 0 {
+			conf, err = opts.Engine.crawlConfigTree(ctx, startDir, []string{opts.Config}, opts.Limits)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+	}
+	warnings := conf.Warnings
+	conf.Rules = filterRules(conf.Rules, opts)
+	for _, rule := range conf.Rules {
+		if _, err := rule.Match.Compile(); err != nil {
+			warnings = append(warnings, rule.warning(levelError, "invalid_regex", fmt.Sprintf("invalid regex %q: %v", rule.Match, err)))
+		}
+	}
+	warnings = append(warnings, checkRules(conf.Rules, opts.Score || conf.Score)...)
+	now := time.Now()
+	for _, rule := range conf.Rules {
+		warnings = append(warnings, lintRule(rule)...)
+		// expired rules are left for the config's maintainers to remove
+		if rule.expired(now) {
+			warnings = append(warnings, rule.expiredWarning())
+		}
+	}
+	// problems hidden by --warn-level don't fail the check
+	if shown := shownWarnings(warnings, opts.WarnLevel); len(shown) > 0 {
+		printWarnings(os.Stderr, "", shown, opts)
+		return 1
+	}
+	fmt.Println(opts.Engine.trf("%d rules OK", len(conf.Rules)))
+	return 0
+}
+
+// location names the rule for messages about its config, with the line of
+// the rule when it's known.
+func (r Rule) location() string {
+	if r.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", r.Source, r.Line, r.Label)
+	}
+	return fmt.Sprintf("%s: %s", r.Source, r.Label)
+}
+
+// conditional reports whether the rule can fail to match an input its
+// pattern matches.
+func (r Rule) conditional() bool {
+	return r.Mime != "" || r.Kind != "" || len(r.When) > 0 || len(r.WhenTime) > 0 || r.Hostname != nil || r.Machine != nil ||
+		r.RefuseExp
+}
+
+// checkRules finds the rules that can never win: those repeating the pattern
+// of a higher ranked rule, and those ranked below a rule matching anything.
+// With scoring, rules more specific than the catch-all still win over it.
+func checkRules(rules []Rule, score bool) []warning {
+	var warnings []warning
+	seen := map[string]Rule{}
+	var catchAll *Rule
+
+	for i, rule := range rules {
+		if catchAll != nil && (!score || scoreRule(rule).total() <= scoreRule(*catchAll).total()) {
+			warnings = append(warnings, rule.warning(levelWarning, "shadowed_rule", fmt.Sprintf("shadowed by catch-all %q at %s", catchAll.Match, catchAll.location())))
+			continue
+		}
+		// rules with conditions besides the pattern may not match at all
+		if rule.conditional() {
+			continue
+		}
+		if first, ok := seen[rule.Match.String()]; ok {
+			warnings = append(warnings, rule.warning(levelWarning, "duplicate_pattern", fmt.Sprintf("duplicate pattern %q, already used at %s", rule.Match, first.location())))
+			continue
+		}
+		seen[rule.Match.String()] = rule
+		if matchesAnything(rule.Match.String()) {
+			catchAll = &rules[i]
+		}
+	}
+	return warnings
+}
+
+// matchesAnything reports whether a pattern matches every input. Patterns
+// without anchors that match the empty string match everywhere, as do .* and
+// anchored variants of it.
+func matchesAnything(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	re = re.Simplify()
+	anchored := hasAnchor(re)
+
+	if re.Op == syntax.OpConcat {
+		subs := re.Sub
+		if len(subs) > 0 && subs[0].Op == syntax.OpBeginText {
+			subs = subs[1:]
+		}
+		if len(subs) > 0 && subs[len(subs)-1].Op == syntax.OpEndText {
+			subs = subs[:len(subs)-1]
+		}
+		if len(subs) == 1 {
+			re = subs[0]
+		}
+	}
+	if re.Op == syntax.OpStar && (re.Sub[0].Op == syntax.OpAnyChar || re.Sub[0].Op == syntax.OpAnyCharNotNL) {
+		return true
+	}
+	matched, _ := regexp.MatchString(pattern, "")
+	return matched && !anchored
+}
+
+func hasAnchor(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasAnchor(sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cliFlag documents a flag for --help, help COMMAND and the man page. Its
+// one line of help and its default are those it's defined with, where it's
+// parsed, this adds what the definition doesn't say.
+type cliFlag struct {
+	Long    string
+	Short   string
+	Arg     string // name of the value, empty for switches
+	Default string // shown instead of the default it's defined with
+	Help    string // of flags parsed without a definition, such as --help
+	Detail  string // more for the man page
+}
+
+// cliCommand documents a subcommand and its flags, which define defines.
+type cliCommand struct {
+	Name   string
+	Args   string
+	Help   string
+	Detail string
+	Flags  []cliFlag
+	define func(fs *flag.FlagSet)
+}
+
+// cliFlags are the flags of apporte itself.
+var cliFlags = []cliFlag{
+	{Long: "null", Short: "0"},
+	{Long: "base", Arg: "DIR",
+		Detail: "For paths reported relative to a root, as by git status or compilers. Configs are still crawled from the working directory."},
+	{Long: "physical", Short: "P",
+		Detail: "Configs are otherwise crawled up the directory as given, through symlinks."},
+	{Long: "profile", Arg: "LIST", Default: "$APPORTE_PROFILE"},
+	{Long: "config", Short: "c", Arg: "PATH",
+		Detail: "The config outranks every crawled one and needn't be trusted."},
+	{Long: "config-timeout", Arg: "DURATION",
+		Detail: "Configs are loaded concurrently. One that isn't read, decrypted and parsed in time is reported as unreadable and skipped."},
+	{Long: "capture"},
+	{Long: "category", Arg: "LIST"},
+	{Long: "clipboard"},
+	{Long: "debug-bundle", Arg: "FILE",
+		Detail: "The .tar.gz holds the command line, the environment with the values of variables that may be secrets left out, the configs, the merged rules, the inputs, how each rule fared against each input and the command of the winner. The dispatch goes on as usual."},
+	{Long: "detach", Short: "d"},
+	{Long: "disable-rule", Arg: "NAME"},
+	{Long: "explain", Short: "e",
+		Detail: "Prints the winning rule of each input, where it comes from and the command it would run, as well as the last dispatch of the input or rule."},
+	{Long: "enable-only", Arg: "NAME"},
+	{Long: "from-snapshot", Arg: "FILE",
+		Detail: "The rules written by apporte snapshot are used as they are, no config is crawled or loaded."},
+	{Long: "help", Short: "h", Help: "Show this message"},
+	{Long: "head"},
+	{Long: "head-timeout", Arg: "DURATION"},
+	{Long: "input", Short: "i", Arg: "INPUT",
+		Detail: "Takes one input, which may start with a dash, instead of the arguments."},
+	{Long: "jobs", Short: "j", Arg: "N", Default: "CPU count"},
+	{Long: "lines", Short: "l"},
+	{Long: "max-config-size", Arg: "BYTES"},
+	{Long: "max-input-size", Arg: "BYTES"},
+	{Long: "max-rules", Arg: "N"},
+	{Long: "name", Arg: "NAME"},
+	{Long: "normalize", Arg: "LIST", Default: "the configs'"},
+	{Long: "picker", Arg: "COMMAND"},
+	{Long: "print-reason",
+		Detail: `For example {"status":3,"reason":"no_match","input":"notes.txt"}. Reasons are dispatched, usage, no_match, config_error, cancelled, interrupted, dispatch_failed, command_failed and error.`},
+	{Long: "raw"},
+	{Long: "regex-timeout", Arg: "DURATION",
+		Detail: "PCRE backtracks, a rule whose pattern takes longer to match an input doesn't match it."},
+	{Long: "stdin",
+		Detail: "The whole of stdin is one input, unless --lines or --null split it."},
+	{Long: "stdin-data"},
+	{Long: "stdin-timeout", Arg: "DURATION"},
+	{Long: "stdio-server"},
+	{Long: "strict"},
+	{Long: "save"},
+	{Long: "score"},
+	{Long: "score-debug"},
+	{Long: "set", Arg: "NAME=VALUE"},
+	{Long: "skip-network-fs",
+		Detail: "NFS, SMB and other network mounts, as well as autofs mount points, aren't crawled for configs. The -c config and the user config are still loaded."},
+	{Long: "stat-timeout", Arg: "DURATION",
+		Detail: "A directory that doesn't answer in time, such as an autofs mount of an unreachable host, is skipped instead of hanging the crawl."},
+	{Long: "url",
+		Detail: "Links are left as they are and open in $BROWSER when no rule matches."},
+	{Long: "verbose", Short: "v",
+		Detail: "Prints what --explain prints, then dispatches anyway."},
+	{Long: "warn-format", Arg: "FORMAT",
+		Detail: "With json, each problem is an object on a line of stderr, with its level, kind, source, profile, rule index, line and message."},
+	{Long: "warn-level", Arg: "LEVEL",
+		Detail: "Errors are problems that made apporte skip a config or rule, warnings the others, such as unknown keys or shadowed rules. check only fails for the problems shown."},
+	{Long: "with", Arg: "COMMAND"},
+	{Long: "yes", Short: "y"},
+}
+
+// cliCommands are the subcommands, in the order they are listed.
+var cliCommands = []cliCommand{
+	{Name: "add", Args: "--match REGEX --cmd COMMAND [OPTION]", Help: "Append a rule given with --match and --cmd to a config",
+		define: new(addFlags).define,
+		Flags: []cliFlag{
+			{Long: "cmd", Arg: "COMMAND"},
+			{Long: "description", Arg: "TEXT"},
+			{Long: "match", Arg: "REGEX"},
+			{Long: "name", Arg: "NAME"},
+			{Long: "to", Arg: "CONFIG"},
+		}},
+	{Name: "apply", Args: "[OPTION] DIR...", Help: "Dispatch every file in DIR",
+		define: new(applyFlags).define,
+		Flags: []cliFlag{
+			{Long: "limit", Arg: "N"},
+			{Long: "print-cmd"},
+			{Long: "recursive", Short: "r"},
+		}},
+	{Name: "audit", Args: "CONFIG", Help: "List the commands CONFIG can run, flagging risky ones",
+		Detail: "Flags commands run through a shell, reaching the network or taken from the input. Exits with 1 when anything is flagged."},
+	{Name: "check", Args: "[OPTION] [DIR]", Help: "Report problems in the configs applying to DIR",
+		Detail: "Also lints rules for catch-all patterns, unescaped dots, references to missing groups and shell syntax in commands run without a shell.",
+		define: new(checkFlags).define,
+		Flags: []cliFlag{
+			{Long: "fix"},
+		}},
+	{Name: "dispatch-id", Args: "ID INPUT", Help: "Dispatch INPUT to the rule with the menu ID"},
+	{Name: "doctor", Help: "Report on configs, rules and the environment"},
+	{Name: "edit", Args: "[INPUT]", Help: "Edit the nearest config, or the one with the rule for INPUT",
+		Detail: "Opens $VISUAL or $EDITOR at the line of the rule when the editor is known to take one."},
+	{Name: "fmt", Args: "[OPTION] [FILE]...", Help: "Rewrite configs in the canonical style",
+		define: new(formatFlags).define,
+		Flags: []cliFlag{
+			{Long: "check"},
+		}},
+	{Name: "generate-desktop", Args: "[OPTION] [DIR]", Help: `Write desktop entries listing rules under "Open With"`,
+		define: new(desktopFlags).define,
+		Flags: []cliFlag{
+			{Long: "dir", Arg: "DIR", Default: "$XDG_DATA_HOME/applications"},
+		}},
+	{Name: "help", Args: "[COMMAND|config]", Help: "Describe a command, or the keys of configs"},
+	{Name: "init", Args: "[OPTION]", Help: "Write a starter config to the current directory",
+		define: new(initFlags).define,
+		Flags: []cliFlag{
+			{Long: "user"},
+		}},
+	{Name: "man", Help: "Print the man page"},
+	{Name: "menu", Args: "[OPTION] INPUT", Help: "List the rules matching INPUT as menu entries",
+		define: new(menuFlags).define,
+		Flags: []cliFlag{
+			{Long: "format", Arg: "FORMAT"},
+		}},
+	{Name: "queue", Args: "[OPTION]", Help: "List what running watch and apply processes dispatch",
+		Detail: "Shows the dispatches running and those waiting for a slot, by rule, with how long they have been at it.",
+		define: new(queueFlags).define,
+		Flags: []cliFlag{
+			{Long: "json"},
+		}},
+	{Name: "redo", Args: "[N]", Help: "Run the Nth most recent dispatch again, the last by default",
+		Detail: "The command runs exactly as it was recorded in the history, in the same directory, whatever the configs say now. With --explain, it is only shown."},
+	{Name: "setup", Args: "[OPTION] [url|windows|darwin]", Help: "Write the user config from the programs installed, or register apporte with the system",
+		Detail: "Without arguments, a wizard proposes a rule for each kind of input from the programs it finds, writes the user config, and offers to handle web links and list the rules in file managers. url makes apporte the handler of web links. windows registers it in HKCU for the chosen extensions and schemes, darwin installs an app bundle for the chosen types and schemes.",
+		define: new(setupFlags).define,
+		Flags: []cliFlag{
+			{Long: "extensions", Arg: "LIST"},
+			{Long: "schemes", Arg: "LIST", Default: "http,https for url"},
+			{Long: "uninstall"},
+			{Long: "utis", Arg: "LIST"},
+		}},
+	{Name: "simulate", Args: "--corpus FILE [OPTION]", Help: "Report how many inputs of a corpus the rules match, and by which rule",
+		Detail: "Every line of FILE is matched against the rules of the current directory, as find or a shell history would list them. Nothing is dispatched. The report counts the inputs each rule wins, rules winning none included, and samples the inputs no rule matches.",
+		define: new(simulateFlags).define,
+		Flags: []cliFlag{
+			{Long: "corpus", Arg: "FILE"},
+			{Long: "json"},
+			{Long: "sample", Arg: "N"},
+		}},
+	{Name: "snapshot", Args: "[OPTION] [DIR]", Help: "Write the merged rules applying to DIR for --from-snapshot",
+		Detail: "The rules are written in rank order with macros, defaults and flags applied, along with where each comes from. The same configs always give the same file.",
+		define: new(snapshotFlags).define,
+		Flags: []cliFlag{
+			{Long: "output", Short: "o", Arg: "FILE", Default: "stdout"},
+		}},
+	{Name: "test", Args: "--self [OPTION]", Help: "Check the expansion of commands with random inputs",
+		Detail: "Placeholders are filled in with random groups and inputs made of the characters of placeholders and quotes, which must reach the commands as they are, and argvs are quoted and split again. The first failure of each check is shown, with the seed to repeat it with --seed.",
+		define: new(testFlags).define,
+		Flags: []cliFlag{
+			{Long: "runs", Arg: "N"},
+			{Long: "seed", Arg: "N"},
+			{Long: "self"},
+		}},
+	{Name: "trust", Args: "[OPTION] [CONFIG]", Help: "Let the nearest config, or CONFIG, dispatch",
+		define: new(trustFlags).define,
+		Flags: []cliFlag{
+			{Long: "revoke"},
+		}},
+	{Name: "tui", Help: "Browse the rules and test inputs against them"},
+	{Name: "undo", Help: "Move the file of the last sortable dispatch back",
+		Detail: "Rules with sortable = true move their input to the last argument of their command. Each undo moves back the file of the latest move not undone yet. With --explain, the move is only shown."},
+	{Name: "watch", Args: "[OPTION] DIR", Help: "Dispatch files as they appear in DIR",
+		define: new(watchFlags).define,
+		Flags: []cliFlag{
+			{Long: "debounce", Arg: "DURATION"},
+			{Long: "exclude", Arg: "GLOB"},
+			{Long: "include", Arg: "GLOB"},
+			{Long: "max-children", Arg: "N"},
+			{Long: "metrics", Arg: "ADDR"},
+		}},
+}
+
+// cliEnvironment documents the environment variables apporte reads.
+var cliEnvironment = [][2]string{
+	{"APPORTE_PROFILE", "Default of --profile"},
+	{"APPORTE_NO_HISTORY", "Set to 1 to stop recording dispatches"},
+	{"APPORTE_IMPLICIT_STDIN", "Set to 1 to read stdin without --stdin when it isn't a terminal, deprecated"},
+	{"BROWSER", "Opens the links no rule matches with --url"},
+	{"TERMINAL", "Terminal emulator of terminal rules"},
+	{"VISUAL, EDITOR", "Editor of the edit and tui commands"},
+	{"LC_ALL, LC_MESSAGES, LANG, LANGUAGE", "Locale of the lang, region and languages facts"},
+}
+
+// exitStatuses document the exit statuses of dispatching.
+var exitStatuses = [][2]string{
+	{"0", "Every input was dispatched"},
+	{"1", "Another error, such as failing to read stdin"},
+	{"2", "Usage error"},
+	{"3", "No rule matched an input"},
+	{"4", "Invalid configs with --strict"},
+	{"5", "Dispatching failed or was cancelled, or a command apporte waited for failed (with --capture, its status instead)"},
+	{"130", "Interrupted by SIGINT or SIGTERM before dispatching everything"},
+}
+
+// ruleKeyHelp and configKeyHelp document the keys of configs.
+var (
+	ruleKeyHelp = map[string]string{
+		"name":             "Name used by --disable-rule and --enable-only",
+		"match":            "Regex matched against the input, with {{macros}}",
+		"description":      "Label shown with --explain",
+		"category":         `Group selected with --category, e.g. "media"`,
+		"icon":             `Icon of the rule in menus, a theme icon name such as "mpv" or an image path`,
+		"enabled":          "Set to false to ignore the rule",
+		"override":         "Replace rules of farther configs with the same name or match",
+		"exact":            "Match the whole input instead of any part of it",
+		"regex_flags":      `Flags of the pattern: "i", "m", "s" or "U"`,
+		"engine":           `Regex engine of the pattern: "re2", or "pcre" for lookarounds and backreferences`,
+		"mime":             `Content type links must serve with --head, e.g. "video/*"`,
+		"kind":             `Only match inputs of this kind: "path", "url" or "other"`,
+		"when":             `Only match while system facts hold, e.g. "displays >= 2"`,
+		"apporte":          "Command to run, as a string, a list of arguments or a list of commands run in order",
+		"timeout":          `Kill the command after a duration, e.g. "30s"`,
+		"when_time":        `Only match at these times, e.g. "Mon-Fri 09:00-18:00"`,
+		"hostname":         `Only match on hosts whose name matches this pattern, e.g. "work-.*"`,
+		"machine":          `Only match on machines of a class matching this pattern, e.g. "laptop|desktop"`,
+		"deprecated":       `Warn with this message whenever the rule matches, e.g. "use the 'media' rule instead"`,
+		"expires":          `Date after which the rule warns that it expired, e.g. "2025-12-31"`,
+		"on_expiry":        `What an expired rule does: "warn" (default) or "refuse" to stop matching`,
+		"retries":          "Run the command again after a non-zero exit, waiting 1s, 2s, 4s...",
+		"rematch":          "Match each line the command writes as a new input",
+		"background":       "Detach the command and return immediately",
+		"cwd":              "Working directory of the command",
+		"env":              `Extra environment variables, e.g. { FOO = "$1" }`,
+		"env_clear":        "Run commands with a minimal environment instead of apporte's",
+		"env_allow":        `Variables of apporte's environment kept by env_clear, e.g. ["SSH_AUTH_SOCK", "XDG_*"]`,
+		"secret":           "Environment variables fetched from a secret store",
+		"terminal":         "Open in $TERMINAL when not started from a terminal",
+		"target":           `"tmux-split" or "tmux-window" when inside tmux`,
+		"sortable":         "The command moves the input to its last argument, apporte undo moves it back",
+		"success_when":     `When the command succeeded, e.g. 'exit in 0, 2 and stdout matches "OK"', instead of exiting with 0`,
+		"confirm":          "Ask before running the command",
+		"prompt":           "Values asked for before dispatching",
+		"notify":           "Send a desktop notification when the command exits",
+		"or_else":          "Fallback command(s) tried while the command fails",
+		"stdin":            `"inherit", "null" or "file:PATH"`,
+		"stdout":           `"inherit", "null", "file:PATH" or "append:PATH"`,
+		"stderr":           "Same as stdout",
+		"sandbox":          `Wrap the command in a sandbox, e.g. "bwrap"`,
+		"security_label":   `Confine the command with a label, "apparmor:PROFILE" or "selinux:CONTEXT"`,
+		"scope":            "Run in a transient systemd user scope",
+		"scope_properties": `systemd properties, e.g. ["CPUWeight=20"]`,
+		"nice":             "Niceness of the command",
+		"ionice":           `"idle", "best-effort[:N]" or "realtime[:N]"`,
+		"rlimits":          `prlimit resources, e.g. { as = "4294967296" }`,
+		"umask":            `Umask of the command on Unix, e.g. "002"`,
+		"group":            "Group the command runs in on Unix, by name or ID",
+		"host":             "Run the command on another machine over ssh",
+		"path_map":         "Local to remote path prefixes, for host",
+		"container":        "Run the command in a container of this image",
+		"assoc":            "Open with the system's default application instead",
+		"dbus":             "Open in this running application over D-Bus instead",
+		"bundle":           "Open with this macOS app bundle ID instead",
+		"single_instance":  `true or "wait" to wait while the rule runs for the same input, "skip" to give up`,
+		"debounce":         `Dispatch the files of a watch together once quiet, e.g. "5s"`,
+		"rate_limit":       `Most dispatches in a watch, e.g. "10/1m"`,
+		"concurrency":      "Most dispatches of the rule running at a time in a watch or apply process",
+		"pre":              "Command run before the dispatch",
+		"post":             "Command run after the dispatch, with {status}",
+	}
+	configKeyHelp = map[string]string{
+		"version":          "Schema of the config, unknown keys are errors from 2 on",
+		"pre":              "Command run before every dispatch",
+		"post":             "Command run after every dispatch",
+		"sandboxes":        "Sandbox commands by name, for sandbox",
+		"security_labels":  "Commands applying a kind of label with {label}, for security_label, user config or -c only",
+		"container":        "Command running a container, for container",
+		"unicode":          `Normalization form of inputs, e.g. "NFC"`,
+		"unicode_patterns": "Normalize the patterns as well",
+		"normalize":        `Normalizers of inputs run in order, e.g. ["strip_ansi", "trim"]`,
+		"providers":        "Commands resolving {NAME.KEY} placeholders with {key}, by NAME",
+		"allow_commands":   `The only programs the config runs, e.g. ["mpv", "zathura"]`,
+		"rule":             "The rules, as [[rule]] tables",
+		"profile":          "Rules only active with a profile, as [[profile.NAME.rule]] tables",
+		"override":         "Names or patterns of the rules of farther configs to drop",
+		"strict":           "Abort on invalid configs instead of skipping them",
+		"score":            "Let the most specific matching rule win",
+		"exact":            "Match whole inputs, the default of the rules' exact",
+		"age_identity":     "Identity file decrypting .apporte.toml.age, user config or -c only",
+		"minisign_keys":    "Public keys of minisign signatures, user config only",
+		"allowed_signers":  "Allowed signers file of ssh signatures, user config only",
+		"defaults":         "Options inherited by the rules, as a [defaults] table",
+		"macros":           "Patterns used as {{name}} in match, as a [macros] table",
+		"pathmap":          "Prefixes of input paths rewritten for commands, as a [pathmap] table, user config or -c only",
+	}
+)
+
+// findCommand returns the documentation of a subcommand.
+func findCommand(name string) (cliCommand, bool) {
+	for _, c := range cliCommands {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+// flagName formats the names of a flag as "-s, --long VALUE".
+func (f cliFlag) flagName() string {
+	name := "    --" + f.Long
+	if f.Short != "" {
+		name = "-" + f.Short + ", --" + f.Long
+	}
+	if f.Arg != "" {
+		name += " " + f.Arg
+	}
+	return name
+}
+
+// help returns the usage the flag is defined with in fs, under its long or
+// short name, and its default unless it's the zero value.
+func (f cliFlag) help(fs *flag.FlagSet) string {
+	help, def := f.Help, f.Default
+	for _, name := range []string{f.Long, f.Short} {
+		defined := fs.Lookup(name)
+		if name == "" || defined == nil || defined.Usage == "" {
+			continue
+		}
+		help = defined.Usage
+		if def == "" {
+			def = flagDefault(defined, f.Arg)
+		}
+		break
+	}
+	if def != "" {
+		return fmt.Sprintf("%s (default: %s)", help, def)
+	}
+	return help
+}
+
+// flagDefault formats the default of a flag, sizes in bytes in KiB or MiB.
+func flagDefault(f *flag.Flag, arg string) string {
+	switch f.DefValue {
+	case "", "false", "0", "[]":
+		return ""
+	}
+	if n, err := strconv.ParseInt(f.DefValue, 10, 64); err == nil && arg == "BYTES" {
+		switch {
+		case n%(1<<20) == 0:
+			return fmt.Sprintf("%d MiB", n>>20)
+		case n%(1<<10) == 0:
+			return fmt.Sprintf("%d KiB", n>>10)
+		}
+	}
+	return f.DefValue
+}
+
+// printFlags lists flags one per line, as defined in fs.
+func printFlags(w io.Writer, fs *flag.FlagSet, flags []cliFlag) {
+	for _, f := range flags {
+		printEntry(w, f.flagName(), f.help(fs))
+	}
+}
+
+// flagSet returns the flags of the command, as it defines them.
+func (c cliCommand) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.Name, flag.ExitOnError)
+	if c.define != nil {
+		c.define(fs)
+	}
+	return fs
+}
+
+// commandFlags returns the flag set a subcommand parses its arguments with,
+// its flags defined by define.
+func commandFlags(name string, define func(fs *flag.FlagSet)) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	define(fs)
+	fs.Usage = func() { commandUsage(name) }
+	return fs
+}
+
+// printEntry prints a term and its help in two columns, the help on a line
+// of its own when the term is too long.
+func printEntry(w io.Writer, term, help string) {
+	const width = 28
+	if len(term) > width {
+		fmt.Fprintf(w, "  %s\n  %-*s %s\n", term, width, "", help)
+		return
+	}
+	fmt.Fprintf(w, "  %-*s %s\n", width, term, help)
+}
+
+// usage prints --help. Flags defined without documentation are listed too,
+// with the usage they were defined with.
+func usage() {
+	w := os.Stderr
+	fmt.Fprintf(w, `Usage of %[1]s [OPTION]... [INPUT]...
+       %[1]s [OPTION]... COMMAND [ARG]...
+Inputs are the arguments, or else come from -i, --clipboard or stdin with
+--stdin, --lines or --null.
+
+`, os.Args[0])
+	printFlags(w, flag.CommandLine, cliFlags)
+	documented := map[string]bool{}
+	for _, f := range cliFlags {
+		documented[f.Long], documented[f.Short] = true, true
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !documented[f.Name] {
+			printFlags(w, flag.CommandLine, []cliFlag{{Long: f.Name}})
+		}
+	})
+
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range cliCommands {
+		// flags are for help COMMAND
+		args := strings.TrimSpace(strings.ReplaceAll(c.Args, "[OPTION]", ""))
+		if strings.HasPrefix(args, "-") {
+			args = ""
+		}
+		printEntry(w, strings.TrimSpace(c.Name+" "+args), c.Help)
+	}
+	fmt.Fprintf(w, "\nSee %s help COMMAND, %s help config and %s man.\n", os.Args[0], os.Args[0], os.Args[0])
+}
+
+// commandUsage prints the usage of a subcommand, for its -h and errors.
+func commandUsage(name string) {
+	c, _ := findCommand(name)
+	fmt.Fprintf(os.Stderr, "Usage of %s %s\n", os.Args[0], strings.TrimSpace(c.Name+" "+c.Args))
+	printFlags(os.Stderr, c.flagSet(), c.Flags)
+}
+
+// helpCommand describes a subcommand, or the keys of configs.
+func helpCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) != 1 {
+		usage()
+		return 2
+	}
+	if args[0] == "config" {
+		printConfigKeys(os.Stdout)
+		return 0
+	}
+	c, ok := findCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		return 2
+	}
+	fmt.Printf("Usage of %s %s\n\n%s.\n", os.Args[0], strings.TrimSpace(c.Name+" "+c.Args), c.Help)
+	if c.Detail != "" {
+		fmt.Printf("%s\n", c.Detail)
+	}
+	if len(c.Flags) > 0 {
+		fmt.Println()
+		printFlags(os.Stdout, c.flagSet(), c.Flags)
+	}
+	return 0
+}
+
+// printConfigKeys lists the top-level keys of configs and the keys of rules.
+func printConfigKeys(w io.Writer) {
+	fmt.Fprintln(w, "Top-level keys:")
+	for _, key := range tomlKeys(TomlConfig{}) {
+		fmt.Fprintf(w, "  %-18s %s\n", key, configKeyHelp[key])
+	}
+	fmt.Fprintln(w, "\nRule keys, also in [defaults]:")
+	for _, key := range tomlKeys(TomlRule{}) {
+		fmt.Fprintf(w, "  %-18s %s\n", key, ruleKeyHelp[key])
+	}
+}
+
+// manCommand prints the man page, generated from the same documentation as
+// --help.
+func manCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) != 0 {
+		commandUsage("man")
+		return 2
+	}
+	writeManPage(os.Stdout)
+	return 0
+}
+
+// writeManPage writes the man page in roff.
+func writeManPage(w io.Writer) {
+	section := func(name string) { fmt.Fprintf(w, ".SH %s\n", name) }
+	item := func(tag, text string) { fmt.Fprintf(w, ".TP\n%s\n%s\n", tag, roffEscape(text)) }
+	flagItem := func(fs *flag.FlagSet, f cliFlag) {
+		tag := `\fB\-\-` + roffEscape(f.Long) + `\fR`
+		if f.Short != "" {
+			tag = `\fB\-` + roffEscape(f.Short) + `\fR, ` + tag
+		}
+		if f.Arg != "" {
+			tag += ` \fI` + roffEscape(f.Arg) + `\fR`
+		}
+		text := f.help(fs) + "."
+		if f.Detail != "" {
+			text += " " + f.Detail
+		}
+		item(tag, text)
+	}
+
+	fmt.Fprintln(w, `.TH APPORTE 1 "" "apporte" "User Commands"`)
+	section("NAME")
+	fmt.Fprintln(w, `apporte \- dispatch files and links to commands according to rules`)
+	section("SYNOPSIS")
+	fmt.Fprintln(w, `\fBapporte\fR [\fIOPTION\fR]... [\fIINPUT\fR]...`)
+	fmt.Fprintln(w, ".br")
+	fmt.Fprintln(w, `\fBapporte\fR [\fIOPTION\fR]... \fICOMMAND\fR [\fIARG\fR]...`)
+	section("DESCRIPTION")
+	fmt.Fprintln(w, roffEscape(`apporte matches each input, a path, a link or any text, against the rules of the .apporte.toml configs found from the current directory up to the root, then in the user config directory, and runs the command of the winning rule. Closer configs outrank farther ones, and earlier rules later ones.`))
+	fmt.Fprintln(w, ".PP")
+	fmt.Fprintln(w, roffEscape(`Inputs are the arguments, or else come from --input, --clipboard or stdin with --stdin, --lines or --null. Paths given as file:// URIs or shell-escaped are normalized unless --raw is given.`))
+	section("OPTIONS")
+	for _, f := range cliFlags {
+		flagItem(flag.CommandLine, f)
+	}
+	section("COMMANDS")
+	for _, c := range cliCommands {
+		text := c.Help + "."
+		if c.Detail != "" {
+			text += " " + c.Detail
+		}
+		item(`\fB`+roffEscape(c.Name)+`\fR `+roffEscape(c.Args), text)
+		if len(c.Flags) > 0 {
+			fmt.Fprintln(w, ".RS")
+			fs := c.flagSet()
+			for _, f := range c.Flags {
+				flagItem(fs, f)
+			}
+			fmt.Fprintln(w, ".RE")
+		}
+	}
+	section("CONFIGURATION")
+	fmt.Fprintln(w, "Top-level keys:")
+	for _, key := range tomlKeys(TomlConfig{}) {
+		item(`\fB`+roffEscape(key)+`\fR`, configKeyHelp[key])
+	}
+	fmt.Fprintln(w, ".PP")
+	fmt.Fprintln(w, roffEscape("Keys of [[rule]] tables, which the [defaults] table takes as well, but name, match and override:"))
+	for _, key := range tomlKeys(TomlRule{}) {
+		item(`\fB`+roffEscape(key)+`\fR`, ruleKeyHelp[key])
+	}
+	section("ENVIRONMENT")
+	for _, env := range cliEnvironment {
+		item(`\fB`+roffEscape(env[0])+`\fR`, env[1])
+	}
+	section("FILES")
+	item(`\fI.apporte.toml\fR`, "Configs crawled from the current directory up, and the user config in the user config directory.")
+	item(`\fI.apporte.toml.age\fR`, "Encrypted configs, loaded after the plain config of the same directory.")
+	section("EXIT STATUS")
+	for _, status := range exitStatuses {
+		item(`\fB`+status[0]+`\fR`, status[1])
+	}
+	fmt.Fprintln(w, ".PP")
+	fmt.Fprintln(w, roffEscape("With several inputs, the status is that of the last failing one. A command replacing apporte exits with its own status."))
+}
+
+// roffEscape escapes text for roff: backslashes, dashes and the dots and
+// quotes starting a line.
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
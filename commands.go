@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+)
+
+// subcommands are recognized in place of the first input. Inputs that are
+// named like a subcommand can still be passed with -i.
+var subcommands = map[string]func(ctx context.Context, args []string, opts options) int{
+	"add":              addCommand,
+	"apply":            applyCommand,
+	"audit":            auditCommand,
+	"check":            checkCommand,
+	"dispatch-id":      dispatchIDCommand,
+	"doctor":           doctorCommand,
+	"edit":             editCommand,
+	"fmt":              formatCommand,
+	"generate-desktop": generateDesktopCommand,
+	"help":             helpCommand,
+	"init":             initCommand,
+	"man":              manCommand,
+	"menu":             menuCommand,
+	"queue":            queueCommand,
+	"redo":             redoCommand,
+	"setup":            setupCommand,
+	"simulate":         simulateCommand,
+	"snapshot":         snapshotCommand,
+	"test":             testCommand,
+	"trust":            trustCommand,
+	"tui":              tuiCommand,
+	"undo":             undoCommand,
+	"watch":            watchCommand,
+}
+
+// stringList collects the values of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// globList collects the values of a repeatable glob flag.
+type globList []string
+
+func (g *globList) String() string {
+	return fmt.Sprint(*g)
+}
+
+func (g *globList) Set(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+	*g = append(*g, pattern)
+	return nil
+}
+
+// matchAny reports whether name matches any of the globs.
+func (g globList) matchAny(name string) bool {
+	for _, pattern := range g {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseInterspersed parses flags that may come after positional arguments,
+// as in "menu FILE --format json", and returns the positional arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
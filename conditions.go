@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fact is something about the system that when conditions test and rules
+// can use as a placeholder. It's detected the first time it's needed, and
+// again once its ttl is over for facts that change while watch or the stdio
+// server runs.
+type fact struct {
+	mu       sync.Mutex
+	value    string
+	detected time.Time                        // zero until detected
+	ttl      time.Duration                    // 0 if it doesn't change
+	detect   func(ctx context.Context) string // empty when unknown
+}
+
+// factTTL is how long the facts that change, such as on_battery, are kept.
+const factTTL = 10 * time.Second
+
+func (f *fact) get(ctx context.Context) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.detected.IsZero() || f.ttl > 0 && time.Since(f.detected) >= f.ttl {
+		f.value = f.detect(ctx)
+		f.detected = time.Now()
+	}
+	return f.value
+}
+
+// newFacts returns the system facts by name, none detected yet.
+func newFacts() map[string]*fact {
+	// the facts derived from the locale share it
+	locale := &fact{detect: detectLocale}
+	return map[string]*fact{
+		"session":    {detect: detectNow(detectSession)},
+		"display":    {detect: detectNow(detectDisplay)},
+		"displays":   {detect: detectDisplays, ttl: factTTL},
+		"on_battery": {detect: detectOnBattery, ttl: factTTL},
+		"metered":    {detect: detectMetered, ttl: factTTL},
+		"locale":     locale,
+		"lang":       {detect: func(ctx context.Context) string { return localeLang(locale.get(ctx)) }},
+		"region":     {detect: func(ctx context.Context) string { return localeRegion(locale.get(ctx)) }},
+		"languages":  {detect: func(ctx context.Context) string { return detectLanguages(localeLang(locale.get(ctx))) }},
+		"os":         {detect: detectNow(func() string { return runtime.GOOS })},
+		"arch":       {detect: detectNow(func() string { return runtime.GOARCH })},
+		"hostname":   {detect: detectNow(detectHostname)},
+		"machine":    {detect: detectNow(detectMachine)},
+	}
+}
+
+// factNames are the names of the system facts, sorted.
+var factNames = slices.Sorted(maps.Keys(newFacts()))
+
+// isFact reports whether name is a system fact.
+func isFact(name string) bool {
+	_, ok := slices.BinarySearch(factNames, name)
+	return ok
+}
+
+// detectNow adapts the detection of a fact that runs no command.
+func detectNow(detect func() string) func(context.Context) string {
+	return func(context.Context) string { return detect() }
+}
+
+// factValues returns the facts the templates refer to as placeholders,
+// detecting only those.
+func factValues(ctx context.Context, facts map[string]*fact, templates []string) map[string]string {
+	values := map[string]string{}
+	for _, s := range templates {
+		for _, m := range placeholderRe.FindAllStringSubmatch(s, -1) {
+			if f, ok := facts[m[2]]; ok {
+				values[m[2]] = f.get(ctx)
+			}
+		}
+	}
+	return values
+}
+
+// condition compares a fact with a value. A bare fact name tests that it's
+// "true", and a leading ! that it isn't.
+type condition struct {
+	Fact  string
+	Op    string
+	Value string
+}
+
+func (c condition) String() string {
+	return fmt.Sprintf("%s %s %s", c.Fact, c.Op, c.Value)
+}
+
+// conditionRe matches a comparison of a when condition, factRe a bare fact.
+var (
+	conditionRe = regexp.MustCompile(`^([a-z_]+)\s*(==|!=|<=|>=|<|>)\s*(.+)$`)
+	factRe      = regexp.MustCompile(`^!?\s*([a-z_]+)$`)
+)
+
+// parseWhen parses conditions joined with "and", e.g.
+// `displays >= 2 and session == wayland`. Values may be quoted.
+func parseWhen(when string) ([]condition, error) {
+	var conds []condition
+	for _, part := range strings.Split(when, " and ") {
+		part = strings.TrimSpace(part)
+		var c condition
+		if m := conditionRe.FindStringSubmatch(part); m != nil {
+			c = condition{Fact: m[1], Op: m[2], Value: strings.TrimSpace(m[3])}
+			if unquoted, err := strconv.Unquote(c.Value); err == nil {
+				c.Value = unquoted
+			} else if len(c.Value) >= 2 && c.Value[0] == '\'' && c.Value[len(c.Value)-1] == '\'' {
+				c.Value = c.Value[1 : len(c.Value)-1]
+			}
+		} else if m := factRe.FindStringSubmatch(part); m != nil {
+			c = condition{Fact: m[1], Op: "==", Value: "true"}
+			if part[0] == '!' {
+				c.Op = "!="
+			}
+		} else {
+			return nil, fmt.Errorf("invalid when condition %q", part)
+		}
+		if !isFact(c.Fact) {
+			return nil, fmt.Errorf("unknown fact %q in when, expected one of %s", c.Fact, strings.Join(factNames, ", "))
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
+
+// holds reports whether the condition is true now. Facts that can't be
+// detected fail every condition. Numbers compare as numbers, anything else
+// only as equal or not.
+func (c condition) holds(ctx context.Context, facts map[string]*fact) bool {
+	value := facts[c.Fact].get(ctx)
+	if value == "" {
+		return false
+	}
+	a, errA := strconv.ParseFloat(value, 64)
+	b, errB := strconv.ParseFloat(c.Value, 64)
+	if errA != nil || errB != nil {
+		switch c.Op {
+		case "==":
+			return strings.EqualFold(value, c.Value)
+		case "!=":
+			return !strings.EqualFold(value, c.Value)
+		}
+		return false
+	}
+	switch c.Op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+// conditionsHold reports whether all the conditions are true now.
+func conditionsHold(ctx context.Context, conds []condition, facts map[string]*fact) bool {
+	for _, c := range conds {
+		if !c.holds(ctx, facts) {
+			return false
+		}
+	}
+	return true
+}
+
+// detectHostname returns the host name, without a domain.
+func detectHostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
+
+// detectSession names the graphical session: "wayland", "x11" or "tty" on
+// Linux and BSDs, "windows" or "macos" elsewhere.
+func detectSession() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "windows"
+	case "darwin":
+		return "macos"
+	}
+	switch session := os.Getenv("XDG_SESSION_TYPE"); session {
+	case "wayland", "x11", "tty":
+		return session
+	}
+	switch {
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		return "wayland"
+	case os.Getenv("DISPLAY") != "":
+		return "x11"
+	}
+	return "tty"
+}
+
+// detectDisplay returns the Wayland or X11 display apporte runs on.
+func detectDisplay() string {
+	if display := os.Getenv("WAYLAND_DISPLAY"); display != "" {
+		return display
+	}
+	return os.Getenv("DISPLAY")
+}
+
+// detectDisplays counts the connected monitors.
+func detectDisplays(ctx context.Context) string {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; [System.Windows.Forms.Screen]::AllScreens.Length")
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "osascript", "-l", "JavaScript", "-e", "ObjC.import('AppKit'); $.NSScreen.screens.count")
+	default:
+		// connectors of the kernel's DRM devices, whatever the session
+		statuses, _ := filepath.Glob("/sys/class/drm/card*-*/status")
+		count := 0
+		for _, path := range statuses {
+			if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) == "connected" {
+				count++
+			}
+		}
+		if len(statuses) > 0 {
+			return strconv.Itoa(count)
+		}
+		cmd = exec.CommandContext(ctx, "xrandr", "--listmonitors")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	text := strings.TrimSpace(string(out))
+	// xrandr prints "Monitors: N" first
+	if n, ok := strings.CutPrefix(text, "Monitors:"); ok {
+		text, _, _ = strings.Cut(strings.TrimSpace(n), "\n")
+	}
+	if _, err := strconv.Atoi(text); err != nil {
+		return ""
+	}
+	return text
+}
+
+// detectOnBattery reports whether the system runs on battery, "true" or
+// "false". Systems without a battery never do.
+func detectOnBattery(ctx context.Context) string {
+	switch runtime.GOOS {
+	case "windows":
+		status := factOutput(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; [System.Windows.Forms.SystemInformation]::PowerStatus.PowerLineStatus")
+		switch status {
+		case "Offline":
+			return "true"
+		case "Online":
+			return "false"
+		}
+		return ""
+	case "darwin":
+		// pmset -g batt starts with "Now drawing from 'AC Power'"
+		out := factOutput(ctx, "pmset", "-g", "batt")
+		if out == "" {
+			return ""
+		}
+		return strconv.FormatBool(strings.Contains(out, "'Battery Power'"))
+	}
+	supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+	battery := false
+	for _, dir := range supplies {
+		kind, _ := os.ReadFile(filepath.Join(dir, "type"))
+		switch strings.TrimSpace(string(kind)) {
+		case "Mains":
+			if online, _ := os.ReadFile(filepath.Join(dir, "online")); strings.TrimSpace(string(online)) == "1" {
+				return "false"
+			}
+		case "Battery":
+			battery = true
+		}
+	}
+	return strconv.FormatBool(battery)
+}
+
+// detectMetered reports whether the internet connection is metered, "true"
+// or "false", as NetworkManager or Windows tell. It's unknown on macOS.
+func detectMetered(ctx context.Context) string {
+	switch runtime.GOOS {
+	case "windows":
+		cost := factOutput(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"[Windows.Networking.Connectivity.NetworkInformation,Windows.Networking.Connectivity,ContentType=WindowsRuntime] | Out-Null; "+
+				"[Windows.Networking.Connectivity.NetworkInformation]::GetInternetConnectionProfile().GetConnectionCost().NetworkCostType")
+		switch cost {
+		case "Unrestricted":
+			return "false"
+		case "Fixed", "Variable":
+			return "true"
+		}
+		return ""
+	case "darwin":
+		return ""
+	}
+	// NMMetered: 1 yes, 2 no, 3 guessed yes, 4 guessed no
+	out := factOutput(ctx, "gdbus", "call", "--system",
+		"--dest", "org.freedesktop.NetworkManager",
+		"--object-path", "/org/freedesktop/NetworkManager",
+		"--method", "org.freedesktop.DBus.Properties.Get",
+		"org.freedesktop.NetworkManager", "Metered")
+	switch strings.Trim(strings.TrimPrefix(out, "(<uint32"), " >,)") {
+	case "1", "3":
+		return "true"
+	case "2", "4":
+		return "false"
+	}
+	return ""
+}
+
+// factOutput runs a command detecting a fact and returns its trimmed output,
+// or nothing when it fails.
+func factOutput(ctx context.Context, name string, args ...string) string {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// detectLocale returns the locale of messages as language_REGION, e.g.
+// "de_DE", from $LC_ALL, $LC_MESSAGES or $LANG, or else the system's settings.
+// The C locale has no language.
+func detectLocale(ctx context.Context) string {
+	var locale string
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale = os.Getenv(name); locale != "" {
+			break
+		}
+	}
+	if locale == "" {
+		switch runtime.GOOS {
+		case "windows":
+			locale = factOutput(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", "(Get-Culture).Name")
+		case "darwin":
+			locale = factOutput(ctx, "defaults", "read", "-g", "AppleLocale")
+		}
+	}
+	// drop the encoding and modifier of de_DE.UTF-8@euro
+	locale, _, _ = strings.Cut(locale, ".")
+	locale, _, _ = strings.Cut(locale, "@")
+	if locale == "C" || locale == "POSIX" {
+		return ""
+	}
+	lang, region, _ := strings.Cut(strings.ReplaceAll(locale, "-", "_"), "_")
+	if region == "" {
+		return strings.ToLower(lang)
+	}
+	return strings.ToLower(lang) + "_" + strings.ToUpper(region)
+}
+
+// localeLang returns the language of a locale, e.g. "de".
+func localeLang(locale string) string {
+	lang, _, _ := strings.Cut(locale, "_")
+	return lang
+}
+
+// localeRegion returns the region of a locale, e.g. "DE".
+func localeRegion(locale string) string {
+	_, region, _ := strings.Cut(locale, "_")
+	return region
+}
+
+// detectLanguages lists the preferred languages, most preferred first and
+// separated by commas, from $LANGUAGE or else the language of the locale.
+func detectLanguages(fromLocale string) string {
+	var langs []string
+	for _, item := range strings.Split(os.Getenv("LANGUAGE"), ":") {
+		lang, _, _ := strings.Cut(item, "_")
+		if lang != "" && !slices.Contains(langs, strings.ToLower(lang)) {
+			langs = append(langs, strings.ToLower(lang))
+		}
+	}
+	if len(langs) == 0 {
+		return fromLocale
+	}
+	return strings.Join(langs, ",")
+}
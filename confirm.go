@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// confirm prints the command and asks on the terminal whether to run it.
+// The terminal is opened directly since stdin may carry the input. Without a
+// terminal to ask on, the answer is no.
+func (e *engine) confirm(ctx context.Context, argv []string) bool {
+	tty, err := e.platform.OpenTTY()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, e.tr("Confirmation required, but there is no terminal (use --yes)"))
+		return false
+	}
+	defer tty.Close()
+
+	fmt.Fprint(os.Stderr, e.trf("Run %s? [y/N] ", shellJoin(argv)))
+	answer, _ := readAnswer(ctx, bufio.NewReader(tty))
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes", e.tr("y"), e.tr("yes"):
+		return true
+	}
+	return false
+}
+
+// readAnswer reads a line typed on the terminal, giving up when ctx is done,
+// since interrupts don't stop apporte while it waits.
+func readAnswer(ctx context.Context, r *bufio.Reader) (string, error) {
+	type answer struct {
+		line string
+		err  error
+	}
+	answers := make(chan answer, 1)
+	go func() {
+		line, err := r.ReadString('\n')
+		answers <- answer{line, err}
+	}()
+	select {
+	case a := <-answers:
+		return a.line, a.err
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return "", ctx.Err()
+	}
+}
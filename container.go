@@ -0,0 +1,35 @@
+package main
+
+import "os/exec"
+
+// defaultContainer runs the image with the input's directory mounted at the
+// same path and used as the working directory.
+var defaultContainer = []string{
+	"run", "--rm", "--interactive",
+	"--volume", "{dir}:{dir}",
+	"--workdir", "{dir}",
+	"{image}",
+}
+
+// containerRuntime prefers podman over docker.
+func containerRuntime() string {
+	if _, err := exec.LookPath("podman"); err == nil {
+		return "podman"
+	}
+	return "docker"
+}
+
+// resolveContainers fills in the container argv of every rule naming an
+// image, from the top-level container template or the default one.
+func (c *Config) resolveContainers() {
+	template := c.Container
+	for i, rule := range c.Rules {
+		if rule.Container == "" {
+			continue
+		}
+		if template == nil {
+			template = join([]string{containerRuntime()}, defaultContainer)
+		}
+		c.Rules[i].Runner = expandArgv(template, map[string]string{"image": rule.Container})
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// parentDir returns the parent directory of path, or path itself at the root
+// of a drive, UNC share (\\server\share) or long path volume (\\?\C:).
+func parentDir(path string) string {
+	path = filepath.Clean(path)
+	vol := filepath.VolumeName(path)
+	if path == vol || path == vol+string(filepath.Separator) {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+// pathKey identifies a config path for deduplication. Windows paths are
+// case-insensitive.
+func pathKey(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// visitedConfigs remembers the config files seen by a crawl by path and by
+// identity, so that symlinks to an already loaded file are skipped.
+type visitedConfigs struct {
+	paths map[string]bool
+	files []os.FileInfo
+}
+
+// visit reports whether the config file at path, as stat'ed into info, hasn't
+// been seen before. Info is nil when the file couldn't be stat'ed.
+func (v *visitedConfigs) visit(path string, info os.FileInfo) bool {
+	key := pathKey(path)
+	if v.paths[key] {
+		return false
+	}
+	v.paths[key] = true
+
+	if info == nil {
+		return true
+	}
+	for _, seen := range v.files {
+		if os.SameFile(seen, info) {
+			return false
+		}
+	}
+	v.files = append(v.files, info)
+	return true
+}
+
+// crawlStart resolves the directory the crawl starts from. Logical traversal
+// walks up the path as given, symlinks included, like the shell's $PWD.
+// Physical traversal resolves symlinks first and walks up the real parents.
+func crawlStart(dir string, physical bool) (string, error) {
+	if !physical {
+		return dir, nil
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return dir, fmt.Errorf("cannot resolve %q, crawling it logically: %w", dir, err)
+	}
+	return resolved, nil
+}
+
+// Tiers of the configs a rule can come from, from the highest ranked. Rules
+// standing in when none match, such as the browser for links, are in a tier
+// of their own.
+const (
+	tierBuiltin     = iota - 1
+	tierPrioritized // given with -c
+	tierCrawled     // found from the start directory up to the root
+	tierUser        // the user config
+)
+
+// crawlLimits bound the configs loaded, so that a generated config gone wrong
+// fails early, and the directories crawled, so that a slow mount doesn't hang
+// apporte. All can be changed with flags.
+type crawlLimits struct {
+	ConfigSize   int64         // of each config, in bytes
+	Rules        int           // in all configs
+	SkipNetwork  bool          // skip crawled directories on network filesystems
+	StatTimeout  time.Duration // skip crawled directories slower to stat, zero for none
+	FileTimeout  time.Duration // to load each config, zero for none
+	RegexTimeout time.Duration // of each match of a PCRE pattern, zero for none
+}
+
+// defaultCrawlLimits are the limits unless --max-config-size or --max-rules
+// are given.
+var defaultCrawlLimits = crawlLimits{ConfigSize: 1 << 20, Rules: 10000, RegexTimeout: defaultRegexTimeout}
+
+// rank orders rules by the tier of their config, the place of the config in
+// its tier and the place of the rule in its config. Unlike a running count,
+// a rank doesn't depend on how many rules the configs ranked above have.
+type rank struct {
+	Tier  int
+	File  int
+	Index int
+}
+
+// less reports whether r outranks o.
+func (r rank) less(o rank) bool {
+	if r.Tier != o.Tier {
+		return r.Tier < o.Tier
+	}
+	if r.File != o.File {
+		return r.File < o.File
+	}
+	return r.Index < o.Index
+}
+
+func (r rank) String() string {
+	return fmt.Sprintf("(%d, %d, %d)", r.Tier, r.File, r.Index)
+}
+
+// configTier returns the tier of the i-th of the paths listed by configPaths.
+func configTier(paths []string, i int, prioritizedConfigPath []string) int {
+	switch {
+	case i < len(prioritizedConfigPath):
+		return tierPrioritized
+	case i >= len(paths)-2 && pathKey(strings.TrimSuffix(paths[i], ageSuffix)) == pathKey(userConfigPath()):
+		return tierUser
+	}
+	return tierCrawled
+}
+
+// crawlKeys are what a crawl needs to open and trust configs, along with the
+// defaults of the user config, found before
+// it starts.
+type crawlKeys struct {
+	ageIdentity string
+	signers     signers
+	own         map[string]bool   // configs that needn't be signed or trusted
+	trust       map[string]string // hashes of trusted configs by path key
+	defaults    ruleDefaults      // under the defaults of every config
+	warnings    []warning         // why the user config gives none of them
+}
+
+// trusted reports whether the config at path was trusted with the content
+// data.
+func (k crawlKeys) trusted(path string, data []byte) bool {
+	return k.trust[pathKey(path)] == configHash(data)
+}
+
+// findCrawlKeys looks up the keys for the configs among paths. The user's
+// own configs, the user config and those given with -c, needn't be signed or
+// trusted.
+func (e *engine) findCrawlKeys(ctx context.Context, paths []string, prioritizedConfigPath []string, limits crawlLimits) crawlKeys {
+	keys := crawlKeys{
+		ageIdentity: e.ageIdentity(ctx, paths, prioritizedConfigPath, limits),
+		own:         map[string]bool{},
+		trust:       loadTrust(),
+	}
+	if user := userConfigPath(); user != "" {
+		keys.own[pathKey(user)] = true
+		keys.own[pathKey(user+ageSuffix)] = true
+		tc, md, err := e.decodeOwnConfig(ctx, user, limits)
+		if err == nil {
+			keys.signers = configSigners(user, tc)
+			keys.defaults, err = decodeDefaults(tc, md)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			keys.warnings = append(keys.warnings, warning{Level: levelError, Kind: "invalid_config", Source: user,
+				Message: fmt.Sprintf("its defaults, signing keys and age_identity don't apply: %v", err)})
+		}
+	}
+	for _, path := range prioritizedConfigPath {
+		if path != "" {
+			keys.own[pathKey(path)] = true
+		}
+	}
+	return keys
+}
+
+// decodeOwnConfig reads one of the user's own configs for the keys of a
+// crawl, templates expanded, as loadRulesFromFile does. Encrypted configs,
+// which need the keys to be read, have none to give.
+func (e *engine) decodeOwnConfig(ctx context.Context, path string, limits crawlLimits) (TomlConfig, toml.MetaData, error) {
+	var tc TomlConfig
+	data, err := readConfigFile(path, limits.ConfigSize)
+	if err != nil {
+		return tc, toml.MetaData{}, err
+	}
+	if isTemplate(data) {
+		if data, err = expandTemplate(ctx, data, e.facts); err != nil {
+			return tc, toml.MetaData{}, fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	md, err := toml.Decode(string(data), &tc)
+	if err != nil {
+		return tc, md, fmt.Errorf("failed to parse TOML: %w", err)
+	}
+	return tc, md, nil
+}
+
+// unreadableConfig describes why a config that exists, or may exist, can't be
+// read, such as permissions or an I/O error. The path is the source of the
+// warning.
+func unreadableConfig(err error) warning {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return warning{Level: levelError, Kind: "unreadable_config", Message: "cannot read config: " + err.Error()}
+}
+
+// crawlWorkers bounds the configs loaded at once by a crawl.
+const crawlWorkers = 8
+
+// configLoad is a config file loaded by a worker of the crawl. Its rules are
+// ranked by file once the configs before it are merged.
+type configLoad struct {
+	info   os.FileInfo // nil when the file couldn't be stat'ed
+	loaded Config
+	err    error
+}
+
+// loadConfigFiles loads the config files among paths concurrently, each
+// within the limits' file timeout. Files that don't exist are left with
+// neither info nor error.
+func (e *engine) loadConfigFiles(ctx context.Context, paths []string, prioritizedConfigPath []string, cache *regexCache, keys crawlKeys, limits crawlLimits) []configLoad {
+	loads := make([]configLoad, len(paths))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, crawlWorkers)
+	for i, path := range paths {
+		tier := configTier(paths, i, prioritizedConfigPath)
+		if path == "" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if ctx.Err() != nil {
+				return
+			}
+			loads[i] = e.loadConfigFile(ctx, path, tier, cache, keys, limits)
+		}()
+	}
+	wg.Wait()
+	return loads
+}
+
+// loadConfigFile loads the config at path for loadConfigFiles. A config taking
+// longer than the file timeout is reported unreadable and left loading in the
+// background.
+func (e *engine) loadConfigFile(ctx context.Context, path string, tier int, cache *regexCache, keys crawlKeys, limits crawlLimits) configLoad {
+	done := make(chan configLoad, 1)
+	go func() {
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			done <- configLoad{}
+			return
+		}
+		loaded, err := e.loadRulesFromFile(ctx, path, rank{Tier: tier}, cache, keys, limits)
+		done <- configLoad{info: info, loaded: loaded, err: err}
+	}()
+
+	var timeout <-chan time.Time
+	if limits.FileTimeout > 0 {
+		timer := time.NewTimer(limits.FileTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case load := <-done:
+		return load
+	case <-timeout:
+		return configLoad{err: warning{Level: levelError, Kind: "unreadable_config",
+			Message: fmt.Sprintf("cannot read config within %s, see --config-timeout", limits.FileTimeout)}}
+	case <-ctx.Done():
+		return configLoad{}
+	}
+}
+
+// mergeConfig adds a loaded config to conf with the file rank of base, and
+// returns the number of rules it brings.
+func mergeConfig(configPath string, load configLoad, base rank, visited *visitedConfigs, limits crawlLimits, conf *Config) int {
+	if load.info == nil && load.err == nil || !visited.visit(configPath, load.info) {
+		return 0
+	}
+
+	loaded, err := load.loaded, load.err
+	for i := range loaded.Rules {
+		loaded.Rules[i].Rank.File = base.File
+	}
+	conf.Strict = conf.Strict || loaded.Strict
+	conf.Score = conf.Score || loaded.Score
+	conf.Unsigned = append(conf.Unsigned, loaded.Unsigned...)
+	conf.Warnings = append(conf.Warnings, loaded.Warnings...)
+	if err == nil && len(conf.Rules)+len(loaded.Rules) > limits.Rules {
+		err = warning{Level: levelError, Kind: "too_many_rules", Message: fmt.Sprintf("more than %d rules in all configs, see --max-rules", limits.Rules)}
+	}
+	if err == nil {
+		for _, rule := range loaded.Rules {
+			// closer configs redefine these rules instead of outranking them
+			if conf.Overrides[rule.Name] || conf.Overrides[rule.Match.String()] {
+				continue
+			}
+			conf.Rules = append(conf.Rules, rule)
+		}
+		for key := range loaded.Overrides {
+			conf.Overrides[key] = true
+		}
+		conf.Pre = append(conf.Pre, loaded.Pre...)
+		conf.Post = append(conf.Post, loaded.Post...)
+		// closer configs are loaded first and take precedence, but crawled
+		// ones only add sandboxes, the user's rules stay confined as set
+		for name, argv := range loaded.Sandboxes {
+			_, builtin := builtinSandboxes[name]
+			if _, ok := conf.Sandboxes[name]; !ok && !(builtin && base.Tier == tierCrawled) {
+				conf.Sandboxes[name] = argv
+			}
+		}
+		// confinement is the user's, the configs it confines can't undo it
+		for kind, argv := range loaded.Labelers {
+			if _, ok := conf.Labelers[kind]; !ok && base.Tier != tierCrawled {
+				conf.Labelers[kind] = argv
+			}
+		}
+		for name, argv := range loaded.Providers {
+			if _, ok := conf.Providers[name]; !ok {
+				conf.Providers[name] = argv
+			}
+		}
+		// mount points are the machine's, a repo can't redirect its inputs
+		for prefix, target := range loaded.PathMap {
+			if _, ok := conf.PathMap[prefix]; !ok && base.Tier != tierCrawled {
+				conf.PathMap[prefix] = target
+			}
+		}
+		if conf.Container == nil {
+			conf.Container = loaded.Container
+		}
+		if conf.Normalize == nil {
+			conf.Normalize = loaded.Normalize
+		}
+		return len(loaded.Rules)
+	}
+	conf.Warnings = append(conf.Warnings, warningsOf(err, configPath)...)
+	return 0
+}
+
+// configPaths lists the config files that may apply to start, in crawl
+// order: the prioritized paths, then from start up to the root, then the
+// user config. An encrypted config comes right after the plain one of its
+// directory.
+func configPaths(start string, prioritizedConfigPath []string) []string {
+	// prioritized paths (rank 0+)
+	paths := append([]string(nil), prioritizedConfigPath...)
+
+	// $PWD -> root
+	dir := start
+	for {
+		paths = append(paths, filepath.Join(dir, ".apporte.toml"), filepath.Join(dir, ".apporte.toml"+ageSuffix))
+
+		parent := parentDir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	// user config is lowest priority
+	if userConfDir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(userConfDir, ".apporte.toml"), filepath.Join(userConfDir, ".apporte.toml"+ageSuffix))
+	}
+	return paths
+}
+
+// nearestConfig returns the first existing plain config in crawl order, or
+// an empty string if there is none. Encrypted configs can't be edited in
+// place.
+func nearestConfig(start string, prioritizedConfigPath []string) string {
+	for _, path := range configPaths(start, prioritizedConfigPath) {
+		if strings.HasSuffix(path, ageSuffix) {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// skipDir reports whether the configs of a crawled directory are skipped by
+// the limits: the directory is on a network filesystem, or doesn't answer
+// within the stat timeout, as an autofs mount of an unreachable host does.
+// The stat is left running in the background then.
+func skipDir(ctx context.Context, dir string, limits crawlLimits) bool {
+	if !limits.SkipNetwork && limits.StatTimeout <= 0 {
+		return false
+	}
+	done := make(chan bool, 1)
+	go func() {
+		if limits.SkipNetwork {
+			done <- networkFS(dir)
+			return
+		}
+		os.Stat(dir)
+		done <- false
+	}()
+
+	var timeout <-chan time.Time
+	if limits.StatTimeout > 0 {
+		timer := time.NewTimer(limits.StatTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case skip := <-done:
+		return skip
+	case <-timeout:
+		return true
+	case <-ctx.Done():
+		return true
+	}
+}
+
+// skipDirs blanks the crawled configs among paths that are in directories
+// skipped by the limits, before anything stats or reads them, and returns a
+// warning for each of those directories. The directories are checked
+// concurrently, and both configs of a directory share its check.
+func skipDirs(ctx context.Context, paths []string, prioritizedConfigPath []string, limits crawlLimits) []warning {
+	if !limits.SkipNetwork && limits.StatTimeout <= 0 {
+		return nil
+	}
+	var dirs []string
+	for i, path := range paths {
+		if path != "" && configTier(paths, i, prioritizedConfigPath) == tierCrawled && !slices.Contains(dirs, filepath.Dir(path)) {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+	skipped := make([]bool, len(dirs))
+	var wg sync.WaitGroup
+	for i, dir := range dirs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			skipped[i] = skipDir(ctx, dir, limits)
+		}()
+	}
+	wg.Wait()
+
+	var warnings []warning
+	for i, dir := range dirs {
+		if !skipped[i] {
+			continue
+		}
+		warnings = append(warnings, warning{Level: levelWarning, Kind: "skipped_dir", Source: dir,
+			Message: "directory skipped, on a network filesystem or too slow to answer, see --skip-network-fs and --stat-timeout"})
+		for j, path := range paths {
+			if path != "" && configTier(paths, j, prioritizedConfigPath) == tierCrawled && filepath.Dir(path) == dir {
+				paths[j] = ""
+			}
+		}
+	}
+	return warnings
+}
+
+// crawlConfigTree loads the configs applying to start. Problems with the
+// configs are left in the warnings of the result. Configs are loaded
+// concurrently, then merged in crawl order, so that ranks don't depend on
+// which loads first. It stops early when ctx is done, returning the context's
+// error.
+func (e *engine) crawlConfigTree(ctx context.Context, start string, prioritizedConfigPath []string, limits crawlLimits) (Config, error) {
+	conf := Config{Sandboxes: map[string][]string{}, Labelers: map[string][]string{}, Providers: map[string][]string{}, PathMap: map[string]string{}, Overrides: map[string]bool{}}
+	visited := &visitedConfigs{paths: map[string]bool{}}
+	cache := newRegexCache(limits.RegexTimeout)
+	base := rank{Tier: tierPrioritized}
+
+	paths := configPaths(start, prioritizedConfigPath)
+	conf.Warnings = skipDirs(ctx, paths, prioritizedConfigPath, limits)
+	keys := e.findCrawlKeys(ctx, paths, prioritizedConfigPath, limits)
+	conf.Warnings = append(conf.Warnings, keys.warnings...)
+	loads := e.loadConfigFiles(ctx, paths, prioritizedConfigPath, cache, keys, limits)
+	if err := ctx.Err(); err != nil {
+		return conf, err
+	}
+	// crawled configs can add providers and sandboxes, but not redefine
+	// the user's own, nor replace the user's container or normalizers
+	for i, load := range loads {
+		if configTier(paths, i, prioritizedConfigPath) == tierCrawled || load.err != nil {
+			continue
+		}
+		for name, argv := range load.loaded.Providers {
+			if _, ok := conf.Providers[name]; !ok {
+				conf.Providers[name] = argv
+			}
+		}
+		for name, argv := range load.loaded.Sandboxes {
+			if _, ok := conf.Sandboxes[name]; !ok {
+				conf.Sandboxes[name] = argv
+			}
+		}
+		if conf.Container == nil {
+			conf.Container = load.loaded.Container
+		}
+		if conf.Normalize == nil {
+			conf.Normalize = load.loaded.Normalize
+		}
+	}
+	for i, configPath := range paths {
+		if tier := configTier(paths, i, prioritizedConfigPath); tier != base.Tier {
+			base = rank{Tier: tier}
+		}
+		if mergeConfig(configPath, loads[i], base, visited, limits, &conf) > 0 {
+			base.File++
+		}
+	}
+
+	conf.Warnings = append(conf.Warnings, conf.checkProviderPlaceholders()...)
+	conf.Warnings = append(conf.Warnings, conf.resolveSandboxes()...)
+	conf.Warnings = append(conf.Warnings, conf.resolveLabels()...)
+	conf.resolveContainers()
+	conf.resolvePathMaps()
+	return conf, nil
+}
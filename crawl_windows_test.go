@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestParentDirWindows(t *testing.T) {
+	for _, tc := range []struct{ path, want string }{
+		{`C:\Users\me`, `C:\Users`},
+		{`C:\Users`, `C:\`},
+		{`C:\`, `C:\`},
+		{`C:/Users/me/`, `C:\Users`},
+		{`\\server\share\dir\sub`, `\\server\share\dir`},
+		{`\\server\share\dir`, `\\server\share\`},
+		{`\\server\share\`, `\\server\share\`},
+		{`\\server\share`, `\\server\share`},
+		{`\\?\C:\Users\me`, `\\?\C:\Users`},
+		{`\\?\C:\Users`, `\\?\C:\`},
+		{`\\?\C:\`, `\\?\C:\`},
+		{`\\?\UNC\server\share\dir`, `\\?\UNC\server\share\`},
+		{`\\?\UNC\server\share\`, `\\?\UNC\server\share\`},
+	} {
+		if got := parentDir(tc.path); got != tc.want {
+			t.Errorf("parentDir(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestPathKeyWindows(t *testing.T) {
+	for _, tc := range []struct{ a, b string }{
+		{`C:\Users\Me\.apporte.toml`, `c:\users\me\.APPORTE.toml`},
+		{`C:/Users/me/./x/../.apporte.toml`, `c:\users\me\.apporte.toml`},
+		{`\\Server\Share\dir\.apporte.toml`, `\\server\share\DIR\.apporte.toml`},
+		{`\\?\C:\Users\me\.apporte.toml`, `\\?\c:\USERS\me\.apporte.toml`},
+	} {
+		if pathKey(tc.a) != pathKey(tc.b) {
+			t.Errorf("pathKey(%q) = %q, pathKey(%q) = %q, want them equal", tc.a, pathKey(tc.a), tc.b, pathKey(tc.b))
+		}
+	}
+	if a, b := `C:\a\.apporte.toml`, `D:\a\.apporte.toml`; pathKey(a) == pathKey(b) {
+		t.Errorf("pathKey(%q) = pathKey(%q) = %q, want them different", a, b, pathKey(a))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// fileManagerBus is the dbus value showing inputs in the file manager rather
+// than opening them in an application.
+const fileManagerBus = "FileManager1"
+
+// uriSchemeRe matches inputs that already are URIs.
+var uriSchemeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+
+// dbusArgv hands the input to a running application over D-Bus, through its
+// org.freedesktop.Application interface, instead of starting another
+// instance. D-Bus activation starts the application if it isn't running.
+func dbusArgv(rule Rule) []string {
+	uris := "[" + gvariantQuote(inputURI(rule.Input)) + "]"
+	if rule.DBus == fileManagerBus {
+		return []string{
+			"gdbus", "call", "--session",
+			"--dest", "org.freedesktop.FileManager1",
+			"--object-path", "/org/freedesktop/FileManager1",
+			"--method", "org.freedesktop.FileManager1.ShowItems",
+			uris, "''",
+		}
+	}
+	path := "/" + strings.NewReplacer(".", "/", "-", "_").Replace(rule.DBus)
+	return []string{
+		"gdbus", "call", "--session",
+		"--dest", rule.DBus,
+		"--object-path", path,
+		"--method", "org.freedesktop.Application.Open",
+		uris, "@a{sv} {}",
+	}
+}
+
+// inputURI returns the input as a URI, turning paths into file:// URIs.
+func inputURI(input string) string {
+	if uriSchemeRe.MatchString(input) && !filepath.IsAbs(input) {
+		return input
+	}
+	if abs, err := filepath.Abs(input); err == nil {
+		input = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(input)}).String()
+}
+
+// gvariantQuote quotes a string in the GVariant text format gdbus parses.
+func gvariantQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// noDefaultKeys are the rule keys that would make every rule the same.
+var noDefaultKeys = map[string]bool{"name": true, "match": true, "override": true}
+
+// ruleDefaults are the values of a [defaults] table and the keys it sets.
+// Rules inherit the keys they don't set themselves, and the entries of the
+// tables, such as env, they don't have.
+type ruleDefaults struct {
+	rule TomlRule
+	keys map[string]bool
+}
+
+// decodeDefaults finds the keys set in the [defaults] table of a config.
+func decodeDefaults(tc TomlConfig, md toml.MetaData) (ruleDefaults, error) {
+	d := ruleDefaults{rule: tc.Defaults, keys: map[string]bool{}}
+	for _, key := range md.Keys() {
+		if len(key) != 2 || key[0] != "defaults" {
+			continue
+		}
+		if noDefaultKeys[key[1]] {
+			return d, fmt.Errorf("%s can't have a default", key[1])
+		}
+		d.keys[key[1]] = true
+	}
+	return d, nil
+}
+
+// under returns the defaults of d, falling back to those of base.
+func (d ruleDefaults) under(base ruleDefaults) ruleDefaults {
+	if len(base.keys) == 0 {
+		return d
+	}
+	merged := ruleDefaults{rule: applyDefaults(d.rule, base, d.keys), keys: map[string]bool{}}
+	for key := range base.keys {
+		merged.keys[key] = true
+	}
+	for key := range d.keys {
+		merged.keys[key] = true
+	}
+	return merged
+}
+
+// applyDefaults sets the defaults of the keys r doesn't set. Tables are
+// merged, the entries of r winning.
+func applyDefaults(r TomlRule, d ruleDefaults, set map[string]bool) TomlRule {
+	rv := reflect.ValueOf(&r).Elem()
+	dv := reflect.ValueOf(d.rule)
+	for i := 0; i < rv.NumField(); i++ {
+		key, _, _ := strings.Cut(rv.Type().Field(i).Tag.Get("toml"), ",")
+		if !d.keys[key] {
+			continue
+		}
+		field, def := rv.Field(i), dv.Field(i)
+		switch {
+		case !set[key]:
+			field.Set(def)
+		case field.Kind() == reflect.Map && !def.IsNil():
+			merged := reflect.MakeMap(field.Type())
+			for _, k := range def.MapKeys() {
+				merged.SetMapIndex(k, def.MapIndex(k))
+			}
+			for _, k := range field.MapKeys() {
+				merged.SetMapIndex(k, field.MapIndex(k))
+			}
+			field.Set(merged)
+		}
+	}
+	return r
+}
+
+// ruleKeySets finds the keys each rule sets, by table of rules and index, as
+// the decoded rules can't tell a false or empty value from a missing one.
+func ruleKeySets(src string) (map[string][]map[string]bool, error) {
+	type rules struct {
+		Rules []map[string]interface{} `toml:"rule"`
+	}
+	var raw struct {
+		rules
+		Profiles map[string]rules `toml:"profile"`
+	}
+	if _, err := toml.Decode(src, &raw); err != nil {
+		return nil, err
+	}
+	sets := map[string][]map[string]bool{}
+	keysOf := func(table string, list []map[string]interface{}) {
+		for _, rule := range list {
+			set := map[string]bool{}
+			for key := range rule {
+				set[key] = true
+			}
+			sets[table] = append(sets[table], set)
+		}
+	}
+	keysOf("rule", raw.Rules)
+	for name, profile := range raw.Profiles {
+		keysOf("profile."+name+".rule", profile.Rules)
+	}
+	return sets, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// desktopIDRe matches the characters that can't be part of a desktop file ID.
+var desktopIDRe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// desktopEntry is a generated desktop entry.
+type desktopEntry struct {
+	id       string
+	name     string
+	comment  string
+	icon     string
+	args     []string // arguments of apporte before the files
+	mimeType string
+}
+
+// desktopFlags are the flags of generate-desktop.
+type desktopFlags struct {
+	dir string
+}
+
+func (f *desktopFlags) define(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", "", "Directory to write the entries to")
+}
+
+// generateDesktopCommand writes a desktop entry for every named rule and for
+// the content types of the other rules, so that file managers list the rules
+// under "Open With". Entries of earlier runs are replaced.
+func generateDesktopCommand(ctx context.Context, args []string, opts options) int {
+	var given desktopFlags
+	flags := commandFlags("generate-desktop", given.define)
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	configDir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to get current directory: %v", err))
+		return 1
+	}
+	if flags.NArg() == 1 {
+		if configDir, err = filepath.Abs(flags.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to resolve %s: %v", flags.Arg(0), err))
+			return 1
+		}
+	}
+	conf, err := loadConfig(ctx, configDir, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to load rules:\n%s", err))
+		return 1
+	}
+
+	if given.dir == "" {
+		if given.dir, err = applicationsDir(); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to locate the applications directory: %v", err))
+			return 1
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to locate apporte: %v", err))
+		return 1
+	}
+
+	if err := opts.Engine.writeDesktopEntries(given.dir, exe, desktopEntries(conf.Rules)); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write desktop entries: %v", err))
+		return 1
+	}
+	return 0
+}
+
+// desktopEntries returns an entry running each named rule alone, and one per
+// content type that unnamed rules are restricted to. The entry of a content
+// type has the icon of its best ranked rule with one.
+func desktopEntries(rules []Rule) []desktopEntry {
+	var entries []desktopEntry
+	named := map[string]bool{}
+	byMime := map[string]string{}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			if icon, ok := byMime[rule.Mime]; rule.Mime != "" && (!ok || icon == "") {
+				byMime[rule.Mime] = rule.Icon
+			}
+			continue
+		}
+		if named[rule.Name] {
+			continue
+		}
+		named[rule.Name] = true
+		name := rule.Desc
+		if name == "" {
+			name = rule.Name
+		}
+		entries = append(entries, desktopEntry{
+			id:       "apporte-rule-" + desktopIDRe.ReplaceAllString(rule.Name, "-"),
+			name:     name,
+			comment:  fmt.Sprintf("Open with the apporte rule %q", rule.Name),
+			icon:     rule.Icon,
+			args:     []string{"--enable-only", rule.Name},
+			mimeType: rule.Mime,
+		})
+	}
+
+	mimes := make([]string, 0, len(byMime))
+	for mime := range byMime {
+		mimes = append(mimes, mime)
+	}
+	sort.Strings(mimes)
+	for _, mime := range mimes {
+		entries = append(entries, desktopEntry{
+			id:       "apporte-mime-" + desktopIDRe.ReplaceAllString(strings.ReplaceAll(mime, "*", "all"), "-"),
+			name:     "Apporte (" + mime + ")",
+			comment:  "Open according to apporte rules",
+			icon:     byMime[mime],
+			mimeType: mime,
+		})
+	}
+	return entries
+}
+
+// writeDesktopEntries replaces the generated entries in dir, and refreshes the
+// MIME cache of the directory if the tool is installed.
+func (e *engine) writeDesktopEntries(dir, exe string, entries []desktopEntry) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, pattern := range []string{"apporte-rule-*.desktop", "apporte-mime-*.desktop"} {
+		stale, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, path := range stale {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		argv := []string{desktopQuote(exe)}
+		for _, arg := range entry.args {
+			argv = append(argv, desktopQuote(arg))
+		}
+		content := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=%s
+Comment=%s
+Exec=%s %%F
+NoDisplay=true
+`, desktopEscape(entry.name), desktopEscape(entry.comment), strings.Join(argv, " "))
+		if entry.icon != "" {
+			content += "Icon=" + desktopEscape(entry.icon) + "\n"
+		}
+		if entry.mimeType != "" {
+			content += "MimeType=" + entry.mimeType + ";\n"
+		}
+
+		path := filepath.Join(dir, entry.id+".desktop")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return err
+		}
+		fmt.Println(e.trf("Wrote %s", path))
+	}
+
+	if _, err := exec.LookPath("update-desktop-database"); err == nil {
+		if out, err := exec.Command("update-desktop-database", dir).CombinedOutput(); err != nil {
+			return fmt.Errorf("update-desktop-database: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// desktopEscape escapes a string value of a desktop entry.
+func desktopEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+	return r.Replace(s)
+}
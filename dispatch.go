@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// needsWait reports whether the rule requires apporte to supervise the
+// command instead of replacing itself with it.
+func (r Rule) needsWait() bool {
+	return r.Timeout > 0 || r.Retries > 0 || r.Capture || r.Background || r.Notify || r.Sortable ||
+		len(r.Success) > 0 ||
+		len(r.Post) > 0 || len(r.OrElse) > 0 ||
+		r.Stdin != "" || r.Stdout != "" || r.Stderr != "" ||
+		r.TempDir != "" || r.Single != ""
+}
+
+// prepareDispatch rewrites the expanded command according to the rule's
+// options and the environment apporte runs in.
+func (e *engine) prepareDispatch(rule Rule) (Rule, error) {
+	if rule.DBus != "" {
+		rule.Apporte = dbusArgv(rule)
+		return rule, nil
+	}
+	rule.Apporte = rule.wrap(rule.Apporte)
+
+	if rule.Target != "" && os.Getenv("TMUX") != "" {
+		rule.Apporte = inTmux(rule)
+		return rule, nil
+	}
+	if rule.Terminal && !e.platform.HasTTY() {
+		argv, err := e.platform.Terminal(rule.Apporte)
+		if err != nil {
+			return rule, err
+		}
+		rule.Apporte = argv
+	}
+	return rule, nil
+}
+
+// wrap puts argv inside the rule's container, sandbox, security label and
+// resource controls, and sends it to the rule's host if there is one.
+func (r Rule) wrap(argv []string) []string {
+	if r.Host != "" {
+		return remoteArgv(r, join(r.Limits, r.Confiner, r.Wrapper, r.Runner, argv))
+	}
+	if r.Runner == nil {
+		argv = resolveCommand(argv)
+	}
+	return join(r.Limits, r.Confiner, r.Wrapper, r.Runner, argv)
+}
+
+func join(parts ...[]string) []string {
+	var joined []string
+	for _, p := range parts {
+		joined = append(joined, p...)
+	}
+	return joined
+}
+
+// dispatch replaces the current process with the rule's command, unless the
+// rule needs apporte to stay around and supervise the child.
+func (e *engine) dispatch(rule Rule) error {
+	argv := rule.Apporte
+	if len(argv) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	if rule.needsWait() {
+		return run(rule)
+	}
+	return e.execRule(rule)
+}
+
+// execRule replaces apporte with the rule's command, or runs it as a child
+// where the platform has no exec.
+func (e *engine) execRule(rule Rule) error {
+	if !e.platform.CanExec() {
+		return run(rule)
+	}
+	argv := rule.Apporte
+	binary, err := exec.LookPath(argv[0])
+	if err != nil {
+		return fmt.Errorf("command not found: %s", argv[0])
+	}
+	if rule.Cwd != "" {
+		if err := os.Chdir(rule.Cwd); err != nil {
+			return err
+		}
+	}
+	if err := setExecCredentials(rule); err != nil {
+		return err
+	}
+	return e.platform.Exec(binary, argv, environ(rule))
+}
+
+// environ returns apporte's environment, only what env_clear keeps of it if
+// set, with the match context and the rule's variables merged in.
+// Overridden variables are dropped, as execve keeps duplicates around.
+func environ(rule Rule) []string {
+	vars := matchEnv(rule)
+	for k, v := range rule.Env {
+		vars[k] = v
+	}
+
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if _, ok := vars[k]; !ok && rule.keepsEnv(k) {
+			env = append(env, kv)
+		}
+	}
+	return append(env, sortedEnv(vars)...)
+}
+
+// matchEnv describes the match to the child through APPORTE_* variables.
+func matchEnv(rule Rule) map[string]string {
+	vars := map[string]string{
+		"APPORTE_INPUT":  rule.Input,
+		"APPORTE_RULE":   rule.Match.String(),
+		"APPORTE_SOURCE": rule.Source,
+	}
+	for i := 1; i < len(rule.Groups); i++ {
+		vars[fmt.Sprintf("APPORTE_GROUP_%d", i)] = rule.Groups[i]
+	}
+	return vars
+}
+
+// sortedEnv formats variables as KEY=value pairs in a stable order.
+func sortedEnv(env map[string]string) []string {
+	pairs := make([]string, 0, len(env))
+	for k, v := range env {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// run starts the rule's command as a child process and waits for it to exit,
+// killing it once the rule's timeout expires.
+func run(rule Rule) error {
+	argv := rule.Apporte
+	if len(argv) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	if rule.Background {
+		return detach(rule)
+	}
+
+	ctx := context.Background()
+	if rule.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rule.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = rule.Cwd
+	cmd.Env = environ(rule)
+
+	closeStreams, err := setStreams(cmd, rule, true)
+	if err != nil {
+		return err
+	}
+	defer closeStreams()
+	if rule.Capture {
+		cmd.Stdout = rule.output()
+	}
+	// success_when reads the streams it checks on their way
+	var stdout, stderr tailBuffer
+	if watches(rule.Success, "stdout") {
+		cmd.Stdout = teeOutput(cmd.Stdout, &stdout)
+	}
+	if watches(rule.Success, "stderr") {
+		cmd.Stderr = teeOutput(cmd.Stderr, &stderr)
+	}
+
+	restore, err := setCredentials(cmd, rule)
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	restore()
+	if err != nil {
+		return err
+	}
+	stop := forwardSignals(cmd.Process)
+	err = cmd.Wait()
+	stop()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s %w after %s: %w", argv[0], errTimedOut, rule.Timeout, err)
+	}
+	if len(rule.Success) > 0 {
+		return checkSuccess(rule.Success, err, stdout.String(), stderr.String())
+	}
+	return err
+}
+
+// dispatchOrElse dispatches the rule's command and, for as long as that
+// fails, each of its fallbacks in turn.
+func (e *engine) dispatchOrElse(rule Rule, dispatchFn func(Rule) error) error {
+	err := dispatchFn(rule)
+	for err != nil && len(rule.OrElse) > 0 {
+		fmt.Fprintln(os.Stderr, e.trf("%s failed: %v, trying %s", rule.Apporte[0], err, rule.OrElse[0][0]))
+
+		rule.Apporte, rule.OrElse = rule.OrElse[0], rule.OrElse[1:]
+		if rule, err = e.prepareDispatch(rule); err != nil {
+			continue
+		}
+		err = dispatchFn(rule)
+	}
+	return err
+}
+
+// retryDelay is the wait before the first retry of a failed command, doubled
+// before each further one.
+const retryDelay = time.Second
+
+// retrying wraps a dispatch function to run the command again, up to the
+// rule's retries, for as long as it exits with a non-zero status or short of
+// its success_when. Commands that can't be started or time out aren't retried.
+func (e *engine) retrying(dispatchFn func(Rule) error) func(Rule) error {
+	return func(rule Rule) error {
+		err := dispatchFn(rule)
+		delay := retryDelay
+		for i := 0; i < rule.Retries; i++ {
+			if !commandFailed(err) || errors.Is(err, errTimedOut) {
+				break
+			}
+			fmt.Fprintln(os.Stderr, e.trf("%s failed: %v, retrying in %s (%d/%d)", rule.Apporte[0], err, delay, i+1, rule.Retries))
+			time.Sleep(delay)
+			delay *= 2
+			err = dispatchFn(rule)
+		}
+		return err
+	}
+}
+
+// forwardSignals relays interrupts and termination requests sent to apporte
+// to the child for as long as it runs, instead of letting them kill apporte
+// and orphan the child.
+func forwardSignals(child *os.Process) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				_ = child.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// exitStatus picks apporte's own exit status after a failed dispatch: the
+// child's status, 128+N for a child killed by signal N, or 1.
+// errTimedOut is wrapped by the error of a command killed for running
+// longer than the timeout of its rule.
+var errTimedOut = errors.New("timed out")
+
+// commandFailed reports whether err is that of a command that ran and exited
+// with a non-zero status, or short of its success_when, rather than one that
+// couldn't start.
+func commandFailed(err error) bool {
+	var exitErr *exec.ExitError
+	var unsuccessful *unsuccessfulError
+	return errors.As(err, &exitErr) || errors.As(err, &unsuccessful)
+}
+
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if sig, ok := signalStatus(exitErr.ProcessState); ok {
+			return 128 + sig
+		}
+		if code := exitErr.ExitCode(); code > 0 {
+			return code
+		}
+	}
+	return 1
+}
+
+// runSteps runs the commands leading up to the rule's final one in order,
+// stopping at the first failure.
+func runSteps(rule Rule) error {
+	rule.Background, rule.Success = false, nil
+	for _, step := range rule.Steps {
+		rule.Apporte = rule.wrap(step)
+		if err := run(rule); err != nil {
+			return fmt.Errorf("step %v: %w", step, err)
+		}
+	}
+	return nil
+}
+
+// detach starts the rule's command in a session of its own, with stdio
+// connected to the null device, and returns without waiting for it.
+func detach(rule Rule) error {
+	argv := rule.Apporte
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = rule.Cwd
+	cmd.Env = environ(rule)
+	cmd.SysProcAttr = detachedSysProcAttr()
+
+	closeStreams, err := setStreams(cmd, rule, false)
+	if err != nil {
+		return err
+	}
+	defer closeStreams()
+
+	restore, err := setCredentials(cmd, rule)
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	restore()
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"main.go/platform"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestPrepareDispatchTerminal(t *testing.T) {
+	fake := &platform.Fake{Emulator: []string{"term", "-e"}}
+	e := newEngine()
+	e.platform = fake
+	rule := Rule{Apporte: []string{"/bin/vim", "x"}, Terminal: true}
+
+	got, err := e.prepareDispatch(rule)
+	want := []string{"term", "-e", "/bin/vim", "x"}
+	if err != nil || !slices.Equal(got.Apporte, want) {
+		t.Errorf("without a tty: prepareDispatch = %q, %v, want %q", got.Apporte, err, want)
+	}
+
+	fake.TTY = true
+	got, err = e.prepareDispatch(rule)
+	if err != nil || !slices.Equal(got.Apporte, rule.Apporte) {
+		t.Errorf("with a tty: prepareDispatch = %q, %v, want %q", got.Apporte, err, rule.Apporte)
+	}
+
+	fake.TTY, fake.Emulator = false, nil
+	if _, err := e.prepareDispatch(rule); err == nil {
+		t.Error("without a terminal emulator: prepareDispatch succeeded")
+	}
+}
+
+func TestDispatchExecs(t *testing.T) {
+	binary, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	fake := &platform.Fake{}
+	e := newEngine()
+	e.platform = fake
+
+	argv := []string{binary, "-test.run=^$"}
+	if err := e.dispatch(Rule{Match: &lazyRegexp{pattern: ".*"}, Apporte: argv}); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if len(fake.Execs) != 1 || !slices.Equal(fake.Execs[0], argv) {
+		t.Errorf("Execs = %q, want [%q]", fake.Execs, argv)
+	}
+}
+
+func TestNotifyDone(t *testing.T) {
+	fake := &platform.Fake{}
+	e := newEngine()
+	e.platform = fake
+	rule := Rule{Apporte: []string{"mpv"}, Input: "a.mkv"}
+
+	if err := e.notifyDone(rule, nil); err != nil {
+		t.Fatalf("notifyDone: %v", err)
+	}
+	want := [2]string{"apporte: mpv", "Finished a.mkv"}
+	if len(fake.Notifications) != 1 || fake.Notifications[0] != want {
+		t.Errorf("Notifications = %q, want [%q]", fake.Notifications, want)
+	}
+}
+
+func TestConfirmAsksTheTerminal(t *testing.T) {
+	fake := &platform.Fake{}
+	e := newEngine()
+	e.platform = fake
+	argv := []string{"rm", "x"}
+
+	for _, tc := range []struct {
+		answers string
+		want    bool
+	}{{"y\n", true}, {"yes\n", true}, {"n\n", false}, {"\n", false}, {"", false}} {
+		fake.Answers = tc.answers
+		if got := e.confirm(context.Background(), argv); got != tc.want {
+			t.Errorf("confirm with the answer %q = %t, want %t", tc.answers, got, tc.want)
+		}
+	}
+}
+
+func TestAssociation(t *testing.T) {
+	fake := &platform.Fake{Assoc: []string{"assoc-open", "{input}"}}
+	e := newEngine()
+	e.platform = fake
+
+	rule, err := e.convertRule(TomlRule{Match: `\.pdf$`, Assoc: true}, TomlConfig{}, newRegexCache(0))
+	if err != nil {
+		t.Fatalf("convertRule: %v", err)
+	}
+	if !slices.Equal(rule.Apporte, fake.Assoc) {
+		t.Errorf("assoc rule Apporte = %q, want %q", rule.Apporte, fake.Assoc)
+	}
+	got := expandRule(e.associationRule("a b.pdf")).Apporte
+	want := []string{"assoc-open", "a b.pdf"}
+	if !slices.Equal(got, want) {
+		t.Errorf("associationRule Apporte = %q, want %q", got, want)
+	}
+}
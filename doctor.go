@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// doctorCommand reports on the configs and the environment apporte runs in,
+// for troubleshooting and bug reports. It fails if it found problems.
+func doctorCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) > 0 {
+		commandUsage("doctor")
+		return 2
+	}
+	problems := 0
+
+	fmt.Println(opts.Engine.tr("Platform:"))
+	fmt.Printf("  %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	if exe, err := os.Executable(); err == nil {
+		fmt.Printf("  apporte: %s\n", exe)
+	}
+
+	cwd, _ := os.Getwd()
+	startDir, err := crawlStart(cwd, opts.Physical)
+	if err != nil {
+		fmt.Println("  " + opts.Engine.trf("warning: %v", err))
+	}
+
+	fmt.Println("\n" + opts.Engine.tr("Configs:"))
+	visited := &visitedConfigs{paths: map[string]bool{}}
+	cache := newRegexCache(opts.Limits.RegexTimeout)
+	base := rank{Tier: tierPrioritized}
+	paths := configPaths(startDir, []string{opts.Config})
+	for _, w := range skipDirs(ctx, paths, []string{opts.Config}, opts.Limits) {
+		fmt.Println("  " + opts.Engine.trf("%s: skipped, see --skip-network-fs and --stat-timeout", w.Source))
+	}
+	keys := opts.Engine.findCrawlKeys(ctx, paths, []string{opts.Config}, opts.Limits)
+	for _, w := range keys.warnings {
+		problems++
+		fmt.Printf("  %s: %s\n", w.Source, w.Message)
+	}
+	for i, path := range paths {
+		if tier := configTier(paths, i, []string{opts.Config}); tier != base.Tier {
+			base = rank{Tier: tier}
+		}
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if !visited.visit(path, info) {
+			fmt.Println("  " + opts.Engine.trf("%s: same file as an earlier config, skipped", path))
+			continue
+		}
+		loaded, err := opts.Engine.loadRulesFromFile(ctx, path, base, cache, keys, opts.Limits)
+		var messages []string
+		for _, w := range append(warningsOf(err, path), loaded.Warnings...) {
+			// the path starts the line already
+			w.Source = ""
+			messages = append(messages, w.Error())
+		}
+		switch {
+		case len(messages) > 0:
+			problems++
+			fmt.Printf("  %s: %s\n", path, indent(strings.Join(messages, "\n")))
+		case len(loaded.Unsigned) > 0 && opts.Strict:
+			problems++
+			fmt.Println("  " + opts.Engine.trf("%s: unsigned, refused in strict mode", path))
+		case len(loaded.Rules) == 0:
+			fmt.Println("  " + opts.Engine.trf("%s: no rules", path))
+		default:
+			fmt.Println("  " + opts.Engine.trf("%s: ranks %s-%s", path, loaded.Rules[0].Rank, loaded.Rules[len(loaded.Rules)-1].Rank))
+		}
+		if len(loaded.Rules) > 0 {
+			base.File++
+		}
+	}
+
+	fmt.Println("\n" + opts.Engine.tr("Rules:"))
+	// problems of whole files are listed above already
+	conf, _ := opts.Engine.crawlConfigTree(ctx, startDir, []string{opts.Config}, opts.Limits)
+	conf.Rules = filterRules(conf.Rules, opts)
+	for _, rule := range conf.Rules {
+		if _, err := rule.Match.Compile(); err != nil {
+			problems++
+			fmt.Println("  " + opts.Engine.trf("%s: invalid regex %q", rule.location(), rule.Match))
+		}
+		if name := missingCommand(rule); name != "" {
+			problems++
+			fmt.Println("  " + opts.Engine.trf("%s: command %q is not installed", rule.location(), name))
+		}
+		for _, w := range rule.placeholderWarnings() {
+			problems++
+			fmt.Printf("  %s: %s\n", w.location(), w.Message)
+		}
+	}
+	for _, w := range checkRules(conf.Rules, opts.Score || conf.Score) {
+		problems++
+		fmt.Printf("  %s: %s\n", w.location(), w.Message)
+	}
+	fmt.Println("  " + opts.Engine.trf("%d rules loaded", len(conf.Rules)))
+
+	fmt.Println("\n" + opts.Engine.tr("Integration:"))
+	for _, name := range []string{"BROWSER", "TERMINAL", "EDITOR", "APPORTE_PROFILE"} {
+		fmt.Printf("  $%s: %s\n", name, orNone(os.Getenv(name)))
+	}
+	fmt.Printf("  tty: %t\n", opts.Engine.platform.HasTTY())
+	fmt.Printf("  tmux: %t\n", os.Getenv("TMUX") != "")
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		fmt.Printf("  xdg-open: %s\n", xdgOpenStatus())
+	}
+
+	if problems > 0 {
+		fmt.Println("\n" + opts.Engine.trf("%d problems found", problems))
+		return 1
+	}
+	return 0
+}
+
+// missingCommand returns the command of a rule that can't be found, if any.
+// Commands running on other hosts or in containers can't be checked here.
+func missingCommand(rule Rule) string {
+	if rule.Host != "" || rule.Container != "" {
+		return ""
+	}
+	apporte := rule.Apporte
+	if rule.DBus != "" {
+		apporte = []string{"gdbus"}
+	}
+	for _, argv := range append(rule.Steps, apporte) {
+		if len(argv) == 0 || placeholderRe.MatchString(argv[0]) {
+			continue
+		}
+		if _, err := exec.LookPath(resolveCommand(argv)[0]); err != nil {
+			return argv[0]
+		}
+	}
+	return ""
+}
+
+// xdgOpenStatus tells whether xdg-open is installed and whether it is a shim
+// forwarding to apporte.
+func xdgOpenStatus() string {
+	path, err := exec.LookPath("xdg-open")
+	if err != nil {
+		return "not installed"
+	}
+	target, err := filepath.EvalSymlinks(path)
+	exe, exeErr := os.Executable()
+	if err == nil && exeErr == nil {
+		if exe, err = filepath.EvalSymlinks(exe); err == nil && target == exe {
+			return path + " (apporte shim)"
+		}
+	}
+	return path
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(unset)"
+	}
+	return s
+}
+
+// indent continues a multi-line message under its first line.
+func indent(s string) string {
+	return strings.ReplaceAll(s, "\n", "\n    ")
+}
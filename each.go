@@ -0,0 +1,44 @@
+package main
+
+import (
+	"maps"
+	"regexp"
+	"strconv"
+)
+
+// eachRe matches the {each.N} placeholders of an argument.
+var eachRe = regexp.MustCompile(`\{each\.(\d+)\}`)
+
+// usesEach reports whether the rule repeats arguments for every match of
+// its pattern.
+func (r Rule) usesEach() bool {
+	for _, argv := range r.commands() {
+		for _, arg := range argv {
+			if eachRe.MatchString(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandEach expands an argument with {each.N} placeholders into one
+// argument per match of the pattern, N being a group of that match. Groups a
+// match doesn't have are empty strings. The groups and the other
+// placeholders are substituted in one pass, so that what a match has is
+// never taken for a placeholder.
+func expandEach(arg string, values map[string]string, matches [][]string) []string {
+	expanded := make([]string, 0, len(matches))
+	for _, match := range matches {
+		each := maps.Clone(values)
+		for _, m := range eachRe.FindAllStringSubmatch(arg, -1) {
+			n, _ := strconv.Atoi(m[1])
+			each["each."+m[1]] = ""
+			if n < len(match) {
+				each["each."+m[1]] = match[n]
+			}
+		}
+		expanded = append(expanded, expand(arg, each))
+	}
+	return expanded
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandEachLeavesInputsAlone(t *testing.T) {
+	rule := Rule{
+		Match:   &lazyRegexp{pattern: `x(\d+)`},
+		Apporte: []string{"open", "{each.1}", "{input}"},
+		Input:   "/tmp/x1{each.1}y22",
+		Groups:  []string{"x1", "1"},
+		Each:    [][]string{{"x1", "1"}, {"x22", "22"}},
+	}
+	got := expandRule(rule).Apporte
+	want := []string{"open", "1", "22", "/tmp/x1{each.1}y22"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expandRule(%q).Apporte = %q, want %q", rule.Input, got, want)
+	}
+}
+
+func TestExpandEachMissingGroup(t *testing.T) {
+	got := expandEach("-{each.2}-", map[string]string{}, [][]string{{"a", "b"}, {"a", "b", "c"}})
+	want := []string{"--", "-c-"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expandEach = %q, want %q", got, want)
+	}
+}
+
+func TestExpandFilesLeavesInputsAlone(t *testing.T) {
+	rule := Rule{
+		Match:   &lazyRegexp{pattern: `.*`},
+		Apporte: []string{"open", "$0", "{files}"},
+		Input:   "{files}",
+		Groups:  []string{"{files}"},
+		Files:   []string{"a", "b"},
+	}
+	got := expandRule(rule).Apporte
+	want := []string{"open", "{files}", "a", "b"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expandRule(%q).Apporte = %q, want %q", rule.Input, got, want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// editCommand opens the nearest config in the editor, or the config with the
+// rule winning the given input.
+func editCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) > 1 {
+		commandUsage("edit")
+		return 2
+	}
+
+	cwd, _ := os.Getwd()
+	var path string
+	line := 0
+	if len(args) == 1 {
+		conf, err := loadConfig(ctx, cwd, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Errors while loading rules:\n%s", err))
+			return 1
+		}
+		input := prepareInput(args[0], conf, opts)
+		matched, _ := matchRules(ctx, input, conf.Rules, opts)
+		if len(matched) == 0 {
+			fmt.Println(opts.Engine.tr("No rules matched."))
+			return 1
+		}
+		path, line = matched[0].Source, matched[0].Line
+	} else {
+		startDir, err := crawlStart(cwd, opts.Physical)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: %v", err))
+		}
+		if path = nearestConfig(startDir, []string{opts.Config}); path == "" {
+			fmt.Fprintln(os.Stderr, opts.Engine.tr("No config found, create one with apporte init."))
+			return 1
+		}
+	}
+
+	cmd := editorCommand(path, line)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := keepTrust(path, cmd.Run); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Editor failed: %v", err))
+		return exitStatus(err)
+	}
+	return 0
+}
+
+// editorCommand opens path in the editor, at the line if the editor is known
+// to take one as +LINE.
+func editorCommand(path string, line int) *exec.Cmd {
+	argv := editor()
+	switch strings.TrimSuffix(filepath.Base(argv[0]), ".exe") {
+	case "vi", "vim", "nvim", "nano", "emacs", "emacsclient", "micro", "kak", "joe", "mg":
+		if line > 0 {
+			argv = append(argv[:len(argv):len(argv)], "+"+strconv.Itoa(line))
+		}
+	}
+	return exec.Command(argv[0], append(argv[1:], path)...)
+}
+
+// editor returns the argv of the user's editor. Like git, $VISUAL and $EDITOR
+// may carry arguments.
+func editor() []string {
+	for _, name := range []string{"VISUAL", "EDITOR"} {
+		if fields := strings.Fields(os.Getenv(name)); len(fields) > 0 {
+			return fields
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"notepad"}
+	}
+	return []string{"vi"}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"main.go/platform"
+	"os"
+	"sync"
+)
+
+// An engine holds what apporte finds out, caches and reports while it runs:
+// the system facts, the content types of links, the configs it decrypted,
+// the command policy and message catalog it read, the failure reported on
+// exit, where its own output goes and the platform it runs commands on. main
+// makes one for the process, which the commands reach through their options.
+type engine struct {
+	facts        map[string]*fact
+	contentTypes contentTypeCache
+	decrypted    decryptedConfigs
+	failure      failureReport
+	policy       func() (commandPolicy, error)
+	catalog      func() map[string]string
+	platform     platform.Platform
+
+	// stdout is where apporte prints and what commands inherit, stderr
+	// for the stdio server, whose stdout only carries responses
+	stdout *os.File
+}
+
+func newEngine() *engine {
+	return &engine{
+		facts:    newFacts(),
+		policy:   sync.OnceValues(readPolicy),
+		catalog:  sync.OnceValue(readCatalog),
+		platform: platform.Native(),
+		stdout:   os.Stdout,
+	}
+}
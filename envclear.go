@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// baselineEnv are the variables commands of env_clear rules keep besides
+// those of env_allow: enough to find programs, write temporary files and
+// reach the display, but nothing about the session's credentials.
+var baselineEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "LANG", "LC_*", "TERM", "TMPDIR",
+	"DISPLAY", "WAYLAND_DISPLAY", "XDG_RUNTIME_DIR",
+	// what Windows programs need to start at all
+	"SYSTEMROOT", "WINDIR", "COMSPEC", "PATHEXT", "TEMP", "TMP",
+	"USERPROFILE", "APPDATA", "LOCALAPPDATA", "USERNAME",
+}
+
+// checkEnvAllow validates the names and globs of env_allow.
+func checkEnvAllow(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" || strings.ContainsAny(pattern, "=/") {
+			return fmt.Errorf("invalid env_allow pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// keepsEnv reports whether a command of the rule gets the variable of
+// apporte's environment.
+func (r Rule) keepsEnv(name string) bool {
+	if !r.EnvClear {
+		return true
+	}
+	if runtime.GOOS == "windows" {
+		name = strings.ToUpper(name)
+	}
+	for _, patterns := range [][]string{baselineEnv, r.EnvAllow} {
+		for _, pattern := range patterns {
+			if runtime.GOOS == "windows" {
+				pattern = strings.ToUpper(pattern)
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
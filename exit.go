@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Exit statuses of apporte when dispatching inputs. Subcommands have their
+// own, 0 for success, 1 for failures and 2 for usage errors.
+const (
+	exitOK          = 0
+	exitError       = 1 // anything else, such as failing to read stdin
+	exitUsage       = 2
+	exitNoMatch     = 3
+	exitConfig      = 4
+	exitDispatchErr = 5
+	exitInterrupted = 130 // by SIGINT or SIGTERM, as shells report it
+)
+
+// exitReport is what --print-reason prints when apporte exits.
+type exitReport struct {
+	Status        int    `json:"status"`
+	Reason        string `json:"reason"`
+	Input         string `json:"input,omitempty"`
+	CommandStatus int    `json:"command_status,omitempty"` // of a failed command
+	Error         string `json:"error,omitempty"`
+}
+
+// failureReport is the failure reported on exit. With several inputs, the
+// last one failing wins, as for the exit status.
+type failureReport struct {
+	sync.Mutex
+	report exitReport
+	failed bool
+}
+
+// fail records why dispatching an input failed and returns the exit status.
+// Reasons are "usage", "no_match", "config_error", "cancelled",
+// "interrupted", "dispatch_failed", "command_failed" and "error".
+func (e *engine) fail(status int, reason, input string, err error) int {
+	report := exitReport{Status: status, Reason: reason, Input: input}
+	if err != nil {
+		report.Error = err.Error()
+		if commandFailed(err) {
+			report.Reason = "command_failed"
+			report.CommandStatus = exitStatus(err)
+		}
+	}
+	e.failure.Lock()
+	defer e.failure.Unlock()
+	e.failure.report, e.failure.failed = report, true
+	return status
+}
+
+// dispatchFailure returns the status of a failed dispatch: that of the
+// command if it ran, as when it replaces apporte, or else exitDispatchErr.
+func dispatchFailure(input string, err error, opts options) int {
+	status := exitDispatchErr
+	if commandFailed(err) {
+		status = exitStatus(err)
+	}
+	return opts.Engine.fail(status, "dispatch_failed", input, err)
+}
+
+// interrupted reports that apporte was interrupted before dispatching the
+// input, if any, and returns the exit status.
+func (e *engine) interrupted(input string, err error) int {
+	if input == "" {
+		fmt.Fprintln(os.Stderr, e.tr("Interrupted"))
+	} else {
+		fmt.Fprintln(os.Stderr, e.trf("Interrupted before dispatching %s", input))
+	}
+	return e.fail(exitInterrupted, "interrupted", input, err)
+}
+
+// printExitReason writes the reason of the exit status as a JSON object.
+func (e *engine) printExitReason(w io.Writer, status int) {
+	e.failure.Lock()
+	report := e.failure.report
+	failed := e.failure.failed
+	e.failure.Unlock()
+	switch {
+	case status == exitOK:
+		report = exitReport{Reason: "dispatched"}
+	case !failed:
+		report = exitReport{Reason: "error"}
+	}
+	report.Status = status
+	data, _ := json.Marshal(report)
+	fmt.Fprintln(w, string(data))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// placeholderRe matches $N groups as well as {N}, {name} and {prompt.name}
+// placeholders.
+var placeholderRe = regexp.MustCompile(`\$(\d+)|\{(\d+|[a-z_]+(?:\.[a-z0-9_]+)?)\}`)
+
+// placeholders returns the values available for substitution in a matched
+// rule, keyed by placeholder name.
+func placeholders(rule Rule) map[string]string {
+	dir := filepath.Dir(rule.Input)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	values := map[string]string{
+		"input":        rule.Input,
+		"dir":          dir,
+		"config_dir":   filepath.Dir(rule.Source),
+		"content_type": rule.ContentType,
+	}
+	for name, value := range rule.Facts {
+		values[name] = value
+	}
+	for name, answer := range rule.Answers {
+		values[name] = answer
+	}
+	for name, value := range rule.Provided {
+		values[name] = value
+	}
+	for i, group := range rule.Groups {
+		values[strconv.Itoa(i)] = group
+	}
+	// the paths are those of the mount point commands see, {dir} included
+	if len(rule.InputMap) > 0 {
+		values["input"] = mapInputPath(values["input"], rule.InputMap)
+		values["dir"] = mapInputPath(values["dir"], rule.InputMap)
+		for i := range rule.Groups {
+			values[strconv.Itoa(i)] = mapInputPath(values[strconv.Itoa(i)], rule.InputMap)
+		}
+	}
+	return values
+}
+
+// expand substitutes placeholders in s. Unknown placeholders are kept as is.
+func expand(s string, values map[string]string) string {
+	return placeholderRe.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[1:]
+		if m[0] == '{' {
+			name = m[1 : len(m)-1]
+		}
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+func expandArgv(argv []string, values map[string]string) []string {
+	expanded := make([]string, len(argv))
+	for i, part := range argv {
+		expanded[i] = expand(part, values)
+	}
+	return expanded
+}
+
+// expandCommand expands a command of a rule, replacing every {files}
+// argument with the files, one argument each, and repeating every argument
+// with {each.N} placeholders for each match. Arguments are told apart as
+// written, so that inputs looking like placeholders are passed on as they are.
+func expandCommand(argv []string, values map[string]string, files []string, each [][]string) []string {
+	expanded := make([]string, 0, len(argv))
+	for _, arg := range argv {
+		switch {
+		case arg == "{files}":
+			expanded = append(expanded, files...)
+		case eachRe.MatchString(arg):
+			expanded = append(expanded, expandEach(arg, values, each)...)
+		default:
+			expanded = append(expanded, expand(arg, values))
+		}
+	}
+	return expanded
+}
+
+func expandCommands(commands [][]string, values map[string]string, files []string, each [][]string) [][]string {
+	expanded := make([][]string, len(commands))
+	for i, argv := range commands {
+		expanded[i] = expandCommand(argv, values, files, each)
+	}
+	return expanded
+}
+
+// expandRule substitutes placeholders in every templated field of a matched
+// rule. The result shares no slices or maps with the original.
+func expandRule(rule Rule) Rule {
+	values := placeholders(rule)
+
+	files := rule.Files
+	if files == nil {
+		files = []string{rule.Input}
+	}
+	if len(rule.InputMap) > 0 {
+		mapped := make([]string, len(files))
+		for i, file := range files {
+			mapped[i] = mapInputPath(file, rule.InputMap)
+		}
+		files = mapped
+	}
+
+	each := rule.Each
+	if len(rule.InputMap) > 0 {
+		each = make([][]string, len(rule.Each))
+		for i, match := range rule.Each {
+			each[i] = make([]string, len(match))
+			for j, group := range match {
+				each[i][j] = mapInputPath(group, rule.InputMap)
+			}
+		}
+	}
+
+	rule.Apporte = expandCommand(rule.Apporte, values, files, each)
+	rule.Steps = expandCommands(rule.Steps, values, files, each)
+	rule.Wrapper = expandArgv(rule.Wrapper, values)
+	if rule.Runner != nil {
+		rule.Runner = expandArgv(rule.Runner, values)
+	}
+	rule.OrElse = expandCommands(rule.OrElse, values, files, each)
+	rule.Pre = expandCommands(rule.Pre, values, files, each)
+	rule.Post = expandCommands(rule.Post, values, files, each)
+	rule.Cwd = expand(rule.Cwd, values)
+	rule.Host = expand(rule.Host, values)
+	rule.Stdin = expand(rule.Stdin, values)
+	rule.Stdout = expand(rule.Stdout, values)
+	rule.Stderr = expand(rule.Stderr, values)
+
+	if rule.Env != nil {
+		env := make(map[string]string, len(rule.Env))
+		for k, v := range rule.Env {
+			env[k] = expand(v, values)
+		}
+		rule.Env = env
+	}
+
+	return rule
+}
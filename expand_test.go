@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+)
+
+// The checks of expansion and quoting are in selftest.go, shared with
+// apporte test --self; the fuzz targets give them what the fuzzer comes up with.
+
+func FuzzShellQuote(f *testing.F) {
+	for _, seed := range []string{"", "a b", "it's", `"$0"`, "{input}", "a\nb", `\`, "'\"'\"'"} {
+		f.Add(seed, "x")
+	}
+	f.Fuzz(func(t *testing.T, a, b string) {
+		if !utf8.ValidString(a) || !utf8.ValidString(b) {
+			t.Skip()
+		}
+		if err := checkQuoting(a, b); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func FuzzExpand(f *testing.F) {
+	for _, seed := range []string{"", "$1", "{0}", "{input}", "$1$2{2}", "{each.1}", "{files}", "{prompt.name}", "$$1"} {
+		f.Add(seed, "b")
+	}
+	f.Fuzz(func(t *testing.T, g1, g2 string) {
+		if err := checkExpand(g1, g2); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func FuzzExpandCommand(f *testing.F) {
+	f.Add("/tmp/x1{each.1}y22", "{files}")
+	f.Add("$1", "{input}")
+	f.Fuzz(func(t *testing.T, input, file string) {
+		if err := checkExpandCommand(input, file); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestGroupIndexes checks that every group lands in its own place, however
+// many there are.
+func TestGroupIndexes(t *testing.T) {
+	if err := checkGroupIndexes("g", "$1"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestExpandRuleCopies checks that expanding a rule leaves the rule as it was.
+func TestExpandRuleCopies(t *testing.T) {
+	if err := checkExpandRuleCopies("a", "x"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestSelfChecks runs every check of apporte test --self with random inputs,
+// as the command does.
+func TestSelfChecks(t *testing.T) {
+	for _, c := range selfChecks {
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 500; i++ {
+			if err := c.check(randomInput(r), randomInput(r)); err != nil {
+				t.Errorf("%s: %v", c.name, err)
+				break
+			}
+		}
+	}
+}
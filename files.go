@@ -0,0 +1,58 @@
+package main
+
+// maxFilesLen bounds the combined length of the inputs passed to a single
+// {files} invocation, well below the argv limits of common systems.
+const maxFilesLen = 128 * 1024
+
+// usesFiles reports whether the rule takes all of its inputs at once.
+func (r Rule) usesFiles() bool {
+	for _, argv := range append([][]string{r.Apporte}, append(r.Steps, r.OrElse...)...) {
+		for _, arg := range argv {
+			if arg == "{files}" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// batchFiles merges the results whose winning rule uses {files} into one
+// result per rule, split into chunks that fit a command line. A merged result
+// takes the place of the first input it contains.
+func batchFiles(results []matchResult) []matchResult {
+	type ruleKey struct {
+		source string
+		rank   rank
+	}
+	chunks := map[ruleKey]int{}
+	var batched []matchResult
+
+	for _, result := range results {
+		if len(result.Matched) == 0 || !result.Matched[0].usesFiles() {
+			batched = append(batched, result)
+			continue
+		}
+		rule := result.Matched[0]
+		key := ruleKey{rule.Source, rule.Rank}
+
+		if i, ok := chunks[key]; ok {
+			merged := &batched[i].Matched[0]
+			size := 0
+			for _, file := range merged.Files {
+				size += len(file) + 1
+			}
+			if size+len(result.Input)+1 <= maxFilesLen {
+				merged.Files = append(merged.Files, result.Input)
+				continue
+			}
+		}
+
+		// the matched rules are shared between duplicate inputs
+		matched := append([]Rule(nil), result.Matched...)
+		matched[0].Files = []string{result.Input}
+		result.Matched = matched
+		chunks[key] = len(batched)
+		batched = append(batched, result)
+	}
+	return batched
+}
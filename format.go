@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// formatFlags are the flags of fmt.
+type formatFlags struct {
+	check bool
+}
+
+func (f *formatFlags) define(fs *flag.FlagSet) {
+	fs.BoolVar(&f.check, "check", false, "List unformatted files instead of rewriting them")
+}
+
+// formatCommand rewrites config files in the canonical style. With --check,
+// it only lists the files that aren't formatted and fails if there are any.
+func formatCommand(ctx context.Context, args []string, opts options) int {
+	var given formatFlags
+	flags := commandFlags("fmt", given.define)
+	flags.Parse(args)
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{".apporte.toml"}
+	}
+
+	status := 0
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read %s: %v", path, err))
+			status = 1
+			continue
+		}
+		// the branches of a template needn't be valid TOML together
+		if isTemplate(src) {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Skipping %s, templates are left as written", path))
+			continue
+		}
+		formatted, err := formatConfig(src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to format %s: %v", path, err))
+			status = 1
+			continue
+		}
+		if bytes.Equal(src, formatted) {
+			continue
+		}
+		if given.check {
+			fmt.Println(path)
+			status = 1
+			continue
+		}
+		err = keepTrust(path, func() error {
+			return os.WriteFile(path, formatted, 0o644)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write %s: %v", path, err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// tomlStatement is a header or a key/value pair of a config, along with the
+// comments written above and after it.
+type tomlStatement struct {
+	comments []string
+	header   string // "[name]" or "[[name]]", empty for key/value pairs
+	key      string
+	value    string
+	trailing string
+}
+
+// tomlTable is a table header with its key/value pairs. The top-level keys
+// form a table without header.
+type tomlTable struct {
+	head tomlStatement
+	keys []tomlStatement
+}
+
+// placeholderKeys hold commands or paths, in which $N is written as {N}.
+var placeholderKeys = map[string]bool{
+	"apporte": true, "or_else": true, "pre": true, "post": true, "cwd": true,
+	"env": true, "stdin": true, "stdout": true, "stderr": true, "host": true,
+}
+
+var dollarGroupRe = regexp.MustCompile(`\$(\d+)`)
+
+// formatConfig returns the canonical form of a config. Keys of known tables
+// are put in the order of the documentation, tables keep their order since it
+// ranks the rules. Comments move along with the statement they precede.
+func formatConfig(src []byte) ([]byte, error) {
+	var check interface{}
+	if _, err := toml.Decode(string(src), &check); err != nil {
+		return nil, fmt.Errorf("failed to parse TOML: %w", err)
+	}
+
+	statements, head, tail, err := scanStatements(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []tomlTable{{}}
+	for _, st := range statements {
+		if st.header != "" {
+			tables = append(tables, tomlTable{head: st})
+			continue
+		}
+		last := &tables[len(tables)-1]
+		last.keys = append(last.keys, st)
+	}
+
+	var out strings.Builder
+	if len(head) > 0 {
+		out.WriteString(strings.Join(head, "\n") + "\n")
+	}
+	for i, table := range tables {
+		order, isRule := tableOrder(table.head.header)
+		sort.SliceStable(table.keys, func(a, b int) bool {
+			return keyIndex(order, table.keys[a].key) < keyIndex(order, table.keys[b].key)
+		})
+
+		if out.Len() > 0 && (i > 0 || len(table.keys) > 0) {
+			out.WriteString("\n")
+		}
+		if table.head.header != "" {
+			writeStatement(&out, table.head.comments, table.head.header, table.head.trailing)
+		}
+		for _, st := range table.keys {
+			value, err := formatValue(st.value, (isRule || i == 0) && placeholderKeys[st.key])
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", st.key, err)
+			}
+			writeStatement(&out, st.comments, st.key+" = "+value, st.trailing)
+		}
+	}
+	if len(tail) > 0 {
+		if out.Len() > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString(strings.Join(tail, "\n") + "\n")
+	}
+
+	formatted := []byte(out.String())
+	if _, err := toml.Decode(out.String(), &check); err != nil {
+		return nil, fmt.Errorf("formatting produced invalid TOML: %w", err)
+	}
+	return formatted, nil
+}
+
+func writeStatement(out *strings.Builder, comments []string, line string, trailing string) {
+	for _, comment := range comments {
+		out.WriteString(comment + "\n")
+	}
+	if trailing != "" {
+		line += " " + trailing
+	}
+	out.WriteString(line + "\n")
+}
+
+// tableOrder returns the canonical key order of a table and whether it is a
+// rule. Unknown tables keep their own order.
+func tableOrder(header string) ([]string, bool) {
+	name := strings.Trim(header, "[] ")
+	switch {
+	case header == "":
+		return tomlKeys(TomlConfig{}), false
+	case name == "rule" || strings.HasPrefix(name, "profile.") && strings.HasSuffix(name, ".rule"):
+		return tomlKeys(TomlRule{}), true
+	}
+	return nil, false
+}
+
+// keyIndex sorts unknown keys after the known ones.
+func keyIndex(order []string, key string) int {
+	if i := slices.Index(order, key); i >= 0 {
+		return i
+	}
+	return len(order)
+}
+
+// scanStatements splits a config into statements. Comments after the last
+// statement are returned separately, and so are the comments at the top of
+// the file when a blank line separates them from the first statement.
+func scanStatements(src string) ([]tomlStatement, []string, []string, error) {
+	var (
+		statements []tomlStatement
+		head       []string
+		comments   []string
+		scanner    tomlScanner
+		current    *tomlStatement
+		value      strings.Builder
+	)
+
+	for _, line := range strings.Split(strings.TrimRight(src, "\n"), "\n") {
+		if current != nil {
+			code, comment := scanner.scan(line)
+			value.WriteString("\n" + code)
+			if comment != "" {
+				current.comments = append(current.comments, comment)
+			}
+			if scanner.done() {
+				current.value = value.String()
+				statements = append(statements, *current)
+				current = nil
+			}
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			if len(statements) == 0 && head == nil && comments != nil {
+				head, comments = comments, nil
+			}
+			// blank lines only survive between comments
+			if len(comments) > 0 && comments[len(comments)-1] != "" {
+				comments = append(comments, "")
+			}
+			continue
+		case strings.HasPrefix(trimmed, "#"):
+			comments = append(comments, trimmed)
+			continue
+		}
+
+		code, comment := scanner.scan(trimmed)
+		code = strings.TrimSpace(code)
+		st := tomlStatement{comments: comments, trailing: comment}
+		comments = nil
+
+		// commented out rules stay apart from the table below them
+		if strings.HasPrefix(code, "[") {
+			st.header = code
+			statements = append(statements, st)
+			continue
+		}
+		key, rest, ok := strings.Cut(code, "=")
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("unexpected line %q", trimmed)
+		}
+		st.key = strings.TrimSpace(key)
+		st.comments = trimBlank(st.comments)
+		if scanner.done() {
+			st.value = strings.TrimSpace(rest)
+			statements = append(statements, st)
+			continue
+		}
+		// a multi-line value, its comments are moved above it
+		if st.trailing != "" {
+			st.comments = append(st.comments, st.trailing)
+			st.trailing = ""
+		}
+		current = &st
+		value.Reset()
+		value.WriteString(rest)
+	}
+	return statements, head, trimBlank(comments), nil
+}
+
+// tableLines are the lines of the headers of array tables in a config, by
+// table name such as "rule" or "profile.work.rule".
+type tableLines map[string][]int
+
+// ruleLines finds the lines of the array table headers of a config. Tables
+// written inline have no header and aren't listed.
+func ruleLines(src string) tableLines {
+	lines := tableLines{}
+	var scanner tomlScanner
+	for n, line := range strings.Split(src, "\n") {
+		if !scanner.done() {
+			scanner.scan(line)
+			continue
+		}
+		code, _ := scanner.scan(strings.TrimSpace(line))
+		code = strings.TrimSpace(code)
+		if !strings.HasPrefix(code, "[[") || !strings.HasSuffix(code, "]]") {
+			continue
+		}
+		parts := strings.Split(strings.Trim(code, "[]"), ".")
+		for i, part := range parts {
+			parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+		}
+		name := strings.Join(parts, ".")
+		lines[name] = append(lines[name], n+1)
+	}
+	return lines
+}
+
+// line returns the line of the i-th table named name, or 0 if it wasn't
+// found.
+func (t tableLines) line(name string, i int) int {
+	if i < len(t[name]) {
+		return t[name][i]
+	}
+	return 0
+}
+
+func trimBlank(comments []string) []string {
+	for len(comments) > 0 && comments[len(comments)-1] == "" {
+		comments = comments[:len(comments)-1]
+	}
+	return comments
+}
+
+// tomlScanner tracks strings and brackets across the lines of a value, to
+// find where comments start and where the value ends.
+type tomlScanner struct {
+	depth     int
+	multiline string // delimiter of the open multi-line string
+}
+
+func (s *tomlScanner) done() bool {
+	return s.depth <= 0 && s.multiline == ""
+}
+
+// scan returns the code and the comment of a line.
+func (s *tomlScanner) scan(line string) (string, string) {
+	for i := 0; i < len(line); i++ {
+		if s.multiline != "" {
+			if s.multiline == `"""` && line[i] == '\\' {
+				i++
+			} else if strings.HasPrefix(line[i:], s.multiline) {
+				i += len(s.multiline) - 1
+				s.multiline = ""
+			}
+			continue
+		}
+
+		switch c := line[i]; c {
+		case '#':
+			return line[:i], strings.TrimSpace(line[i:])
+		case '[', '{':
+			s.depth++
+		case ']', '}':
+			s.depth--
+		case '"', '\'':
+			delim := line[i : i+1]
+			if strings.HasPrefix(line[i:], strings.Repeat(delim, 3)) {
+				s.multiline = strings.Repeat(delim, 3)
+				i += 2
+				continue
+			}
+			for i++; i < len(line) && line[i] != c; i++ {
+				if c == '"' && line[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return line, ""
+}
+
+// formatValue returns the canonical text of a TOML value.
+func formatValue(text string, placeholders bool) (string, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode("v = "+text, &doc); err != nil {
+		return "", err
+	}
+	formatted, ok := formatAny(doc["v"], placeholders, 0)
+	if !ok {
+		// dates and such are rare enough to be left as written
+		return strings.TrimSpace(text), nil
+	}
+	return formatted, nil
+}
+
+func formatAny(v interface{}, placeholders bool, indent int) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		if placeholders {
+			v = dollarGroupRe.ReplaceAllString(v, "{$1}")
+		}
+		return formatString(v), true
+	case int64, bool:
+		return fmt.Sprint(v), true
+	case float64:
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s, true
+	case []interface{}:
+		parts := make([]string, len(v))
+		nested := false
+		for i, elem := range v {
+			switch elem.(type) {
+			case []interface{}, map[string]interface{}:
+				nested = true
+			}
+			part, ok := formatAny(elem, placeholders, indent+1)
+			if !ok {
+				return "", false
+			}
+			parts[i] = part
+		}
+		if !nested {
+			return "[" + strings.Join(parts, ", ") + "]", true
+		}
+		// one command per line for lists of commands
+		pad := strings.Repeat("  ", indent+1)
+		return "[\n" + pad + strings.Join(parts, ",\n"+pad) + ",\n" + strings.Repeat("  ", indent) + "]", true
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return "{}", true
+		}
+		keys := slices.Sorted(maps.Keys(v))
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			part, ok := formatAny(v[k], placeholders, indent)
+			if !ok {
+				return "", false
+			}
+			parts[i] = formatKey(k) + " = " + part
+		}
+		return "{ " + strings.Join(parts, ", ") + " }", true
+	}
+	return "", false
+}
+
+var bareKeyRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func formatKey(k string) string {
+	if bareKeyRe.MatchString(k) {
+		return k
+	}
+	return formatString(k)
+}
+
+// formatString prefers literal strings for patterns and Windows paths, which
+// would otherwise need every backslash escaped.
+func formatString(s string) string {
+	if strings.ContainsAny(s, `\"`) && !strings.ContainsAny(s, "'\n\r\t") {
+		return "'" + s + "'"
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -2,4 +2,10 @@ module main.go
 
 go 1.24.1
 
-require github.com/BurntSushi/toml v1.5.0 // indirect
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/dlclark/regexp2 v1.7.0
+	github.com/fsnotify/fsnotify v1.10.1
+	golang.org/x/sys v0.13.0
+	golang.org/x/text v0.30.0
+)
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contentTypeCache remembers the content type of every link, so that a link
+// is only requested once however many rules look at it.
+type contentTypeCache struct {
+	sync.Mutex
+	byURL map[string]*contentType
+}
+
+type contentType struct {
+	once  sync.Once
+	value string
+}
+
+// linkContentType returns the media type a link serves, without parameters,
+// or an empty string if it isn't a web link or can't be found out. A timeout
+// of zero never sends a HEAD request.
+func (e *engine) linkContentType(ctx context.Context, input string, timeout time.Duration) string {
+	if timeout == 0 || !strings.HasPrefix(input, "http://") && !strings.HasPrefix(input, "https://") {
+		return ""
+	}
+
+	cache := &e.contentTypes
+	cache.Lock()
+	if cache.byURL == nil {
+		cache.byURL = map[string]*contentType{}
+	}
+	ct, ok := cache.byURL[input]
+	if !ok {
+		ct = &contentType{}
+		cache.byURL[input] = ct
+	}
+	cache.Unlock()
+
+	ct.once.Do(func() {
+		client := http.Client{Timeout: timeout}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, input, nil)
+		if err != nil {
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			// an interrupted request says nothing of the link, ask again next time
+			if ctx.Err() != nil {
+				cache.Lock()
+				delete(cache.byURL, input)
+				cache.Unlock()
+			}
+			return
+		}
+		resp.Body.Close()
+		if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+			ct.value = mediaType
+		}
+	})
+	return ct.value
+}
+
+// matchMime reports whether a content type matches a pattern such as
+// "video/*".
+func matchMime(pattern, contentType string) bool {
+	ok, _ := path.Match(pattern, contentType)
+	return ok
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHistorySize bounds the history log. Past it, the older half of the
+// dispatches is dropped.
+const maxHistorySize = 1 << 20
+
+// historyEntry is a dispatch recorded in the history log, or the undoing of
+// the move of a sortable rule.
+type historyEntry struct {
+	Time    time.Time    `json:"time"`
+	Input   string       `json:"input"`
+	Rule    string       `json:"rule"` // menu ID of the rule
+	Source  string       `json:"source"`
+	Line    int          `json:"line,omitempty"`
+	Command []string     `json:"command"`
+	Cwd     string       `json:"cwd,omitempty"`
+	Moved   *historyMove `json:"moved,omitempty"`  // by a sortable rule
+	Undo    bool         `json:"undo,omitempty"`   // moved back by apporte undo
+	Failed  bool         `json:"failed,omitempty"` // by the success_when of the rule
+	// what the rule did besides the command that isn't recorded, such as
+	// its environment, which may hold secrets
+	Unrecorded []string `json:"unrecorded,omitempty"`
+}
+
+// historyMove is where a sortable rule moved its input from and to, as
+// absolute paths.
+type historyMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// historyPath returns the path of the history log, one JSON entry per line.
+func historyPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apporte", "history.jsonl"), nil
+}
+
+// historyEnabled reports whether dispatches are recorded.
+// APPORTE_NO_HISTORY=1 turns it off.
+func historyEnabled() bool {
+	return os.Getenv("APPORTE_NO_HISTORY") != "1"
+}
+
+// newHistoryEntry records the dispatch of an input to the rule.
+func newHistoryEntry(input string, rule Rule) historyEntry {
+	return historyEntry{
+		Time:    time.Now(),
+		Input:   input,
+		Rule:    rule.id(),
+		Source:  rule.Source,
+		Line:    rule.Line,
+		Command: rule.Apporte,
+		Cwd:     rule.Cwd,
+
+		Unrecorded: rule.unrecorded(),
+	}
+}
+
+// unrecorded returns the settings of a prepared rule that a history entry
+// doesn't record, so that a redo of it would run something else.
+func (r Rule) unrecorded() []string {
+	var names []string
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{
+		{"env", len(r.Env) > 0 || r.EnvClear},
+		{"secret", len(r.Secrets) > 0},
+		{"steps", len(r.Steps) > 0},
+		{"stdin", r.Stdin != ""},
+		{"stdout", r.Stdout != ""},
+		{"stderr", r.Stderr != ""},
+		{"or_else", len(r.OrElse) > 0},
+		{"pre", len(r.Pre) > 0},
+		{"post", len(r.Post) > 0},
+		{"confirm", r.Confirm},
+		{"umask", r.Umask != ""},
+		{"group", r.Group != ""},
+	} {
+		if setting.set {
+			names = append(names, setting.name)
+		}
+	}
+	return names
+}
+
+// appendHistory adds an entry to the history log.
+func appendHistory(entry historyEntry) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > maxHistorySize {
+		return trimHistory(path)
+	}
+	return nil
+}
+
+// trimHistory drops the older half of the history log.
+func trimHistory(path string) error {
+	entries, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, entry := range entries[len(entries)/2:] {
+		data, _ := json.Marshal(entry)
+		b.Write(append(data, '\n'))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o600)
+}
+
+// readHistory reads the entries of the history log, oldest first. Lines that
+// don't parse are skipped.
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), maxHistorySize)
+	for scanner.Scan() {
+		var entry historyEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// lastDispatch finds the latest dispatch of the input, or else of the rule.
+func lastDispatch(input, ruleID string) (historyEntry, bool) {
+	path, err := historyPath()
+	if err != nil {
+		return historyEntry{}, false
+	}
+	entries, err := readHistory(path)
+	if err != nil {
+		return historyEntry{}, false
+	}
+	entries = slices.DeleteFunc(entries, func(e historyEntry) bool { return e.Undo })
+	for _, match := range []func(historyEntry) bool{
+		func(e historyEntry) bool { return e.Input == input },
+		func(e historyEntry) bool { return e.Rule == ruleID },
+	} {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if match(entries[i]) {
+				return entries[i], true
+			}
+		}
+	}
+	return historyEntry{}, false
+}
+
+// printHistoryDiff shows how a dispatch differs from the last one of the same
+// input or rule.
+func (e *engine) printHistoryDiff(input string, rule Rule) {
+	last, ok := lastDispatch(input, rule.id())
+	if !ok {
+		return
+	}
+	what := e.tr("this input")
+	if last.Input != input {
+		what = e.trf("this rule, with %s", last.Input)
+	}
+	if last.Failed {
+		what += e.tr(", failed")
+	}
+	e.explainField("Last Run", "%s, for %s", last.Time.Format(time.DateTime), what)
+
+	location := rule.Source
+	if rule.Line > 0 {
+		location = fmt.Sprintf("%s:%d", rule.Source, rule.Line)
+	}
+	lastLocation := last.Source
+	if last.Line > 0 {
+		lastLocation = fmt.Sprintf("%s:%d", last.Source, last.Line)
+	}
+	if last.Rule != rule.id() || lastLocation != location {
+		fmt.Fprintln(e.stdout, "  - "+e.trf("rule %s at %s", last.Rule, lastLocation))
+		fmt.Fprintln(e.stdout, "  + "+e.trf("rule %s at %s", rule.id(), location))
+	}
+	was, now := shellJoin(last.Command), shellJoin(rule.Apporte)
+	if last.Input == input && was != now {
+		fmt.Fprintf(e.stdout, "  - %s\n", was)
+		fmt.Fprintf(e.stdout, "  + %s\n", now)
+	} else if last.Input == input {
+		fmt.Fprintln(e.stdout, "  "+e.tr("same command"))
+	}
+}
+
+// redoCommand runs the Nth most recent dispatch of the history log again, the
+// command exactly as it ran then. Dispatches of rules that did more than run
+// their command, with an environment, steps, redirections, hooks or a
+// confirmation, aren't redone, as the history only has their command. With
+// --explain, it only shows the dispatch.
+func redoCommand(ctx context.Context, args []string, opts options) int {
+	n := 1
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			commandUsage("redo")
+			return 2
+		}
+	default:
+		commandUsage("redo")
+		return 2
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("No history: %v", err))
+		return 1
+	}
+	entries, err := readHistory(path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read the history: %v", err))
+		return 1
+	}
+	entries = slices.DeleteFunc(entries, func(e historyEntry) bool { return e.Undo })
+	if n > len(entries) {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Only %d dispatches in the history", len(entries)))
+		return 1
+	}
+	entry := entries[len(entries)-n]
+
+	if opts.Explain || opts.Verbose || opts.PrintCmd {
+		e := opts.Engine
+		e.explainField("Input", "%s", entry.Input)
+		e.explainField("Dispatched", "%s", entry.Time.Format(time.DateTime))
+		if entry.Line > 0 {
+			e.explainField("From File", "%s:%d", entry.Source, entry.Line)
+		} else {
+			e.explainField("From File", "%s", entry.Source)
+		}
+		if entry.Cwd != "" {
+			e.explainField("Directory", "%s", entry.Cwd)
+		}
+		e.explainField("Command", "%s", shellJoin(entry.Command))
+		if entry.Failed {
+			e.explainField("Status", "%s", e.tr("failed"))
+		}
+		if len(entry.Unrecorded) > 0 {
+			e.explainField("Not Recorded", "%s", strings.Join(entry.Unrecorded, ", "))
+		}
+	}
+	if opts.Explain || opts.PrintCmd {
+		return 0
+	}
+	if err := ctx.Err(); err != nil {
+		return opts.Engine.interrupted(entry.Input, err)
+	}
+	if len(entry.Unrecorded) > 0 {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Cannot redo the dispatch of %s, the history doesn't record the %s of its rule; dispatch it again instead", entry.Input, strings.Join(entry.Unrecorded, ", ")))
+		return 1
+	}
+
+	rule := Rule{
+		Match:      &lazyRegexp{},
+		Apporte:    entry.Command,
+		Cwd:        entry.Cwd,
+		Source:     entry.Source,
+		Line:       entry.Line,
+		Input:      entry.Input,
+		Groups:     []string{entry.Input},
+		Background: opts.Detach,
+	}
+	if err := opts.Engine.checkPolicy(rule.Apporte); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", entry.Input, err))
+		return 1
+	}
+	if historyEnabled() {
+		// the redo is now the most recent dispatch
+		entry.Time = time.Now()
+		if err := appendHistory(entry); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: failed to record %s in the history: %v", entry.Input, err))
+		}
+	}
+	if err := opts.Engine.dispatch(rule); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", entry.Input, err))
+		return 1
+	}
+	return 0
+}
+
+// recordMove records the dispatch of a sortable rule after its command ran,
+// with where it moved the input: to the last argument of the command, or
+// into it when that is a directory, as mv does.
+func recordMove(input string, rule Rule) error {
+	entry := newHistoryEntry(input, rule)
+	from, err := filepath.Abs(input)
+	if err != nil {
+		return err
+	}
+	to := rule.Apporte[len(rule.Apporte)-1]
+	if !filepath.IsAbs(to) && rule.Cwd != "" {
+		to = filepath.Join(rule.Cwd, to)
+	}
+	if to, err = filepath.Abs(to); err != nil {
+		return err
+	}
+	if info, err := os.Stat(to); err == nil && info.IsDir() {
+		to = filepath.Join(to, filepath.Base(from))
+	}
+
+	var moveErr error
+	if _, err := os.Lstat(from); err == nil {
+		moveErr = fmt.Errorf("%s is still there, the command of a sortable rule must move it", from)
+	} else if _, err := os.Lstat(to); err != nil {
+		moveErr = fmt.Errorf("%s isn't at %s, the command of a sortable rule must move it to its last argument", from, to)
+	} else {
+		entry.Moved = &historyMove{From: from, To: to}
+	}
+	if err := appendHistory(entry); err != nil {
+		return err
+	}
+	return moveErr
+}
+
+// lastMove finds the most recent move of a sortable rule that isn't undone
+// yet. Each undo in the log cancels the latest move before it, so undoing
+// again goes further back.
+func lastMove(entries []historyEntry) (historyEntry, bool) {
+	undone := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		switch {
+		case entries[i].Undo:
+			undone++
+		case entries[i].Moved == nil:
+		case undone > 0:
+			undone--
+		default:
+			return entries[i], true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// moveFile moves a file, copying it when it can't be renamed to another
+// filesystem.
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	info, statErr := os.Lstat(from)
+	if err == nil || statErr != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// undoCommand moves the input of the most recent sortable dispatch back where
+// it came from. With --explain, it only shows the move.
+func undoCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) > 0 {
+		commandUsage("undo")
+		return 2
+	}
+	path, err := historyPath()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("No history: %v", err))
+		return 1
+	}
+	entries, err := readHistory(path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read the history: %v", err))
+		return 1
+	}
+	entry, ok := lastMove(entries)
+	if !ok {
+		fmt.Fprintln(os.Stderr, opts.Engine.tr("Nothing to undo, no sortable rule moved a file"))
+		return 1
+	}
+	move := entry.Moved
+
+	if opts.Explain || opts.PrintCmd {
+		fmt.Println(opts.Engine.trf("Would move %s back to %s, moved %s", move.To, move.From, entry.Time.Format(time.DateTime)))
+		return 0
+	}
+	// neither file is overwritten
+	if _, err := os.Lstat(move.To); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Cannot undo, %s is gone: %v", move.To, err))
+		return 1
+	}
+	if _, err := os.Lstat(move.From); err == nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Cannot undo, %s exists again", move.From))
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(move.From), 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Cannot undo: %v", err))
+		return 1
+	}
+	if err := moveFile(move.To, move.From); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Cannot undo: %v", err))
+		return 1
+	}
+
+	undo := historyEntry{
+		Time:   time.Now(),
+		Input:  move.To,
+		Rule:   entry.Rule,
+		Source: entry.Source,
+		Line:   entry.Line,
+		Moved:  &historyMove{From: move.To, To: move.From},
+		Undo:   true,
+	}
+	if err := appendHistory(undo); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: failed to record the undo in the history: %v", err))
+	}
+	fmt.Println(opts.Engine.trf("Moved %s back to %s", move.To, move.From))
+	return 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+)
+
+// withHooks surrounds the rule's own hooks with the top-level ones: global
+// pre hooks run first and global post hooks run last. The facts the rule and
+// its hooks use are detected then, once the rule is about to be dispatched.
+func (c Config) withHooks(ctx context.Context, rule Rule, facts map[string]*fact) Rule {
+	rule.Pre = append(append([][]string{}, c.Pre...), rule.Pre...)
+	rule.Post = append(append([][]string{}, rule.Post...), c.Post...)
+	rule.Facts = factValues(ctx, facts, rule.templates())
+	return rule
+}
+
+// runHooks runs each hook to completion in the rule's working directory and
+// environment, stopping at the first failure.
+func runHooks(hooks [][]string, rule Rule) error {
+	rule.Timeout = 0
+	rule.Background = false
+	rule.Stdin, rule.Stdout, rule.Stderr = "", "", ""
+	for _, hook := range hooks {
+		rule.Apporte = hook
+		if err := run(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPostHooks runs the rule's post hooks with the result of the dispatch
+// available as {status} and $APPORTE_STATUS.
+func runPostHooks(rule Rule, dispatchErr error) error {
+	status := strconv.Itoa(exitCode(dispatchErr))
+
+	env := map[string]string{"APPORTE_STATUS": status}
+	for k, v := range rule.Env {
+		env[k] = v
+	}
+	rule.Env = env
+
+	hooks := make([][]string, len(rule.Post))
+	for i, hook := range rule.Post {
+		hooks[i] = expandArgv(hook, map[string]string{"status": status})
+	}
+	return runHooks(hooks, rule)
+}
+
+// exitCode maps the result of a dispatch to a process exit status, using -1
+// when the command never ran or was killed.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var unsuccessful *unsuccessfulError
+	if errors.As(err, &unsuccessful) {
+		return unsuccessful.ExitCode()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
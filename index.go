@@ -0,0 +1,176 @@
+package main
+
+import (
+	"regexp/syntax"
+	"sort"
+	"sync"
+)
+
+// literalIndexMin is the number of rules from which inputs are matched
+// through a literalIndex rather than against every rule.
+const literalIndexMin = 256
+
+// affixes are the literals every input a pattern matches starts or ends with.
+type affixes struct {
+	once   sync.Once
+	prefix string
+	suffix string
+}
+
+// literalAffixes returns the literal prefix of a pattern anchored at the
+// start of the input and the literal suffix of one anchored at its end, as
+// "jpg" for `\.jpg$`. Patterns that aren't RE2 have neither.
+func (l *lazyRegexp) literalAffixes() (prefix, suffix string) {
+	l.affixes.once.Do(func() {
+		if l.engine == enginePCRE {
+			return
+		}
+		re, err := syntax.Parse(l.pattern, syntax.Perl)
+		if err != nil {
+			return
+		}
+		parts := flattenConcat(re)
+		if len(parts) > 0 && parts[0].Op == syntax.OpBeginText {
+			for _, part := range parts[1:] {
+				if !isLiteral(part) {
+					break
+				}
+				l.affixes.prefix += string(part.Rune)
+			}
+		}
+		if n := len(parts); n > 0 && parts[n-1].Op == syntax.OpEndText {
+			suffix := ""
+			for i := n - 2; i >= 0 && isLiteral(parts[i]); i-- {
+				suffix = string(parts[i].Rune) + suffix
+			}
+			l.affixes.suffix = suffix
+		}
+	})
+	return l.affixes.prefix, l.affixes.suffix
+}
+
+// flattenConcat lists what a pattern matches in a row, looking into its
+// groups.
+func flattenConcat(re *syntax.Regexp) []*syntax.Regexp {
+	switch re.Op {
+	case syntax.OpConcat:
+		var parts []*syntax.Regexp
+		for _, sub := range re.Sub {
+			parts = append(parts, flattenConcat(sub)...)
+		}
+		return parts
+	case syntax.OpCapture:
+		return flattenConcat(re.Sub[0])
+	}
+	return []*syntax.Regexp{re}
+}
+
+// isLiteral reports whether re matches a fixed, case-sensitive string.
+func isLiteral(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0
+}
+
+// A literalIndex finds the rules that can match an input by the literals
+// their patterns anchor to its start or end, so that only their patterns are
+// run. Rules without such literals are candidates for every input.
+type literalIndex struct {
+	rules []Rule
+	forms map[string]*affixTries // by Unicode normalization form of the rules
+}
+
+// affixTries hold the rules with a literal prefix, and those with a literal
+// suffix, in tries of the literals, the suffixes reversed.
+type affixTries struct {
+	prefixes trieNode
+	suffixes trieNode
+	always   []int
+}
+
+type trieNode struct {
+	next  map[byte]*trieNode
+	rules []int // whose literal ends here
+}
+
+func (n *trieNode) insert(key []byte, rule int) {
+	for _, c := range key {
+		if n.next == nil {
+			n.next = map[byte]*trieNode{}
+		}
+		child, ok := n.next[c]
+		if !ok {
+			child = &trieNode{}
+			n.next[c] = child
+		}
+		n = child
+	}
+	n.rules = append(n.rules, rule)
+}
+
+// collect adds the rules of the keys that s starts with, reading s through
+// at, to the set.
+func (n *trieNode) collect(length int, at func(int) byte, set map[int]bool) {
+	for i := 0; ; i++ {
+		for _, rule := range n.rules {
+			set[rule] = true
+		}
+		if i == length {
+			return
+		}
+		if n = n.next[at(i)]; n == nil {
+			return
+		}
+	}
+}
+
+func newLiteralIndex(rules []Rule) *literalIndex {
+	idx := &literalIndex{rules: rules, forms: map[string]*affixTries{}}
+	for i, rule := range rules {
+		tries, ok := idx.forms[rule.Unicode]
+		if !ok {
+			tries = &affixTries{}
+			idx.forms[rule.Unicode] = tries
+		}
+		prefix, suffix := rule.Match.literalAffixes()
+		switch {
+		case prefix == "" && suffix == "":
+			tries.always = append(tries.always, i)
+		case len(prefix) >= len(suffix):
+			tries.prefixes.insert([]byte(prefix), i)
+		default:
+			reversed := []byte(suffix)
+			for l, r := 0, len(reversed)-1; l < r; l, r = l+1, r-1 {
+				reversed[l], reversed[r] = reversed[r], reversed[l]
+			}
+			tries.suffixes.insert(reversed, i)
+		}
+	}
+	return idx
+}
+
+// candidates returns the rules whose patterns can match the input, in the
+// order of the rules indexed.
+func (idx *literalIndex) candidates(input string) []Rule {
+	subject := input
+	if _, member, ok := splitArchivePath(input); ok {
+		subject = member
+	}
+	set := map[int]bool{}
+	for form, tries := range idx.forms {
+		s := normalizeUnicode(subject, form)
+		for _, rule := range tries.always {
+			set[rule] = true
+		}
+		tries.prefixes.collect(len(s), func(i int) byte { return s[i] }, set)
+		tries.suffixes.collect(len(s), func(i int) byte { return s[len(s)-1-i] }, set)
+	}
+	indices := make([]int, 0, len(set))
+	for i := range set {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	candidates := make([]Rule, len(indices))
+	for i, rule := range indices {
+		candidates[i] = idx.rules[rule]
+	}
+	return candidates
+}
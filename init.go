@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// starterConfig is written by init. Every rule is commented out, so that a
+// fresh config doesn't change what apporte does before it's edited.
+const starterConfig = `# apporte config, rules are tried from top to bottom and the first match wins.
+# Configs in parent directories and the user config apply after this one.
+version = 2
+
+# Open web pages in the browser
+# [[rule]]
+# name = "web"
+# match = "^https?://"
+# apporte = ["firefox", "{0}"]
+
+# Read PDFs
+# [[rule]]
+# name = "pdf"
+# match = '\.pdf$'
+# apporte = ["zathura", "{0}"]
+
+# View images, all of them in one viewer
+# [[rule]]
+# name = "image"
+# match = '\.(png|jpe?g|gif|webp)$'
+# apporte = ["imv", "{files}"]
+
+# Play videos and music
+# [[rule]]
+# name = "media"
+# match = '\.(mkv|mp4|webm|mp3|flac|ogg)$'
+# apporte = ["mpv", "{0}"]
+# background = true
+
+# Edit text and source files in a terminal
+# [[rule]]
+# name = "text"
+# match = '\.(txt|md|go|py|rs|toml|json)$'
+# apporte = ["nvim", "{0}"]
+# terminal = true
+
+# Read manpages, e.g. ls(1)
+# [[rule]]
+# name = "man"
+# match = '^([A-Za-z0-9_.-]+)\((\d+)\)$'
+# apporte = ["man", "{2}", "{1}"]
+# terminal = true
+`
+
+// initFlags are the flags of init.
+type initFlags struct {
+	user bool
+}
+
+func (f *initFlags) define(fs *flag.FlagSet) {
+	fs.BoolVar(&f.user, "user", false, "Write the user config instead")
+}
+
+// initCommand writes a starter config to the current directory, or to the
+// user config directory. Existing configs are never overwritten.
+func initCommand(ctx context.Context, args []string, opts options) int {
+	var given initFlags
+	flags := commandFlags("init", given.define)
+	flags.Parse(args)
+
+	dir := "."
+	if given.user {
+		userConfDir, err := os.UserConfigDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("No user config directory: %v", err))
+			return 1
+		}
+		dir = userConfDir
+	}
+	path := filepath.Join(dir, ".apporte.toml")
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("%s already exists", path))
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to create %s: %v", path, err))
+		return 1
+	}
+	if _, err := f.WriteString(starterConfig); err != nil {
+		f.Close()
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write %s: %v", path, err))
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write %s: %v", path, err))
+		return 1
+	}
+	if err := setTrust(path, true); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to trust %s: %v", path, err))
+	}
+	fmt.Println(opts.Engine.trf("Created %s", path))
+	return 0
+}
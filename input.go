@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// normalizeInput turns file:// URIs and shell-escaped paths, as handed over
+// by browsers, file managers and drag-and-drop into terminals, into plain
+// paths. Anything else is returned unchanged.
+func normalizeInput(input string) string {
+	if strings.HasPrefix(strings.ToLower(input), "file://") {
+		if path, ok := fileURIPath(input); ok {
+			return path
+		}
+		return input
+	}
+
+	if exists(input) {
+		return input
+	}
+	if len(input) >= 2 && (input[0] == '\'' || input[0] == '"') && input[len(input)-1] == input[0] {
+		if unquoted := input[1 : len(input)-1]; exists(unquoted) {
+			return unquoted
+		}
+	}
+	if runtime.GOOS != "windows" && strings.ContainsRune(input, '\\') {
+		if unescaped := unescapeShell(input); exists(unescaped) {
+			return unescaped
+		}
+	}
+	return input
+}
+
+// inputKinds are the kinds of inputs rules can be restricted to.
+var inputKinds = map[string]bool{"path": true, "url": true, "other": true}
+
+// urlSchemeRe matches the scheme of a URL. Schemes are longer than a letter,
+// which would be a Windows drive.
+var urlSchemeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]+:`)
+
+// inputKind classifies an input as a "url", a "path" or "other". Paths exist
+// or look like one, with a directory or an extension. file:// URIs are paths.
+func inputKind(input string) string {
+	if urlSchemeRe.MatchString(input) {
+		if strings.HasPrefix(strings.ToLower(input), "file:") {
+			return "path"
+		}
+		return "url"
+	}
+	if exists(input) || strings.ContainsRune(input, '/') || filepath.Ext(input) != "" ||
+		runtime.GOOS == "windows" && strings.ContainsRune(input, '\\') {
+		return "path"
+	}
+	return "other"
+}
+
+// readInputs reads the inputs from stdin. Without a separator the whole of
+// it is one input. No input may be longer than maxInput bytes, which also
+// bounds how much is read before giving up on a file piped in by mistake.
+func readInputs(r io.Reader, separator string, maxInput int) ([]string, error) {
+	if separator == "" {
+		data, err := io.ReadAll(io.LimitReader(r, int64(maxInput)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxInput {
+			return nil, fmt.Errorf("input is longer than %d bytes, see --max-input-size", maxInput)
+		}
+		if input := strings.TrimSpace(string(data)); input != "" {
+			return []string{input}, nil
+		}
+		return nil, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxInput+1)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, separator[0]); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	var inputs []string
+	for scanner.Scan() {
+		input := scanner.Text()
+		if separator == "\n" {
+			input = strings.TrimSuffix(input, "\r")
+		}
+		if input != "" {
+			inputs = append(inputs, input)
+		}
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return nil, fmt.Errorf("input is longer than %d bytes, see --max-input-size", maxInput)
+	}
+	return inputs, scanner.Err()
+}
+
+// implicitStdin reports whether stdin is read without --stdin when it isn't
+// a terminal, as apporte used to. Cron and CI jobs often have a stdin that is
+// never closed or carries something else, so it takes APPORTE_IMPLICIT_STDIN=1
+// now. The setting goes away in the next release.
+func (e *engine) implicitStdin() bool {
+	if os.Getenv("APPORTE_IMPLICIT_STDIN") != "1" {
+		return false
+	}
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice != 0 {
+		return false
+	}
+	fmt.Fprintln(os.Stderr, e.tr("Warning: APPORTE_IMPLICIT_STDIN is deprecated, pass --stdin instead"))
+	return true
+}
+
+// startReader signals when the first read of the wrapped reader returns.
+type startReader struct {
+	r       io.Reader
+	once    sync.Once
+	started chan struct{}
+}
+
+func (s *startReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.once.Do(func() { close(s.started) })
+	return n, err
+}
+
+// readStdinInputs reads the inputs from stdin, giving up if nothing arrives
+// within the timeout. Once stdin starts, it is read to the end however long
+// that takes, as with a slow find piped in, or until ctx is done.
+func readStdinInputs(ctx context.Context, separator string, maxInput int, timeout time.Duration) ([]string, error) {
+	type result struct {
+		inputs []string
+		err    error
+	}
+	r := &startReader{r: os.Stdin, started: make(chan struct{})}
+	done := make(chan result, 1)
+	go func() {
+		inputs, err := readInputs(r, separator, maxInput)
+		done <- result{inputs, err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case <-r.started:
+	case <-expired:
+		return nil, fmt.Errorf("nothing to read within %s, see --stdin-timeout", timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case res := <-done:
+		return res.inputs, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fileURIPath converts a file:// URI into a local path. URIs naming another
+// host are only meaningful on Windows, as UNC paths.
+func fileURIPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+
+	host := strings.ToLower(u.Host)
+	hostname, _ := os.Hostname()
+	local := host == "" || host == "localhost" || host == strings.ToLower(hostname)
+
+	if runtime.GOOS != "windows" {
+		return u.Path, local
+	}
+	if !local {
+		return `\\` + u.Host + filepath.FromSlash(u.Path), true
+	}
+	// file:///C:/dir has a leading slash before the drive letter
+	return filepath.FromSlash(strings.TrimPrefix(u.Path, "/")), true
+}
+
+// unescapeShell removes backslash escapes, as in /path/with\ spaces.
+func unescapeShell(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// resolveBase joins a relative path with the directory given with --base.
+// Links, and other inputs that neither look like a path nor name a file
+// under base, are left alone.
+func resolveBase(input, base string) string {
+	if input == "" || urlSchemeRe.MatchString(input) || filepath.IsAbs(input) {
+		return input
+	}
+	joined := filepath.Join(base, input)
+	if inputKind(input) != "path" && !exists(joined) {
+		return input
+	}
+	return joined
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// matchStdinData matches the name given to content piped to stdin, and saves
+// the content under that name in a temporary directory for the winning rule
+// to open. Content no rule wants isn't saved.
+func matchStdinData(ctx context.Context, r io.Reader, name string, rules []Rule, opts options) ([]matchResult, error) {
+	matched, matchErr := matchRules(ctx, name, rules, opts)
+	result := matchResult{Input: name, Matched: matched, Err: matchErr}
+	if len(matched) == 0 {
+		return []matchResult{result}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "apporte-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err == nil {
+		_, err = io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	result.Matched[0].Input = path
+	result.Matched[0].TempDir = dir
+	return []matchResult{result}, nil
+}
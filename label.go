@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// builtinLabelers are the wrappers applying a security label to commands,
+// by kind of label. Config files may override them or add their own under
+// [security_labels], with the label as {label}.
+var builtinLabelers = map[string][]string{
+	"apparmor": {"aa-exec", "-p", "{label}", "--"},
+	"selinux":  {"runcon", "{label}"},
+}
+
+// parseSecurityLabel splits a security_label such as "apparmor:downloads"
+// into its kind and the label.
+func parseSecurityLabel(label string) (kind, value string, err error) {
+	kind, value, ok := strings.Cut(label, ":")
+	if !ok || kind == "" || value == "" {
+		return "", "", fmt.Errorf("invalid security_label %q, expected KIND:LABEL, e.g. apparmor:PROFILE", label)
+	}
+	return kind, value, nil
+}
+
+// resolveLabels looks up the wrapper of every rule with a security label.
+// Rules with a label of an unknown kind are dropped rather than run
+// unconfined.
+func (c *Config) resolveLabels() []warning {
+	var warnings []warning
+	rules := c.Rules[:0]
+
+	for _, rule := range c.Rules {
+		if rule.SecLabel != "" {
+			kind, label, _ := parseSecurityLabel(rule.SecLabel)
+			template, ok := c.Labelers[kind]
+			if !ok {
+				template, ok = builtinLabelers[kind]
+			}
+			if !ok {
+				warnings = append(warnings, rule.warning(levelError, "unknown_security_label", fmt.Sprintf("unknown kind of security label %q", kind)))
+				continue
+			}
+			rule.Confiner = expandArgv(template, map[string]string{"label": label})
+		}
+		rules = append(rules, rule)
+	}
+
+	c.Rules = rules
+	return warnings
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// parseExpires parses the date of expires, e.g. "2025-12-31". The rule
+// expires once that day is over, in local time.
+func parseExpires(date string) (time.Time, error) {
+	day, err := time.ParseInLocation(time.DateOnly, date, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expires %q, expected a date such as 2025-12-31", date)
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+// expired reports whether the rule's expiry date has passed.
+func (r Rule) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// lifecycleWarnings are the warnings about a deprecated or expired rule
+// that matched.
+func (r Rule) lifecycleWarnings(now time.Time) []warning {
+	var warnings []warning
+	if r.Deprecated != "" {
+		warnings = append(warnings, r.warning(levelWarning, "deprecated_rule", "deprecated: "+r.Deprecated))
+	}
+	if r.expired(now) {
+		warnings = append(warnings, r.expiredWarning())
+	}
+	return warnings
+}
+
+func (r Rule) expiredWarning() warning {
+	msg := fmt.Sprintf("expired on %s", r.Toml.Expires)
+	if r.RefuseExp {
+		msg += ", not dispatched anymore"
+	}
+	return r.warning(levelWarning, "expired_rule", msg)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rlimitNames are the resources prlimit(1) knows about.
+var rlimitNames = map[string]bool{
+	"as": true, "core": true, "cpu": true, "data": true, "fsize": true,
+	"locks": true, "memlock": true, "msgqueue": true, "nice": true,
+	"nofile": true, "nproc": true, "rss": true, "rtprio": true,
+	"rttime": true, "sigpending": true, "stack": true,
+}
+
+var ioniceClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// resourceLimits translates a rule's resource settings into the argv of
+// systemd-run, nice, ionice and prlimit, in that order, ending up in front
+// of the command.
+func resourceLimits(r TomlRule) ([]string, error) {
+	var argv []string
+
+	if r.Scope {
+		argv = append(argv, "systemd-run", "--user", "--scope", "--quiet")
+		for _, prop := range r.ScopeProps {
+			argv = append(argv, "--property="+prop)
+		}
+		argv = append(argv, "--")
+	} else if len(r.ScopeProps) > 0 {
+		return nil, fmt.Errorf("scope_properties without scope = true")
+	}
+
+	if r.Nice != 0 {
+		argv = append(argv, "nice", "-n", strconv.Itoa(r.Nice))
+	}
+
+	if r.Ionice != "" {
+		name, level, hasLevel := strings.Cut(r.Ionice, ":")
+		class, ok := ioniceClasses[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid ionice %q", r.Ionice)
+		}
+		argv = append(argv, "ionice", "-c", class)
+		if hasLevel {
+			if _, err := strconv.Atoi(level); err != nil {
+				return nil, fmt.Errorf("invalid ionice level %q", level)
+			}
+			argv = append(argv, "-n", level)
+		}
+	}
+
+	if len(r.Rlimits) > 0 {
+		names := make([]string, 0, len(r.Rlimits))
+		for name := range r.Rlimits {
+			if !rlimitNames[name] {
+				return nil, fmt.Errorf("unknown rlimit %q", name)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		argv = append(argv, "prlimit")
+		for _, name := range names {
+			argv = append(argv, fmt.Sprintf("--%s=%s", name, r.Rlimits[name]))
+		}
+		argv = append(argv, "--")
+	}
+
+	return argv, nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// shellOperators are the arguments that only mean something to a shell.
+var shellOperators = map[string]bool{
+	"|": true, "||": true, "&&": true, ";": true, "&": true,
+	">": true, ">>": true, "<": true, "2>": true, "2>&1": true,
+}
+
+// extensionDotRe matches what follows a dot meant as the dot of an extension
+// or a domain: a few letters or digits ending the pattern or an alternative.
+var extensionDotRe = regexp.MustCompile(`^[A-Za-z0-9]{1,5}(?:$|\$|\||\))`)
+
+// lintRule finds what in a rule is valid, but likely not what was meant:
+// patterns matching every input by accident, dots that match any character,
+// placeholders nothing fills in and shell syntax in commands that don't run
+// in a shell. Groups the commands refer to that the pattern doesn't have are
+// reported as the rule is loaded.
+func lintRule(rule Rule) []warning {
+	if _, err := rule.Match.Compile(); err != nil {
+		// reported as an invalid regex already
+		return nil
+	}
+	var warnings []warning
+	if accidentalCatchAll(rule.Match.String()) {
+		warnings = append(warnings, rule.warning(levelWarning, "catch_all_pattern",
+			fmt.Sprintf("pattern %q matches every input, as it matches an empty string anywhere; anchor it, or write .* to mean it", rule.Toml.Match)))
+	}
+	if fixed, n := escapeExtensionDots(rule.Toml.Match); n > 0 {
+		warnings = append(warnings, rule.warning(levelWarning, "unescaped_dot",
+			fmt.Sprintf("the dot of pattern %q matches any character, did you mean %q?", rule.Toml.Match, fixed)))
+	}
+
+	warnings = append(warnings, rule.placeholderWarnings()...)
+	for _, argv := range rule.commands() {
+		if arg, ok := shellSyntax(argv); ok {
+			warnings = append(warnings, rule.warning(levelWarning, "shell_syntax",
+				fmt.Sprintf("%q is passed to %s as is, no shell runs the command; use [\"sh\", \"-c\", SCRIPT] for one", arg, argv[0])))
+		}
+	}
+	return warnings
+}
+
+// accidentalCatchAll reports whether a pattern matches every input without
+// being written to: it matches an empty string and has no anchor, as
+// "(foo)?" or "x*" do. ".*" and its anchored forms are meant.
+func accidentalCatchAll(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	re = re.Simplify()
+	if re.Op == syntax.OpStar && (re.Sub[0].Op == syntax.OpAnyChar || re.Sub[0].Op == syntax.OpAnyCharNotNL) {
+		return false
+	}
+	matched, _ := regexp.MatchString(pattern, "")
+	return matched && !hasAnchor(re)
+}
+
+// escapeExtensionDots escapes the dots of a pattern that are followed by what
+// looks like an extension or a domain, as in "mp4$" or "com)", and returns
+// how many it escaped. Dots in character classes are literal already.
+func escapeExtensionDots(pattern string) (string, int) {
+	var b strings.Builder
+	n := 0
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteString(pattern[i : i+2])
+			i++
+			continue
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+			// a ] right after [ or [^ is part of the class
+			for _, prefix := range []string{"[^]", "[]", "[^"} {
+				if strings.HasPrefix(pattern[i:], prefix) {
+					b.WriteString(prefix)
+					i += len(prefix) - 1
+					break
+				}
+			}
+			if pattern[i] != '[' {
+				continue
+			}
+		case c == '.' && extensionDotRe.MatchString(pattern[i+1:]):
+			b.WriteString(`\.`)
+			n++
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), n
+}
+
+// commands returns every command of the rule, as run.
+func (r Rule) commands() [][]string {
+	commands := append(append(append([][]string{}, r.Steps...), r.Apporte), r.OrElse...)
+	return append(append(commands, r.Pre...), r.Post...)
+}
+
+// templates returns the strings of the rule placeholders are expanded in:
+// its commands, wrappers, paths and environment.
+func (r Rule) templates() []string {
+	templates := []string{r.Cwd, r.Stdin, r.Stdout, r.Stderr, r.Host}
+	for _, argv := range append(r.commands(), r.Wrapper, r.Runner) {
+		templates = append(templates, argv...)
+	}
+	for _, value := range r.Env {
+		templates = append(templates, value)
+	}
+	return templates
+}
+
+// groupWarnings reports the groups the rule refers to in its commands, paths
+// and environment that its pattern doesn't have, which would be passed on as
+// a literal $N. Only the patterns of rules referring to groups beyond the
+// whole match are compiled for it.
+func (r Rule) groupWarnings() []warning {
+	if len(deadGroups(r.templates(), 0)) == 0 {
+		return nil
+	}
+	re, err := r.Match.Compile()
+	if err != nil {
+		// reported as an invalid regex when the rule is matched or checked
+		return nil
+	}
+	groups := re.NumSubexp()
+	var warnings []warning
+	for _, n := range deadGroups(r.templates(), groups) {
+		warnings = append(warnings, r.warning(levelWarning, "dead_group_reference",
+			fmt.Sprintf("the command refers to group %d, but the pattern has %d", n, groups)))
+	}
+	return warnings
+}
+
+// deadGroups returns the groups the templates refer to as $N, {N} or
+// {each.N} beyond the groups of the pattern, in order.
+func deadGroups(templates []string, groups int) []int {
+	seen := map[int]bool{}
+	var dead []int
+	for _, s := range templates {
+		for _, m := range placeholderRe.FindAllStringSubmatch(s, -1) {
+			ref := m[1]
+			if ref == "" {
+				ref = strings.TrimPrefix(m[2], "each.")
+			}
+			n, err := strconv.Atoi(ref)
+			if err != nil || n <= groups || seen[n] {
+				continue
+			}
+			seen[n] = true
+			dead = append(dead, n)
+		}
+	}
+	sort.Ints(dead)
+	return dead
+}
+
+// knownPlaceholders are the placeholders filled in for every match, besides
+// its groups and the system facts.
+var knownPlaceholders = map[string]bool{"input": true, "dir": true, "config_dir": true, "content_type": true, "files": true}
+
+// checkPlaceholders rejects the placeholders of a rule that can only be
+// mistakes, such as {each.x} or the answer to a prompt the rule doesn't have.
+// Placeholders of providers are checked once configs are merged, as the
+// provider may come from another config.
+func (r Rule) checkPlaceholders() error {
+	_, err := r.placeholderProblems()
+	return err
+}
+
+// placeholderWarnings reports the placeholders of a rule that nothing fills
+// in, such as a misspelled {inptu}. They reach its commands as written, as
+// the braces may be meant for the command, such as awk's {print}.
+func (r Rule) placeholderWarnings() []warning {
+	var warnings []warning
+	unknown, _ := r.placeholderProblems()
+	for _, name := range unknown {
+		warnings = append(warnings, r.warning(levelWarning, "unknown_placeholder",
+			fmt.Sprintf("nothing fills in placeholder %s, it's passed on as written", name)))
+	}
+	return warnings
+}
+
+// placeholderProblems returns the placeholders of a rule that nothing fills
+// in, and the first that's invalid.
+func (r Rule) placeholderProblems() ([]string, error) {
+	prompts := map[string]bool{}
+	for _, p := range r.Prompts {
+		prompts[p.Name] = true
+	}
+	var unknown []string
+	check := func(s string, extra string) error {
+		for _, m := range placeholderRe.FindAllStringSubmatch(s, -1) {
+			name := m[2]
+			namespace, key, dotted := strings.Cut(name, ".")
+			switch {
+			case name == "" || name == extra || knownPlaceholders[name] || isFact(name):
+			case !dotted && name[0] >= '0' && name[0] <= '9':
+			case namespace == "each":
+				if _, err := strconv.Atoi(key); err != nil {
+					return fmt.Errorf("invalid placeholder %s, expected {each.N}", m[0])
+				}
+			case namespace == "prompt":
+				if !prompts[key] {
+					return fmt.Errorf("placeholder %s refers to no prompt of the rule", m[0])
+				}
+			case dotted:
+				// a provider's
+			default:
+				if !slices.Contains(unknown, m[0]) {
+					unknown = append(unknown, m[0])
+				}
+			}
+		}
+		return nil
+	}
+	post := Rule{Post: r.Post}.templates()
+	r.Post = nil
+	for _, s := range r.templates() {
+		if err := check(s, ""); err != nil {
+			return unknown, err
+		}
+	}
+	// post hooks are also given the status of the dispatch
+	for _, s := range post {
+		if err := check(s, "status"); err != nil {
+			return unknown, err
+		}
+	}
+	return unknown, nil
+}
+
+// checkProviderPlaceholders drops the rules using placeholders of providers
+// that no merged config has, rather than run them with the placeholder as
+// written.
+func (c *Config) checkProviderPlaceholders() []warning {
+	var warnings []warning
+	rules := c.Rules[:0]
+
+	for _, rule := range c.Rules {
+		if name, ok := rule.unknownProvider(c.Providers); ok {
+			warnings = append(warnings, rule.warning(levelError, "unknown_placeholder", fmt.Sprintf("placeholder {%s} refers to no provider", name)))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	c.Rules = rules
+	return warnings
+}
+
+// unknownProvider returns the first placeholder of the rule belonging to a
+// provider that isn't among providers.
+func (r Rule) unknownProvider(providers map[string][]string) (string, bool) {
+	for _, s := range r.templates() {
+		for _, m := range placeholderRe.FindAllStringSubmatch(s, -1) {
+			namespace, _, dotted := strings.Cut(m[2], ".")
+			if _, ok := providers[namespace]; dotted && !reservedProviders[namespace] && !ok {
+				return m[2], true
+			}
+		}
+	}
+	return "", false
+}
+
+// shellSyntax returns the first argument of a command that only a shell
+// would make sense of, unless the command is a shell.
+func shellSyntax(argv []string) (string, bool) {
+	if len(argv) == 0 {
+		return "", false
+	}
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(argv[0]), ".exe"))
+	if _, ok := shellInterpreters[name]; ok {
+		return "", false
+	}
+	for _, arg := range argv[1:] {
+		if shellOperators[arg] || strings.Contains(arg, "$(") || strings.Contains(arg, "`") {
+			return arg, true
+		}
+	}
+	return "", false
+}
+
+// matchKeyRe matches the match key of a rule table.
+var matchKeyRe = regexp.MustCompile(`^(\s*match\s*=\s*)(.*)$`)
+
+// fixDots escapes the dots that lintRule reports in the patterns of rules,
+// rewriting the match key in the rule's table of its config. Patterns set
+// elsewhere, such as in [defaults], and encrypted configs are left alone.
+// It returns the number of patterns fixed in each config.
+func fixDots(rules []Rule) (map[string]int, error) {
+	byFile := map[string][]Rule{}
+	for _, rule := range rules {
+		if _, n := escapeExtensionDots(rule.Toml.Match); n > 0 && rule.Line > 0 && !strings.HasSuffix(rule.Source, ageSuffix) {
+			byFile[rule.Source] = append(byFile[rule.Source], rule)
+		}
+	}
+
+	fixed := map[string]int{}
+	for path, rules := range byFile {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return fixed, err
+		}
+		lines := strings.Split(string(src), "\n")
+		for _, rule := range rules {
+			if fixMatchLine(lines, rule) {
+				fixed[path]++
+			}
+		}
+		if fixed[path] == 0 {
+			continue
+		}
+		updated := strings.Join(lines, "\n")
+		var check interface{}
+		if _, err := toml.Decode(updated, &check); err != nil {
+			return fixed, fmt.Errorf("not fixing %s, the result isn't valid TOML: %w", path, err)
+		}
+		err = keepTrust(path, func() error {
+			return os.WriteFile(path, []byte(updated), 0o644)
+		})
+		if err != nil {
+			return fixed, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return fixed, nil
+}
+
+// fixMatchLine rewrites the match key in the table of rule, which starts at
+// its line, if it still holds the pattern as loaded.
+func fixMatchLine(lines []string, rule Rule) bool {
+	for i := rule.Line; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "[") {
+			return false
+		}
+		var s tomlScanner
+		code, comment := s.scan(lines[i])
+		m := matchKeyRe.FindStringSubmatch(code)
+		if m == nil || !s.done() {
+			continue
+		}
+		var doc map[string]interface{}
+		if _, err := toml.Decode("v = "+m[2], &doc); err != nil || doc["v"] != rule.Toml.Match {
+			return false
+		}
+		fixed, _ := escapeExtensionDots(rule.Toml.Match)
+		lines[i] = m[1] + formatString(fixed)
+		if comment != "" {
+			lines[i] += " " + comment
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLiteralBracesLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".apporte.toml")
+	config := `
+[[rule]]
+match = '\.log$'
+apporte = ["awk", "{print}", "$0"]
+
+[[rule]]
+match = '\.json$'
+apporte = ["jq", ".{name}", "$0"]
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys := crawlKeys{own: map[string]bool{pathKey(path): true}}
+	conf, err := newEngine().loadRulesFromFile(context.Background(), path, rank{Tier: tierPrioritized}, newRegexCache(0), keys, defaultCrawlLimits)
+	if err != nil {
+		t.Fatalf("loadRulesFromFile: %v", err)
+	}
+	if len(conf.Rules) != 2 {
+		t.Fatalf("loaded %d rules, want 2", len(conf.Rules))
+	}
+
+	rule := conf.Rules[0]
+	rule.Input, rule.Groups = "a.log", []string{"a.log"}
+	got := expandRule(rule).Apporte
+	want := []string{"awk", "{print}", "a.log"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expandRule(%q).Apporte = %q, want %q", rule.Input, got, want)
+	}
+	for i, placeholder := range []string{"{print}", "{name}"} {
+		warnings := conf.Rules[i].placeholderWarnings()
+		if len(warnings) != 1 || warnings[0].Kind != "unknown_placeholder" || warnings[0].Level != levelWarning {
+			t.Errorf("placeholderWarnings of the rule using %s = %v, want one unknown_placeholder warning", placeholder, warnings)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+)
+
+// catalogs translate the messages apporte prints, keyed by the English
+// message, by language. English needs no catalog.
+var catalogs = map[string]map[string]string{
+	"de": {
+		// explain
+		"Input":                 "Eingabe",
+		"Rule":                  "Regel",
+		"Profile":               "Profil",
+		"Kind":                  "Art",
+		"When":                  "Wenn",
+		"When Time":             "Zeitfenster",
+		"Hostname":              "Hostname",
+		"Machine":               "Maschine",
+		"Deprecated":            "Veraltet",
+		"Expires":               "Läuft ab",
+		"Category":              "Kategorie",
+		"Matched":               "Muster",
+		"Description":           "Beschreibung",
+		"From File":             "Aus Datei",
+		"Step":                  "Schritt",
+		"Command":               "Befehl",
+		"Or Else":               "Sonst",
+		"Rank":                  "Rang",
+		"Groups":                "Gruppen",
+		"Content Type":          "Inhaltstyp",
+		"Timeout":               "Zeitlimit",
+		"Cwd":                   "Verzeichnis",
+		"Env":                   "Umgebung",
+		"Background":            "Hintergrund",
+		"Pre":                   "Vorher",
+		"Post":                  "Nachher",
+		"unknown":               "unbekannt",
+		"%s (%s now)":           "%s (derzeit %s)",
+		"%s (tier, file, rule)": "%s (Stufe, Datei, Regel)",
+		"Last Run":              "Letzter Lauf",
+		"%s, for %s":            "%s, für %s",
+		"this input":            "diese Eingabe",
+		"this rule, with %s":    "diese Regel, mit %s",
+		", failed":              ", fehlgeschlagen",
+		"same command":          "gleicher Befehl",
+		"rule %s at %s":         "Regel %s in %s",
+		"Dispatched":            "Gestartet",
+		"Directory":             "Verzeichnis",
+		"Status":                "Status",
+		"failed":                "fehlgeschlagen",
+		"Not Recorded":          "Nicht erfasst",
+
+		// warnings
+		"Warnings while loading rules":    "Warnungen beim Laden der Regeln",
+		"Warnings while matching rules":   "Warnungen beim Abgleichen der Regeln",
+		"Errors while loading rules:\n%s": "Fehler beim Laden der Regeln:\n%s",
+
+		// inputs
+		"No input provided. Use -i, positional arg, --clipboard, or --stdin.": "Keine Eingabe. Verwende -i, ein Argument, --clipboard oder --stdin.",
+		"Failed to read clipboard: %v":                                        "Zwischenablage konnte nicht gelesen werden: %v",
+		"Failed to read stdin: %v":                                            "Standardeingabe konnte nicht gelesen werden: %v",
+		"--stdin-data needs --name to match against.":                         "--stdin-data braucht --name zum Abgleichen.",
+		"Input is longer than %d bytes, see --max-input-size":                 "Die Eingabe ist länger als %d Bytes, siehe --max-input-size",
+		"Invalid --base: %v":                                                  "Ungültiges --base: %v",
+		"Invalid command %q: %v":                                              "Ungültiger Befehl %q: %v",
+		"--warn-level is warning, error or none, --warn-format text or json.": "--warn-level ist warning, error oder none, --warn-format text oder json.",
+		"Warning: APPORTE_IMPLICIT_STDIN is deprecated, pass --stdin instead": "Warnung: APPORTE_IMPLICIT_STDIN ist veraltet, verwende stattdessen --stdin",
+		"Warning: %v":                          "Warnung: %v",
+		"Warning: no rule named %q":            "Warnung: keine Regel namens %q",
+		"Warning: no rules in profile %q":      "Warnung: keine Regeln im Profil %q",
+		"Warning: no rules in category %q":     "Warnung: keine Regeln in der Kategorie %q",
+		"Failed to write the debug bundle: %v": "Debug-Paket konnte nicht geschrieben werden: %v",
+		"Wrote the debug bundle to %s":         "Debug-Paket nach %s geschrieben",
+
+		// dispatch
+		"No rules matched.":                                               "Keine Regel passt.",
+		"No rules matched: %s":                                            "Keine Regel passt: %s",
+		"No rule picked for %s":                                           "Keine Regel gewählt für %s",
+		"Dispatch failed for %s: %v":                                      "Start fehlgeschlagen für %s: %v",
+		"Dispatch cancelled for %s":                                       "Start abgebrochen für %s",
+		"Failed to lock %s: %v":                                           "Sperren von %s fehlgeschlagen: %v",
+		"Skipped %s, the rule is already running for it":                  "%s übersprungen, die Regel läuft bereits dafür",
+		"Pre hook failed for %s: %v":                                      "Pre-Hook fehlgeschlagen für %s: %v",
+		"Post hook failed for %s: %v":                                     "Post-Hook fehlgeschlagen für %s: %v",
+		"Notification failed for %s: %v":                                  "Benachrichtigung fehlgeschlagen für %s: %v",
+		"Warning: failed to record %s in the history: %v":                 "Warnung: %s konnte nicht im Verlauf gespeichert werden: %v",
+		"Warning: the dispatch of %s can't be undone: %v":                 "Warnung: der Start von %s lässt sich nicht rückgängig machen: %v",
+		"Waiting for %q, which is already running for %s":                 "Warte auf %q, das bereits für %s läuft",
+		"%s failed: %v, trying %s":                                        "%s fehlgeschlagen: %v, versuche %s",
+		"%s failed: %v, retrying in %s (%d/%d)":                           "%s fehlgeschlagen: %v, neuer Versuch in %s (%d/%d)",
+		"Interrupted":                                                     "Unterbrochen",
+		"Interrupted before dispatching %s":                               "Unterbrochen vor dem Start von %s",
+		"Scores for %s:":                                                  "Punkte für %s:",
+		"%4d  anchors %d, conditions %d, literals %-3d rank %-12s %s  %s": "%4d  Anker %d, Bedingungen %d, Literale %-3d Rang %-12s %s  %s",
+		"Failed to read the output to rematch: %v":                        "Ausgabe zum erneuten Abgleichen konnte nicht gelesen werden: %v",
+		"Stopped rematching after %d rules":                               "Erneutes Abgleichen nach %d Regeln beendet",
+		"Nothing to rematch, the command wrote no output":                 "Nichts erneut abzugleichen, der Befehl hat nichts ausgegeben",
+		"Failed to read requests: %v":                                     "Anfragen konnten nicht gelesen werden: %v",
+		"Failed to write a response: %v":                                  "Antwort konnte nicht geschrieben werden: %v",
+
+		// confirm
+		"Confirmation required, but there is no terminal (use --yes)": "Bestätigung nötig, aber kein Terminal vorhanden (--yes verwenden)",
+		"Run %s? [y/N] ": "%s ausführen? [j/N] ",
+		"y":              "j",
+		"yes":            "ja",
+
+		// picker and prompts
+		"Choose a rule for %s:":                      "Wähle eine Regel für %s:",
+		"Picker %s not found, choose a rule for %s:": "Auswahl %s nicht gefunden, wähle eine Regel für %s:",
+		"Picker failed: %v":                          "Auswahl fehlgeschlagen: %v",
+		"There is no terminal to choose on":          "Kein Terminal zum Auswählen vorhanden",
+		"Rule [1]: ":                                 "Regel [1]: ",
+		"prompt %s needs an answer, but there is no terminal (use --set %s=VALUE)": "Frage %s braucht eine Antwort, aber kein Terminal ist vorhanden (--set %s=WERT verwenden)",
+
+		// subcommands
+		"Invalid directory: %v":                                 "Ungültiges Verzeichnis: %v",
+		"Failed to read %s: %v":                                 "%s konnte nicht gelesen werden: %v",
+		"Failed to write %s: %v":                                "%s konnte nicht geschrieben werden: %v",
+		"Failed to create %s: %v":                               "%s konnte nicht angelegt werden: %v",
+		"%s already exists":                                     "%s existiert bereits",
+		"Created %s":                                            "%s angelegt",
+		"Wrote %s":                                              "%s geschrieben",
+		"No user config directory: %v":                          "Kein Benutzer-Konfigurationsverzeichnis: %v",
+		"Failed to locate apporte: %v":                          "apporte wurde nicht gefunden: %v",
+		"Failed to load rules:\n%s":                             "Regeln konnten nicht geladen werden:\n%s",
+		"Errors while loading rules for %s:\n%s":                "Fehler beim Laden der Regeln für %s:\n%s",
+		"Errors while loading rules, skipping %s:\n%s":          "Fehler beim Laden der Regeln, %s übersprungen:\n%s",
+		"Warnings while matching rules:\n%s":                    "Warnungen beim Abgleichen der Regeln:\n%s",
+		"Warning: failed to publish the queue: %v":              "Warnung: die Warteschlange konnte nicht veröffentlicht werden: %v",
+		"Invalid regex %q: %v":                                  "Ungültiger regulärer Ausdruck %q: %v",
+		"Added rule to %s":                                      "Regel zu %s hinzugefügt",
+		"Added rule for %s to %s":                               "Regel für %s zu %s hinzugefügt",
+		"Failed to walk %s: %v":                                 "%s konnte nicht durchlaufen werden: %v",
+		"Invalid config path: %v":                               "Ungültiger Konfigurationspfad: %v",
+		"Failed to read the config: %v":                         "Die Konfiguration konnte nicht gelesen werden: %v",
+		"Failed to load the config: %v":                         "Die Konfiguration konnte nicht geladen werden: %v",
+		"%d commands, %d flagged":                               "%d Befehle, %d markiert",
+		"Fixed %d patterns in %s":                               "%d Muster in %s korrigiert",
+		"%d rules OK":                                           "%d Regeln in Ordnung",
+		"Platform:":                                             "Plattform:",
+		"warning: %v":                                           "Warnung: %v",
+		"Configs:":                                              "Konfigurationen:",
+		"%s: skipped, see --skip-network-fs and --stat-timeout": "%s: übersprungen, siehe --skip-network-fs und --stat-timeout",
+		"%s: same file as an earlier config, skipped":           "%s: dieselbe Datei wie eine frühere Konfiguration, übersprungen",
+		"%s: unsigned, refused in strict mode":                  "%s: unsigniert, im strikten Modus abgelehnt",
+		"%s: no rules":                                          "%s: keine Regeln",
+		"%s: ranks %s-%s":                                       "%s: Ränge %s-%s",
+		"Rules:":                                                "Regeln:",
+		"%s: invalid regex %q":                                  "%s: ungültiger regulärer Ausdruck %q",
+		"%s: command %q is not installed":                       "%s: Befehl %q ist nicht installiert",
+		"%d rules loaded":                                       "%d Regeln geladen",
+		"Integration:":                                          "Integration:",
+		"%d problems found":                                     "%d Probleme gefunden",
+		"No config found":                                       "Keine Konfiguration gefunden",
+		"No config found, create one with apporte init.":        "Keine Konfiguration gefunden, lege eine mit apporte init an.",
+		"Editor failed: %v":                                     "Editor fehlgeschlagen: %v",
+		"Skipping %s, templates are left as written":            "%s übersprungen, Vorlagen bleiben wie geschrieben",
+		"Failed to format %s: %v":                               "%s konnte nicht formatiert werden: %v",
+		"Failed to get current directory: %v":                   "Das aktuelle Verzeichnis ist nicht ermittelbar: %v",
+		"Failed to resolve %s: %v":                              "%s konnte nicht aufgelöst werden: %v",
+		"Failed to locate the applications directory: %v":       "Das Anwendungsverzeichnis wurde nicht gefunden: %v",
+		"Failed to write desktop entries: %v":                   "Desktop-Einträge konnten nicht geschrieben werden: %v",
+		"Failed to trust %s: %v":                                "%s konnte nicht vertraut werden: %v",
+		"Failed to write the menu: %v":                          "Das Menü konnte nicht geschrieben werden: %v",
+		"No rule %q matches %s":                                 "Keine Regel %q passt auf %s",
+		"Failed to read the queues: %v":                         "Die Warteschlangen konnten nicht gelesen werden: %v",
+		"No watch or apply is running.":                         "Kein watch oder apply läuft.",
+		"%s (pid %d), %d of %d running, %d waiting":             "%s (PID %d), %d von %d laufen, %d warten",
+		"running  %-12s %s, for %s":                             "läuft   %-12s %s, seit %s",
+		"waiting  %-12s %s, for %s":                             "wartet   %-12s %s, seit %s",
+		"No history: %v":                                        "Kein Verlauf: %v",
+		"Failed to read the history: %v":                        "Der Verlauf konnte nicht gelesen werden: %v",
+		"Only %d dispatches in the history":                     "Nur %d Starts im Verlauf",
+		"Cannot redo the dispatch of %s, the history doesn't record the %s of its rule; dispatch it again instead": "Der Start von %s lässt sich nicht wiederholen, der Verlauf erfasst %s seiner Regel nicht; starte es stattdessen erneut",
+		"Nothing to undo, no sortable rule moved a file":                                                           "Nichts rückgängig zu machen, keine sortierende Regel hat eine Datei verschoben",
+		"Would move %s back to %s, moved %s":                                                                       "Würde %s zurück nach %s verschieben, verschoben am %s",
+		"Cannot undo, %s is gone: %v":                                                                              "Rückgängig nicht möglich, %s ist weg: %v",
+		"Cannot undo, %s exists again":                                                                             "Rückgängig nicht möglich, %s existiert wieder",
+		"Cannot undo: %v":                                                                                          "Rückgängig nicht möglich: %v",
+		"Warning: failed to record the undo in the history: %v":                                                    "Warnung: das Rückgängigmachen konnte nicht im Verlauf gespeichert werden: %v",
+		"Moved %s back to %s":                                                                                      "%s zurück nach %s verschoben",
+		"setup %s only works on %s":                                                                                "setup %s funktioniert nur unter %s",
+		"Failed to set up %s: %v":                                                                                  "Einrichtung von %s fehlgeschlagen: %v",
+		"Failed to register the URL handler: %v":                                                                   "Der URL-Handler konnte nicht registriert werden: %v",
+		"Warning: $BROWSER is unset, links no rule matches will fail to open":                                      "Warnung: $BROWSER ist nicht gesetzt, Links ohne passende Regel lassen sich nicht öffnen",
+		"apporte handles %s":                                                                                       "apporte öffnet %s",
+		"%s handles %s":                                                                                            "%s öffnet %s",
+		"Registered apporte, choose it as the browser in the settings that opened":                                 "apporte registriert, wähle es in den geöffneten Einstellungen als Browser",
+		"Choose it in the settings that opened for types other applications claim":                                 "Wähle es in den geöffneten Einstellungen für Typen, die andere Anwendungen beanspruchen",
+		"Unregistered apporte":                                                                                     "apporte abgemeldet",
+		"Installed %s":                                                                                             "%s installiert",
+		"Removed %s":                                                                                               "%s entfernt",
+		"Failed to read the corpus: %v":                                                                            "Der Korpus konnte nicht gelesen werden: %v",
+		"%d inputs, %d matched (%.1f%%), %d unmatched":                                                             "%d Eingaben, %d zugeordnet (%.1f%%), %d ohne Regel",
+		"Hits by rule:":                                                                                            "Treffer je Regel:",
+		"Unmatched, %d of %d:":                                                                                     "Ohne Regel, %d von %d:",
+		"No snapshot written, as configs failed to load":                                                           "Kein Snapshot geschrieben, da Konfigurationen nicht geladen werden konnten",
+		"Failed to write the snapshot: %v":                                                                         "Der Snapshot konnte nicht geschrieben werden: %v",
+		"Wrote %d rules to %s":                                                                                     "%d Regeln nach %s geschrieben",
+		"Failed to update the trust of %s: %v":                                                                     "Das Vertrauen in %s konnte nicht geändert werden: %v",
+		"Revoked the trust of %s":                                                                                  "Vertrauen in %s entzogen",
+		"Trusted %s":                                                                                               "%s wird vertraut",
+		tuiHelp: `Gib eine Eingabe zum Testen ein, oder einen Befehl:
+  :d N	Regel N für diese Sitzung aus- oder einschalten
+  :e N	die Konfiguration von Regel N bearbeiten
+  :r	die Konfigurationen neu laden
+  :q	beenden`,
+		"No rule %q":                             "Keine Regel %q",
+		"%s, icon %s":                            "%s, Symbol %s",
+		"Type an input to test it, :h for help.": "Gib eine Eingabe zum Testen ein, :h für Hilfe.",
+		"No rules match %s":                      "Keine Regel passt auf %s",
+		"%s: %d matching, * wins":                "%s: %d passend, * gewinnt",
+		"Failed to serve metrics: %v":            "Metriken konnten nicht bereitgestellt werden: %v",
+		"Failed to watch %s: %v":                 "%s konnte nicht beobachtet werden: %v",
+		"Rate limit of %q reached, skipping %s":  "Ratenlimit von %q erreicht, %s übersprungen",
+		"Watch error: %v":                        "Fehler beim Beobachten: %v",
+		"%s already exists, edit it with apporte edit or remove it to start over": "%s existiert bereits, bearbeite sie mit apporte edit oder entferne sie, um neu anzufangen",
+		"Web links":                      "Weblinks",
+		"PDFs":                           "PDFs",
+		"Images":                         "Bilder",
+		"Videos and music":               "Videos und Musik",
+		"Text and source files":          "Text- und Quelldateien",
+		"%s: nothing found, skipped":     "%s: nichts gefunden, übersprungen",
+		"0) none":                        "0) keins",
+		"Choose [1]: ":                   "Auswahl [1]: ",
+		"Not adding the rule for %s: %v": "Die Regel für %s wird nicht hinzugefügt: %v",
+		"The config:\n\n%s":              "Die Konfiguration:\n\n%s",
+		"Write it to %s? [Y/n] ":         "Nach %s schreiben? [J/n] ",
+		"Created %s with %d rules":       "%s mit %d Regeln angelegt",
+		"Make apporte the handler of web links, sending them through the rules? [y/N] ": "apporte zum Handler von Weblinks machen, die dann durch die Regeln gehen? [j/N] ",
+		`List the rules under "Open With" of file managers? [y/N] `:                     `Die Regeln unter „Öffnen mit" der Dateimanager aufführen? [j/N] `,
+		"Seed %d, %d runs of each check":                                                "Startwert %d, %d Durchläufe je Prüfung",
+		"ok    %s":                                                                      "ok    %s",
+		"FAIL  %s: %v":                                                                  "FEHLER  %s: %v",
+		"%d of %d checks failed":                                                        "%d von %d Prüfungen fehlgeschlagen",
+		"quoting":                                                                       "Quoting",
+		"expansion":                                                                     "Ersetzung",
+		"command expansion":                                                             "Ersetzung in Befehlen",
+		"group indexes":                                                                 "Gruppennummern",
+		"rule copies":                                                                   "Kopien von Regeln",
+	},
+}
+
+// detectLanguage returns the language of messages, from the first of
+// $LC_ALL, $LC_MESSAGES and $LANG that's set, e.g. "de" for "de_DE.UTF-8".
+func detectLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		locale := os.Getenv(name)
+		if locale == "" {
+			continue
+		}
+		lang, _, _ := strings.Cut(locale, ".")
+		lang, _, _ = strings.Cut(lang, "_")
+		lang, _, _ = strings.Cut(lang, "@")
+		if lang == "C" || lang == "POSIX" {
+			return "en"
+		}
+		return strings.ToLower(lang)
+	}
+	return "en"
+}
+
+// localeFilePath returns the catalog of a language users can add or
+// override messages with.
+func localeFilePath(lang string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apporte", "locale", lang+".toml"), nil
+}
+
+// readCatalog returns the catalog of the language of messages, built-in
+// messages overridden by those of the user's catalog, which the engine reads
+// once. Catalogs that fail to parse are ignored, messages are never worth
+// failing for.
+func readCatalog() map[string]string {
+	lang := detectLanguage()
+	messages := map[string]string{}
+	for msg, translated := range catalogs[lang] {
+		messages[msg] = translated
+	}
+	if path, err := localeFilePath(lang); err == nil {
+		var user map[string]string
+		if _, err := toml.DecodeFile(path, &user); err == nil {
+			for msg, translated := range user {
+				messages[msg] = translated
+			}
+		}
+	}
+	return messages
+}
+
+// tr translates a message, which is kept as is when there's no translation.
+func (e *engine) tr(msg string) string {
+	if translated, ok := e.catalog()[msg]; ok {
+		return translated
+	}
+	return msg
+}
+
+// trf formats the translation of a message.
+func (e *engine) trf(format string, args ...any) string {
+	return fmt.Sprintf(e.tr(format), args...)
+}
+
+// explainField prints a line of explain, translated, with the values lined
+// up at the second tab stop.
+func (e *engine) explainField(label, format string, args ...any) {
+	label = e.tr(label)
+	tabs := "\t"
+	if utf8.RuneCountInString(label) < 8 {
+		tabs = "\t\t"
+	}
+	fmt.Fprintf(e.stdout, "%s%s: %s\n", label, tabs, e.trf(format, args...))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// singleInstanceModes are what a single-instance rule does when it's already
+// running for the same input.
+var singleInstanceModes = map[string]bool{"wait": true, "skip": true}
+
+// parseSingle reads single_instance, which is true for "wait" or one of the
+// modes.
+func parseSingle(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case bool:
+		if v {
+			return "wait", nil
+		}
+		return "", nil
+	case string:
+		if !singleInstanceModes[v] {
+			return "", fmt.Errorf("invalid single_instance %q", v)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid single_instance %v", v)
+}
+
+// lockInstance takes the lock of the rule for the input, waiting for it or
+// giving up depending on the rule's mode. The lock is released by unlock, or
+// when apporte exits.
+func (e *engine) lockInstance(rule Rule, input string) (unlock func(), ok bool, err error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, false, err
+	}
+	dir = filepath.Join(dir, "apporte", "locks")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, false, err
+	}
+	sum := sha1.Sum([]byte(rule.Source + "\x00" + rule.Label + "\x00" + input))
+	f, err := os.OpenFile(filepath.Join(dir, hex.EncodeToString(sum[:8])+".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ok, err = lockFile(f, false)
+	if err == nil && !ok && rule.Single == "wait" {
+		fmt.Fprintln(os.Stderr, e.trf("Waiting for %q, which is already running for %s", rule.menuLabel(), input))
+		ok, err = lockFile(f, true)
+	}
+	if err != nil || !ok {
+		f.Close()
+		return nil, false, err
+	}
+	// closing the file releases the lock
+	return func() { f.Close() }, true, nil
+}
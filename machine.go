@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// machineFilePath returns the file naming the class of this machine, such
+// as "laptop", for the machine key of rules.
+func machineFilePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apporte", "machine"), nil
+}
+
+// detectMachine returns the class of this machine from $APPORTE_MACHINE, or
+// else the first line of the machine file.
+func detectMachine() string {
+	if machine := os.Getenv("APPORTE_MACHINE"); machine != "" {
+		return machine
+	}
+	path, err := machineFilePath()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	first, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSpace(first)
+}
+
+// compileFactPattern compiles the pattern a rule key matches a whole fact
+// against, as "work-.*" for hostname.
+func compileFactPattern(key, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex in %s: %w", key, err)
+	}
+	return re, nil
+}
+
+// factMatches reports whether a fact matches the pattern of a rule, true
+// without one. Facts that can't be detected match no pattern.
+func factMatches(ctx context.Context, facts map[string]*fact, re *regexp.Regexp, name string) bool {
+	if re == nil {
+		return true
+	}
+	value := facts[name].get(ctx)
+	return value != "" && re.MatchString(value)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// builtinMacros are the patterns shipped with apporte for match, used as
+// {{name}}. The extension macros match the end of the input, ignoring case.
+var builtinMacros = map[string]string{
+	"image_ext":    `(?i:\.(?:jpe?g|png|gif|webp|avif|heic|bmp|tiff?|svg|ico))$`,
+	"video_ext":    `(?i:\.(?:mkv|mp4|m4v|webm|avi|mov|wmv|flv|mpe?g|ts|ogv))$`,
+	"audio_ext":    `(?i:\.(?:mp3|flac|ogg|opus|m4a|aac|wav|wma|aiff?))$`,
+	"archive_ext":  `(?i:\.(?:zip|tar|tar\.(?:gz|bz2|xz|zst)|tgz|tbz2|txz|7z|rar))$`,
+	"document_ext": `(?i:\.(?:pdf|epub|djvu|docx?|odt|xlsx?|ods|pptx?|odp|rtf))$`,
+	"url":          `(?i:https?://[^\s/?#]+[^\s]*)`,
+	"email":        `[\w.+-]+@[\w-]+(?:\.[\w-]+)+`,
+	"ipv4":         `\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`,
+	"uuid":         `(?i:\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b)`,
+	"git_hash":     `\b[0-9a-f]{7,40}\b`,
+}
+
+// macroRe matches a macro in a pattern.
+var macroRe = regexp.MustCompile(`\{\{([a-z][a-z0-9_]*)\}\}`)
+
+// expandMacros substitutes the macros of a pattern, those of the config
+// overriding the built-in ones. Macros can use other macros.
+func expandMacros(pattern string, macros map[string]string) (string, error) {
+	return expandMacrosIn(pattern, macros, nil)
+}
+
+func expandMacrosIn(pattern string, macros map[string]string, stack []string) (string, error) {
+	var err error
+	expanded := macroRe.ReplaceAllStringFunc(pattern, func(m string) string {
+		name := m[2 : len(m)-2]
+		body, ok := macros[name]
+		if !ok {
+			body, ok = builtinMacros[name]
+		}
+		switch {
+		case err != nil:
+			return m
+		case !ok:
+			err = fmt.Errorf("unknown macro %s", m)
+			return m
+		}
+		for _, outer := range stack {
+			if outer == name {
+				err = fmt.Errorf("macro %s uses itself through %s", m, strings.Join(stack, ", "))
+				return m
+			}
+		}
+		body, err = expandMacrosIn(body, macros, append(stack, name))
+		// a group, so that repeating or alternating the macro applies to all of it
+		return "(?:" + body + ")"
+	})
+	return expanded, err
+}
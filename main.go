@@ -1,37 +1,266 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
-	"io"
+	"io/fs"
+	"maps"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type TomlRule struct {
-	Match   string      `toml:"match"`
-	Apporte interface{} `toml:"apporte"` // string or []string
+	Name       string            `toml:"name"`
+	Match      string            `toml:"match"`
+	Desc       string            `toml:"description"`
+	Category   string            `toml:"category"`
+	Icon       string            `toml:"icon"`
+	Enabled    *bool             `toml:"enabled"` // defaults to true
+	Override   bool              `toml:"override"`
+	Exact      *bool             `toml:"exact"` // defaults to the file's exact
+	RegexFlags []string          `toml:"regex_flags"`
+	Engine     string            `toml:"engine"`  // "re2" or "pcre"
+	Mime       string            `toml:"mime"`    // content type of links, e.g. "video/*"
+	Kind       string            `toml:"kind"`    // "path", "url" or "other"
+	When       string            `toml:"when"`    // e.g. "displays >= 2"
+	Apporte    interface{}       `toml:"apporte"` // string, []string or [][]string
+	Timeout    string            `toml:"timeout"`
+	WhenTime   string            `toml:"when_time"`
+	Hostname   string            `toml:"hostname"`
+	Machine    string            `toml:"machine"`
+	Deprecated string            `toml:"deprecated"` // message shown when it matches
+	Expires    string            `toml:"expires"`    // date, e.g. "2025-12-31"
+	OnExpiry   string            `toml:"on_expiry"`  // "warn" or "refuse"
+	Retries    int               `toml:"retries"`
+	Rematch    bool              `toml:"rematch"` // match the output as new inputs
+	Background bool              `toml:"background"`
+	Cwd        string            `toml:"cwd"`
+	Env        map[string]string `toml:"env"`
+	EnvClear   bool              `toml:"env_clear"`
+	EnvAllow   []string          `toml:"env_allow"`
+	Secret     map[string]string `toml:"secret"` // variable name to reference
+	Terminal   bool              `toml:"terminal"`
+	Target     string            `toml:"target"`
+	Sortable   bool              `toml:"sortable"`
+	Success    string            `toml:"success_when"` // e.g. `stdout matches "OK"`
+	Confirm    bool              `toml:"confirm"`
+	Prompt     tomlPrompts       `toml:"prompt"` // name to question or { text, default }
+	Notify     bool              `toml:"notify"`
+	OrElse     interface{}       `toml:"or_else"` // same forms as apporte
+	Stdin      string            `toml:"stdin"`
+	Stdout     string            `toml:"stdout"`
+	Stderr     string            `toml:"stderr"`
+	Sandbox    string            `toml:"sandbox"`
+	SecLabel   string            `toml:"security_label"` // e.g. "apparmor:PROFILE"
+	Scope      bool              `toml:"scope"`
+	ScopeProps []string          `toml:"scope_properties"`
+	Nice       int               `toml:"nice"`
+	Ionice     string            `toml:"ionice"`
+	Rlimits    map[string]string `toml:"rlimits"`
+	Umask      string            `toml:"umask"` // octal, Unix only
+	Group      string            `toml:"group"` // name or ID, Unix only
+	Host       string            `toml:"host"`
+	PathMap    map[string]string `toml:"path_map"`
+	Container  string            `toml:"container"`
+	Assoc      bool              `toml:"assoc"`
+	DBus       string            `toml:"dbus"`            // application ID to activate
+	Bundle     string            `toml:"bundle"`          // macOS app bundle ID
+	Single     interface{}       `toml:"single_instance"` // true, "wait" or "skip"
+	Debounce   string            `toml:"debounce"`        // watch mode only
+	RateLimit  string            `toml:"rate_limit"`      // e.g. "10/1m", watch mode only
+	Concurrent int               `toml:"concurrency"`     // watch and apply only
+	Pre        interface{}       `toml:"pre"`             // string or []string
+	Post       interface{}       `toml:"post"`            // string or []string
 }
 
-type TomlConfig struct {
+// TomlProfile groups rules that only apply while the profile is active.
+type TomlProfile struct {
 	Rules []TomlRule `toml:"rule"`
 }
 
+type TomlConfig struct {
+	Version         int                    `toml:"version"`
+	Pre             interface{}            `toml:"pre"`
+	Post            interface{}            `toml:"post"`
+	Sandboxes       map[string][]string    `toml:"sandboxes"`
+	Labelers        map[string][]string    `toml:"security_labels"` // wrappers by kind of label
+	Container       []string               `toml:"container"`
+	Unicode         string                 `toml:"unicode"`          // normalization form of inputs
+	UnicodePatterns bool                   `toml:"unicode_patterns"` // normalize patterns as well
+	Normalize       []string               `toml:"normalize"`        // normalizers of inputs
+	Providers       map[string][]string    `toml:"providers"`        // commands resolving {NAME.KEY}
+	AllowCommands   []string               `toml:"allow_commands"`   // the only commands its rules run
+	Rules           []TomlRule             `toml:"rule"`
+	Profiles        map[string]TomlProfile `toml:"profile"`
+	Defaults        TomlRule               `toml:"defaults"` // inherited by the rules
+	Macros          map[string]string      `toml:"macros"`   // patterns used as {{name}}
+	PathMap         map[string]string      `toml:"pathmap"`  // input prefixes rewritten for commands
+	Override        []string               `toml:"override"` // rule names or patterns
+	Strict          bool                   `toml:"strict"`
+	Score           bool                   `toml:"score"`
+	Exact           bool                   `toml:"exact"`           // anchor every pattern
+	AgeIdentity     string                 `toml:"age_identity"`    // decrypts .apporte.toml.age
+	MinisignKeys    []string               `toml:"minisign_keys"`   // user config only
+	AllowedSigners  string                 `toml:"allowed_signers"` // user config only
+}
+
+// Config is everything loaded by the crawl: rules in rank order and the
+// hooks declared at the top level of any config file.
+type Config struct {
+	Rules     []Rule
+	Pre       [][]string
+	Post      [][]string
+	Sandboxes map[string][]string
+	Labelers  map[string][]string
+	Providers map[string][]string // commands of placeholder providers, by name
+	PathMap   map[string]string
+	Container []string        // argv template for container rules
+	Normalize []string        // normalizers of inputs, of the closest config setting them
+	Overrides map[string]bool // rule names and patterns dropped from farther configs
+	Strict    bool            // config errors abort instead of being skipped
+	Score     bool            // the most specific matching rule wins
+	Unsigned  []string        // configs without signature, refused in strict mode
+	Warnings  []warning       // problems that don't invalidate the config
+}
+
 type Rule struct {
-	Match   *regexp.Regexp
-	Apporte []string
-	Source  string
-	Rank    int
-	Groups  []string
+	Name        string
+	Profile     string // only active with this profile, if set
+	Match       *lazyRegexp
+	Desc        string // human readable label
+	Category    string // selected with --category, e.g. "media"
+	Icon        string // theme icon name or image path, for menus
+	Apporte     []string
+	Steps       [][]string // run to completion before Apporte
+	Source      string
+	Label       string // position in Source, e.g. "rule 2"
+	Line        int    // of the rule's header in Source, 0 if unknown
+	Index       int    // in its table of rules in Source
+	Rank        rank
+	Input       string
+	When        []condition
+	WhenTime    []timeWindow
+	Hostname    *regexp.Regexp
+	Machine     *regexp.Regexp
+	Mime        string            // content type pattern links must match
+	Kind        string            // of the inputs matched, any if empty
+	ContentType string            // found with a HEAD request for links
+	Facts       map[string]string // detected for the placeholders of the rule and its hooks
+	Files       []string          // inputs batched into one invocation by {files}
+	TempDir     string            // extracted archive member, removed after dispatch
+	DBus        string            // application ID opening the input over D-Bus
+	Single      string            // "wait" or "skip" while running for the same input
+	Groups      []string
+	Each        [][]string // every match of the pattern, for {each.N}
+	Timeout     time.Duration
+	Retries     int           // runs again after a non-zero exit
+	Capture     bool          // stdout goes to apporte's, whatever the rule says
+	Rematch     bool          // stdout lines are matched as new inputs
+	Debounce    time.Duration // quiet period batching the files of a watch
+	RateLimit   int           // most dispatches per RatePeriod in watch mode
+	Concurrent  int           // most dispatches at a time in watch and apply
+	RatePeriod  time.Duration
+	Deprecated  string    // why, and what to use instead
+	Expires     time.Time // zero if the rule never expires
+	RefuseExp   bool      // expired, the rule doesn't match anymore
+	Background  bool
+	Cwd         string
+	Env         map[string]string
+	EnvClear    bool              // commands get a minimal environment, plus EnvAllow
+	EnvAllow    []string          // names and globs of the variables kept
+	Secrets     map[string]string // variable name to secret reference
+	Terminal    bool
+	Target      string
+	Sortable    bool
+	Success     []successCriterion // success_when of the command, exit status 0 if none
+	Confirm     bool
+	Prompts     []prompt          // asked before dispatching
+	Answers     map[string]string // to the prompts, by placeholder name
+	Provided    map[string]string // by providers, by placeholder name
+	Notify      bool
+	OrElse      [][]string // fallbacks tried in order while dispatching fails
+	Stdin       string
+	Stdout      string
+	Stderr      string
+	Output      *os.File // apporte's stdout, stderr for the stdio server
+	Sandbox     string
+	Wrapper     []string // sandbox argv the command is appended to
+	SecLabel    string   // "KIND:LABEL" applied to the command
+	Confiner    []string // argv applying SecLabel, wrapping the sandbox
+	Limits      []string // resource control argv wrapping the sandbox
+	Umask       string   // octal umask of the command
+	Group       string   // group the command runs in
+	Host        string
+	PathMap     map[string]string // local path prefix to remote path prefix
+	InputMap    map[string]string // [pathmap] of the configs, rewriting inputs
+	Container   string
+	Runner      []string // container argv the command is appended to
+	Unicode     string   // normalization form applied to inputs
+	Allowed     []string // allow_commands of the config, any command if nil
+	Pre         [][]string
+	Post        [][]string
+	Toml        TomlRule // as written, with the defaults, for snapshots
+}
+
+// lazyRegexp defers compilation of a pattern until a rule is actually
+// evaluated against an input.
+type lazyRegexp struct {
+	pattern string
+	engine  string
+	timeout time.Duration // of PCRE matches
+	once    sync.Once
+	re      matcher
+	err     error
+	affixes affixes
+}
+
+func (l *lazyRegexp) Compile() (matcher, error) {
+	l.once.Do(func() {
+		l.re, l.err = compilePattern(l.pattern, l.engine, l.timeout)
+	})
+	return l.re, l.err
+}
+
+func (l *lazyRegexp) String() string {
+	return l.pattern
+}
+
+// regexCache hands out one lazyRegexp per distinct pattern and engine, so
+// identical patterns across config files are compiled at most once.
+type regexCache struct {
+	mu      sync.Mutex
+	timeout time.Duration // of PCRE matches
+	entries map[string]*lazyRegexp
+}
+
+func newRegexCache(timeout time.Duration) *regexCache {
+	return &regexCache{timeout: timeout, entries: map[string]*lazyRegexp{}}
+}
+
+func (c *regexCache) get(pattern, engine string) *lazyRegexp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := engine + "\x00" + pattern
+	if l, ok := c.entries[key]; ok {
+		return l
+	}
+	l := &lazyRegexp{pattern: pattern, engine: engine, timeout: c.timeout}
+	c.entries[key] = l
+	return l
 }
 
 func normalizeApporte(v interface{}) ([]string, error) {
@@ -53,175 +282,1090 @@ func normalizeApporte(v interface{}) ([]string, error) {
 	}
 }
 
-func loadRulesFromFile(path string, baseRank int) ([]Rule, error) {
-	var tc TomlConfig
-	var finalErr error
-
-	if _, err := os.Stat(path); err != nil {
-		return nil, nil
+// normalizeCommands accepts a single command in the same forms as apporte,
+// or a list of such commands.
+func normalizeCommands(v interface{}) ([][]string, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		argv, err := normalizeApporte(v)
+		return [][]string{argv}, err
 	}
-	if _, err := toml.DecodeFile(path, &tc); err != nil {
-		return nil, fmt.Errorf("failed to parse TOML: %w", err)
+	if _, ok := list[0].([]interface{}); !ok {
+		argv, err := normalizeApporte(v)
+		return [][]string{argv}, err
 	}
 
-	var rules []Rule
-	for i, r := range tc.Rules {
-		re, err := regexp.Compile(r.Match)
-		if err != nil {
-			finalErr = errors.Join(finalErr, fmt.Errorf("rule %d: invalid regex %q: %w", i, r.Match, err))
-			continue
+	var commands [][]string
+	for _, command := range list {
+		if _, ok := command.([]interface{}); !ok {
+			return nil, fmt.Errorf("mixed commands and arguments in list: %v", command)
 		}
-		apporteStr, err := normalizeApporte(r.Apporte)
+		argv, err := normalizeApporte(command)
 		if err != nil {
-			finalErr = errors.Join(finalErr, fmt.Errorf("rule %d: invalid apporte: %w", i, err))
-			continue
+			return nil, err
 		}
-		rules = append(rules, Rule{
-			Match:   re,
-			Apporte: apporteStr,
-			Source:  path,
-			Rank:    baseRank + i,
-		})
+		commands = append(commands, argv)
 	}
+	return commands, nil
+}
 
-	return rules, finalErr
+// normalizeSteps splits a list of commands into the leading steps and the
+// final command. A single command has no steps.
+func normalizeSteps(v interface{}) ([][]string, []string, error) {
+	commands, err := normalizeCommands(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return commands[:len(commands)-1], commands[len(commands)-1], nil
 }
 
-func parentDir(path string) string {
-	return filepath.Dir(filepath.Clean(path))
+// normalizeHook accepts an optional hook command in the same forms as apporte.
+func normalizeHook(v interface{}) ([][]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	argv, err := normalizeApporte(v)
+	if err != nil {
+		return nil, err
+	}
+	return [][]string{argv}, nil
 }
 
-func tryLoadRules(
-	configPath string,
-	rulesCount int,
-	visitedPaths map[string]bool,
-	allRules *[]Rule,
-	finalErr *error,
-) int {
-	if visitedPaths[configPath] {
-		return 0
+func (e *engine) loadRulesFromFile(ctx context.Context, path string, base rank, cache *regexCache, keys crawlKeys, limits crawlLimits) (Config, error) {
+	var tc TomlConfig
+	var conf Config
+	var finalErr error
+
+	// the file is read once, so that what is verified, trusted and parsed
+	// is the same however the file changes meanwhile
+	raw, err := readConfigFile(path, limits.ConfigSize)
+	if errors.Is(err, fs.ErrNotExist) {
+		return conf, nil
+	}
+	if err != nil {
+		return conf, err
+	}
+	signed, err := verifySignature(ctx, path, raw, keys.signers)
+	if err != nil {
+		return conf, err
+	}
+	// signed configs are vouched for by their signer
+	if !signed && !keys.own[pathKey(path)] {
+		conf.Unsigned = []string{path}
+		if !keys.trusted(path, raw) {
+			return conf, fmt.Errorf("%w, review it and run apporte trust", errUntrusted)
+		}
+	}
+	data, err := e.decryptConfig(ctx, path, raw, keys.ageIdentity)
+	if err != nil {
+		return conf, err
+	}
+	if isTemplate(data) {
+		if data, err = expandTemplate(ctx, data, e.facts); err != nil {
+			return conf, fmt.Errorf("invalid template: %w", err)
+		}
+	}
+	md, err := toml.Decode(string(data), &tc)
+	if err != nil {
+		return conf, fmt.Errorf("failed to parse TOML: %w", err)
 	}
-	visitedPaths[configPath] = true
 
-	rules, err := loadRulesFromFile(configPath, rulesCount)
-	if err == nil {
-		*allRules = append(*allRules, rules...)
-		return len(rules)
+	conf.Strict = tc.Strict
+	conf.Score = tc.Score
+	if conf.Warnings, err = checkSchema(tc, md, string(data)); err != nil {
+		return conf, err
 	}
-	if !os.IsNotExist(err) {
-		*finalErr = errors.Join(*finalErr, fmt.Errorf("error in %q: %w", configPath, err))
+	for i := range conf.Warnings {
+		conf.Warnings[i].Source = path
+	}
+	defaults, err := decodeDefaults(tc, md)
+	if err != nil {
+		return conf, fmt.Errorf("invalid defaults: %w", err)
+	}
+	defaults = defaults.under(keys.defaults)
+	var keySets map[string][]map[string]bool
+	if len(defaults.keys) > 0 {
+		if keySets, err = ruleKeySets(string(data)); err != nil {
+			return conf, err
+		}
+	}
+	// the keys a rule doesn't set come from the defaults
+	inherit := func(table string, i int, r TomlRule) TomlRule {
+		if len(defaults.keys) == 0 {
+			return r
+		}
+		return applyDefaults(r, defaults, keySets[table][i])
+	}
+	if err := checkWrappers("sandbox", tc.Sandboxes); err != nil {
+		return conf, err
+	}
+	conf.Sandboxes = tc.Sandboxes
+	if err := checkWrappers("security label", tc.Labelers); err != nil {
+		return conf, err
+	}
+	conf.Labelers = tc.Labelers
+	if err := checkProviders(tc.Providers); err != nil {
+		return conf, err
+	}
+	conf.Providers = tc.Providers
+	if err := checkPathMap(tc.PathMap); err != nil {
+		return conf, err
+	}
+	conf.PathMap = tc.PathMap
+	if tc.Container != nil && len(tc.Container) == 0 {
+		return conf, errors.New("container has no command")
+	}
+	conf.Container = tc.Container
+	if err := checkNormalizers(tc.Normalize); err != nil {
+		return conf, err
+	}
+	conf.Normalize = tc.Normalize
+	conf.Overrides = map[string]bool{}
+	for _, key := range tc.Override {
+		conf.Overrides[key] = true
 	}
-	return 0
-}
 
-func crawlConfigTree(start string, prioritizedConfigPath []string) ([]Rule, error) {
-	var allRules []Rule
-	var finalErr error
-	visitedPaths := map[string]bool{}
-	rulesCount := 0
+	if _, ok := unicodeForms[tc.Unicode]; !ok {
+		return conf, fmt.Errorf("invalid unicode normalization %q", tc.Unicode)
+	}
 
-	// prioritized paths (rank 0+)
-	for _, configPath := range prioritizedConfigPath {
-		rulesCount += tryLoadRules(configPath, rulesCount, visitedPaths, &allRules, &finalErr)
+	if conf.Pre, err = normalizeHook(tc.Pre); err != nil {
+		finalErr = errors.Join(finalErr, warning{Level: levelError, Kind: "invalid_hook", Source: path, Message: fmt.Sprintf("invalid pre hook: %v", err)})
+	}
+	if conf.Post, err = normalizeHook(tc.Post); err != nil {
+		finalErr = errors.Join(finalErr, warning{Level: levelError, Kind: "invalid_hook", Source: path, Message: fmt.Sprintf("invalid post hook: %v", err)})
+	}
+	if err := checkConfigCommands(conf, tc.AllowCommands); err != nil {
+		return conf, err
 	}
 
-	// $PWD -> root
-	dir := start
-	for {
-		configPath := filepath.Join(dir, ".apporte.toml")
-		rulesCount += tryLoadRules(configPath, rulesCount, visitedPaths, &allRules, &finalErr)
+	lines := ruleLines(string(data))
+	add := func(profile string, i int, r TomlRule, line int) {
+		if r.Enabled != nil && !*r.Enabled {
+			return
+		}
+		// app bundles only exist on macOS, elsewhere the rule doesn't apply
+		if r.Bundle != "" && runtime.GOOS != "darwin" {
+			return
+		}
+		rule, err := e.convertRule(r, tc, cache)
+		if err == nil {
+			err = checkAllowedRule(rule)
+		}
+		if err != nil {
+			finalErr = errors.Join(finalErr, warning{Level: levelError, Kind: "invalid_rule", Source: path, Profile: profile, Rule: &i, Line: line, Message: err.Error()})
+			return
+		}
+		rule.Profile = profile
+		rule.Source = path
+		rule.Label = ruleLabel(profile, i)
+		rule.Line = line
+		rule.Index = i
+		rule.Rank = rank{Tier: base.Tier, File: base.File, Index: len(conf.Rules)}
+		rule.Toml = r
+		conf.Warnings = append(conf.Warnings, rule.groupWarnings()...)
+		conf.Rules = append(conf.Rules, rule)
+		if r.Override {
+			if rule.Name != "" {
+				conf.Overrides[rule.Name] = true
+			}
+			conf.Overrides[rule.Match.String()] = true
+		}
+	}
 
-		parent := parentDir(dir)
-		if parent == dir {
-			break
+	// profile rules outrank the unscoped rules of the same file, so that an
+	// active profile can take over a file type
+	for _, name := range slices.Sorted(maps.Keys(tc.Profiles)) {
+		table := "profile." + name + ".rule"
+		for i, r := range tc.Profiles[name].Rules {
+			add(name, i, inherit(table, i, r), lines.line(table, i))
 		}
-		dir = parent
 	}
+	for i, r := range tc.Rules {
+		add("", i, inherit("rule", i, r), lines.line("rule", i))
+	}
+
+	return conf, finalErr
+}
 
-	// user config is lowest priority
-	if userConfDir, err := os.UserConfigDir(); err == nil {
-		configPath := filepath.Join(userConfDir, ".apporte.toml")
-		rulesCount += tryLoadRules(configPath, rulesCount, visitedPaths, &allRules, &finalErr)
+// regexFlagNames are the flags of RE2 that can be set for a whole pattern.
+var regexFlagNames = map[string]string{
+	"i": "case-insensitive",
+	"m": "multi-line, ^ and $ match at line breaks",
+	"s": "dot matches line breaks",
+	"U": "ungreedy",
+}
+
+// regexFlags turns flag names into the inline flags group of a pattern.
+func regexFlags(names []string) (string, error) {
+	var flags strings.Builder
+	for _, name := range names {
+		if _, ok := regexFlagNames[name]; !ok {
+			return "", fmt.Errorf("invalid regex flag %q", name)
+		}
+		flags.WriteString(name)
 	}
+	return "(?" + flags.String() + ")", nil
+}
 
-	return allRules, finalErr
+// convertRule validates a rule as written in a config file.
+func (e *engine) convertRule(r TomlRule, tc TomlConfig, cache *regexCache) (Rule, error) {
+	var steps [][]string
+	var apporteStr []string
+	var err error
+	if r.Assoc {
+		if r.Apporte != nil {
+			return Rule{}, errors.New("assoc and apporte are exclusive")
+		}
+		apporteStr = e.platform.Association()
+	} else if r.Bundle != "" {
+		if r.Apporte != nil {
+			return Rule{}, errors.New("bundle and apporte are exclusive")
+		}
+		apporteStr = []string{"open", "-b", r.Bundle, "{files}"}
+	} else if r.DBus != "" {
+		// the command is built from the input when dispatching
+		if r.Apporte != nil {
+			return Rule{}, errors.New("dbus and apporte are exclusive")
+		}
+	} else if steps, apporteStr, err = normalizeSteps(r.Apporte); err != nil {
+		return Rule{}, fmt.Errorf("invalid apporte: %w", err)
+	}
+	var timeout time.Duration
+	if r.Timeout != "" {
+		timeout, err = time.ParseDuration(r.Timeout)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	if r.Retries < 0 {
+		return Rule{}, fmt.Errorf("invalid retries %d", r.Retries)
+	}
+	if r.Target != "" && !validTargets[r.Target] {
+		return Rule{}, fmt.Errorf("invalid target %q", r.Target)
+	}
+	pre, err := normalizeHook(r.Pre)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid pre hook: %w", err)
+	}
+	post, err := normalizeHook(r.Post)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid post hook: %w", err)
+	}
+	if err := validateStreams(r.Stdin, r.Stdout, r.Stderr); err != nil {
+		return Rule{}, err
+	}
+	var debounce time.Duration
+	if r.Debounce != "" {
+		if debounce, err = time.ParseDuration(r.Debounce); err != nil {
+			return Rule{}, fmt.Errorf("invalid debounce: %w", err)
+		}
+	}
+	var rateLimit int
+	var ratePeriod time.Duration
+	if r.RateLimit != "" {
+		if rateLimit, ratePeriod, err = parseRateLimit(r.RateLimit); err != nil {
+			return Rule{}, err
+		}
+	}
+	if err := checkEnvAllow(r.EnvAllow); err != nil {
+		return Rule{}, err
+	}
+	if (r.EnvClear || len(r.EnvAllow) > 0) && r.Host != "" {
+		return Rule{}, errors.New("env_clear doesn't apply to commands run on a host")
+	}
+	if r.SecLabel != "" {
+		if _, _, err := parseSecurityLabel(r.SecLabel); err != nil {
+			return Rule{}, err
+		}
+	}
+	if r.Concurrent < 0 {
+		return Rule{}, fmt.Errorf("invalid concurrency %d, expected a positive number", r.Concurrent)
+	}
+	if err := validateSecrets(r.Secret); err != nil {
+		return Rule{}, err
+	}
+	// neither ssh nor tmux pass the environment of the command on
+	if len(r.Secret) > 0 && (r.Host != "" || r.Target != "") {
+		return Rule{}, errors.New("secret doesn't apply to commands run on a host or in a tmux target")
+	}
+	prompts, err := parsePrompts(r.Prompt)
+	if err != nil {
+		return Rule{}, err
+	}
+	single, err := parseSingle(r.Single)
+	if err != nil {
+		return Rule{}, err
+	}
+	limits, err := resourceLimits(r)
+	if err != nil {
+		return Rule{}, err
+	}
+	if r.Kind != "" && !inputKinds[r.Kind] {
+		return Rule{}, fmt.Errorf("invalid kind %q, expected path, url or other", r.Kind)
+	}
+	var when []condition
+	if r.When != "" {
+		if when, err = parseWhen(r.When); err != nil {
+			return Rule{}, err
+		}
+	}
+	hostname, err := compileFactPattern("hostname", r.Hostname)
+	if err != nil {
+		return Rule{}, err
+	}
+	machine, err := compileFactPattern("machine", r.Machine)
+	if err != nil {
+		return Rule{}, err
+	}
+	var expires time.Time
+	if r.Expires != "" {
+		if expires, err = parseExpires(r.Expires); err != nil {
+			return Rule{}, err
+		}
+	}
+	switch r.OnExpiry {
+	case "", "warn", "refuse":
+	default:
+		return Rule{}, fmt.Errorf("invalid on_expiry %q, expected warn or refuse", r.OnExpiry)
+	}
+	if r.OnExpiry != "" && r.Expires == "" {
+		return Rule{}, errors.New("on_expiry needs expires")
+	}
+	var success []successCriterion
+	if r.Success != "" {
+		if r.Background {
+			return Rule{}, errors.New("success_when doesn't apply to background commands")
+		}
+		if success, err = parseSuccessWhen(r.Success); err != nil {
+			return Rule{}, err
+		}
+	}
+	var whenTime []timeWindow
+	if r.WhenTime != "" {
+		if whenTime, err = parseWhenTime(r.WhenTime); err != nil {
+			return Rule{}, err
+		}
+	}
+	if mask, err := strconv.ParseUint(r.Umask, 8, 32); r.Umask != "" && (err != nil || mask > 0o777) {
+		return Rule{}, fmt.Errorf("invalid umask %q", r.Umask)
+	}
+	if r.Group != "" {
+		if err := checkGroup(r.Group); err != nil {
+			return Rule{}, err
+		}
+	}
+	var orElse [][]string
+	if r.OrElse != nil {
+		if orElse, err = normalizeCommands(r.OrElse); err != nil {
+			return Rule{}, fmt.Errorf("invalid or_else: %w", err)
+		}
+	}
+	pattern, err := expandMacros(r.Match, tc.Macros)
+	if err != nil {
+		return Rule{}, err
+	}
+	if tc.UnicodePatterns {
+		pattern = normalizeUnicode(pattern, tc.Unicode)
+	}
+	if err := checkEngine(r.Engine, r.RegexFlags); err != nil {
+		return Rule{}, err
+	}
+	if len(r.RegexFlags) > 0 {
+		flags, err := regexFlags(r.RegexFlags)
+		if err != nil {
+			return Rule{}, err
+		}
+		pattern = flags + pattern
+	}
+	exact := tc.Exact
+	if r.Exact != nil {
+		exact = *r.Exact
+	}
+	if exact {
+		pattern = `\A(?:` + pattern + `)\z`
+	}
+	rule := Rule{
+		Name:       r.Name,
+		Mime:       r.Mime,
+		Kind:       r.Kind,
+		When:       when,
+		WhenTime:   whenTime,
+		Hostname:   hostname,
+		Machine:    machine,
+		Deprecated: r.Deprecated,
+		Expires:    expires,
+		RefuseExp:  r.OnExpiry == "refuse",
+		DBus:       r.DBus,
+		Single:     single,
+		Debounce:   debounce,
+		RateLimit:  rateLimit,
+		RatePeriod: ratePeriod,
+		Concurrent: r.Concurrent,
+		Match:      cache.get(pattern, r.Engine),
+		Desc:       r.Desc,
+		Category:   r.Category,
+		Icon:       r.Icon,
+		Apporte:    apporteStr,
+		Steps:      steps,
+		Timeout:    timeout,
+		Retries:    r.Retries,
+		Rematch:    r.Rematch,
+		Background: r.Background,
+		Cwd:        r.Cwd,
+		Env:        r.Env,
+		EnvClear:   r.EnvClear || len(r.EnvAllow) > 0,
+		EnvAllow:   r.EnvAllow,
+		Secrets:    r.Secret,
+		Terminal:   r.Terminal,
+		Target:     r.Target,
+		Sortable:   r.Sortable,
+		Success:    success,
+		Confirm:    r.Confirm,
+		Notify:     r.Notify,
+		OrElse:     orElse,
+		Stdin:      r.Stdin,
+		Stdout:     r.Stdout,
+		Stderr:     r.Stderr,
+		Sandbox:    r.Sandbox,
+		SecLabel:   r.SecLabel,
+		Limits:     limits,
+		Prompts:    prompts,
+		Umask:      r.Umask,
+		Group:      r.Group,
+		Host:       r.Host,
+		PathMap:    r.PathMap,
+		Container:  r.Container,
+		Unicode:    tc.Unicode,
+		Allowed:    tc.AllowCommands,
+		Pre:        pre,
+		Post:       post,
+	}
+	if err := rule.checkPlaceholders(); err != nil {
+		return Rule{}, err
+	}
+	return rule, nil
 }
 
-func matchRule(input string, rule Rule) (Rule, bool) {
-	result := rule.Match.FindStringSubmatch(input)
+func matchRule(ctx context.Context, input string, rule Rule, opts options) (Rule, bool, error) {
+	// patterns are only compiled for rules taking this kind of input
+	if rule.Kind != "" && inputKind(input) != rule.Kind {
+		return Rule{}, false, nil
+	}
+	re, err := rule.Match.Compile()
+	if err != nil {
+		return Rule{}, false, rule.warning(levelError, "invalid_regex", fmt.Sprintf("invalid regex %q: %v", rule.Match, err))
+	}
+	// members of archives are matched by their path inside the archive
+	subject := input
+	if _, member, ok := splitArchivePath(input); ok {
+		subject = member
+	}
+	subject = normalizeUnicode(subject, rule.Unicode)
+	result, err := re.Submatch(subject)
+	if err != nil {
+		return Rule{}, false, rule.warning(levelError, "regex_timeout", err.Error())
+	}
 	if result == nil {
-		rule.Groups = result
-		return Rule{}, false
+		return Rule{}, false, nil
+	}
+	// the link is only requested once a rule's pattern matches it
+	rule.ContentType = opts.Engine.linkContentType(ctx, input, opts.HeadTimeout)
+	if rule.Mime != "" && !matchMime(rule.Mime, rule.ContentType) {
+		return Rule{}, false, nil
 	}
+	// facts are only detected for rules whose pattern matches
+	if !conditionsHold(ctx, rule.When, opts.Engine.facts) || !inTimeWindows(rule.WhenTime, time.Now()) {
+		return Rule{}, false, nil
+	}
+	if !factMatches(ctx, opts.Engine.facts, rule.Hostname, "hostname") || !factMatches(ctx, opts.Engine.facts, rule.Machine, "machine") {
+		return Rule{}, false, nil
+	}
+	now := time.Now()
+	if rule.RefuseExp && rule.expired(now) {
+		return Rule{}, false, rule.expiredWarning()
+	}
+	rule.Input = input
 	rule.Groups = result
-	return rule, true
+	if rule.usesEach() {
+		if rule.Each, err = re.SubmatchAll(subject); err != nil {
+			return Rule{}, false, rule.warning(levelError, "regex_timeout", err.Error())
+		}
+	}
+	return rule, true, joinWarnings(rule.lifecycleWarnings(now))
 }
 
-func matchRules(input string, rules []Rule) ([]Rule, error) {
+func matchRules(ctx context.Context, input string, rules []Rule, opts options) ([]Rule, error) {
 	var (
-		matched []Rule
-		mu      sync.Mutex
-		wg      sync.WaitGroup
+		matched  []Rule
+		finalErr error
 	)
 
-	concurrency := runtime.NumCPU()
-	sem := make(chan struct{}, concurrency)
-
 	for _, rule := range rules {
+		matchedRule, ok, err := matchRule(ctx, input, rule, opts)
+		if err != nil {
+			finalErr = errors.Join(finalErr, err)
+		}
+		if ok {
+			matched = append(matched, matchedRule)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Rank.less(matched[j].Rank)
+	})
+	// distinct configs never share a rank, something went wrong if they do
+	for i := 1; i < len(matched); i++ {
+		if matched[i].Rank == matched[i-1].Rank {
+			finalErr = errors.Join(finalErr, warning{
+				Level:   levelWarning,
+				Kind:    "rank_tie",
+				Message: fmt.Sprintf("%s and %s tie at rank %s", matched[i-1].location(), matched[i].location(), matched[i].Rank),
+			})
+		}
+	}
+
+	return matched, finalErr
+}
+
+type matchResult struct {
+	Input   string
+	Matched []Rule
+	Err     error
+}
+
+// matchInputs matches a batch of inputs against the rules, running at most
+// opts.Jobs inputs concurrently. Repeated inputs are only matched once. Once
+// ctx is done, the inputs left are reported as failing with its error.
+func matchInputs(ctx context.Context, inputs []string, rules []Rule, opts options) []matchResult {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// with many rules, only those whose literals an input has are run
+	var literals *literalIndex
+	if len(rules) >= literalIndexMin {
+		literals = newLiteralIndex(rules)
+	}
+
+	index := map[string]int{}
+	var distinct []string
+	for _, input := range inputs {
+		if _, ok := index[input]; !ok {
+			index[input] = len(distinct)
+			distinct = append(distinct, input)
+		}
+	}
+
+	var wg sync.WaitGroup
+	memo := make([]matchResult, len(distinct))
+	sem := make(chan struct{}, jobs)
+
+	for i, input := range distinct {
 		wg.Add(1)
 
-		go func(r Rule) {
+		go func(i int, input string) {
 			defer wg.Done()
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			if matchedRule, ok := matchRule(input, r); ok {
-				mu.Lock()
-				matched = append(matched, matchedRule)
-				mu.Unlock()
+			if err := ctx.Err(); err != nil {
+				memo[i] = matchResult{Input: input, Err: err}
+				return
+			}
+			candidates := rules
+			if literals != nil {
+				candidates = literals.candidates(input)
 			}
-		}(rule)
+			matched, err := matchRules(ctx, input, candidates, opts)
+			memo[i] = matchResult{Input: input, Matched: matched, Err: err}
+		}(i, input)
 	}
-
 	wg.Wait()
-	sort.SliceStable(matched, func(i, j int) bool {
-		return matched[i].Rank < matched[j].Rank
-	})
 
-	return matched, nil
+	results := make([]matchResult, len(inputs))
+	for i, input := range inputs {
+		results[i] = memo[index[input]]
+	}
+	return results
+}
+
+func (e *engine) printExplain(ctx context.Context, input string, selected Rule) {
+	e.explainField("Input", "%s", input)
+	if selected.Name != "" {
+		e.explainField("Rule", "%s", selected.Name)
+	}
+	if selected.Profile != "" {
+		e.explainField("Profile", "%s", selected.Profile)
+	}
+	if selected.Kind != "" {
+		e.explainField("Kind", "%s", selected.Kind)
+	}
+	for _, c := range selected.When {
+		now := e.facts[c.Fact].get(ctx)
+		if now == "" {
+			now = e.tr("unknown")
+		}
+		e.explainField("When", "%s (%s now)", c, now)
+	}
+	for _, w := range selected.WhenTime {
+		e.explainField("When Time", "%s", w)
+	}
+	if selected.Hostname != nil {
+		e.explainField("Hostname", "%s (%s now)", selected.Toml.Hostname, e.facts["hostname"].get(ctx))
+	}
+	if selected.Machine != nil {
+		machine := e.facts["machine"].get(ctx)
+		if machine == "" {
+			machine = e.tr("unknown")
+		}
+		e.explainField("Machine", "%s (%s now)", selected.Toml.Machine, machine)
+	}
+	if selected.Deprecated != "" {
+		e.explainField("Deprecated", "%s", selected.Deprecated)
+	}
+	if selected.Toml.Expires != "" {
+		e.explainField("Expires", "%s", selected.Toml.Expires)
+	}
+	if selected.Category != "" {
+		e.explainField("Category", "%s", selected.Category)
+	}
+	e.explainField("Matched", "%s", selected.Match)
+	if selected.Desc != "" {
+		e.explainField("Description", "%s", selected.Desc)
+	}
+	if selected.Line > 0 {
+		e.explainField("From File", "%s:%d", selected.Source, selected.Line)
+	} else {
+		e.explainField("From File", "%s", selected.Source)
+	}
+	for _, step := range selected.Steps {
+		e.explainField("Step", "%v", step)
+	}
+	e.explainField("Command", "%v", selected.Apporte)
+	for _, fallback := range selected.OrElse {
+		e.explainField("Or Else", "%v", fallback)
+	}
+	e.explainField("Rank", "%s (tier, file, rule)", selected.Rank)
+	e.explainField("Groups", "%v", selected.Groups)
+	if selected.ContentType != "" {
+		e.explainField("Content Type", "%s", selected.ContentType)
+	}
+	if selected.Timeout > 0 {
+		e.explainField("Timeout", "%s", selected.Timeout)
+	}
+	if selected.Cwd != "" {
+		e.explainField("Cwd", "%s", selected.Cwd)
+	}
+	if len(selected.Env) > 0 {
+		e.explainField("Env", "%v", sortedEnv(selected.Env))
+	}
+	if selected.Background {
+		e.explainField("Background", "%t", selected.Background)
+	}
+	for _, hook := range selected.Pre {
+		e.explainField("Pre", "%v", hook)
+	}
+	for _, hook := range selected.Post {
+		e.explainField("Post", "%v", hook)
+	}
+	fmt.Fprintln(e.stdout)
+}
+
+// options are the global flags, shared by the default mode and subcommands.
+type options struct {
+	Explain  bool
+	Verbose  bool
+	Detach   bool
+	Yes      bool
+	Physical bool
+	Raw      bool
+	Strict   bool
+	URL      bool // running as the system URL handler
+	PrintCmd bool
+	Capture  bool // run commands in the foreground, passing their output on
+	Score    bool // the most specific matching rule wins
+	Scores   bool // print how matching rules score
+	Depth    int  // rules whose output led to this dispatch
+	Config   string
+	Snapshot string // dispatched against instead of the configs
+	Picker   string
+	Jobs     int
+
+	Profiles     []string          // active profiles
+	Categories   []string          // of the only rules to keep, if any
+	DisableRules []string          // names of rules to skip
+	EnableOnly   []string          // names of the only rules to keep, if any
+	Answers      map[string]string // to prompts, given with --set
+	Normalize    []string          // given with --normalize, nil for the configs'
+	Base         string            // relative input paths are resolved against
+
+	Engine      *engine       // of the process
+	Limits      crawlLimits   // of the configs loaded
+	HeadTimeout time.Duration // of HEAD requests, zero to send none
+	WarnLevel   string        // of the warnings shown, see warnLevels
+	WarnFormat  string        // of the warnings shown, "text" or "json"
 }
 
-func expandApporte(rules []Rule) []Rule {
-	for i := range rules {
-		for j, group := range rules[i].Groups {
-			placeholder := fmt.Sprintf("$%d", j)
-			for k, part := range rules[i].Apporte {
-				rules[i].Apporte[k] = strings.ReplaceAll(part, placeholder, group)
+// loadConfig crawls for config files from dir, or reads the snapshot given
+// with --from-snapshot, reporting problems as warnings. In strict mode, invalid configs and patterns are errors instead.
+// Being interrupted through ctx is always an error.
+func loadConfig(ctx context.Context, dir string, opts options) (Config, error) {
+	startDir, err := crawlStart(dir, opts.Physical)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: %v", err))
+	}
+	var conf Config
+	if opts.Snapshot != "" {
+		conf, err = opts.Engine.loadSnapshot(opts.Snapshot, opts.Limits)
+	} else {
+		conf, err = opts.Engine.crawlConfigTree(ctx, startDir, []string{opts.Config}, opts.Limits)
+	}
+	if err != nil {
+		return conf, err
+	}
+	warnings := conf.Warnings
+	if opts.Strict || conf.Strict {
+		for _, path := range conf.Unsigned {
+			warnings = append(warnings, warning{Level: levelError, Kind: "unsigned_config", Source: path, Message: "config isn't signed"})
+		}
+		for _, rule := range conf.Rules {
+			if _, err := rule.Match.Compile(); err != nil {
+				warnings = append(warnings, rule.warning(levelError, "invalid_regex", fmt.Sprintf("invalid regex %q: %v", rule.Match, err)))
 			}
 		}
+		if len(warnings) > 0 {
+			return conf, joinWarnings(warnings)
+		}
+	}
+	printWarnings(os.Stderr, "Warnings while loading rules", warnings, opts)
+	// duplicate and shadowed rules are left to check and doctor, finding
+	// them compiles every pattern
+	conf.Rules = filterRules(conf.Rules, opts)
+	return conf, nil
+}
+
+// filterRules drops the rules of inactive profiles and those switched off on
+// the command line.
+func filterRules(rules []Rule, opts options) []Rule {
+	known := map[string]bool{}
+	profiles := map[string]bool{}
+	categories := map[string]bool{}
+	for _, rule := range rules {
+		known[rule.Name] = true
+		profiles[rule.Profile] = true
+		categories[rule.Category] = true
+	}
+	for _, name := range append(opts.DisableRules, opts.EnableOnly...) {
+		if !known[name] {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: no rule named %q", name))
+		}
+	}
+	for _, profile := range opts.Profiles {
+		if !profiles[profile] {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: no rules in profile %q", profile))
+		}
+	}
+	for _, category := range opts.Categories {
+		if !categories[category] {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: no rules in category %q", category))
+		}
+	}
+
+	var kept []Rule
+	for _, rule := range rules {
+		if rule.Profile != "" && !slices.Contains(opts.Profiles, rule.Profile) {
+			continue
+		}
+		if slices.Contains(opts.DisableRules, rule.Name) {
+			continue
+		}
+		if len(opts.EnableOnly) > 0 && !slices.Contains(opts.EnableOnly, rule.Name) {
+			continue
+		}
+		if len(opts.Categories) > 0 && !slices.Contains(opts.Categories, rule.Category) {
+			continue
+		}
+		kept = append(kept, rule)
 	}
-	return rules
+	return kept
 }
 
-func dispatch(argv []string) error {
-	if len(argv) == 0 {
-		return fmt.Errorf("empty command")
+// splitProfiles parses a comma-separated list of profile names.
+func splitList(list string) []string {
+	var profiles []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			profiles = append(profiles, name)
+		}
 	}
+	return profiles
+}
 
-	if runtime.GOOS == "windows" {
-		// syscall.Exec is a noop on Windows
-		cmd := exec.Command(argv[0], argv[1:]...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		return cmd.Run()
+// prepareRule expands a matched rule and rewrites its command for dispatch,
+// once the commands it runs are checked against the command policies.
+func (c Config) prepareRule(rule Rule, opts options) (Rule, error) {
+	selected := expandRule(rule)
+	if err := c.allowsDispatch(opts.Engine, selected); err != nil {
+		return selected, err
+	}
+	selected.Background = selected.Background || opts.Detach
+	selected.Output = opts.Engine.stdout
+	if opts.Capture {
+		selected.Capture = true
 	}
+	// the output, or the move, must reach apporte
+	if selected.Capture || selected.Rematch || selected.Sortable || len(selected.Success) > 0 {
+		selected.Background, selected.Terminal, selected.Target = false, false, ""
+	}
+	return opts.Engine.prepareDispatch(selected)
+}
 
-	binary, err := exec.LookPath(argv[0])
-	if err != nil {
-		return fmt.Errorf("command not found: %s", argv[0])
+// dispatchResults dispatches the winning rule of every match result and
+// returns the exit status. A batch can't replace the process, so each of its
+// commands runs to completion. Once ctx is done, no further command runs.
+func dispatchResults(ctx context.Context, conf Config, results []matchResult, opts options, batch bool) int {
+	if err := ctx.Err(); err != nil {
+		return opts.Engine.interrupted("", err)
+	}
+	printWarnings(os.Stderr, "Warnings while matching rules", matchWarnings(results), opts)
+
+	for _, result := range results {
+		if opts.Score || conf.Score {
+			sortByScore(result.Matched)
+		}
+		if opts.Scores && len(result.Matched) > 0 {
+			opts.Engine.printScores(os.Stderr, result.Input, result.Matched)
+		}
+	}
+
+	if batch {
+		results = batchFiles(results)
+	}
+
+	answers := map[string]map[string]string{}
+	var tempDirs []string
+	defer func() {
+		for _, dir := range tempDirs {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	status := 0
+	for _, result := range results {
+		if err := ctx.Err(); err != nil {
+			return opts.Engine.interrupted(result.Input, err)
+		}
+		if len(result.Matched) == 0 && opts.URL {
+			if rule, ok := browserRule(result.Input); ok {
+				result.Matched = []Rule{rule}
+			}
+		} else if len(result.Matched) == 0 && opts.Engine.platform.AssociationFallback() {
+			result.Matched = []Rule{opts.Engine.associationRule(result.Input)}
+		}
+		if len(result.Matched) == 0 {
+			// the output of a capture is only the commands'
+			out := opts.Engine.stdout
+			if opts.Capture {
+				out = os.Stderr
+			}
+			status = opts.Engine.fail(exitNoMatch, "no_match", result.Input, nil)
+			if batch {
+				fmt.Fprintln(out, opts.Engine.trf("No rules matched: %s", result.Input))
+			} else {
+				fmt.Fprintln(out, opts.Engine.tr("No rules matched."))
+			}
+			continue
+		}
+
+		if opts.Picker != "" && len(result.Matched) > 1 && !opts.Explain {
+			picked, ok := opts.Engine.pickRule(ctx, result.Input, result.Matched, opts.Picker)
+			if !ok {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("No rule picked for %s", result.Input))
+				status = opts.Engine.fail(exitDispatchErr, "cancelled", result.Input, nil)
+				continue
+			}
+			result.Matched = []Rule{picked}
+		}
+
+		rule := conf.withHooks(ctx, result.Matched[0], opts.Engine.facts)
+		if archive, member, ok := splitArchivePath(rule.Input); ok && !opts.Explain && !opts.PrintCmd {
+			dir, path, err := extractMember(archive, member)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", result.Input, err))
+				status = dispatchFailure(result.Input, err, opts)
+				continue
+			}
+			rule.Input = path
+			rule.TempDir = dir
+		}
+		// a detached command may still need the file after apporte exits
+		if rule.TempDir != "" {
+			if rule.Background || opts.Detach {
+				rule.TempDir = ""
+			} else {
+				tempDirs = append(tempDirs, rule.TempDir)
+			}
+		}
+		// a batch asks once per rule, explaining shows where answers go
+		if len(rule.Prompts) > 0 && !opts.Explain && !opts.PrintCmd {
+			key := rule.Source + "\x00" + rule.Label
+			if answers[key] == nil {
+				a, err := opts.Engine.askPrompts(ctx, rule, opts.Answers)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", result.Input, err))
+					status = dispatchFailure(result.Input, err, opts)
+					continue
+				}
+				answers[key] = a
+			}
+			rule.Answers = answers[key]
+		}
+		selected, err := conf.prepareRule(rule, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", result.Input, err))
+			status = dispatchFailure(result.Input, err, opts)
+			continue
+		}
+		if opts.PrintCmd {
+			for _, step := range selected.Steps {
+				fmt.Fprintln(opts.Engine.stdout, shellJoin(selected.wrap(step)))
+			}
+			fmt.Fprintln(opts.Engine.stdout, shellJoin(selected.Apporte))
+			continue
+		}
+		if opts.Explain || opts.Verbose {
+			opts.Engine.printExplain(ctx, result.Input, selected)
+			opts.Engine.printHistoryDiff(result.Input, selected)
+		}
+		if opts.Explain {
+			continue
+		}
+		if selected.Confirm && !opts.Yes && !opts.Engine.confirm(ctx, selected.Apporte) {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch cancelled for %s", result.Input))
+			status = opts.Engine.fail(exitDispatchErr, "cancelled", result.Input, nil)
+			continue
+		}
+
+		// the placeholders of providers are only filled in now
+		if len(conf.Providers) > 0 {
+			if rule, err = opts.Engine.resolveProviders(ctx, conf, rule); err == nil && len(rule.Provided) > 0 {
+				selected, err = conf.prepareRule(rule, opts)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", result.Input, err))
+				status = dispatchFailure(result.Input, err, opts)
+				continue
+			}
+		}
+		if selected, err = resolveSecrets(ctx, selected); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", result.Input, err))
+			status = dispatchFailure(result.Input, err, opts)
+			continue
+		}
+
+		// answering prompts may have taken a while
+		if err := ctx.Err(); err != nil {
+			return opts.Engine.interrupted(result.Input, err)
+		}
+
+		unlock := func() {}
+		if selected.Single != "" {
+			var locked bool
+			unlock, locked, err = opts.Engine.lockInstance(selected, result.Input)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to lock %s: %v", result.Input, err))
+				status = dispatchFailure(result.Input, err, opts)
+				continue
+			}
+			if !locked {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Skipped %s, the rule is already running for it", result.Input))
+				continue
+			}
+		}
+
+		if err := runHooks(selected.Pre, selected); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Pre hook failed for %s: %v", result.Input, err))
+			status = dispatchFailure(result.Input, err, opts)
+			unlock()
+			continue
+		}
+
+		var output string
+		if selected.Rematch {
+			f, err := os.CreateTemp("", "apporte-rematch-")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", result.Input, err))
+				status = dispatchFailure(result.Input, err, opts)
+				unlock()
+				continue
+			}
+			f.Close()
+			output = f.Name()
+			selected.Stdout = "file:" + output
+			selected.Capture = false
+		}
+
+		dispatchFn := opts.Engine.dispatch
+		if batch {
+			dispatchFn = run
+		}
+		if selected.Retries > 0 {
+			dispatchFn = opts.Engine.retrying(dispatchFn)
+		}
+		// recorded beforehand, apporte may be replaced by the command, but
+		// sortable rules run to completion and are recorded with their move,
+		// and those with success_when with whether they succeeded
+		if historyEnabled() && !selected.Sortable && len(selected.Success) == 0 {
+			if err := appendHistory(newHistoryEntry(result.Input, selected)); err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: failed to record %s in the history: %v", result.Input, err))
+			}
+		}
+		err = runSteps(selected)
+		if err == nil {
+			err = opts.Engine.dispatchOrElse(selected, dispatchFn)
+		}
+		if selected.Sortable && err == nil && historyEnabled() {
+			if err := recordMove(result.Input, selected); err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: the dispatch of %s can't be undone: %v", result.Input, err))
+			}
+		} else if len(selected.Success) > 0 && historyEnabled() {
+			entry := newHistoryEntry(result.Input, selected)
+			entry.Failed = err != nil
+			if err := appendHistory(entry); err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: failed to record %s in the history: %v", result.Input, err))
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Dispatch failed for %s: %v", result.Input, err))
+			status = dispatchFailure(result.Input, err, opts)
+		}
+
+		// background commands haven't finished by now
+		if selected.Notify && !selected.Background {
+			if err := opts.Engine.notifyDone(selected, err); err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Notification failed for %s: %v", result.Input, err))
+			}
+		}
+		if err := runPostHooks(selected, err); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Post hook failed for %s: %v", result.Input, err))
+		}
+		unlock()
+
+		if output != "" {
+			if err != nil {
+				os.Remove(output)
+			} else if s := rematchOutput(ctx, conf, output, opts); s != 0 {
+				status = s
+			}
+		}
 	}
-	return syscall.Exec(binary, argv, os.Environ())
+	// the last command was interrupted along with apporte
+	if err := ctx.Err(); err != nil {
+		return opts.Engine.interrupted("", err)
+	}
+	return status
 }
 
 func main() {
@@ -234,90 +1378,257 @@ func main() {
 		shortConfig    = flag.String("c", "", "Prioritized config path")
 		inputFlag      = flag.String("input", "", "")
 		inputFlagShort = flag.String("i", "", "Input to match against")
+		longJobs       = flag.Int("jobs", 0, "")
+		shortJobs      = flag.Int("j", 0, "Number of inputs matched concurrently")
+		longDetach     = flag.Bool("detach", false, "")
+		shortDetach    = flag.Bool("d", false, "Run commands in the background")
+		longPhysical   = flag.Bool("physical", false, "")
+		shortPhysical  = flag.Bool("P", false, "Resolve symlinks before crawling for configs")
+		nullSep        = flag.Bool("0", false, "Read NUL-separated inputs from stdin")
+		longNull       = flag.Bool("null", false, "")
+		longLines      = flag.Bool("lines", false, "")
+		shortLines     = flag.Bool("l", false, "Read one input per line from stdin")
+		capture        = flag.Bool("capture", false, "Pass the output and exit status of commands on")
+		picker         = flag.String("picker", "", "Choose among the matching rules with this command, e.g. fzf")
+		clipboard      = flag.Bool("clipboard", false, "Take the input from the clipboard")
+		stdinFlag      = flag.Bool("stdin", false, "Read the inputs from stdin")
+		stdioServer    = flag.Bool("stdio-server", false, "Answer JSON requests on stdin, for editor plugins")
+		stdinTimeout   = flag.Duration("stdin-timeout", 10*time.Second, "How long to wait for stdin to start, 0 for ever")
+		raw            = flag.Bool("raw", false, "Match inputs as given, without normalizing file:// URIs and escapes")
+		normalizeList  = flag.String("normalize", "", "Comma-separated normalizers of inputs, or none")
+		base           = flag.String("base", "", "Directory relative input paths are resolved against")
+		longYes        = flag.Bool("yes", false, "")
+		shortYes       = flag.Bool("y", false, "Dispatch without asking for confirmation")
+		strict         = flag.Bool("strict", false, "Abort on invalid configs instead of skipping them")
+		score          = flag.Bool("score", false, "Let the most specific matching rule win")
+		scoreDebug     = flag.Bool("score-debug", false, "Show how matching rules score")
+		profile        = flag.String("profile", os.Getenv("APPORTE_PROFILE"), "Comma-separated profiles to activate")
+		category       = flag.String("category", "", "Comma-separated categories of the only rules to use")
+		head           = flag.Bool("head", false, "Find the content type of links with a HEAD request")
+		urlMode        = flag.Bool("url", false, "Handle links as the system URL handler")
+		stdinData      = flag.Bool("stdin-data", false, "Read the content to dispatch from stdin, matched by --name")
+		dataName       = flag.String("name", "", "File name the content from stdin is matched as")
+		with           = flag.String("with", "", "Dispatch to this command instead of matching rules")
+		save           = flag.Bool("save", false, "Save the --with command as a rule")
+		maxInput       = flag.Int("max-input-size", 64<<10, "Longest input accepted, in bytes")
+		printReason    = flag.Bool("print-reason", false, "Print why apporte exits as JSON on stderr")
+		warnLevel      = flag.String("warn-level", "warning", "Config problems shown: warning, error or none")
+		warnFormat     = flag.String("warn-format", "text", "Format of config problems: text or json")
+		fromSnapshot   = flag.String("from-snapshot", "", "Dispatch against a snapshot instead of the configs")
+		debugBundle    = flag.String("debug-bundle", "", "Write what went into the dispatch to a tarball for bug reports")
+		disableRules   stringList
+		enableOnly     stringList
+		setValues      stringList
 	)
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, `Usage of %s [OPTION] [-i|--input] FILE...
-  -c, --config		Prioritized config path
-  -e, --explain		Show details without dispatching
-  -h, --help		Show this message
-  -i, --input		Input to match against
-  -v, --verbose		Show details and dispatch
-`, os.Args[0])
-	}
+	limits := defaultCrawlLimits
+	headTimeout := flag.Duration("head-timeout", 3*time.Second, "Timeout of HEAD requests")
+	flag.Int64Var(&limits.ConfigSize, "max-config-size", limits.ConfigSize, "Largest config file loaded, in bytes")
+	flag.IntVar(&limits.Rules, "max-rules", limits.Rules, "Most rules loaded from all configs")
+	flag.BoolVar(&limits.SkipNetwork, "skip-network-fs", false, "Skip crawled directories on network filesystems")
+	flag.DurationVar(&limits.StatTimeout, "stat-timeout", 0, "Skip crawled directories slower to stat, 0 for no limit")
+	flag.DurationVar(&limits.FileTimeout, "config-timeout", 0, "Skip configs slower to load, 0 for no limit")
+	flag.DurationVar(&limits.RegexTimeout, "regex-timeout", limits.RegexTimeout, "Longest match of a pcre pattern, 0 for no limit")
+	flag.Var(&disableRules, "disable-rule", "Skip the rule with this name (repeatable)")
+	flag.Var(&enableOnly, "enable-only", "Only use the rule with this name (repeatable)")
+	flag.Var(&setValues, "set", "Answer the prompt NAME (repeatable)")
+	flag.Usage = usage
 	flag.Parse()
+	eng := newEngine()
+	exit := func(status int) {
+		if *printReason {
+			eng.printExitReason(os.Stderr, status)
+		}
+		os.Exit(status)
+	}
+	if !*head {
+		*headTimeout = 0
+	}
+
+	// an interrupt stops apporte where it's safe to, a second one right away,
+	// unless a command apporte waits for gets it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
 
-	explain := *longExplain || *shortExplain
-	verbose := *longVerbose || *shortVerbose
+	opts := options{
+		Explain:  *longExplain || *shortExplain,
+		Verbose:  *longVerbose || *shortVerbose,
+		Detach:   *longDetach || *shortDetach,
+		Yes:      *longYes || *shortYes,
+		Physical: *longPhysical || *shortPhysical,
+		Raw:      *raw,
+		Strict:   *strict,
+		URL:      *urlMode,
+		Capture:  *capture,
+		Score:    *score,
+		Scores:   *scoreDebug,
+		Config:   *longConfig,
+		Snapshot: *fromSnapshot,
+		Picker:   *picker,
+		Jobs:     runtime.NumCPU(),
 
-	config := *longConfig
+		Engine:      eng,
+		Limits:      limits,
+		HeadTimeout: *headTimeout,
+		WarnLevel:   *warnLevel,
+		WarnFormat:  *warnFormat,
+
+		Profiles:     splitList(*profile),
+		Categories:   splitList(*category),
+		DisableRules: disableRules,
+		EnableOnly:   enableOnly,
+	}
+	if _, ok := warnLevels[opts.WarnLevel]; !ok || opts.WarnFormat != "text" && opts.WarnFormat != "json" {
+		fmt.Fprintln(os.Stderr, eng.tr("--warn-level is warning, error or none, --warn-format text or json."))
+		exit(eng.fail(exitUsage, "usage", "", nil))
+	}
+	answers, err := parseSetValues(setValues)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(eng.fail(exitUsage, "usage", "", err))
+	}
+	opts.Answers = answers
+	// without --normalize, the configs choose the normalizers
+	if *normalizeList != "" {
+		if opts.Normalize, err = parseNormalizers(*normalizeList); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(eng.fail(exitUsage, "usage", "", err))
+		}
+	}
+	if *base != "" {
+		info, err := os.Stat(*base)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s isn't a directory", *base)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, eng.trf("Invalid --base: %v", err))
+			exit(eng.fail(exitUsage, "usage", "", err))
+		}
+		opts.Base, _ = filepath.Abs(*base)
+	}
 	if *shortConfig != "" {
-		config = *shortConfig
+		opts.Config = *shortConfig
+	}
+	if *longJobs > 0 {
+		opts.Jobs = *longJobs
+	}
+	if *shortJobs > 0 {
+		opts.Jobs = *shortJobs
+	}
+
+	if command, ok := subcommands[flag.Arg(0)]; ok {
+		status := command(ctx, flag.Args()[1:], opts)
+		// subcommands exit with 2 for usage errors too
+		if status == exitUsage {
+			eng.fail(exitUsage, "usage", "", nil)
+		}
+		exit(status)
+	}
+	if *stdioServer {
+		exit(serveStdio(ctx, os.Stdin, opts))
+	}
+
+	// stdin carries a single input unless a separator is chosen
+	separator := ""
+	if *longLines || *shortLines {
+		separator = "\n"
+	}
+	if *nullSep || *longNull {
+		separator = "\x00"
 	}
 
-	var input string
+	var inputs []string
 
 	switch {
+	case *stdinData:
+		// stdin is the content, the input is only its name
+		if *dataName == "" {
+			fmt.Fprintln(os.Stderr, eng.tr("--stdin-data needs --name to match against."))
+			exit(eng.fail(exitUsage, "usage", "", nil))
+		}
+		inputs = []string{*dataName}
 	case *inputFlag != "":
-		input = *inputFlag
+		inputs = []string{*inputFlag}
 	case *inputFlagShort != "":
-		input = *inputFlagShort
-	default:
-		args := flag.Args()
-		if len(args) > 0 {
-			input = args[0]
-		} else {
-			stat, _ := os.Stdin.Stat()
-			if (stat.Mode() & os.ModeCharDevice) == 0 {
-				data, err := io.ReadAll(os.Stdin)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to read stdin: %v\n", err)
-					os.Exit(1)
-				}
-				input = strings.TrimSpace(string(data))
-			}
+		inputs = []string{*inputFlagShort}
+	case *clipboard:
+		input, err := eng.platform.Clipboard()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, eng.trf("Failed to read clipboard: %v", err))
+			exit(eng.fail(exitError, "error", "", err))
+		}
+		if input != "" {
+			inputs = []string{input}
+		}
+	case len(flag.Args()) > 0:
+		inputs = flag.Args()
+	case *stdinFlag || separator != "" || eng.implicitStdin():
+		var err error
+		inputs, err = readStdinInputs(ctx, separator, *maxInput, *stdinTimeout)
+		if ctx.Err() != nil {
+			exit(eng.interrupted("", err))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, eng.trf("Failed to read stdin: %v", err))
+			exit(eng.fail(exitError, "error", "", err))
 		}
 	}
 
-	if input == "" {
-		fmt.Fprintln(os.Stderr, "No input provided. Use -i, positional arg, or pipe stdin.")
-		os.Exit(1)
+	if len(inputs) == 0 {
+		fmt.Fprintln(os.Stderr, eng.tr("No input provided. Use -i, positional arg, --clipboard, or --stdin."))
+		exit(eng.fail(exitUsage, "usage", "", nil))
+	}
+	for _, input := range inputs {
+		if len(input) > *maxInput {
+			fmt.Fprintln(os.Stderr, eng.trf("Input is longer than %d bytes, see --max-input-size", *maxInput))
+			exit(eng.fail(exitUsage, "usage", "", nil))
+		}
 	}
 
 	startDir, _ := os.Getwd()
-	rules, err := crawlConfigTree(startDir, []string{config})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warnings while loading rules:\n%s\n", err)
+	conf, err := loadConfig(ctx, startDir, opts)
+	if ctx.Err() != nil {
+		exit(eng.interrupted("", err))
 	}
-
-	matched, err := matchRules(input, rules)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error matching rules: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, eng.trf("Errors while loading rules:\n%s", err))
+		exit(eng.fail(exitConfig, "config_error", "", err))
 	}
-	if len(matched) == 0 {
-		fmt.Println("No rules matched.")
-		return
+	for i, input := range inputs {
+		inputs[i] = prepareInput(input, conf, opts)
 	}
-
-	matched = expandApporte(matched)
-	selected := matched[0]
-
-	if explain || verbose {
-		fmt.Printf("Input		: %s\n", input)
-		fmt.Printf("Matched		: %s\n", selected.Match)
-		fmt.Printf("From File	: %s\n", selected.Source)
-		fmt.Printf("Command		: %v\n", selected.Apporte)
-		fmt.Printf("Rank		: %d\n", selected.Rank)
-		fmt.Printf("Groups		: %v\n", selected.Groups)
-		fmt.Println()
+	var results []matchResult
+	if *stdinData {
+		results, err = matchStdinData(ctx, os.Stdin, inputs[0], conf.Rules, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, eng.trf("Failed to read stdin: %v", err))
+			exit(eng.fail(exitError, "error", "", err))
+		}
+	} else if *with != "" {
+		argv, err := shellSplit(*with)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, eng.trf("Invalid command %q: %v", *with, err))
+			exit(eng.fail(exitUsage, "usage", "", err))
+		}
+		for _, input := range inputs {
+			results = append(results, matchResult{Input: input, Matched: []Rule{withRule(input, argv)}})
+		}
+		if *save {
+			if err := saveWithRule(inputs[0], argv, opts); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	} else {
+		results = matchInputs(ctx, inputs, conf.Rules, opts)
 	}
-
-	if explain {
-		return
+	// commands may replace the process, the bundle is written first
+	if *debugBundle != "" {
+		if err := writeDebugBundle(ctx, *debugBundle, startDir, inputs, conf, results, opts); err != nil {
+			fmt.Fprintln(os.Stderr, eng.trf("Failed to write the debug bundle: %v", err))
+		} else {
+			fmt.Fprintln(os.Stderr, eng.trf("Wrote the debug bundle to %s", *debugBundle))
+		}
 	}
 
-	if err := dispatch(selected.Apporte); err != nil {
-		fmt.Fprintf(os.Stderr, "Dispatch failed: %v\n", err)
-		os.Exit(1)
-	}
+	exit(dispatchResults(ctx, conf, results, opts, len(results) > 1))
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// menuEntry is a rule offered for an input in a file manager's menu.
+type menuEntry struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Icon  string `json:"icon,omitempty"`
+}
+
+// id identifies the rule for dispatch-id. Named rules go by their name, the
+// others by their place in their config, which is stable until it's edited.
+func (r Rule) id() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	sum := sha1.Sum([]byte(r.Source + "\x00" + r.Label))
+	return hex.EncodeToString(sum[:6])
+}
+
+// menuLabel is the text a menu shows for the rule.
+func (r Rule) menuLabel() string {
+	switch {
+	case r.Desc != "":
+		return r.Desc
+	case r.Name != "":
+		return r.Name
+	}
+	return shellJoin(r.Apporte)
+}
+
+// menuFlags are the flags of menu.
+type menuFlags struct {
+	format string
+}
+
+func (f *menuFlags) define(fs *flag.FlagSet) {
+	fs.StringVar(&f.format, "format", "text", "Output format: text or json")
+}
+
+// menuCommand lists the rules matching an input, best first, for plugins of
+// file managers to build an "Open With" menu. The chosen entry is run with
+// dispatch-id.
+func menuCommand(ctx context.Context, args []string, opts options) int {
+	var given menuFlags
+	flags := commandFlags("menu", given.define)
+	args = parseInterspersed(flags, args)
+	if len(args) != 1 || given.format != "text" && given.format != "json" {
+		flags.Usage()
+		return 2
+	}
+
+	cwd, _ := os.Getwd()
+	conf, err := loadConfig(ctx, cwd, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Errors while loading rules:\n%s", err))
+		return 1
+	}
+	input := prepareInput(args[0], conf, opts)
+	matched, err := matchRules(ctx, input, conf.Rules, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Warnings while matching rules:\n%s", err))
+	}
+	if opts.Score || conf.Score {
+		sortByScore(matched)
+	}
+
+	entries := []menuEntry{}
+	seen := map[string]bool{}
+	for _, rule := range matched {
+		// overridden rules are gone already, but names can still repeat
+		if seen[rule.id()] {
+			continue
+		}
+		seen[rule.id()] = true
+		entries = append(entries, menuEntry{ID: rule.id(), Label: rule.menuLabel(), Icon: rule.Icon})
+	}
+
+	if given.format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write the menu: %v", err))
+			return 1
+		}
+		return 0
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\n", entry.ID, strings.ReplaceAll(entry.Label, "\n", " "))
+	}
+	return 0
+}
+
+// dispatchIDCommand dispatches an input to the rule with the given menu ID,
+// provided the rule still matches it.
+func dispatchIDCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) != 2 {
+		commandUsage("dispatch-id")
+		return 2
+	}
+
+	id := args[0]
+	cwd, _ := os.Getwd()
+	conf, err := loadConfig(ctx, cwd, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Errors while loading rules:\n%s", err))
+		return 1
+	}
+	input := prepareInput(args[1], conf, opts)
+	matched, err := matchRules(ctx, input, conf.Rules, opts)
+	for _, rule := range matched {
+		if rule.id() == id {
+			return dispatchResults(ctx, conf, []matchResult{{Input: input, Matched: []Rule{rule}, Err: err}}, opts, false)
+		}
+	}
+	fmt.Fprintln(os.Stderr, opts.Engine.trf("No rule %q matches %s", id, input))
+	return 1
+}
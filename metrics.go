@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// matchBuckets are the upper bounds of the match latency histogram, in
+// seconds.
+var matchBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// watchMetrics counts what apporte watch does, for Prometheus to scrape.
+type watchMetrics struct {
+	mu          sync.Mutex
+	loads       map[string]int // config loads by result
+	files       map[string]int // files by result of matching
+	dispatches  map[[2]string]int
+	watchErrors int
+	matchCounts []int // per bucket of matchBuckets, not cumulative
+	matchCount  int
+	matchSum    float64
+}
+
+func newWatchMetrics() *watchMetrics {
+	return &watchMetrics{
+		loads:       map[string]int{},
+		files:       map[string]int{},
+		dispatches:  map[[2]string]int{},
+		matchCounts: make([]int, len(matchBuckets)),
+	}
+}
+
+// The methods of watchMetrics do nothing on a nil receiver, which is what
+// watch has without --metrics.
+
+func (m *watchMetrics) configLoaded(err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.loads["error"]++
+	} else {
+		m.loads["ok"]++
+	}
+}
+
+func (m *watchMetrics) matched(d time.Duration, results []matchResult) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := d.Seconds()
+	m.matchCount++
+	m.matchSum += seconds
+	for i, bound := range matchBuckets {
+		if seconds <= bound {
+			m.matchCounts[i]++
+			break
+		}
+	}
+	for _, result := range results {
+		switch {
+		case result.Err != nil && len(result.Matched) == 0:
+			m.files["error"]++
+		case len(result.Matched) == 0:
+			m.files["unmatched"]++
+		default:
+			m.files["matched"]++
+		}
+	}
+}
+
+// dispatched counts a dispatch of a rule, by its name or else its menu ID,
+// with result "ok", "failed" or "rate_limited".
+func (m *watchMetrics) dispatched(rule Rule, result string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dispatches[[2]string{rule.id(), result}]++
+}
+
+func (m *watchMetrics) watchError() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchErrors++
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *watchMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeCounters(w, "apporte_config_loads_total", "Configs loaded for new files, by result.", "result", m.loads)
+	writeCounters(w, "apporte_files_total", "Files matched against the rules, by result.", "result", m.files)
+
+	fmt.Fprintln(w, "# HELP apporte_match_duration_seconds Time to match a file against the rules.")
+	fmt.Fprintln(w, "# TYPE apporte_match_duration_seconds histogram")
+	cumulative := 0
+	for i, bound := range matchBuckets {
+		cumulative += m.matchCounts[i]
+		fmt.Fprintf(w, "apporte_match_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "apporte_match_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.matchCount)
+	fmt.Fprintf(w, "apporte_match_duration_seconds_sum %g\n", m.matchSum)
+	fmt.Fprintf(w, "apporte_match_duration_seconds_count %d\n", m.matchCount)
+
+	fmt.Fprintln(w, "# HELP apporte_dispatches_total Dispatches of files, by rule and result.")
+	fmt.Fprintln(w, "# TYPE apporte_dispatches_total counter")
+	keys := make([][2]string, 0, len(m.dispatches))
+	for key := range m.dispatches {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "apporte_dispatches_total{rule=%s,result=%s} %d\n", labelValue(key[0]), labelValue(key[1]), m.dispatches[key])
+	}
+
+	fmt.Fprintln(w, "# HELP apporte_watch_errors_total Errors of the directory watcher.")
+	fmt.Fprintln(w, "# TYPE apporte_watch_errors_total counter")
+	fmt.Fprintf(w, "apporte_watch_errors_total %d\n", m.watchErrors)
+}
+
+// writeCounters writes a counter with one label, a series per value.
+func writeCounters(w io.Writer, name, help, label string, counts map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, labelValue(value), counts[value])
+	}
+}
+
+// labelValue quotes a label value of the Prometheus text format.
+func labelValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// serveMetrics serves the metrics at /metrics of addr until the process
+// exits. The listener is opened before returning, so that a busy address
+// fails right away.
+func serveMetrics(addr string, m *watchMetrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(ln)
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+// networkFSTypes are the names of network filesystems, and of autofs, whose
+// directories mount one when stat'ed.
+var networkFSTypes = map[string]bool{
+	"nfs":    true,
+	"smbfs":  true,
+	"afpfs":  true,
+	"webdav": true,
+	"autofs": true,
+}
+
+// networkFS reports whether dir is on a network filesystem.
+func networkFS(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	name := make([]byte, 0, len(st.Fstypename))
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return networkFSTypes[string(name)]
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// Magic numbers of network filesystems, and of autofs, whose directories
+// mount one when stat'ed.
+var networkFSTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517b:     true, // SMB
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x5346414f: true, // AFS
+	0x73757245: true, // Coda
+	0x00c36400: true, // Ceph
+	0x0187:     true, // autofs
+}
+
+// networkFS reports whether dir is on a network filesystem.
+func networkFS(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	return networkFSTypes[uint32(st.Type)]
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// networkFS can't tell network filesystems apart on this platform.
+func networkFS(dir string) bool {
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// networkFS reports whether dir is on a UNC share or a mapped network drive.
+func networkFS(dir string) bool {
+	vol := filepath.VolumeName(dir)
+	switch {
+	case strings.HasPrefix(strings.ToUpper(vol), `\\?\UNC\`):
+		return true
+	case strings.HasPrefix(vol, `\\`) && !strings.HasPrefix(vol, `\\?\`):
+		return true
+	}
+	root, err := windows.UTF16PtrFromString(vol + `\`)
+	if err != nil {
+		return false
+	}
+	return windows.GetDriveType(root) == windows.DRIVE_REMOTE
+}
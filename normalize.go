@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"mime/quotedprintable"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ansiRe matches the escape sequences terminals put around text: CSI
+// sequences such as colors, OSC sequences such as hyperlinks, and the
+// two-byte escapes.
+var ansiRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// normalizers rewrite inputs before they are matched, chained in the order
+// the normalize key or --normalize lists them.
+var normalizers = map[string]func(string) string{
+	"trim":         strings.TrimSpace,
+	"strip_ansi":   func(s string) string { return ansiRe.ReplaceAllString(s, "") },
+	"expand_tilde": expandTilde,
+	"resolve":      resolvePath,
+	"decode_qp":    decodeQuotedPrintable,
+}
+
+// checkNormalizers validates a chain of normalizers.
+func checkNormalizers(names []string) error {
+	for _, name := range names {
+		if _, ok := normalizers[name]; !ok {
+			return fmt.Errorf("unknown normalizer %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(normalizers)), ", "))
+		}
+	}
+	return nil
+}
+
+// prepareInput readies an input for matching the rules of conf: unless it's
+// --raw, the normalizers of --normalize, or else of the configs, then file://
+// URIs and shell escapes, which links given to the URL handler never have.
+// Relative paths are resolved against --base, by the resolve normalizer too,
+// rather than the working directory.
+func prepareInput(input string, conf Config, opts options) string {
+	if !opts.Raw {
+		chain := opts.Normalize
+		if chain == nil {
+			chain = conf.Normalize
+		}
+		for _, name := range chain {
+			if name == "resolve" && opts.Base != "" {
+				input = resolveBase(input, opts.Base)
+				continue
+			}
+			input = normalizers[name](input)
+		}
+		if !opts.URL {
+			input = normalizeInput(input)
+		}
+	}
+	if opts.Base != "" {
+		input = resolveBase(input, opts.Base)
+	}
+	return input
+}
+
+// parseNormalizers parses the chain of --normalize, a comma-separated list
+// or "none".
+func parseNormalizers(list string) ([]string, error) {
+	names := []string{}
+	if list == "none" {
+		return names, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, checkNormalizers(names)
+}
+
+// expandTilde replaces a leading ~ with the home directory.
+func expandTilde(s string) string {
+	if s != "~" && !strings.HasPrefix(s, "~/") && !strings.HasPrefix(s, `~\`) {
+		return s
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return s
+	}
+	return home + s[1:]
+}
+
+// resolvePath makes a relative path absolute against the working directory.
+// Links and other inputs are left alone.
+func resolvePath(s string) string {
+	if s == "" || urlSchemeRe.MatchString(s) || filepath.IsAbs(s) || inputKind(s) != "path" {
+		return s
+	}
+	abs, err := filepath.Abs(s)
+	if err != nil {
+		return s
+	}
+	return abs
+}
+
+// decodeQuotedPrintable decodes quoted-printable text, as links copied out
+// of raw mails are. Inputs that aren't valid quoted-printable are kept.
+func decodeQuotedPrintable(s string) string {
+	if !strings.Contains(s, "=") {
+		return s
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(s)))
+	if err != nil {
+		return s
+	}
+	return string(decoded)
+}
@@ -0,0 +1,13 @@
+package main
+
+import "fmt"
+
+// notifyDone sends a desktop notification about a finished dispatch.
+func (e *engine) notifyDone(rule Rule, dispatchErr error) error {
+	title := "apporte: " + rule.Apporte[0]
+	body := fmt.Sprintf("Finished %s", rule.Input)
+	if dispatchErr != nil {
+		body = fmt.Sprintf("Failed %s (exit status %d)", rule.Input, exitCode(dispatchErr))
+	}
+	return e.platform.Notify(title, body)
+}
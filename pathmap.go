@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkPathMap rejects the entries of a [pathmap] table that would rewrite
+// every input or none.
+func checkPathMap(pathMap map[string]string) error {
+	for from, to := range pathMap {
+		if strings.TrimRight(from, `/\`) == "" || to == "" {
+			return fmt.Errorf("invalid pathmap entry %q = %q", from, to)
+		}
+	}
+	return nil
+}
+
+// resolvePathMaps gives every rule the [pathmap] of the configs, whichever
+// config the rule comes from, since mount points are a matter of the machine.
+func (c *Config) resolvePathMaps() {
+	if len(c.PathMap) == 0 {
+		return
+	}
+	for i := range c.Rules {
+		c.Rules[i].InputMap = c.PathMap
+	}
+}
+
+// mapPrefix finds the longest prefix of the path map that path starts with,
+// returning what the prefix maps to and the rest of the path. Prefixes are
+// local paths, or URLs such as smb://nas/media.
+func mapPrefix(path string, pathMap map[string]string) (target, rest string, ok bool) {
+	prefixes := make([]string, 0, len(pathMap))
+	for prefix := range pathMap {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	for _, prefix := range prefixes {
+		local, sep := filepath.Clean(prefix), string(filepath.Separator)
+		if strings.Contains(prefix, "://") {
+			local, sep = strings.TrimSuffix(prefix, "/"), "/"
+		}
+		if path == local || strings.HasPrefix(path, local+sep) {
+			return pathMap[prefix], strings.TrimPrefix(path, local), true
+		}
+	}
+	return "", "", false
+}
+
+// mapInputPath rewrites a path or URL of the input by the [pathmap] of the
+// configs, for the command to find it where it is mounted. Relative paths of
+// existing files are made absolute first. Anything else is returned unchanged.
+func mapInputPath(s string, pathMap map[string]string) string {
+	path := s
+	if !filepath.IsAbs(s) && !strings.Contains(s, "://") {
+		if _, err := os.Stat(s); err == nil {
+			if abs, err := filepath.Abs(s); err == nil {
+				path = abs
+			}
+		}
+	}
+	target, rest, ok := mapPrefix(path, pathMap)
+	if !ok {
+		return s
+	}
+	if strings.Contains(target, "://") {
+		rest = filepath.ToSlash(rest)
+	}
+	return target + rest
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/dlclark/regexp2"
+)
+
+// Regex engines of rules. RE2 matches in linear time, PCRE adds lookarounds
+// and backreferences at the cost of a backtracking engine.
+const (
+	engineRE2  = "re2"
+	enginePCRE = "pcre"
+)
+
+// defaultRegexTimeout bounds each match of a PCRE pattern unless
+// --regex-timeout is given.
+const defaultRegexTimeout = 100 * time.Millisecond
+
+// A matcher is a compiled pattern, of either engine.
+type matcher interface {
+	// NumSubexp returns the number of groups of the pattern.
+	NumSubexp() int
+	// Submatch returns the match and its groups, nil if s doesn't match.
+	Submatch(s string) ([]string, error)
+	// SubmatchAll returns every match that doesn't overlap the one before,
+	// with its groups.
+	SubmatchAll(s string) ([][]string, error)
+}
+
+type re2Matcher struct{ *regexp.Regexp }
+
+func (m re2Matcher) Submatch(s string) ([]string, error) {
+	return m.FindStringSubmatch(s), nil
+}
+
+func (m re2Matcher) SubmatchAll(s string) ([][]string, error) {
+	return m.FindAllStringSubmatch(s, -1), nil
+}
+
+type pcreMatcher struct{ re *regexp2.Regexp }
+
+func (m pcreMatcher) NumSubexp() int {
+	return len(m.re.GetGroupNumbers()) - 1
+}
+
+func (m pcreMatcher) Submatch(s string) ([]string, error) {
+	match, err := m.re.FindStringMatch(s)
+	if err != nil {
+		return nil, fmt.Errorf("matching took longer than %s, see --regex-timeout", m.re.MatchTimeout)
+	}
+	if match == nil {
+		return nil, nil
+	}
+	return matchGroups(match), nil
+}
+
+func (m pcreMatcher) SubmatchAll(s string) ([][]string, error) {
+	var all [][]string
+	match, err := m.re.FindStringMatch(s)
+	for ; match != nil && err == nil; match, err = m.re.FindNextMatch(match) {
+		all = append(all, matchGroups(match))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("matching took longer than %s, see --regex-timeout", m.re.MatchTimeout)
+	}
+	return all, nil
+}
+
+func matchGroups(match *regexp2.Match) []string {
+	groups := match.Groups()
+	result := make([]string, len(groups))
+	for i, g := range groups {
+		result[i] = g.String()
+	}
+	return result
+}
+
+// compilePattern compiles a pattern for an engine. PCRE matches give up
+// after timeout, zero for never.
+func compilePattern(pattern, engine string, timeout time.Duration) (matcher, error) {
+	if engine != enginePCRE {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re2Matcher{re}, nil
+	}
+	re, err := regexp2.Compile(pattern, regexp2.RE2)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		re.MatchTimeout = timeout
+	}
+	return pcreMatcher{re}, nil
+}
+
+// checkEngine validates the engine of a rule, and the flags of its pattern
+// against it.
+func checkEngine(engine string, flags []string) error {
+	switch engine {
+	case "", engineRE2:
+		return nil
+	case enginePCRE:
+		for _, name := range flags {
+			if name == "U" {
+				return errors.New(`regex flag "U" isn't supported by the pcre engine`)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid engine %q, expected re2 or pcre", engine)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// pickRule lets the user choose among the rules matching an input with the
+// picker command, such as fzf. The picker reads one rule per line on stdin and
+// prints the chosen line. When it isn't installed, the rules are listed on the
+// terminal to choose by number instead.
+func (e *engine) pickRule(ctx context.Context, input string, matched []Rule, picker string) (Rule, bool) {
+	var lines bytes.Buffer
+	for i, rule := range matched {
+		fmt.Fprintf(&lines, "%d\t%s\t%s\n", i+1, strings.ReplaceAll(rule.menuLabel(), "\n", " "), rule.location())
+	}
+
+	argv := strings.Fields(picker)
+	if len(argv) == 0 {
+		fmt.Fprintf(os.Stderr, "%s\n%s", e.trf("Choose a rule for %s:", input), lines.String())
+		return e.pickByNumber(ctx, matched)
+	}
+	if _, err := exec.LookPath(argv[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n%s", e.trf("Picker %s not found, choose a rule for %s:", argv[0], input), lines.String())
+		return e.pickByNumber(ctx, matched)
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = &lines
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Fprintln(os.Stderr, e.trf("Picker failed: %v", err))
+	}
+	// an aborted picker prints nothing and fails
+	n, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\t")
+	return pickedRule(matched, n)
+}
+
+// pickByNumber asks on the terminal for the number of a rule, the first by
+// default.
+func (e *engine) pickByNumber(ctx context.Context, matched []Rule) (Rule, bool) {
+	tty, err := e.platform.OpenTTY()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, e.tr("There is no terminal to choose on"))
+		return Rule{}, false
+	}
+	defer tty.Close()
+
+	fmt.Fprint(os.Stderr, e.tr("Rule [1]: "))
+	answer, _ := readAnswer(ctx, bufio.NewReader(tty))
+	if ctx.Err() != nil {
+		return Rule{}, false
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		answer = "1"
+	}
+	return pickedRule(matched, answer)
+}
+
+// pickedRule returns the rule numbered n from 1.
+func pickedRule(matched []Rule, n string) (Rule, bool) {
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(matched) {
+		return Rule{}, false
+	}
+	return matched[i-1], true
+}
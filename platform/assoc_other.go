@@ -0,0 +1,14 @@
+//go:build !darwin && !windows
+
+package platform
+
+// Association opens the input with the application the system
+// associates with it.
+func (native) Association() []string {
+	return []string{"xdg-open", "{input}"}
+}
+
+// AssociationFallback is false, inputs no rule matches are left alone.
+func (native) AssociationFallback() bool {
+	return false
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package platform
+
+// Association opens the input with the application the system
+// associates with it, through ShellExecute without the quoting pitfalls of
+// cmd /C start.
+func (native) Association() []string {
+	return []string{"rundll32", "url.dll,FileProtocolHandler", "{input}"}
+}
+
+// AssociationFallback is true, the system associations are the only thing
+// most Windows users have configured.
+func (native) AssociationFallback() bool {
+	return true
+}
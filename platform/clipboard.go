@@ -0,0 +1,21 @@
+package platform
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func (native) Clipboard() (string, error) {
+	for _, argv := range clipboardCommands() {
+		if _, err := exec.LookPath(argv[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(argv[0], argv[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", argv[0], err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", fmt.Errorf("no clipboard tool found")
+}
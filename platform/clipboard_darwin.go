@@ -0,0 +1,8 @@
+//go:build darwin
+
+package platform
+
+// clipboardCommands lists the tools tried in order to read the clipboard.
+func clipboardCommands() [][]string {
+	return [][]string{{"pbpaste"}}
+}
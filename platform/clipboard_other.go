@@ -0,0 +1,17 @@
+//go:build !darwin && !windows
+
+package platform
+
+import "os"
+
+// clipboardCommands lists the tools tried in order to read the clipboard.
+func clipboardCommands() [][]string {
+	var commands [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		commands = append(commands, []string{"wl-paste", "--no-newline"})
+	}
+	return append(commands,
+		[]string{"xclip", "-selection", "clipboard", "-out"},
+		[]string{"xsel", "--clipboard", "--output"},
+	)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package platform
+
+import "errors"
+
+// CanExec is false, there is no exec to replace apporte with a command on
+// this platform.
+func (native) CanExec() bool {
+	return false
+}
+
+func (native) Exec(binary string, argv, env []string) error {
+	return errors.ErrUnsupported
+}
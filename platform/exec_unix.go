@@ -0,0 +1,14 @@
+//go:build unix
+
+package platform
+
+import "syscall"
+
+func (native) CanExec() bool {
+	return true
+}
+
+// Exec replaces apporte with binary.
+func (native) Exec(binary string, argv, env []string) error {
+	return syscall.Exec(binary, argv, env)
+}
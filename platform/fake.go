@@ -0,0 +1,72 @@
+package platform
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Fake is a Platform for tests, which records what apporte asks of the
+// system instead of doing it.
+type Fake struct {
+	ClipboardText string   // returned by Clipboard
+	TTY           bool     // returned by HasTTY
+	Answers       string   // read from OpenTTY, which fails if there are none
+	NoExec        bool     // makes CanExec report false
+	Emulator      []string // put before the command by Terminal, none found if empty
+	Assoc         []string // returned by Association
+	Fallback      bool     // returned by AssociationFallback
+
+	mu            sync.Mutex
+	Execs         [][]string  // the argv of each Exec
+	Notifications [][2]string // the title and body of each Notify
+}
+
+func (f *Fake) CanExec() bool {
+	return !f.NoExec
+}
+
+func (f *Fake) Exec(binary string, argv, env []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Execs = append(f.Execs, argv)
+	return nil
+}
+
+func (f *Fake) Clipboard() (string, error) {
+	return f.ClipboardText, nil
+}
+
+func (f *Fake) Notify(title, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Notifications = append(f.Notifications, [2]string{title, body})
+	return nil
+}
+
+func (f *Fake) HasTTY() bool {
+	return f.TTY
+}
+
+func (f *Fake) OpenTTY() (io.ReadCloser, error) {
+	if f.Answers == "" {
+		return nil, errors.New("no terminal")
+	}
+	return io.NopCloser(strings.NewReader(f.Answers)), nil
+}
+
+func (f *Fake) Association() []string {
+	return f.Assoc
+}
+
+func (f *Fake) AssociationFallback() bool {
+	return f.Fallback
+}
+
+func (f *Fake) Terminal(argv []string) ([]string, error) {
+	if len(f.Emulator) == 0 {
+		return nil, errors.New("no terminal emulator found")
+	}
+	return join(f.Emulator, argv), nil
+}
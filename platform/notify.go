@@ -0,0 +1,5 @@
+package platform
+
+func (native) Notify(title, body string) error {
+	return notifyCommand(title, body).Run()
+}
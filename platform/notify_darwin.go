@@ -0,0 +1,13 @@
+//go:build darwin
+
+package platform
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func notifyCommand(title, body string) *exec.Cmd {
+	script := fmt.Sprintf("display notification %q with title %q", body, title)
+	return exec.Command("osascript", "-e", script)
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !windows
+
+package platform
+
+import "os/exec"
+
+func notifyCommand(title, body string) *exec.Cmd {
+	return exec.Command("notify-send", title, body)
+}
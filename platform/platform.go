@@ -0,0 +1,50 @@
+// Package platform holds what apporte does differently on each operating
+// system: replacing itself with a command, reading the clipboard, sending
+// notifications, finding a terminal and opening with the system
+// associations. Each system compiles only its own implementation, and Fake
+// stands in for it in tests.
+package platform
+
+import "io"
+
+// A Platform does what touches the system around apporte.
+type Platform interface {
+	// CanExec reports whether Exec can replace the process, commands run
+	// as children otherwise.
+	CanExec() bool
+	// Exec replaces the process with binary, run with argv and env.
+	Exec(binary string, argv, env []string) error
+	// Clipboard returns the text on the system clipboard.
+	Clipboard() (string, error)
+	// Notify sends a desktop notification.
+	Notify(title, body string) error
+	// HasTTY reports whether apporte is attached to a terminal a command
+	// can use directly.
+	HasTTY() bool
+	// OpenTTY opens the terminal to ask questions on, as stdin may carry
+	// the input.
+	OpenTTY() (io.ReadCloser, error)
+	// Terminal wraps argv so that it runs inside a new terminal window.
+	Terminal(argv []string) ([]string, error)
+	// Association returns the command opening {input} with the application
+	// the system associates with it.
+	Association() []string
+	// AssociationFallback reports whether the inputs no rule matches are
+	// opened with the system associations.
+	AssociationFallback() bool
+}
+
+// Native returns the platform apporte was built for.
+func Native() Platform {
+	return native{}
+}
+
+type native struct{}
+
+func join(parts ...[]string) []string {
+	var joined []string
+	for _, p := range parts {
+		joined = append(joined, p...)
+	}
+	return joined
+}
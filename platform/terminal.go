@@ -0,0 +1,44 @@
+package platform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// terminals lists known emulators with the arguments that go between the
+// emulator and the command it should run.
+var terminals = map[string][]string{
+	"alacritty":      {"-e"},
+	"foot":           {},
+	"gnome-terminal": {"--"},
+	"kitty":          {},
+	"konsole":        {"-e"},
+	"st":             {"-e"},
+	"urxvt":          {"-e"},
+	"wezterm":        {"start", "--"},
+	"xfce4-terminal": {"-x"},
+	"xterm":          {"-e"},
+}
+
+// terminalSearchOrder is tried when $TERMINAL is unset.
+var terminalSearchOrder = []string{
+	"foot", "kitty", "alacritty", "wezterm", "gnome-terminal",
+	"konsole", "xfce4-terminal", "urxvt", "st", "xterm",
+}
+
+// Terminal wraps argv in $TERMINAL, or else the system's terminal.
+func (native) Terminal(argv []string) ([]string, error) {
+	if term := strings.Fields(os.Getenv("TERMINAL")); len(term) > 0 {
+		// a single word names the emulator, anything longer is used verbatim
+		if len(term) == 1 {
+			args, ok := terminals[filepath.Base(term[0])]
+			if !ok {
+				args = []string{"-e"}
+			}
+			term = join(term, args)
+		}
+		return join(term, argv), nil
+	}
+	return systemTerminal(argv)
+}
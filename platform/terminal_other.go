@@ -0,0 +1,37 @@
+//go:build !windows
+
+package platform
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// HasTTY reports whether apporte is attached to a terminal the command can
+// use directly.
+func (native) HasTTY() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}
+
+// OpenTTY opens the controlling terminal.
+func (native) OpenTTY() (io.ReadCloser, error) {
+	return os.Open("/dev/tty")
+}
+
+// systemTerminal wraps argv so that it runs in the first emulator of
+// terminalSearchOrder that's installed.
+func systemTerminal(argv []string) ([]string, error) {
+	for _, name := range terminalSearchOrder {
+		if _, err := exec.LookPath(name); err == nil {
+			return join([]string{name}, terminals[name], argv), nil
+		}
+	}
+	return nil, fmt.Errorf("no terminal emulator found, set $TERMINAL")
+}
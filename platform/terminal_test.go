@@ -0,0 +1,24 @@
+package platform
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTerminalFromEnvironment(t *testing.T) {
+	for _, tc := range []struct {
+		terminal string
+		want     []string
+	}{
+		{"kitty", []string{"kitty", "vim", "x"}},
+		{"/usr/bin/wezterm", []string{"/usr/bin/wezterm", "start", "--", "vim", "x"}},
+		{"myterm", []string{"myterm", "-e", "vim", "x"}},
+		{"myterm --exec", []string{"myterm", "--exec", "vim", "x"}},
+	} {
+		t.Setenv("TERMINAL", tc.terminal)
+		got, err := Native().Terminal([]string{"vim", "x"})
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("TERMINAL=%q: Terminal = %q, %v, want %q", tc.terminal, got, err, tc.want)
+		}
+	}
+}
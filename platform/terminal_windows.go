@@ -0,0 +1,25 @@
+//go:build windows
+
+package platform
+
+import (
+	"io"
+	"os"
+)
+
+// HasTTY reports whether apporte is attached to a console the command can
+// use directly.
+func (native) HasTTY() bool {
+	stat, err := os.Stdout.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// OpenTTY opens the console.
+func (native) OpenTTY() (io.ReadCloser, error) {
+	return os.Open("CONIN$")
+}
+
+// systemTerminal wraps argv so that it runs in a new console window.
+func systemTerminal(argv []string) ([]string, error) {
+	return join([]string{"cmd", "/C", "start", ""}, argv), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// prompt is a value a rule asks for before dispatching, available as
+// {prompt.NAME}.
+type prompt struct {
+	Name    string
+	Text    string
+	Default string
+}
+
+var promptNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// tomlPrompts are the prompts of a rule by name, as written in a config.
+type tomlPrompts map[string]tomlPrompt
+
+// tomlPrompt is either the question or a table with text and default.
+type tomlPrompt struct {
+	Text    string
+	Default string
+}
+
+func (p *tomlPrompt) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		p.Text = v
+		return nil
+	case map[string]interface{}:
+		for key, field := range v {
+			s, ok := field.(string)
+			switch {
+			case !ok:
+				return fmt.Errorf("%s must be a string", key)
+			case key == "text":
+				p.Text = s
+			case key == "default":
+				p.Default = s
+			default:
+				return fmt.Errorf("unknown key %q", key)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("must be a string or a table")
+}
+
+// parsePrompts checks the prompts of a rule and sorts them by name.
+func parsePrompts(table tomlPrompts) ([]prompt, error) {
+	var prompts []prompt
+	for name, p := range table {
+		if !promptNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid prompt name %q", name)
+		}
+		if p.Text == "" {
+			p.Text = name + "?"
+		}
+		prompts = append(prompts, prompt{Name: name, Text: p.Text, Default: p.Default})
+	}
+	sort.Slice(prompts, func(i, j int) bool { return prompts[i].Name < prompts[j].Name })
+	return prompts, nil
+}
+
+// parseSetValues parses the NAME=VALUE answers of --set.
+func parseSetValues(list []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range list {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !promptNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid --set %q, expected NAME=VALUE", pair)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// askPrompts returns the answers to the rule's prompts, keyed by placeholder
+// name. Values given with --set are taken as is. Otherwise the terminal is
+// asked, an empty answer picking the default, and without a terminal the
+// default is used if there is one.
+func (e *engine) askPrompts(ctx context.Context, rule Rule, set map[string]string) (map[string]string, error) {
+	answers := map[string]string{}
+	var tty *bufio.Reader
+	for _, p := range rule.Prompts {
+		if value, ok := set[p.Name]; ok {
+			answers["prompt."+p.Name] = value
+			continue
+		}
+
+		if tty == nil {
+			f, err := e.platform.OpenTTY()
+			if err != nil {
+				if p.Default == "" {
+					return nil, errors.New(e.trf("prompt %s needs an answer, but there is no terminal (use --set %s=VALUE)", p.Name, p.Name))
+				}
+				answers["prompt."+p.Name] = p.Default
+				continue
+			}
+			defer f.Close()
+			tty = bufio.NewReader(f)
+		}
+
+		if p.Default != "" {
+			fmt.Fprintf(os.Stderr, "%s [%s] ", p.Text, p.Default)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s ", p.Text)
+		}
+		answer, _ := readAnswer(ctx, tty)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if answer = strings.TrimSpace(answer); answer == "" {
+			answer = p.Default
+		}
+		answers["prompt."+p.Name] = answer
+	}
+	return answers, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// providerTimeout bounds how long a provider may take to resolve one
+// placeholder.
+const providerTimeout = 10 * time.Second
+
+// providerNameRe matches the names of providers, the part before the dot of
+// their placeholders.
+var providerNameRe = regexp.MustCompile(`^[a-z_]+$`)
+
+// reservedProviders are namespaces of placeholders apporte resolves itself.
+var reservedProviders = map[string]bool{"prompt": true, "each": true}
+
+// A placeholderProvider resolves the placeholders of a namespace, such as
+// {git.branch} for git, at dispatch time.
+type placeholderProvider interface {
+	resolve(ctx context.Context, e *engine, key string, rule Rule) (string, error)
+}
+
+// commandProvider is a provider of the [providers] table: the command runs
+// with {key} and the placeholders of the match expanded in its arguments,
+// and the environment of the rule's commands, the match described by
+// APPORTE_* variables. It's confined as they are, by the rule's sandbox,
+// security label and resource limits. What it prints, without the trailing
+// newline, is the value.
+type commandProvider []string
+
+func (p commandProvider) resolve(ctx context.Context, e *engine, key string, rule Rule) (string, error) {
+	values := placeholders(rule)
+	for name, value := range factValues(ctx, e.facts, p) {
+		values[name] = value
+	}
+	wrapper := expandArgv(rule.Wrapper, values)
+	env := make(map[string]string, len(rule.Env))
+	for k, v := range rule.Env {
+		env[k] = expand(v, values)
+	}
+	rule.Env = env
+	values["key"] = key
+	command := expandArgv(p, values)
+	if err := e.checkPolicy(command, wrapper, rule.Confiner); err != nil {
+		return "", err
+	}
+	argv := join(rule.Limits, rule.Confiner, wrapper, command)
+
+	ctx, cancel := context.WithTimeout(ctx, providerTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = environ(rule)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// checkProviders validates the [providers] table of a config.
+func checkProviders(providers map[string][]string) error {
+	for name, argv := range providers {
+		if !providerNameRe.MatchString(name) || reservedProviders[name] {
+			return fmt.Errorf("invalid provider name %q", name)
+		}
+		if len(argv) == 0 {
+			return fmt.Errorf("provider %s has no command", name)
+		}
+	}
+	return nil
+}
+
+// resolveProviders runs the providers of the placeholders the rule uses, once
+// each, for expandRule to fill in. A provider failing fails the dispatch
+// rather than leaving the placeholder in the command. Like secrets, they
+// are resolved once the dispatch is certain, so that neither --explain nor a
+// declined confirmation runs them.
+func (e *engine) resolveProviders(ctx context.Context, conf Config, rule Rule) (Rule, error) {
+	if len(conf.Providers) == 0 {
+		return rule, nil
+	}
+	provided := map[string]string{}
+	for _, template := range rule.templates() {
+		for _, m := range placeholderRe.FindAllStringSubmatch(template, -1) {
+			name, key, ok := strings.Cut(m[2], ".")
+			if !ok {
+				continue
+			}
+			argv, known := conf.Providers[name]
+			if _, done := provided[m[2]]; !known || done {
+				continue
+			}
+			value, err := commandProvider(argv).resolve(ctx, e, key, rule)
+			if err != nil {
+				return rule, fmt.Errorf("placeholder {%s}: %w", m[2], err)
+			}
+			provided[m[2]] = value
+		}
+	}
+	rule.Provided = provided
+	return rule, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A dispatchQueue runs the dispatches of watch and apply with at most max
+// of them at a time, and no more of a rule at a time than its concurrency.
+// Dispatches wait in the order they came, except for those of rules at
+// their cap, which let the others pass. Each watch and apply process has a
+// queue of its own: the budget isn't shared with other processes, and what
+// other commands dispatch, the stdio server included, isn't queued.
+type dispatchQueue struct {
+	mu      sync.Mutex
+	max     int
+	running map[string]int // dispatches by rule
+	active  []*queuedDispatch
+	waiting []*queuedDispatch
+	wg      sync.WaitGroup
+
+	name  string   // of the process, e.g. "watch ~/Downloads"
+	state string   // file apporte queue reads, if published
+	lock  *os.File // held while the process runs
+}
+
+// queuedDispatch is a dispatch in a queue, waiting or running.
+type queuedDispatch struct {
+	Rule   string    `json:"rule"` // name or menu ID
+	Inputs []string  `json:"inputs"`
+	Since  time.Time `json:"since"` // queued, or started once running
+	key    string
+	limit  int
+	run    func()
+}
+
+// queueState is what a process publishes about its queue.
+type queueState struct {
+	PID     int               `json:"pid"`
+	Name    string            `json:"name"`
+	Max     int               `json:"max"`
+	Running []*queuedDispatch `json:"running"`
+	Waiting []*queuedDispatch `json:"waiting"`
+}
+
+func newDispatchQueue(max int) *dispatchQueue {
+	if max < 1 {
+		max = 1
+	}
+	return &dispatchQueue{max: max, running: map[string]int{}}
+}
+
+// submit queues a dispatch of the rule for the inputs, run once the budget
+// allows.
+func (q *dispatchQueue) submit(rule Rule, inputs []string, run func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wg.Add(1)
+	q.waiting = append(q.waiting, &queuedDispatch{
+		Rule:   rule.id(),
+		Inputs: inputs,
+		Since:  time.Now(),
+		key:    rule.Source + "\x00" + rule.Label,
+		limit:  rule.Concurrent,
+		run:    run,
+	})
+	q.startReady()
+}
+
+// startReady starts the waiting dispatches that fit in the budget. The
+// caller holds q.mu.
+func (q *dispatchQueue) startReady() {
+	waiting := q.waiting[:0]
+	for _, d := range q.waiting {
+		if len(q.active) >= q.max || d.limit > 0 && q.running[d.key] >= d.limit {
+			waiting = append(waiting, d)
+			continue
+		}
+		d.Since = time.Now()
+		q.running[d.key]++
+		q.active = append(q.active, d)
+		go func(d *queuedDispatch) {
+			defer q.wg.Done()
+			d.run()
+			q.finish(d)
+		}(d)
+	}
+	q.waiting = waiting
+	q.publish()
+}
+
+func (q *dispatchQueue) finish(d *queuedDispatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[d.key]--
+	for i, a := range q.active {
+		if a == d {
+			q.active = append(q.active[:i], q.active[i+1:]...)
+			break
+		}
+	}
+	q.startReady()
+}
+
+// wait waits for every dispatch queued to have run.
+func (q *dispatchQueue) wait() {
+	q.wg.Wait()
+	q.unpublish()
+}
+
+// stop drops the dispatches still waiting and waits for the running ones.
+func (q *dispatchQueue) stop() {
+	q.mu.Lock()
+	for range q.waiting {
+		q.wg.Done()
+	}
+	q.waiting = nil
+	q.publish()
+	q.mu.Unlock()
+	q.wait()
+}
+
+// queueDir returns the directory where processes publish their queues.
+func queueDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apporte", "queues"), nil
+}
+
+// publishAs makes the queue visible to apporte queue under a name, for as
+// long as the process runs. The lock held on a file next to the state tells
+// live processes from crashed ones.
+func (q *dispatchQueue) publishAs(name string) error {
+	dir, err := queueDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, strconv.Itoa(os.Getpid()))
+	f, err := os.OpenFile(base+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := lockFile(f, false); err != nil {
+		f.Close()
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.name, q.state, q.lock = name, base+".json", f
+	q.publish()
+	return nil
+}
+
+// publish writes the state of the queue, if it's published. The caller
+// holds q.mu.
+func (q *dispatchQueue) publish() {
+	if q.state == "" {
+		return
+	}
+	data, err := json.Marshal(queueState{
+		PID:     os.Getpid(),
+		Name:    q.name,
+		Max:     q.max,
+		Running: q.active,
+		Waiting: q.waiting,
+	})
+	if err != nil {
+		return
+	}
+	// readers never see a partial state
+	tmp := q.state + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err == nil {
+		os.Rename(tmp, q.state)
+	}
+}
+
+func (q *dispatchQueue) unpublish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.state == "" {
+		return
+	}
+	// open files can't be removed on Windows
+	q.lock.Close()
+	os.Remove(q.state)
+	os.Remove(strings.TrimSuffix(q.state, ".json") + ".lock")
+	q.state = ""
+}
+
+// readQueues returns the queues of the running processes, removing those
+// left behind by processes that are gone.
+func readQueues() ([]queueState, error) {
+	dir, err := queueDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var states []queueState
+	for _, path := range paths {
+		lockPath := strings.TrimSuffix(path, ".json") + ".lock"
+		f, err := os.OpenFile(lockPath, os.O_RDWR, 0o600)
+		if errors.Is(err, fs.ErrNotExist) {
+			os.Remove(path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		free, err := lockFile(f, false)
+		f.Close()
+		if err == nil && free {
+			os.Remove(path)
+			os.Remove(lockPath)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var state queueState
+		if err := json.Unmarshal(data, &state); err != nil {
+			continue
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].PID < states[j].PID })
+	return states, nil
+}
+
+// queueFlags are the flags of queue.
+type queueFlags struct {
+	asJSON bool
+}
+
+func (f *queueFlags) define(fs *flag.FlagSet) {
+	fs.BoolVar(&f.asJSON, "json", false, "Print the queues as JSON")
+}
+
+// queueCommand lists what the running watch and apply processes dispatch and
+// what waits for its turn.
+func queueCommand(ctx context.Context, args []string, opts options) int {
+	var given queueFlags
+	flags := commandFlags("queue", given.define)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	states, err := readQueues()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read the queues: %v", err))
+		return 1
+	}
+	if given.asJSON {
+		if states == nil {
+			states = []queueState{}
+		}
+		data, _ := json.MarshalIndent(states, "", "  ")
+		fmt.Println(string(data))
+		return 0
+	}
+	if len(states) == 0 {
+		fmt.Println(opts.Engine.tr("No watch or apply is running."))
+		return 0
+	}
+	now := time.Now()
+	for i, state := range states {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(opts.Engine.trf("%s (pid %d), %d of %d running, %d waiting", state.Name, state.PID, len(state.Running), state.Max, len(state.Waiting)))
+		for _, d := range state.Running {
+			fmt.Println("  " + opts.Engine.trf("running  %-12s %s, for %s", d.Rule, strings.Join(d.Inputs, " "), now.Sub(d.Since).Round(time.Second)))
+		}
+		for _, d := range state.Waiting {
+			fmt.Println("  " + opts.Engine.trf("waiting  %-12s %s, for %s", d.Rule, strings.Join(d.Inputs, " "), now.Sub(d.Since).Round(time.Second)))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// maxRematchDepth bounds chains of rules matching each other's output, which
+// would otherwise loop forever when a rule matches its own.
+const maxRematchDepth = 8
+
+// rematchOutput dispatches each line a rematch rule's command wrote to path
+// as a new input.
+func rematchOutput(ctx context.Context, conf Config, path string, opts options) int {
+	data, err := os.ReadFile(path)
+	os.Remove(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read the output to rematch: %v", err))
+		return 1
+	}
+	if opts.Depth >= maxRematchDepth {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Stopped rematching after %d rules", maxRematchDepth))
+		return 1
+	}
+	opts.Depth++
+
+	var inputs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		inputs = append(inputs, prepareInput(line, conf, opts))
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintln(os.Stderr, opts.Engine.tr("Nothing to rematch, the command wrote no output"))
+		return 1
+	}
+	// apporte can't be replaced while the outer dispatch isn't done
+	return dispatchResults(ctx, conf, matchInputs(ctx, inputs, conf.Rules, opts), opts, true)
+}
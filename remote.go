@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// remoteArgv turns argv into an ssh invocation running it on the rule's
+// host, along with the rule's working directory and environment. Arguments
+// naming local files are made absolute and rewritten through the path map.
+func remoteArgv(rule Rule, argv []string) []string {
+	mapped := make([]string, len(argv))
+	for i, arg := range argv {
+		mapped[i] = arg
+		if i > 0 {
+			mapped[i] = mapPath(arg, rule.PathMap)
+		}
+	}
+
+	command := shellJoin(mapped)
+	if len(rule.Env) > 0 {
+		command = "env " + shellJoin(sortedEnv(rule.Env)) + " " + command
+	}
+	if rule.Cwd != "" {
+		command = "cd " + shellQuote(mapPath(rule.Cwd, rule.PathMap)) + " && " + command
+	}
+	return []string{"ssh", "--", rule.Host, command}
+}
+
+// mapPath rewrites an existing local path by the longest matching prefix of
+// the path map. Anything that isn't a local path is returned unchanged.
+func mapPath(arg string, pathMap map[string]string) string {
+	if _, err := os.Stat(arg); err != nil {
+		return arg
+	}
+	path, err := filepath.Abs(arg)
+	if err != nil {
+		return arg
+	}
+	if target, rest, ok := mapPrefix(path, pathMap); ok {
+		return target + filepath.ToSlash(rest)
+	}
+	return path
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+)
+
+// builtinSandboxes are wrappers available without configuration. Config
+// files may override them or add their own under [sandboxes].
+var builtinSandboxes = map[string][]string{
+	"bwrap": {
+		"bwrap",
+		"--ro-bind", "/", "/",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+		"--bind", "{dir}", "{dir}",
+		"--unshare-all",
+		"--die-with-parent",
+		"--new-session",
+		"--",
+	},
+	"firejail": {
+		"firejail",
+		"--quiet",
+		"--net=none",
+		"--private-tmp",
+		"--",
+	},
+}
+
+// checkWrappers rejects the wrappers of a [sandboxes] or [security_labels]
+// table without a command, which would run the rules naming them unconfined.
+func checkWrappers(kind string, wrappers map[string][]string) error {
+	for name, argv := range wrappers {
+		if len(argv) == 0 || argv[0] == "" {
+			return fmt.Errorf("%s %s has no command", kind, name)
+		}
+	}
+	return nil
+}
+
+// resolveSandboxes looks up the wrapper of every rule naming a sandbox.
+// Rules naming an unknown sandbox are dropped rather than run unconfined.
+func (c *Config) resolveSandboxes() []warning {
+	var warnings []warning
+	rules := c.Rules[:0]
+
+	for _, rule := range c.Rules {
+		if rule.Sandbox != "" {
+			wrapper, ok := c.Sandboxes[rule.Sandbox]
+			if !ok {
+				wrapper, ok = builtinSandboxes[rule.Sandbox]
+			}
+			if !ok {
+				warnings = append(warnings, rule.warning(levelError, "unknown_sandbox", fmt.Sprintf("unknown sandbox %q", rule.Sandbox)))
+				continue
+			}
+			rule.Wrapper = wrapper
+		}
+		rules = append(rules, rule)
+	}
+
+	c.Rules = rules
+	return warnings
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdayNames are the days of when_time, by their three-letter English name.
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// timeWindow is a period of the week rules can be restricted to. A window
+// ending before it starts runs past midnight into the next day.
+type timeWindow struct {
+	Days     [7]bool // by time.Weekday, all when unrestricted
+	Start    time.Duration
+	End      time.Duration // equal to Start for the whole day
+	Location *time.Location
+	spec     string
+}
+
+func (w timeWindow) String() string {
+	return w.spec
+}
+
+// parseWhenTime parses windows separated by ";", each being days, a time range
+// and a time zone, all optional but one of the first two:
+// "Mon-Fri 09:00-18:00", "Sat,Sun", "22:00-06:00 Europe/Paris".
+func parseWhenTime(spec string) ([]timeWindow, error) {
+	var windows []timeWindow
+	for _, part := range strings.Split(spec, ";") {
+		w, err := parseTimeWindow(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid when_time %q: %w", part, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseTimeWindow(spec string) (timeWindow, error) {
+	w := timeWindow{Location: time.Local, spec: spec}
+	fields := strings.Fields(spec)
+	days, hours := false, false
+	for _, field := range fields {
+		switch {
+		case !days && !hours && !strings.Contains(field, ":"):
+			if err := parseDays(field, &w.Days); err != nil {
+				return w, err
+			}
+			days = true
+		case !hours && strings.Contains(field, ":"):
+			start, end, ok := strings.Cut(field, "-")
+			var err error
+			if !ok {
+				return w, fmt.Errorf("time range %q has no end", field)
+			}
+			if w.Start, err = parseClock(start); err != nil {
+				return w, err
+			}
+			if w.End, err = parseClock(end); err != nil {
+				return w, err
+			}
+			hours = true
+		case days || hours:
+			loc, err := time.LoadLocation(field)
+			if err != nil {
+				return w, err
+			}
+			w.Location = loc
+		default:
+			return w, fmt.Errorf("unexpected %q", field)
+		}
+	}
+	if !days && !hours {
+		return w, fmt.Errorf("expected days or a time range")
+	}
+	if !days {
+		w.Days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return w, nil
+}
+
+// parseDays sets the days of a list such as "Mon,Wed" or a range such as
+// "Mon-Fri". Ranges can wrap around the week, e.g. "Fri-Mon".
+func parseDays(list string, days *[7]bool) error {
+	for _, item := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(strings.ToLower(item), "-")
+		first, ok := weekdayNames[from]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdayNames[to]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses a time of day as HH:MM, 24:00 being the end of the day.
+func parseClock(s string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 || h > 24 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// contains reports whether the time falls in the window, in its time zone.
+func (w timeWindow) contains(t time.Time) bool {
+	t = t.In(w.Location)
+	day := t.Weekday()
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	switch {
+	case w.Start == w.End:
+		return w.Days[day]
+	case w.Start < w.End:
+		return w.Days[day] && clock >= w.Start && clock < w.End
+	}
+	// past midnight, the early hours belong to the window of the day before
+	return w.Days[day] && clock >= w.Start || w.Days[(day+6)%7] && clock < w.End
+}
+
+// inTimeWindows reports whether the time falls in any of the windows, or
+// whether there are none.
+func inTimeWindows(windows []timeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return len(windows) == 0
+}
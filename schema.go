@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configVersion is the newest config schema this build understands. Configs
+// without a version key use schema 1, which ignores unknown keys with a
+// warning. From schema 2 on, unknown keys are errors.
+const configVersion = 2
+
+// keyHints explains keys that are commonly written instead of the real ones.
+var keyHints = map[string]string{
+	"rules":        "rules are declared as [[rule]] tables",
+	"rule.cmd":     "the command is set with apporte",
+	"rule.command": "the command is set with apporte",
+	"rule.regex":   "the pattern is set with match",
+	"rule.pattern": "the pattern is set with match",
+}
+
+// checkSchema validates the version of a decoded config and reports the keys
+// that weren't decoded. The warnings are for keys ignored by schema 1.
+func checkSchema(tc TomlConfig, md toml.MetaData, src string) (warnings []warning, err error) {
+	if tc.Version > configVersion {
+		return nil, fmt.Errorf("config version %d is newer than the supported version %d, upgrade apporte", tc.Version, configVersion)
+	}
+	if tc.Version < 0 {
+		return nil, fmt.Errorf("invalid config version %d", tc.Version)
+	}
+
+	var unknown []warning
+	inRules := false
+	for _, key := range md.Undecoded() {
+		if isRuleKey(key) {
+			inRules = true
+			continue
+		}
+		unknown = append(unknown, warning{Kind: "unknown_key", Message: fmt.Sprintf("unknown key %q%s", key.String(), keyHint(key))})
+	}
+	// the keys don't tell which rule they are in, so the rules are read again
+	if inRules {
+		inRule, err := unknownRuleKeys(src)
+		if err != nil {
+			return nil, err
+		}
+		unknown = append(unknown, inRule...)
+	}
+	level := levelWarning
+	if tc.Version >= 2 {
+		level = levelError
+	}
+	for i := range unknown {
+		unknown[i].Level = level
+	}
+	if tc.Version >= 2 {
+		return nil, joinWarnings(unknown)
+	}
+	return unknown, nil
+}
+
+// isRuleKey reports whether key is directly in a rule.
+func isRuleKey(key toml.Key) bool {
+	return len(key) == 2 && key[0] == "rule" ||
+		len(key) == 4 && key[0] == "profile" && key[2] == "rule"
+}
+
+// unknownRuleKeys reports the unknown keys of every rule, along with the rule
+// and its line.
+func unknownRuleKeys(src string) ([]warning, error) {
+	type rules struct {
+		Rules []map[string]interface{} `toml:"rule"`
+	}
+	var raw struct {
+		rules
+		Profiles map[string]rules `toml:"profile"`
+	}
+	if _, err := toml.Decode(src, &raw); err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, key := range tomlKeys(TomlRule{}) {
+		known[key] = true
+	}
+	lines := ruleLines(src)
+
+	var warnings []warning
+	check := func(table, profile string, i int, rule map[string]interface{}) {
+		for _, name := range slices.Sorted(maps.Keys(rule)) {
+			if known[name] {
+				continue
+			}
+			hint := keyHint(toml.Key{"rule", name})
+			warnings = append(warnings, warning{
+				Kind:    "unknown_key",
+				Profile: profile,
+				Rule:    &i,
+				Line:    lines.line(table, i),
+				Message: fmt.Sprintf("unknown key %q%s", name, hint),
+			})
+		}
+	}
+	for _, profile := range slices.Sorted(maps.Keys(raw.Profiles)) {
+		for i, rule := range raw.Profiles[profile].Rules {
+			check("profile."+profile+".rule", profile, i, rule)
+		}
+	}
+	for i, rule := range raw.Rules {
+		check("rule", "", i, rule)
+	}
+	return warnings, nil
+}
+
+// keyHint suggests what an unknown key was meant to be.
+func keyHint(key toml.Key) string {
+	var context string
+	var known []string
+	switch {
+	case len(key) == 1:
+		known = tomlKeys(TomlConfig{})
+	case len(key) == 2 && key[0] == "rule",
+		len(key) == 4 && key[0] == "profile" && key[2] == "rule":
+		context = "rule."
+		known = tomlKeys(TomlRule{})
+	default:
+		return ""
+	}
+
+	name := key[len(key)-1]
+	if hint, ok := keyHints[context+name]; ok {
+		return ", " + hint
+	}
+	for _, k := range known {
+		if editDistance(name, k) <= 2 {
+			return fmt.Sprintf(", did you mean %q?", k)
+		}
+	}
+	return ""
+}
+
+// tomlKeys lists the keys a config struct decodes.
+func tomlKeys(v interface{}) []string {
+	var keys []string
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ","); tag != "" {
+			keys = append(keys, tag)
+		}
+	}
+	return keys
+}
+
+// editDistance is the Levenshtein distance between two keys.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp/syntax"
+	"sort"
+)
+
+// Weights of the parts of a rule's specificity score.
+const (
+	anchorWeight    = 10 // per start or end the pattern is anchored to
+	conditionWeight = 20 // per condition besides the pattern
+	literalWeight   = 1  // per character every match must contain
+)
+
+// ruleScore is how specific a rule is. With scoring, the most specific of the
+// matching rules wins instead of the best ranked one.
+type ruleScore struct {
+	Anchors    int
+	Conditions int
+	Literals   int
+}
+
+func (s ruleScore) total() int {
+	return s.Anchors*anchorWeight + s.Conditions*conditionWeight + s.Literals*literalWeight
+}
+
+// scoreRule rates the specificity of a rule from its pattern and conditions,
+// each when condition counting as one.
+// An invalid pattern scores nothing for it.
+func scoreRule(rule Rule) ruleScore {
+	var s ruleScore
+	if rule.Mime != "" {
+		s.Conditions++
+	}
+	if rule.Profile != "" {
+		s.Conditions++
+	}
+	if rule.Kind != "" {
+		s.Conditions++
+	}
+	s.Conditions += len(rule.When)
+	if len(rule.WhenTime) > 0 {
+		s.Conditions++
+	}
+	if rule.Hostname != nil {
+		s.Conditions++
+	}
+	if rule.Machine != nil {
+		s.Conditions++
+	}
+	if re, err := syntax.Parse(rule.Match.String(), syntax.Perl); err == nil {
+		s.Literals, s.Anchors = requiredLiterals(re)
+	}
+	return s
+}
+
+// requiredLiterals counts the literal characters and anchors that every match
+// of the pattern goes through. Optional parts and alternatives don't count,
+// except what all the alternatives have at least.
+func requiredLiterals(re *syntax.Regexp) (literals, anchors int) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune), 0
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		return 0, 1
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			l, a := requiredLiterals(sub)
+			literals += l
+			anchors += a
+		}
+		return literals, anchors
+	case syntax.OpAlternate:
+		for i, sub := range re.Sub {
+			l, a := requiredLiterals(sub)
+			if i == 0 || l < literals {
+				literals = l
+			}
+			if i == 0 || a < anchors {
+				anchors = a
+			}
+		}
+		return literals, anchors
+	}
+	return 0, 0
+}
+
+// sortByScore orders matching rules from the most specific. Rules as specific
+// keep their rank order.
+func sortByScore(matched []Rule) {
+	sort.SliceStable(matched, func(i, j int) bool {
+		return scoreRule(matched[i]).total() > scoreRule(matched[j]).total()
+	})
+}
+
+// printScores shows how the matching rules of an input score, in the order
+// they are in.
+func (e *engine) printScores(w io.Writer, input string, matched []Rule) {
+	fmt.Fprintln(w, e.trf("Scores for %s:", input))
+	for _, rule := range matched {
+		s := scoreRule(rule)
+		fmt.Fprintln(w, "  "+e.trf("%4d  anchors %d, conditions %d, literals %-3d rank %-12s %s  %s",
+			s.total(), s.Anchors, s.Conditions, s.Literals, rule.Rank, rule.Match, rule.location()))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// secretBackends turn a secret reference, without its scheme, into the argv
+// printing the secret.
+var secretBackends = map[string]func(ref string) ([]string, error){
+	// 1Password, e.g. op://vault/item/field
+	"op": func(ref string) ([]string, error) {
+		return []string{"op", "read", "--no-newline", "op:" + ref}, nil
+	},
+	// pass, the first line of the entry, e.g. pass:work/s3
+	"pass": func(ref string) ([]string, error) {
+		return []string{"pass", "show", ref}, nil
+	},
+	// the system keyring, e.g. keyring:SERVICE/ACCOUNT
+	"keyring": func(ref string) ([]string, error) {
+		service, account, ok := strings.Cut(ref, "/")
+		if !ok || service == "" || account == "" {
+			return nil, fmt.Errorf("expected keyring:SERVICE/ACCOUNT")
+		}
+		if runtime.GOOS == "darwin" {
+			return []string{"security", "find-generic-password", "-s", service, "-a", account, "-w"}, nil
+		}
+		return []string{"secret-tool", "lookup", "service", service, "account", account}, nil
+	},
+}
+
+// secretCommand returns the argv printing the secret a reference points to.
+func secretCommand(ref string) ([]string, error) {
+	scheme, rest, ok := strings.Cut(ref, ":")
+	backend, known := secretBackends[scheme]
+	if !ok || !known {
+		return nil, fmt.Errorf("unknown secret backend in %q, expected op://, pass: or keyring:", ref)
+	}
+	return backend(rest)
+}
+
+// validateSecrets checks the secrets of a rule without resolving them.
+func validateSecrets(secrets map[string]string) error {
+	for name, ref := range secrets {
+		if !envNameRe.MatchString(name) {
+			return fmt.Errorf("invalid secret name %q", name)
+		}
+		if _, err := secretCommand(ref); err != nil {
+			return fmt.Errorf("secret %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveSecrets fetches the rule's secrets into its environment. They are
+// only ever held in memory, and resolved once the dispatch is certain, so
+// that neither --explain nor a declined confirmation asks for them.
+func resolveSecrets(ctx context.Context, rule Rule) (Rule, error) {
+	if len(rule.Secrets) == 0 {
+		return rule, nil
+	}
+	env := make(map[string]string, len(rule.Env)+len(rule.Secrets))
+	for k, v := range rule.Env {
+		env[k] = v
+	}
+	for name, ref := range rule.Secrets {
+		argv, err := secretCommand(ref)
+		if err != nil {
+			return rule, err
+		}
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return rule, fmt.Errorf("secret %s: %s: %w", name, argv[0], err)
+		}
+		value := string(out)
+		// pass keeps metadata on the lines after the secret, other secrets
+		// may span lines
+		if strings.HasPrefix(ref, "pass:") {
+			value, _, _ = strings.Cut(value, "\n")
+		}
+		value = strings.TrimSuffix(value, "\n")
+		env[name] = strings.TrimSuffix(value, "\r")
+	}
+	rule.Env = env
+	return rule, nil
+}
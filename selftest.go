@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The commands apporte runs are built by expansion, so what an input or a
+// group holds must reach them as it is: never taken for a placeholder, a
+// group of its own or a quote. apporte test --self checks it with random
+// inputs on the machine apporte runs on, and the tests fuzz the same checks.
+
+// selfChecks are the properties of expansion and quoting, each given two
+// strings to use as inputs or groups.
+var selfChecks = []struct {
+	name  string
+	check func(a, b string) error
+}{
+	{"quoting", checkQuoting},
+	{"expansion", checkExpand},
+	{"command expansion", checkExpandCommand},
+	{"group indexes", checkGroupIndexes},
+	{"rule copies", checkExpandRuleCopies},
+}
+
+// checkQuoting makes sure quoting an argv for a shell and splitting it again
+// gives it back.
+func checkQuoting(a, b string) error {
+	argv := []string{a, b}
+	got, err := shellSplit(shellJoin(argv))
+	if err != nil || !slices.Equal(got, argv) {
+		return fmt.Errorf("shellSplit(shellJoin(%q)) = %q, %v", argv, got, err)
+	}
+	return nil
+}
+
+// checkExpand makes sure groups land where their placeholders are, however
+// they look themselves.
+func checkExpand(g1, g2 string) error {
+	values := map[string]string{"0": g1 + g2, "1": g1, "2": g2, "input": g1}
+	for template, want := range map[string]string{
+		"$1":          g1,
+		"{2}":         g2,
+		"$1-{2}":      g1 + "-" + g2,
+		"{input}=$0":  g1 + "=" + g1 + g2,
+		"$2$1":        g2 + g1,
+		"{unknown}$1": "{unknown}" + g1,
+	} {
+		if got := expand(template, values); got != want {
+			return fmt.Errorf("expand(%q) with groups %q, %q = %q, want %q", template, g1, g2, got, want)
+		}
+	}
+	return nil
+}
+
+// checkExpandCommand makes sure the inputs spliced in for {files} and
+// {each.N} are never expanded again.
+func checkExpandCommand(input, file string) error {
+	values := map[string]string{"0": input, "input": input}
+	each := [][]string{{input, input}, {file}}
+	got := expandCommand([]string{"open", "$0", "{files}", "<{each.1}>", "{input}"}, values, []string{file, input}, each)
+	want := []string{"open", input, file, input, "<" + input + ">", "<>", input}
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("expandCommand with input %q and file %q = %q, want %q", input, file, got, want)
+	}
+	return nil
+}
+
+// checkGroupIndexes makes sure every group lands in its own place, however
+// many there are: $1 isn't read as the start of $10, nor $10 as $1 and 0.
+func checkGroupIndexes(a, b string) error {
+	rule := Rule{Match: &lazyRegexp{}, Input: a}
+	var templates, want []string
+	for i := 0; i <= 12; i++ {
+		rule.Groups = append(rule.Groups, a+strconv.Itoa(i)+b)
+		templates = append(templates, "$"+strconv.Itoa(i), "{"+strconv.Itoa(i)+"}")
+		want = append(want, rule.Groups[i], rule.Groups[i])
+	}
+	rule.Apporte = templates
+	if got := expandRule(rule).Apporte; !slices.Equal(got, want) {
+		return fmt.Errorf("expandRule(%q) with groups %q = %q, want %q", templates, rule.Groups, got, want)
+	}
+	return nil
+}
+
+// checkExpandRuleCopies makes sure expanding a rule leaves the rule, shared
+// by every input it matches, as it was.
+func checkExpandRuleCopies(input, value string) error {
+	rule := Rule{
+		Match:   &lazyRegexp{},
+		Apporte: []string{"open", "$0"},
+		Steps:   [][]string{{"prepare", "{input}"}},
+		Env:     map[string]string{"FILE": "{input}", "VALUE": value},
+		Input:   input,
+		Groups:  []string{input},
+	}
+	expandRule(rule)
+	if rule.Apporte[1] != "$0" || rule.Steps[0][1] != "{input}" || rule.Env["FILE"] != "{input}" {
+		return fmt.Errorf("expandRule with input %q changed the rule: %q %q %q", input, rule.Apporte, rule.Steps, rule.Env)
+	}
+	return nil
+}
+
+// selfTestPieces are what the random inputs are made of: the characters of
+// placeholders, groups and quotes, and text around them.
+var selfTestPieces = []string{
+	"$", "$$", "{", "}", "0", "1", "2", "9", "10", "input", "files", "each.", "prompt.",
+	"'", `"`, `\`, " ", "\t", "\n", "=", "-", "a", "é", "日本",
+}
+
+// randomInput strings a few pieces together.
+func randomInput(r *rand.Rand) string {
+	var b strings.Builder
+	for n := r.Intn(9); n > 0; n-- {
+		b.WriteString(selfTestPieces[r.Intn(len(selfTestPieces))])
+	}
+	return b.String()
+}
+
+type testFlags struct {
+	self bool
+	runs int
+	seed int64
+}
+
+func (f *testFlags) define(fs *flag.FlagSet) {
+	fs.BoolVar(&f.self, "self", false, "Check the expansion of commands and quoting with random inputs")
+	fs.IntVar(&f.runs, "runs", 1000, "Random inputs given to each check")
+	fs.Int64Var(&f.seed, "seed", 0, "Seed of the random inputs, 0 for a new one")
+}
+
+// testCommand runs the checks of expansion and quoting with random inputs,
+// reporting the first failure of each along with the seed to repeat it.
+func testCommand(ctx context.Context, args []string, opts options) int {
+	var given testFlags
+	flags := commandFlags("test", given.define)
+	flags.Parse(args)
+	if flags.NArg() != 0 || !given.self || given.runs < 1 {
+		flags.Usage()
+		return 2
+	}
+	if given.seed == 0 {
+		given.seed = time.Now().UnixNano()
+	}
+
+	fmt.Println(opts.Engine.trf("Seed %d, %d runs of each check", given.seed, given.runs))
+	failed := 0
+	for _, c := range selfChecks {
+		r := rand.New(rand.NewSource(given.seed))
+		var err error
+		for i := 0; i < given.runs && err == nil; i++ {
+			if ctx.Err() != nil {
+				return opts.Engine.interrupted("", ctx.Err())
+			}
+			err = c.check(randomInput(r), randomInput(r))
+		}
+		if err != nil {
+			failed++
+			fmt.Println("  " + opts.Engine.trf("FAIL  %s: %v", opts.Engine.tr(c.name), err))
+			continue
+		}
+		fmt.Println("  " + opts.Engine.trf("ok    %s", opts.Engine.tr(c.name)))
+	}
+	if failed > 0 {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("%d of %d checks failed", failed, len(selfChecks)))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// protocolVersion is the version of the --stdio-server protocol, sent with
+// every response. It changes when a response changes incompatibly.
+const protocolVersion = 1
+
+// serverRequest is a request to the stdio server, one JSON object per line.
+type serverRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params struct {
+		Input string `json:"input"`
+		Cwd   string `json:"cwd"` // directory to crawl configs from
+	} `json:"params"`
+}
+
+// serverResponse answers a request with a result or an error.
+type serverResponse struct {
+	Version int             `json:"version"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// serverRule describes a matching rule.
+type serverRule struct {
+	ID     string `json:"id"`
+	Label  string `json:"label"`
+	Icon   string `json:"icon,omitempty"`
+	Source string `json:"source"`
+	Line   int    `json:"line,omitempty"`
+	Rank   [3]int `json:"rank"`
+}
+
+// serverExplanation is what dispatching an input would do.
+type serverExplanation struct {
+	Rule       serverRule `json:"rule"`
+	Command    []string   `json:"command"`
+	Steps      [][]string `json:"steps,omitempty"`
+	Cwd        string     `json:"cwd,omitempty"`
+	Background bool       `json:"background"`
+	Terminal   bool       `json:"terminal"`
+}
+
+func newServerRule(rule Rule) serverRule {
+	return serverRule{
+		ID:     rule.id(),
+		Label:  rule.menuLabel(),
+		Icon:   rule.Icon,
+		Source: rule.Source,
+		Line:   rule.Line,
+		Rank:   [3]int{rule.Rank.Tier, rule.Rank.File, rule.Rank.Index},
+	}
+}
+
+// serveStdio answers requests read from in until it's closed, so that editor
+// plugins can keep one apporte running. Configs are crawled again for every
+// request. Anything else apporte or the commands print goes to stderr, stdout
+// only carries responses. The server stops when ctx is done, leaving the
+// request being read unanswered.
+func serveStdio(ctx context.Context, in io.Reader, opts options) int {
+	enc := json.NewEncoder(os.Stdout)
+	opts.Engine.stdout = os.Stderr
+	// commands run in the background, the server can't be replaced by one
+	opts.Detach = true
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	// requests are read in the background, reading can't be interrupted
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		for scanner.Scan() {
+			lines <- append([]byte(nil), scanner.Bytes()...)
+		}
+	}()
+	for {
+		var line []byte
+		select {
+		case <-ctx.Done():
+			return exitInterrupted
+		case l, ok := <-lines:
+			if !ok {
+				if err := scanner.Err(); err != nil {
+					fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read requests: %v", err))
+					return 1
+				}
+				return 0
+			}
+			line = l
+		}
+
+		var req serverRequest
+		resp := serverResponse{Version: protocolVersion}
+		if err := json.Unmarshal(line, &req); err != nil {
+			resp.Error = fmt.Sprintf("invalid request: %v", err)
+		} else {
+			resp.ID = req.ID
+			resp.Result, err = serveRequest(ctx, req, opts)
+			if err != nil {
+				resp.Error = err.Error()
+			}
+		}
+		if err := enc.Encode(resp); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write a response: %v", err))
+			return 1
+		}
+	}
+}
+
+// serveRequest runs a method of the protocol: match lists the rules matching
+// the input, best first, explain shows what dispatching it would run, and
+// dispatch runs it.
+func serveRequest(ctx context.Context, req serverRequest, opts options) (interface{}, error) {
+	switch req.Method {
+	case "match", "explain", "dispatch":
+	default:
+		return nil, fmt.Errorf("unknown method %q", req.Method)
+	}
+	if req.Params.Input == "" {
+		return nil, fmt.Errorf("missing input")
+	}
+
+	dir := req.Params.Cwd
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	conf, err := loadConfig(ctx, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	input := prepareInput(req.Params.Input, conf, opts)
+	matched, matchErr := matchRules(ctx, input, conf.Rules, opts)
+	if opts.Score || conf.Score {
+		sortByScore(matched)
+	}
+
+	switch req.Method {
+	case "match":
+		rules := []serverRule{}
+		for _, rule := range matched {
+			rules = append(rules, newServerRule(rule))
+		}
+		return rules, nil
+	case "explain":
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("no rules match %s", input)
+		}
+		// providers only run when dispatching
+		selected, err := opts.Engine.prepareDispatch(expandRule(conf.withHooks(ctx, matched[0], opts.Engine.facts)))
+		if err != nil {
+			return nil, err
+		}
+		return serverExplanation{
+			Rule:       newServerRule(matched[0]),
+			Command:    selected.Apporte,
+			Steps:      selected.Steps,
+			Cwd:        selected.Cwd,
+			Background: selected.Background,
+			Terminal:   selected.Terminal,
+		}, nil
+	}
+	status := dispatchResults(ctx, conf, []matchResult{{Input: input, Matched: matched, Err: matchErr}}, opts, true)
+	return map[string]int{"status": status}, nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// macBundleID is the identifier of the apporte app bundle, which macOS needs
+// to register a URL handler.
+const macBundleID = "org.apporte.Apporte"
+
+// setupFlags are the flags of setup.
+type setupFlags struct {
+	schemes    string
+	extensions string
+	utis       string
+	uninstall  bool
+}
+
+func (f *setupFlags) define(fs *flag.FlagSet) {
+	fs.StringVar(&f.schemes, "schemes", "http,https", "Comma-separated URL schemes to handle")
+	fs.StringVar(&f.extensions, "extensions", "", "Comma-separated file extensions to handle, Windows only")
+	fs.StringVar(&f.utis, "utis", "", "Comma-separated uniform type identifiers to handle, macOS only")
+	fs.BoolVar(&f.uninstall, "uninstall", false, "Remove the registration, Windows and macOS only")
+}
+
+// setupCommand integrates apporte with the system: as the URL handler on any
+// system, or for files and URLs of the user's choosing on Windows and macOS.
+// Without arguments, it runs the setup wizard.
+func setupCommand(ctx context.Context, args []string, opts options) int {
+	var given setupFlags
+	flags := commandFlags("setup", given.define)
+	flags.Parse(args)
+	if flags.NArg() == 0 && flags.NFlag() == 0 {
+		return setupWizard(ctx, opts)
+	}
+
+	target := flags.Arg(0)
+	if flags.NArg() != 1 || target != "url" && target != "windows" && target != "darwin" {
+		flags.Usage()
+		return 2
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to locate apporte: %v", err))
+		return 1
+	}
+	if target == "windows" || target == "darwin" {
+		if runtime.GOOS != target {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("setup %s only works on %s", target, map[string]string{"windows": "Windows", "darwin": "macOS"}[target]))
+			return 1
+		}
+		// only the schemes asked for, there are no defaults here
+		chosen := ""
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name == "schemes" {
+				chosen = given.schemes
+			}
+		})
+		switch {
+		case target == "windows" && given.uninstall:
+			err = opts.Engine.unregisterWindows()
+		case target == "windows":
+			err = opts.Engine.registerWindows(exe, windowsExtensions(given.extensions), splitList(chosen))
+		case given.uninstall:
+			err = opts.Engine.removeDarwinBundle()
+		default:
+			err = opts.Engine.installDarwinBundle(exe, splitList(given.utis), splitList(chosen))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to set up %s: %v", target, err))
+			return 1
+		}
+		return 0
+	}
+	if given.uninstall || given.extensions != "" || given.utis != "" {
+		flags.Usage()
+		return 2
+	}
+	if err := opts.Engine.registerURLHandler(exe, splitList(given.schemes)); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to register the URL handler: %v", err))
+		return 1
+	}
+	if os.Getenv("BROWSER") == "" {
+		fmt.Fprintln(os.Stderr, opts.Engine.tr("Warning: $BROWSER is unset, links no rule matches will fail to open"))
+	}
+	return 0
+}
+
+// registerURLHandler makes exe the handler of the URL schemes, running it
+// with --url.
+func (e *engine) registerURLHandler(exe string, schemes []string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return e.registerWindowsURLHandler(exe, schemes)
+	case "darwin":
+		return e.registerDarwinURLHandler(schemes)
+	default:
+		return e.registerXDGURLHandler(exe, schemes)
+	}
+}
+
+// registerXDGURLHandler writes a desktop entry for the schemes and makes it
+// their default application.
+func (e *engine) registerXDGURLHandler(exe string, schemes []string) error {
+	dir, err := applicationsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	var mimeTypes []string
+	for _, scheme := range schemes {
+		mimeTypes = append(mimeTypes, "x-scheme-handler/"+scheme)
+	}
+	entry := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=Apporte
+Comment=Open links according to apporte rules
+Exec=%s --url %%u
+NoDisplay=true
+MimeType=%s;
+`, desktopQuote(exe), strings.Join(mimeTypes, ";"))
+
+	path := filepath.Join(dir, "apporte.desktop")
+	if err := os.WriteFile(path, []byte(entry), 0o644); err != nil {
+		return err
+	}
+	fmt.Println(e.trf("Wrote %s", path))
+
+	args := append([]string{"default", "apporte.desktop"}, mimeTypes...)
+	if out, err := exec.Command("xdg-mime", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("xdg-mime: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	fmt.Println(e.trf("apporte handles %s", strings.Join(schemes, ", ")))
+	return nil
+}
+
+// applicationsDir returns the directory of the user's desktop entries.
+func applicationsDir() (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "applications"), nil
+}
+
+// desktopQuote quotes an argument of the Exec key of a desktop entry.
+func desktopQuote(arg string) string {
+	if !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`") {
+		return arg
+	}
+	r := strings.NewReplacer(`"`, `\"`, "`", "\\`", "$", `\$`, `\`, `\\`)
+	return `"` + r.Replace(arg) + `"`
+}
+
+// Registry keys of apporte for the current user.
+const (
+	windowsURLClass  = `HKCU\Software\Classes\ApporteURL`
+	windowsFileClass = `HKCU\Software\Classes\Apporte.File`
+	windowsCaps      = `HKCU\Software\Apporte\Capabilities`
+	windowsApps      = `HKCU\Software\RegisteredApplications`
+)
+
+// registerWindowsURLHandler registers apporte as a URL handler for the user.
+// Windows doesn't let programs pick the default, so the settings are opened
+// for the user to choose apporte.
+func (e *engine) registerWindowsURLHandler(exe string, schemes []string) error {
+	if err := regAdd(append(windowsAppEntries(), windowsURLEntries(exe, schemes)...)); err != nil {
+		return err
+	}
+	fmt.Println(e.tr("Registered apporte, choose it as the browser in the settings that opened"))
+	return exec.Command("rundll32", "url.dll,FileProtocolHandler", "ms-settings:defaultapps").Run()
+}
+
+// registerWindows registers apporte for the user as an application opening
+// files with the extensions and URLs with the schemes, listed under "Open
+// with". Types no other application claims are opened with apporte on a
+// double-click, for the others apporte has to be chosen once.
+func (e *engine) registerWindows(exe string, extensions, schemes []string) error {
+	if len(extensions) == 0 && len(schemes) == 0 {
+		return fmt.Errorf("nothing to register, see --extensions and --schemes")
+	}
+	entries := windowsAppEntries()
+	if len(extensions) > 0 {
+		entries = append(entries,
+			[]string{windowsFileClass, "/ve", "/d", "Apporte file"},
+			[]string{windowsFileClass + `\shell\open\command`, "/ve", "/d", fmt.Sprintf(`"%s" -- "%%1"`, exe)},
+		)
+	}
+	for _, ext := range extensions {
+		entries = append(entries,
+			[]string{`HKCU\Software\Classes\` + ext + `\OpenWithProgids`, "/v", "Apporte.File", "/d", ""},
+			[]string{windowsCaps + `\FileAssociations`, "/v", ext, "/d", "Apporte.File"},
+		)
+	}
+	if len(schemes) > 0 {
+		entries = append(entries, windowsURLEntries(exe, schemes)...)
+	}
+	if err := regAdd(entries); err != nil {
+		return err
+	}
+	fmt.Println(e.trf("apporte handles %s", strings.Join(append(extensions, schemes...), ", ")))
+	fmt.Println(e.tr("Choose it in the settings that opened for types other applications claim"))
+	return exec.Command("rundll32", "url.dll,FileProtocolHandler", "ms-settings:defaultapps").Run()
+}
+
+// unregisterWindows removes what registerWindows and registerWindowsURLHandler
+// added. Keys already gone are skipped.
+func (e *engine) unregisterWindows() error {
+	out, _ := exec.Command("reg", "query", windowsCaps+`\FileAssociations`).Output()
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == "REG_SZ" && strings.HasPrefix(fields[0], ".") {
+			regDelete(`HKCU\Software\Classes\`+fields[0]+`\OpenWithProgids`, "/v", "Apporte.File")
+		}
+	}
+	regDelete(windowsApps, "/v", "Apporte")
+	for _, key := range []string{windowsFileClass, windowsURLClass, `HKCU\Software\Apporte`} {
+		regDelete(key)
+	}
+	fmt.Println(e.tr("Unregistered apporte"))
+	return nil
+}
+
+// windowsAppEntries describe apporte as an application.
+func windowsAppEntries() [][]string {
+	return [][]string{
+		{windowsCaps, "/v", "ApplicationName", "/d", "Apporte"},
+		{windowsCaps, "/v", "ApplicationDescription", "/d", "Open files and links according to apporte rules"},
+		{windowsApps, "/v", "Apporte", "/d", `Software\Apporte\Capabilities`},
+	}
+}
+
+// windowsURLEntries make apporte a handler of the URL schemes.
+func windowsURLEntries(exe string, schemes []string) [][]string {
+	entries := [][]string{
+		{windowsURLClass, "/ve", "/d", "Apporte URL"},
+		{windowsURLClass, "/v", "URL Protocol", "/d", ""},
+		{windowsURLClass + `\shell\open\command`, "/ve", "/d", fmt.Sprintf(`"%s" --url "%%1"`, exe)},
+	}
+	for _, scheme := range schemes {
+		entries = append(entries, []string{windowsCaps + `\URLAssociations`, "/v", scheme, "/d", "ApporteURL"})
+	}
+	return entries
+}
+
+// windowsExtensions parses a comma-separated list of extensions, with or
+// without their dot.
+func windowsExtensions(list string) []string {
+	var extensions []string
+	for _, ext := range splitList(list) {
+		extensions = append(extensions, "."+strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	return extensions
+}
+
+// regAdd writes registry values, each entry being the arguments of reg add.
+func regAdd(entries [][]string) error {
+	for _, entry := range entries {
+		args := append([]string{"add"}, entry...)
+		args = append(args, "/f")
+		if out, err := exec.Command("reg", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("reg add %s: %w: %s", entry[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// regDelete removes a registry key, or a value with /v NAME. Missing ones
+// are no error.
+func regDelete(args ...string) {
+	exec.Command("reg", append(append([]string{"delete"}, args...), "/f")...).Run()
+}
+
+// registerDarwinURLHandler makes the apporte app bundle the default handler
+// through Launch Services. The bundle has to be installed and declare the
+// schemes in its Info.plist, see installDarwinBundle.
+func (e *engine) registerDarwinURLHandler(schemes []string) error {
+	return e.setDarwinDefaults(nil, schemes)
+}
+
+// setDarwinDefaults makes the apporte app bundle the default application for
+// the content types and URL schemes.
+func (e *engine) setDarwinDefaults(utis, schemes []string) error {
+	script := "ObjC.import('CoreServices');"
+	for _, uti := range utis {
+		// kLSRolesAll
+		script += fmt.Sprintf("$.LSSetDefaultRoleHandlerForContentType($(%q), 0xFFFFFFFF, $(%q));", uti, macBundleID)
+	}
+	for _, scheme := range schemes {
+		script += fmt.Sprintf("$.LSSetDefaultHandlerForURLScheme($(%q), $(%q));", scheme, macBundleID)
+	}
+	if out, err := exec.Command("osascript", "-l", "JavaScript", "-e", script).CombinedOutput(); err != nil {
+		return fmt.Errorf("osascript: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	fmt.Println(e.trf("%s handles %s", macBundleID, strings.Join(append(utis, schemes...), ", ")))
+	return nil
+}
+
+// lsregister is the Launch Services tool registering app bundles.
+const lsregister = "/System/Library/Frameworks/CoreServices.framework/Frameworks/LaunchServices.framework/Support/lsregister"
+
+// darwinBundlePath returns where the apporte app bundle is installed.
+func darwinBundlePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Applications", "Apporte.app"), nil
+}
+
+// installDarwinBundle generates a minimal app bundle running exe, declaring
+// the content types and URL schemes, and makes it their default application.
+// macOS hands files and links to applications with Apple Events, which only
+// bundles receive: the bundle is an AppleScript applet passing them on to
+// apporte as arguments.
+func (e *engine) installDarwinBundle(exe string, utis, schemes []string) error {
+	if len(utis) == 0 && len(schemes) == 0 {
+		return fmt.Errorf("nothing to register, see --utis and --schemes")
+	}
+	bundle, err := darwinBundlePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(bundle), 0o755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(bundle); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf(`on open theItems
+	repeat with anItem in theItems
+		do shell script quoted form of %[1]s & " -- " & quoted form of POSIX path of anItem & " >/dev/null 2>&1 &"
+	end repeat
+end open
+
+on open location theURL
+	do shell script quoted form of %[1]s & " --url " & quoted form of theURL & " >/dev/null 2>&1 &"
+end open location
+`, appleScriptString(exe))
+
+	documents, _ := json.Marshal([]map[string]interface{}{{
+		"CFBundleTypeName":   "Apporte Document",
+		"CFBundleTypeRole":   "Viewer",
+		"LSHandlerRank":      "Alternate",
+		"LSItemContentTypes": utis,
+	}})
+	urls, _ := json.Marshal([]map[string]interface{}{{
+		"CFBundleURLName":    "Apporte URL",
+		"CFBundleURLSchemes": schemes,
+	}})
+	plist := filepath.Join(bundle, "Contents", "Info.plist")
+	commands := [][]string{
+		{"osacompile", "-o", bundle, "-e", script},
+		{"plutil", "-replace", "CFBundleIdentifier", "-string", macBundleID, plist},
+		{"plutil", "-replace", "CFBundleName", "-string", "Apporte", plist},
+	}
+	if len(utis) > 0 {
+		commands = append(commands, []string{"plutil", "-replace", "CFBundleDocumentTypes", "-json", string(documents), plist})
+	}
+	if len(schemes) > 0 {
+		commands = append(commands, []string{"plutil", "-replace", "CFBundleURLTypes", "-json", string(urls), plist})
+	}
+	commands = append(commands,
+		// editing Info.plist breaks the signature of the applet
+		[]string{"codesign", "--force", "--sign", "-", bundle},
+		[]string{lsregister, "-f", bundle},
+	)
+	for _, argv := range commands {
+		if out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", filepath.Base(argv[0]), err, strings.TrimSpace(string(out)))
+		}
+	}
+	fmt.Println(e.trf("Installed %s", bundle))
+	return e.setDarwinDefaults(utis, schemes)
+}
+
+// removeDarwinBundle unregisters and deletes the apporte app bundle. Launch
+// Services picks other defaults for what it handled.
+func (e *engine) removeDarwinBundle() error {
+	bundle, err := darwinBundlePath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(bundle); err != nil {
+		return err
+	}
+	exec.Command(lsregister, "-u", bundle).Run()
+	if err := os.RemoveAll(bundle); err != nil {
+		return err
+	}
+	fmt.Println(e.trf("Removed %s", bundle))
+	return nil
+}
+
+// appleScriptString quotes s as an AppleScript string literal.
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// browserRule opens a link no rule matches in $BROWSER. As the URL handler,
+// apporte can't fall back to the system association, which is itself.
+func browserRule(input string) (Rule, bool) {
+	browsers := filepath.SplitList(os.Getenv("BROWSER"))
+	if len(browsers) == 0 || browsers[0] == "" {
+		return Rule{}, false
+	}
+
+	argv := strings.Fields(browsers[0])
+	placed := false
+	for i, arg := range argv {
+		if strings.Contains(arg, "%s") {
+			argv[i] = strings.ReplaceAll(arg, "%s", "{input}")
+			placed = true
+		}
+	}
+	if !placed {
+		argv = append(argv, "{input}")
+	}
+	return Rule{
+		Match:   &lazyRegexp{},
+		Desc:    "Browser from $BROWSER",
+		Apporte: argv,
+		Source:  "($BROWSER)",
+		Rank:    rank{Tier: tierBuiltin},
+		Input:   input,
+		Groups:  []string{input},
+	}, true
+}
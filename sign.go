@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// signers are the keys configs may be signed with. They are only taken from
+// the user config, as a config can't vouch for itself.
+type signers struct {
+	minisign       []string // public keys
+	allowedSigners string   // ssh-keygen allowed signers file
+}
+
+// userConfigPath returns the path of the user config, if there is one.
+func userConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, ".apporte.toml")
+}
+
+// configSigners returns the keys trusted to sign configs of the user
+// config at path.
+func configSigners(path string, tc TomlConfig) signers {
+	allowed := tc.AllowedSigners
+	if rest, ok := strings.CutPrefix(allowed, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			allowed = filepath.Join(home, rest)
+		}
+	}
+	if allowed != "" && !filepath.IsAbs(allowed) {
+		allowed = filepath.Join(filepath.Dir(path), allowed)
+	}
+	return signers{minisign: tc.MinisignKeys, allowedSigners: allowed}
+}
+
+// verifySignature checks the signature next to a config, PATH.minisig for
+// minisign or PATH.sig for ssh-keygen, against data as read from path, and
+// reports whether there is one. A signature that doesn't verify is an error,
+// whatever the mode.
+func verifySignature(ctx context.Context, path string, data []byte, s signers) (bool, error) {
+	if _, err := os.Stat(path + ".minisig"); err == nil {
+		if len(s.minisign) == 0 {
+			return true, fmt.Errorf("config is signed, but the user config sets no minisign_keys")
+		}
+		// minisign only verifies files, a private copy can't change under it
+		dir, err := os.MkdirTemp("", "apporte-verify-")
+		if err != nil {
+			return true, err
+		}
+		defer os.RemoveAll(dir)
+		copied := filepath.Join(dir, filepath.Base(path))
+		if err := os.WriteFile(copied, data, 0o600); err != nil {
+			return true, err
+		}
+		for _, key := range s.minisign {
+			cmd := exec.CommandContext(ctx, "minisign", "-V", "-q", "-P", key, "-m", copied, "-x", path+".minisig")
+			if cmd.Run() == nil {
+				return true, nil
+			}
+		}
+		return true, fmt.Errorf("signature %s.minisig doesn't verify with any of the minisign_keys", path)
+	}
+
+	if _, err := os.Stat(path + ".sig"); err == nil {
+		if s.allowedSigners == "" {
+			return true, fmt.Errorf("config is signed, but the user config sets no allowed_signers")
+		}
+		out, err := exec.CommandContext(ctx, "ssh-keygen", "-Y", "find-principals", "-f", s.allowedSigners, "-s", path+".sig").Output()
+		if err != nil {
+			return true, fmt.Errorf("signature %s.sig isn't from any of the allowed_signers", path)
+		}
+		principal, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		cmd := exec.CommandContext(ctx, "ssh-keygen", "-Y", "verify", "-f", s.allowedSigners, "-I", principal, "-n", "apporte", "-s", path+".sig")
+		cmd.Stdin = bytes.NewReader(data)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return true, fmt.Errorf("signature %s.sig doesn't verify: %s", path, strings.TrimSpace(string(out)))
+		}
+		return true, nil
+	}
+	return false, nil
+}
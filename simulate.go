@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// simulation is the coverage of a corpus by the rules.
+type simulation struct {
+	Inputs    int             `json:"inputs"`
+	Matched   int             `json:"matched"`
+	Rules     []simulatedRule `json:"rules"`
+	Unmatched []string        `json:"unmatched"` // a sample, spread over the corpus
+}
+
+// simulatedRule is how many inputs of a corpus a rule wins.
+type simulatedRule struct {
+	Rule     string `json:"rule"` // name or menu ID
+	Location string `json:"location"`
+	Hits     int    `json:"hits"`
+}
+
+// simulateFlags are the flags of simulate.
+type simulateFlags struct {
+	corpus string
+	sample int
+	asJSON bool
+}
+
+func (f *simulateFlags) define(fs *flag.FlagSet) {
+	fs.StringVar(&f.corpus, "corpus", "", "File with one input per line, - for stdin")
+	fs.IntVar(&f.sample, "sample", 10, "Unmatched inputs to show")
+	fs.BoolVar(&f.asJSON, "json", false, "Print the report as JSON")
+}
+
+// simulateCommand matches every line of a corpus against the rules without
+// dispatching anything, and reports how much of it the rules cover.
+func simulateCommand(ctx context.Context, args []string, opts options) int {
+	var given simulateFlags
+	flags := commandFlags("simulate", given.define)
+	flags.Parse(args)
+	if flags.NArg() != 0 || given.corpus == "" || given.sample < 0 {
+		flags.Usage()
+		return 2
+	}
+
+	r := io.Reader(os.Stdin)
+	if given.corpus != "-" {
+		f, err := os.Open(given.corpus)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read the corpus: %v", err))
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	cwd, _ := os.Getwd()
+	conf, err := loadConfig(ctx, cwd, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Errors while loading rules:\n%s", err))
+		return 1
+	}
+
+	var inputs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		input := scanner.Text()
+		if input == "" {
+			continue
+		}
+		inputs = append(inputs, prepareInput(input, conf, opts))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to read the corpus: %v", err))
+		return 1
+	}
+
+	results := matchInputs(ctx, inputs, conf.Rules, opts)
+	if err := ctx.Err(); err != nil {
+		return opts.Engine.interrupted("", err)
+	}
+	printWarnings(os.Stderr, "Warnings while matching rules", matchWarnings(results), opts)
+	report := simulate(conf, results, given.sample, opts)
+
+	if given.asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return 0
+	}
+	percent := 0.0
+	if report.Inputs > 0 {
+		percent = 100 * float64(report.Matched) / float64(report.Inputs)
+	}
+	fmt.Println(opts.Engine.trf("%d inputs, %d matched (%.1f%%), %d unmatched", report.Inputs, report.Matched, percent, report.Inputs-report.Matched))
+	if len(report.Rules) > 0 {
+		fmt.Println("\n" + opts.Engine.tr("Hits by rule:"))
+		for _, rule := range report.Rules {
+			fmt.Printf("  %8d  %s (%s)\n", rule.Hits, rule.Location, rule.Rule)
+		}
+	}
+	if len(report.Unmatched) > 0 {
+		fmt.Println("\n" + opts.Engine.trf("Unmatched, %d of %d:", len(report.Unmatched), report.Inputs-report.Matched))
+		for _, input := range report.Unmatched {
+			fmt.Printf("  %s\n", input)
+		}
+	}
+	return 0
+}
+
+// simulate counts the inputs each rule wins, rules winning none included,
+// and samples the inputs no rule matches evenly over the corpus.
+func simulate(conf Config, results []matchResult, sample int, opts options) simulation {
+	hits := map[string]int{}
+	var unmatched []string
+	report := simulation{Inputs: len(results), Rules: []simulatedRule{}, Unmatched: []string{}}
+	for _, result := range results {
+		if len(result.Matched) == 0 {
+			unmatched = append(unmatched, result.Input)
+			continue
+		}
+		if opts.Score || conf.Score {
+			sortByScore(result.Matched)
+		}
+		winner := result.Matched[0]
+		hits[winner.Source+"\x00"+winner.Label]++
+		report.Matched++
+	}
+
+	for _, rule := range conf.Rules {
+		report.Rules = append(report.Rules, simulatedRule{
+			Rule:     rule.id(),
+			Location: rule.location(),
+			Hits:     hits[rule.Source+"\x00"+rule.Label],
+		})
+	}
+	// rules are in rank order, which breaks ties
+	sort.SliceStable(report.Rules, func(i, j int) bool { return report.Rules[i].Hits > report.Rules[j].Hits })
+
+	if len(unmatched) <= sample {
+		report.Unmatched = append(report.Unmatched, unmatched...)
+	} else {
+		for i := 0; i < sample; i++ {
+			report.Unmatched = append(report.Unmatched, unmatched[i*len(unmatched)/sample])
+		}
+	}
+	return report
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// snapshotVersion is the version of the snapshots written. Snapshots of a
+// newer version are refused rather than misread.
+const snapshotVersion = 1
+
+// snapshotConfig is a snapshot as read back: the merged rules of a crawl in
+// rank order, along with the tables of the configs they need.
+type snapshotConfig struct {
+	Snapshot  int                 `toml:"snapshot"`
+	Score     bool                `toml:"score"`
+	Pre       [][]string          `toml:"pre"`
+	Post      [][]string          `toml:"post"`
+	Container []string            `toml:"container"`
+	Normalize []string            `toml:"normalize"`
+	Sandboxes map[string][]string `toml:"sandboxes"`
+	Labelers  map[string][]string `toml:"security_labels"`
+	Providers map[string][]string `toml:"providers"`
+	PathMap   map[string]string   `toml:"pathmap"`
+	Rules     []snapshotRule      `toml:"rule"`
+}
+
+// snapshotRule is a rule of a snapshot, with macros, defaults, flags and
+// anchors already applied to it, and where it came from.
+type snapshotRule struct {
+	Source  string   `toml:"source"`
+	Line    int      `toml:"line"`
+	Profile string   `toml:"profile"`
+	Index   int      `toml:"index"`
+	Rank    []int    `toml:"rank"` // tier, file and rule
+	Unicode string   `toml:"unicode"`
+	Allowed []string `toml:"allow_commands"`
+	TomlRule
+}
+
+// snapshotFlags are the flags of snapshot.
+type snapshotFlags struct {
+	output string
+}
+
+func (f *snapshotFlags) define(fs *flag.FlagSet) {
+	fs.StringVar(&f.output, "output", "", "File to write the snapshot to")
+	fs.StringVar(&f.output, "o", "", "File to write the snapshot to")
+}
+
+// snapshotCommand writes the rules applying to a directory, merged and in
+// rank order, to a file that --from-snapshot dispatches against.
+func snapshotCommand(ctx context.Context, args []string, opts options) int {
+	var given snapshotFlags
+	flags := commandFlags("snapshot", given.define)
+	flags.Parse(args)
+
+	dir := "."
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		dir = flags.Arg(0)
+	default:
+		flags.Usage()
+		return 2
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Invalid directory: %v", err))
+		return 1
+	}
+
+	startDir, err := crawlStart(dir, opts.Physical)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: %v", err))
+	}
+	conf, err := opts.Engine.crawlConfigTree(ctx, startDir, []string{opts.Config}, opts.Limits)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// a snapshot of configs that are half skipped would not reproduce much,
+	// so errors fail it whatever --warn-level hides
+	printWarnings(os.Stderr, "Warnings while loading rules", conf.Warnings, opts)
+	errs := slices.DeleteFunc(slices.Clone(conf.Warnings), func(w warning) bool { return w.Level != levelError })
+	if len(errs) > 0 {
+		if len(shownWarnings(errs, opts.WarnLevel)) == 0 {
+			printWarnings(os.Stderr, "Errors while loading rules", errs, options{WarnFormat: opts.WarnFormat, WarnLevel: "error", Engine: opts.Engine})
+		}
+		fmt.Fprintln(os.Stderr, opts.Engine.tr("No snapshot written, as configs failed to load"))
+		return 1
+	}
+	if (opts.Strict || conf.Strict) && len(shownWarnings(conf.Warnings, opts.WarnLevel)) > 0 {
+		return 1
+	}
+
+	data, err := formatSnapshot(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write the snapshot: %v", err))
+		return 1
+	}
+	if given.output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(given.output, data, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write %s: %v", given.output, err))
+		return 1
+	}
+	fmt.Println(opts.Engine.trf("Wrote %d rules to %s", len(conf.Rules), given.output))
+	return 0
+}
+
+// formatSnapshot writes a snapshot of conf. The same configs always give the
+// same bytes: keys are in a fixed order and nothing depends on the time.
+func formatSnapshot(conf Config) ([]byte, error) {
+	var out strings.Builder
+	out.WriteString("# Written by apporte snapshot, dispatch against it with --from-snapshot.\n")
+	fmt.Fprintf(&out, "snapshot = %d\n", snapshotVersion)
+	if conf.Score {
+		out.WriteString("score = true\n")
+	}
+	top := map[string]interface{}{
+		"pre":       conf.Pre,
+		"post":      conf.Post,
+		"container": conf.Container,
+		"normalize": conf.Normalize,
+	}
+	for _, key := range []string{"pre", "post", "container", "normalize"} {
+		if err := writeSnapshotKey(&out, key, top[key]); err != nil {
+			return nil, err
+		}
+	}
+	for _, table := range []struct {
+		name   string
+		values interface{}
+	}{{"sandboxes", conf.Sandboxes}, {"security_labels", conf.Labelers}, {"providers", conf.Providers}, {"pathmap", conf.PathMap}} {
+		v := reflect.ValueOf(table.values)
+		if v.Len() == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "\n[%s]\n", table.name)
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		for _, key := range keys {
+			if err := writeSnapshotKey(&out, formatKey(key.String()), v.MapIndex(key).Interface()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ruleKeys := tomlKeys(TomlRule{})
+	for _, rule := range conf.Rules {
+		r := rule.Toml
+		// the pattern is written as it is matched
+		r.Match, r.RegexFlags, r.Exact = rule.Match.String(), nil, nil
+		r.Enabled, r.Override = nil, false
+		prompts := r.Prompt
+		r.Prompt = nil
+		values, err := snapshotValues(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.location(), err)
+		}
+		if len(prompts) > 0 {
+			table := map[string]interface{}{}
+			for name, p := range prompts {
+				table[name] = p.Text
+				if p.Default != "" {
+					table[name] = map[string]interface{}{"text": p.Text, "default": p.Default}
+				}
+			}
+			values["prompt"] = table
+		}
+
+		out.WriteString("\n[[rule]]\n")
+		fmt.Fprintf(&out, "source = %s\n", formatString(rule.Source))
+		if rule.Line > 0 {
+			fmt.Fprintf(&out, "line = %d\n", rule.Line)
+		}
+		if rule.Profile != "" {
+			fmt.Fprintf(&out, "profile = %s\n", formatString(rule.Profile))
+		}
+		fmt.Fprintf(&out, "index = %d\n", rule.Index)
+		fmt.Fprintf(&out, "rank = [%d, %d, %d]\n", rule.Rank.Tier, rule.Rank.File, rule.Rank.Index)
+		if rule.Unicode != "" {
+			fmt.Fprintf(&out, "unicode = %s\n", formatString(rule.Unicode))
+		}
+		if rule.Allowed != nil {
+			if err := writeSnapshotKey(&out, "allow_commands", rule.Allowed); err != nil {
+				return nil, fmt.Errorf("%s: %w", rule.location(), err)
+			}
+		}
+		for _, key := range ruleKeys {
+			if err := writeSnapshotKey(&out, key, values[key]); err != nil {
+				return nil, fmt.Errorf("%s: %w", rule.location(), err)
+			}
+		}
+	}
+	return []byte(out.String()), nil
+}
+
+// snapshotValues returns the keys of a rule that are set, with the values
+// TOML decodes them to.
+func snapshotValues(r TomlRule) (map[string]interface{}, error) {
+	data, err := toml.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if _, err := toml.Decode(string(data), &values); err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		if v := reflect.ValueOf(value); v.IsZero() || (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0 {
+			delete(values, key)
+		}
+	}
+	return values, nil
+}
+
+// writeSnapshotKey writes a key of a snapshot unless its value is empty.
+func writeSnapshotKey(out *strings.Builder, key string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0 {
+		return nil
+	}
+	// decoded values are what formatAny knows
+	var doc map[string]interface{}
+	data, err := toml.Marshal(map[string]interface{}{"v": value})
+	if err != nil {
+		return err
+	}
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return err
+	}
+	formatted, ok := formatAny(doc["v"], false, 0)
+	if !ok {
+		return fmt.Errorf("cannot write %s", key)
+	}
+	fmt.Fprintf(out, "%s = %s\n", key, formatted)
+	return nil
+}
+
+// loadSnapshot reads the rules of a snapshot in place of the configs. Rules
+// keep the source, line and rank they had when the snapshot was taken.
+func (e *engine) loadSnapshot(path string, limits crawlLimits) (Config, error) {
+	conf := Config{Sandboxes: map[string][]string{}, Labelers: map[string][]string{}, Providers: map[string][]string{}, PathMap: map[string]string{}, Overrides: map[string]bool{}}
+	info, err := os.Stat(path)
+	if err != nil {
+		return conf, err
+	}
+	if info.Size() > limits.ConfigSize {
+		return conf, fmt.Errorf("snapshot %s is larger than %d bytes, see --max-config-size", path, limits.ConfigSize)
+	}
+	var sc snapshotConfig
+	if _, err := toml.DecodeFile(path, &sc); err != nil {
+		return conf, fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+	}
+	switch {
+	case sc.Snapshot == 0:
+		return conf, fmt.Errorf("%s isn't a snapshot", path)
+	case sc.Snapshot > snapshotVersion:
+		return conf, fmt.Errorf("snapshot %s is of version %d, this apporte reads up to %d", path, sc.Snapshot, snapshotVersion)
+	case len(sc.Rules) > limits.Rules:
+		return conf, fmt.Errorf("more than %d rules in snapshot %s, see --max-rules", limits.Rules, path)
+	}
+
+	conf.Score = sc.Score
+	conf.Pre, conf.Post = sc.Pre, sc.Post
+	conf.Container = sc.Container
+	if err := checkNormalizers(sc.Normalize); err != nil {
+		return conf, err
+	}
+	conf.Normalize = sc.Normalize
+	for name, argv := range sc.Sandboxes {
+		conf.Sandboxes[name] = argv
+	}
+	for kind, argv := range sc.Labelers {
+		conf.Labelers[kind] = argv
+	}
+	if err := checkProviders(sc.Providers); err != nil {
+		return conf, err
+	}
+	for name, argv := range sc.Providers {
+		conf.Providers[name] = argv
+	}
+	for prefix, target := range sc.PathMap {
+		conf.PathMap[prefix] = target
+	}
+	cache := newRegexCache(limits.RegexTimeout)
+	for i, r := range sc.Rules {
+		// app bundles only exist on macOS, elsewhere the rule doesn't apply
+		if r.Bundle != "" && runtime.GOOS != "darwin" {
+			continue
+		}
+		if _, ok := unicodeForms[r.Unicode]; !ok || len(r.Rank) != 3 {
+			return conf, fmt.Errorf("invalid rule %d in snapshot %s", i, path)
+		}
+		rule, err := e.convertRule(r.TomlRule, TomlConfig{Unicode: r.Unicode, AllowCommands: r.Allowed}, cache)
+		if err != nil {
+			return conf, fmt.Errorf("invalid rule %d in snapshot %s: %w", i, path, err)
+		}
+		rule.Source = r.Source
+		rule.Line = r.Line
+		rule.Profile = r.Profile
+		rule.Index = r.Index
+		rule.Label = ruleLabel(r.Profile, r.Index)
+		rule.Rank = rank{Tier: r.Rank[0], File: r.Rank[1], Index: r.Rank[2]}
+		rule.Toml = r.TomlRule
+		conf.Rules = append(conf.Rules, rule)
+	}
+
+	conf.Warnings = append(conf.resolveSandboxes(), conf.resolveLabels()...)
+	conf.resolveContainers()
+	conf.resolvePathMaps()
+	return conf, nil
+}
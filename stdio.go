@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// validateStreams checks stdin/stdout/stderr settings, which are "inherit",
+// "null", "file:PATH" or, for output streams, "append:PATH".
+func validateStreams(stdin, stdout, stderr string) error {
+	for _, s := range []struct {
+		name, spec string
+		output     bool
+	}{
+		{"stdin", stdin, false},
+		{"stdout", stdout, true},
+		{"stderr", stderr, true},
+	} {
+		switch {
+		case s.spec == "", s.spec == "inherit", s.spec == "null":
+		case strings.HasPrefix(s.spec, "file:"):
+		case strings.HasPrefix(s.spec, "append:") && s.output:
+		default:
+			return fmt.Errorf("invalid %s %q", s.name, s.spec)
+		}
+	}
+	return nil
+}
+
+// output is the stdout commands inherit from apporte.
+func (r Rule) output() *os.File {
+	if r.Output == nil {
+		return os.Stdout
+	}
+	return r.Output
+}
+
+// setStreams connects the command's stdio as configured by the rule. Unset
+// streams are inherited from apporte, or connected to the null device when
+// inherit is false. The returned function closes any files opened here.
+func setStreams(cmd *exec.Cmd, rule Rule, inherit bool) (func(), error) {
+	var opened []*os.File
+	closeAll := func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}
+
+	open := func(spec string, std *os.File, output bool) (*os.File, error) {
+		switch {
+		case spec == "inherit", spec == "" && inherit:
+			return std, nil
+		case spec == "null", spec == "":
+			return nil, nil
+		}
+
+		var f *os.File
+		var err error
+		if path, ok := strings.CutPrefix(spec, "append:"); ok {
+			f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		} else if output {
+			f, err = os.Create(strings.TrimPrefix(spec, "file:"))
+		} else {
+			f, err = os.Open(strings.TrimPrefix(spec, "file:"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, f)
+		return f, nil
+	}
+
+	// nil files must not end up in the interfaces, or exec would use them
+	stdin, err := open(rule.Stdin, os.Stdin, false)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	stdout, err := open(rule.Stdout, rule.output(), true)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+
+	stderr, err := open(rule.Stderr, os.Stderr, true)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	if stderr != nil {
+		cmd.Stderr = stderr
+	}
+
+	return closeAll, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A successCriterion is a condition of success_when on how the command
+// exited or what it wrote.
+type successCriterion struct {
+	Stream string // "exit", "stdout" or "stderr"
+	Negate bool
+	Codes  []int          // exit statuses, for "exit"
+	Re     *regexp.Regexp // for the output streams
+	spec   string
+}
+
+func (c successCriterion) String() string {
+	return c.spec
+}
+
+// exitCriterionRe matches a condition on the exit status, outputCriterionRe
+// one on an output stream.
+var (
+	exitCriterionRe   = regexp.MustCompile(`^exit\s*(==|!=|\bin\b)\s*(.+)$`)
+	outputCriterionRe = regexp.MustCompile(`^(stdout|stderr)\s+(!?matches)\s+(.+)$`)
+)
+
+// parseSuccessWhen parses conditions joined with "and", e.g.
+// `exit in 0, 2 and stdout matches "OK"`. Patterns are quoted.
+func parseSuccessWhen(spec string) ([]successCriterion, error) {
+	var criteria []successCriterion
+	for _, part := range strings.Split(spec, " and ") {
+		part = strings.TrimSpace(part)
+		c := successCriterion{spec: part}
+		if m := exitCriterionRe.FindStringSubmatch(part); m != nil {
+			c.Stream, c.Negate = "exit", m[1] == "!="
+			values := strings.Split(strings.Trim(m[2], "[] "), ",")
+			if m[1] != "in" && len(values) > 1 {
+				return nil, fmt.Errorf("invalid success_when condition %q, use exit in for several statuses", part)
+			}
+			for _, v := range values {
+				code, err := strconv.Atoi(strings.TrimSpace(v))
+				if err != nil {
+					return nil, fmt.Errorf("invalid exit status %q in success_when", strings.TrimSpace(v))
+				}
+				c.Codes = append(c.Codes, code)
+			}
+		} else if m := outputCriterionRe.FindStringSubmatch(part); m != nil {
+			c.Stream, c.Negate = m[1], m[2] == "!matches"
+			pattern, err := strconv.Unquote(m[3])
+			if q := m[3]; err != nil && len(q) >= 2 && q[0] == '\'' && q[len(q)-1] == '\'' {
+				pattern, err = q[1:len(q)-1], nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid success_when condition %q, the pattern must be quoted", part)
+			}
+			if c.Re, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("invalid regex in success_when: %w", err)
+			}
+		} else {
+			return nil, fmt.Errorf("invalid success_when condition %q", part)
+		}
+		criteria = append(criteria, c)
+	}
+	return criteria, nil
+}
+
+// watches reports whether a condition reads the stream.
+func watches(criteria []successCriterion, stream string) bool {
+	for _, c := range criteria {
+		if c.Stream == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// unsuccessfulError is the error of a command that exited, but not as its
+// rule's success_when expects. It counts as a failed command for retries,
+// fallbacks and the exit status.
+type unsuccessfulError struct {
+	status int
+	unmet  successCriterion
+	err    error // of the command, if it exited with a non-zero status
+}
+
+func (e *unsuccessfulError) Error() string {
+	return fmt.Sprintf("exit status %d, but %s doesn't hold", e.status, e.unmet)
+}
+
+func (e *unsuccessfulError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode returns the status apporte passes on for the command, 1 when the
+// command exited with 0.
+func (e *unsuccessfulError) ExitCode() int {
+	if e.status == 0 {
+		return 1
+	}
+	return e.status
+}
+
+// checkSuccess decides whether a command that exited succeeded by the
+// criteria of its rule, given the error cmd.Wait returned and the output it
+// wrote. Without a condition on the exit status, only 0 is a success.
+func checkSuccess(criteria []successCriterion, err error, stdout, stderr string) error {
+	var exitErr *exec.ExitError
+	if err != nil && (!errors.As(err, &exitErr) || !exitErr.Exited()) {
+		return err
+	}
+	status := exitCode(err)
+	if !watches(criteria, "exit") && status != 0 {
+		return err
+	}
+	for _, c := range criteria {
+		var ok bool
+		switch c.Stream {
+		case "exit":
+			for _, code := range c.Codes {
+				ok = ok || code == status
+			}
+		case "stdout":
+			ok = c.Re.MatchString(stdout)
+		case "stderr":
+			ok = c.Re.MatchString(stderr)
+		}
+		if ok == c.Negate {
+			return &unsuccessfulError{status: status, unmet: c, err: err}
+		}
+	}
+	return nil
+}
+
+// maxCheckedOutput is how much of the end of each output stream is kept for
+// success_when.
+const maxCheckedOutput = 1 << 20
+
+// tailBuffer keeps the last maxCheckedOutput bytes written to it.
+type tailBuffer struct {
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if over := len(b.data) - maxCheckedOutput; over > 0 {
+		b.data = append(b.data[:0], b.data[over:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
+
+// teeOutput makes a stream of the command, which may be discarded, also go
+// to the buffer.
+func teeOutput(w io.Writer, buf *tailBuffer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(w, buf)
+}
@@ -0,0 +1,32 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func signalStatus(state *os.ProcessState) (int, bool) {
+	return 0, false
+}
+
+// setCredentials does nothing, umask and group are Unix settings.
+func setCredentials(cmd *exec.Cmd, rule Rule) (func(), error) {
+	return func() {}, nil
+}
+
+// checkGroup accepts any group, which only applies on Unix.
+func checkGroup(group string) error {
+	return nil
+}
+
+// setExecCredentials does nothing, as commands aren't exec'd here.
+func setExecCredentials(rule Rule) error {
+	return nil
+}
@@ -0,0 +1,117 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// signalStatus reports the signal that killed a process, if any.
+func signalStatus(state *os.ProcessState) (int, bool) {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, false
+	}
+	return int(ws.Signal()), true
+}
+
+// umaskMu keeps concurrent dispatches from starting commands with each
+// other's umask, as it belongs to the whole process.
+var umaskMu sync.Mutex
+
+// setCredentials makes cmd run in the rule's group and with its umask, which
+// is apporte's own until the returned function restores it.
+func setCredentials(cmd *exec.Cmd, rule Rule) (func(), error) {
+	if rule.Group != "" {
+		gid, err := ruleGroup(rule.Group)
+		if err != nil {
+			return nil, err
+		}
+		if gid != uint32(os.Getegid()) {
+			if cmd.SysProcAttr == nil {
+				cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(os.Getuid()), Gid: gid, NoSetGroups: true}
+		}
+	}
+	if rule.Umask == "" {
+		return func() {}, nil
+	}
+	mask, _ := strconv.ParseUint(rule.Umask, 8, 32)
+	umaskMu.Lock()
+	old := syscall.Umask(int(mask))
+	return func() {
+		syscall.Umask(old)
+		umaskMu.Unlock()
+	}, nil
+}
+
+// setExecCredentials switches apporte to the rule's group and umask before
+// it's replaced with the command.
+func setExecCredentials(rule Rule) error {
+	if rule.Group != "" {
+		gid, err := ruleGroup(rule.Group)
+		if err != nil {
+			return err
+		}
+		if gid != uint32(os.Getegid()) {
+			if err := syscall.Setgid(int(gid)); err != nil {
+				return fmt.Errorf("failed to switch to group %s: %w", rule.Group, err)
+			}
+		}
+	}
+	if rule.Umask != "" {
+		mask, _ := strconv.ParseUint(rule.Umask, 8, 32)
+		syscall.Umask(int(mask))
+	}
+	return nil
+}
+
+// checkGroup tells whether apporte can run commands in group at all, so that
+// rules it can't are rejected when they're loaded rather than on every
+// match.
+func checkGroup(group string) error {
+	_, err := ruleGroup(group)
+	return err
+}
+
+// ruleGroup returns the ID of a rule's group. Only root may switch to a group
+// other than apporte's own: for anyone else, setgid fails even for the
+// user's supplementary groups, whose access commands have anyway.
+func ruleGroup(group string) (uint32, error) {
+	gid, err := lookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %s: %w", group, err)
+	}
+	if gid == uint32(os.Getegid()) || os.Geteuid() == 0 {
+		return gid, nil
+	}
+	if groups, _ := os.Getgroups(); slices.Contains(groups, int(gid)) {
+		return 0, fmt.Errorf("group %s needs apporte to run as root, commands already have its access as the user is in it", group)
+	}
+	return 0, fmt.Errorf("group %s needs apporte to run as root", group)
+}
+
+// lookupGroup returns the ID of a group given by name or ID.
+func lookupGroup(group string) (uint32, error) {
+	if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), err
+}
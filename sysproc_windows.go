@@ -0,0 +1,42 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const (
+	detachedProcess       = 0x00000008
+	createNewProcessGroup = 0x00000200
+)
+
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: detachedProcess | createNewProcessGroup,
+		HideWindow:    true,
+	}
+}
+
+// signalStatus reports the signal that killed a process, which processes on
+// Windows don't have.
+func signalStatus(state *os.ProcessState) (int, bool) {
+	return 0, false
+}
+
+// setCredentials does nothing, umask and group are Unix settings.
+func setCredentials(cmd *exec.Cmd, rule Rule) (func(), error) {
+	return func() {}, nil
+}
+
+// checkGroup accepts any group, which only applies on Unix.
+func checkGroup(group string) error {
+	return nil
+}
+
+// setExecCredentials does nothing, as commands aren't exec'd here.
+func setExecCredentials(rule Rule) error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// templateMarker, alone on the first line of a config, makes it a template.
+const templateMarker = "#:template"
+
+// envRefRe matches a reference to an environment variable in a template.
+var envRefRe = regexp.MustCompile(`\{\{env\.([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+
+// isTemplate reports whether a config starts with the template marker.
+func isTemplate(data []byte) bool {
+	first, _, _ := bytes.Cut(data, []byte("\n"))
+	return string(bytes.TrimSpace(first)) == templateMarker
+}
+
+// templateBranch is an #:if block of a template being expanded.
+type templateBranch struct {
+	line   int
+	parent bool // whether the lines around the block are kept
+	active bool // whether the lines of the current branch are kept
+	taken  bool // whether a branch has been kept already
+	isElse bool // whether the current branch is the #:else
+}
+
+// expandTemplate expands a config template before it's parsed. Lines between
+// `#:if COND`, `#:elif COND`, `#:else` and `#:end` are kept only when their
+// condition holds, tested like when, and `{{env.NAME}}` becomes the value of
+// the environment variable. Directives and dropped lines are left empty, so
+// that errors point to the lines of the template.
+func expandTemplate(ctx context.Context, data []byte, facts map[string]*fact) ([]byte, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	var stack []*templateBranch
+	keep := true
+	var out strings.Builder
+	for i, line := range lines {
+		n := i + 1
+		text := strings.TrimSpace(line)
+		if !strings.HasPrefix(text, "#:") {
+			if keep {
+				out.WriteString(envRefRe.ReplaceAllStringFunc(line, func(ref string) string {
+					return os.Getenv(envRefRe.FindStringSubmatch(ref)[1])
+				}))
+			} else if strings.HasSuffix(line, "\n") {
+				out.WriteString("\n")
+			}
+			continue
+		}
+		if strings.HasSuffix(line, "\n") {
+			out.WriteString("\n")
+		}
+		directive, arg, _ := strings.Cut(text[2:], " ")
+		arg = strings.TrimSpace(arg)
+		var top *templateBranch
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		switch directive {
+		case "template":
+			if n != 1 {
+				return nil, fmt.Errorf("line %d: #:template must be the first line", n)
+			}
+		case "if":
+			b := &templateBranch{line: n, parent: keep}
+			if keep {
+				holds, err := templateCondition(ctx, arg, facts)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				b.active, b.taken = holds, holds
+			}
+			stack = append(stack, b)
+			keep = b.active
+		case "elif":
+			if top == nil {
+				return nil, fmt.Errorf("line %d: #:elif without #:if", n)
+			}
+			if top.isElse {
+				return nil, fmt.Errorf("line %d: #:elif after #:else", n)
+			}
+			top.active = false
+			if top.parent && !top.taken {
+				holds, err := templateCondition(ctx, arg, facts)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				top.active, top.taken = holds, holds
+			}
+			keep = top.active
+		case "else":
+			if top == nil {
+				return nil, fmt.Errorf("line %d: #:else without #:if", n)
+			}
+			if top.isElse {
+				return nil, fmt.Errorf("line %d: second #:else", n)
+			}
+			top.isElse = true
+			top.active = top.parent && !top.taken
+			keep = top.active
+		case "end":
+			if top == nil {
+				return nil, fmt.Errorf("line %d: #:end without #:if", n)
+			}
+			stack = stack[:len(stack)-1]
+			keep = top.parent
+		default:
+			return nil, fmt.Errorf("line %d: unknown template directive #:%s", n, directive)
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("line %d: #:if without #:end", stack[len(stack)-1].line)
+	}
+	return []byte(out.String()), nil
+}
+
+// templateCondition tests the condition of an #:if or #:elif.
+func templateCondition(ctx context.Context, cond string, facts map[string]*fact) (bool, error) {
+	if cond == "" {
+		return false, errors.New("missing condition")
+	}
+	conds, err := parseWhen(cond)
+	if err != nil {
+		return false, err
+	}
+	return conditionsHold(ctx, conds, facts), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import "strings"
+
+// validTargets lists the values accepted by a rule's target option.
+var validTargets = map[string]bool{
+	"tmux-split":  true,
+	"tmux-window": true,
+}
+
+// inTmux wraps the rule's command so that it opens in a new tmux pane or
+// window. The pane is spawned by the tmux server, so the working directory
+// and environment are passed along explicitly.
+func inTmux(rule Rule) []string {
+	argv := []string{"tmux", "split-window"}
+	if rule.Target == "tmux-window" {
+		argv = []string{"tmux", "new-window"}
+	}
+
+	if rule.Cwd != "" {
+		argv = append(argv, "-c", rule.Cwd)
+	}
+	vars := matchEnv(rule)
+	for k, v := range rule.Env {
+		vars[k] = v
+	}
+	for _, kv := range sortedEnv(vars) {
+		argv = append(argv, "-e", kv)
+	}
+
+	// the pane would inherit the environment of the tmux server
+	if rule.EnvClear {
+		return append(argv, shellJoin(append(append([]string{"env", "-i"}, environ(rule)...), rule.Apporte...)))
+	}
+	return append(argv, shellJoin(rule.Apporte))
+}
+
+// shellJoin quotes argv into a single POSIX shell command line.
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
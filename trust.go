@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errUntrusted marks configs found by the crawl that the user hasn't
+// trusted yet, in their current content.
+var errUntrusted = errors.New("config isn't trusted")
+
+// trustStorePath returns the file listing the trusted configs, one line of
+// "SHA256 PATH" each.
+func trustStorePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "apporte", "trusted"), nil
+}
+
+// loadTrust returns the hash of every trusted config by path key.
+func loadTrust() map[string]string {
+	trust := map[string]string{}
+	path, err := trustStorePath()
+	if err != nil {
+		return trust
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return trust
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if hash, config, ok := strings.Cut(scanner.Text(), " "); ok {
+			trust[pathKey(config)] = hash
+		}
+	}
+	return trust
+}
+
+// configHash identifies the content of a config as trusted.
+func configHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isTrusted reports whether the config at path is trusted as it is now.
+func isTrusted(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return false
+	}
+	return loadTrust()[pathKey(abs)] == configHash(data)
+}
+
+// setTrust trusts the config at path in its current content, or revokes the
+// trust.
+func setTrust(path string, trusted bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	store, err := trustStorePath()
+	if err != nil {
+		return err
+	}
+
+	// the store is keyed by path key, but keeps paths as written
+	entries := map[string]string{}
+	if data, err := os.ReadFile(store); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if hash, config, ok := strings.Cut(line, " "); ok {
+				entries[config] = hash
+			}
+		}
+	}
+	for config := range entries {
+		if pathKey(config) == pathKey(abs) {
+			delete(entries, config)
+		}
+	}
+	if trusted {
+		data, err := os.ReadFile(abs)
+		if err != nil {
+			return err
+		}
+		entries[abs] = configHash(data)
+	}
+
+	configs := make([]string, 0, len(entries))
+	for config := range entries {
+		configs = append(configs, config)
+	}
+	sort.Strings(configs)
+	var out strings.Builder
+	for _, config := range configs {
+		out.WriteString(entries[config] + " " + config + "\n")
+	}
+	if err := os.MkdirAll(filepath.Dir(store), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(store, []byte(out.String()), 0o600)
+}
+
+// keepTrust runs a change the user makes to a config, and trusts the result
+// if the config was trusted before or didn't exist.
+func keepTrust(path string, change func() error) error {
+	_, statErr := os.Stat(path)
+	trusted := os.IsNotExist(statErr) || isTrusted(path)
+	if err := change(); err != nil {
+		return err
+	}
+	if trusted {
+		return setTrust(path, true)
+	}
+	return nil
+}
+
+// trustFlags are the flags of trust.
+type trustFlags struct {
+	revoke bool
+}
+
+func (f *trustFlags) define(fs *flag.FlagSet) {
+	fs.BoolVar(&f.revoke, "revoke", false, "Revoke the trust instead")
+}
+
+// trustCommand lets the configs of a directory tree dispatch, like direnv's
+// allow. Trust is tied to the content of the config, which needs to be
+// trusted again after it changes.
+func trustCommand(ctx context.Context, args []string, opts options) int {
+	var given trustFlags
+	flags := commandFlags("trust", given.define)
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	if path == "" {
+		cwd, _ := os.Getwd()
+		startDir, err := crawlStart(cwd, opts.Physical)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: %v", err))
+		}
+		if path = nearestConfig(startDir, nil); path == "" {
+			fmt.Fprintln(os.Stderr, opts.Engine.tr("No config found"))
+			return 1
+		}
+	} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, ".apporte.toml")
+	}
+
+	if err := setTrust(path, !given.revoke); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to update the trust of %s: %v", path, err))
+		return 1
+	}
+	if given.revoke {
+		fmt.Println(opts.Engine.trf("Revoked the trust of %s", path))
+	} else {
+		fmt.Println(opts.Engine.trf("Trusted %s", path))
+	}
+	return 0
+}
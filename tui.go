@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tuiHelp lists the keys of the rule browser.
+const tuiHelp = `Type an input to test it, or a command:
+  :d N	disable or enable rule N for this session
+  :e N	edit the config of rule N
+  :r	reload the configs
+  :q	quit`
+
+// tuiCommand browses the merged rules on the terminal. Inputs typed in are
+// matched as they would be dispatched, without dispatching anything.
+func tuiCommand(ctx context.Context, args []string, opts options) int {
+	if len(args) != 0 {
+		commandUsage("tui")
+		return 2
+	}
+	stat, err := os.Stdout.Stat()
+	fullScreen := err == nil && stat.Mode()&os.ModeCharDevice != 0
+
+	cwd, _ := os.Getwd()
+	var conf Config
+	load := func() []Rule {
+		var err error
+		if conf, err = loadConfig(ctx, cwd, opts); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Errors while loading rules:\n%s", err))
+		}
+		return conf.Rules
+	}
+	rules := load()
+	disabled := map[int]bool{}
+	input, message := "", ""
+
+	in := bufio.NewReader(os.Stdin)
+	for {
+		if fullScreen {
+			fmt.Print("\x1b[H\x1b[2J")
+		}
+		tuiDraw(ctx, os.Stdout, rules, disabled, input, opts.Score || conf.Score, opts)
+		if message != "" {
+			fmt.Println(message)
+		}
+		fmt.Print("> ")
+
+		line, err := readAnswer(ctx, in)
+		if err != nil && line == "" {
+			fmt.Println()
+			return 0
+		}
+		line = strings.TrimSpace(line)
+		message = ""
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch cmd {
+		case ":q":
+			return 0
+		case ":h", "?":
+			message = opts.Engine.tr(tuiHelp)
+		case ":r":
+			rules, disabled = load(), map[int]bool{}
+		case ":d", ":e":
+			n, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil || n < 1 || n > len(rules) {
+				message = opts.Engine.trf("No rule %q", arg)
+				break
+			}
+			if cmd == ":d" {
+				disabled[n-1] = !disabled[n-1]
+				break
+			}
+			path := rules[n-1].Source
+			editCmd := editorCommand(path, rules[n-1].Line)
+			editCmd.Stdin, editCmd.Stdout, editCmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if err := keepTrust(path, editCmd.Run); err != nil {
+				message = opts.Engine.trf("Editor failed: %v", err)
+				break
+			}
+			rules, disabled = load(), map[int]bool{}
+		default:
+			input = prepareInput(line, conf, opts)
+		}
+	}
+}
+
+// tuiDraw lists the rules, marking the ones disabled and those matching the
+// input with their order, the winner first.
+func tuiDraw(ctx context.Context, w io.Writer, rules []Rule, disabled map[int]bool, input string, score bool, opts options) {
+	order := map[int]int{}
+	if input != "" {
+		var enabled []Rule
+		// the rank of a rule tells it apart once matched
+		position := map[rank]int{}
+		for i, rule := range rules {
+			if !disabled[i] {
+				enabled = append(enabled, rule)
+				position[rule.Rank] = i
+			}
+		}
+		// ordered as dispatching would, the winner first
+		matched, _ := matchRules(ctx, input, enabled, opts)
+		if score {
+			sortByScore(matched)
+		}
+		for place, rule := range matched {
+			order[position[rule.Rank]] = place + 1
+		}
+	}
+
+	for i, rule := range rules {
+		mark := "  "
+		switch {
+		case disabled[i]:
+			mark = " -"
+		case order[i] == 1:
+			mark = " *"
+		case order[i] > 1:
+			mark = " " + strconv.Itoa(order[i])
+		}
+		fmt.Fprintf(w, "%s %3d  %-40s %s\n", mark, i+1, rule.Match, rule.menuLabel())
+		if rule.Icon != "" {
+			fmt.Fprintln(w, "          "+opts.Engine.trf("%s, icon %s", rule.location(), rule.Icon))
+		} else {
+			fmt.Fprintf(w, "          %s\n", rule.location())
+		}
+	}
+	if input == "" {
+		fmt.Fprintln(w, "\n"+opts.Engine.tr("Type an input to test it, :h for help."))
+		return
+	}
+	if len(order) == 0 {
+		fmt.Fprintln(w, "\n"+opts.Engine.trf("No rules match %s", input))
+		return
+	}
+	fmt.Fprintln(w, "\n"+opts.Engine.trf("%s: %d matching, * wins", input, len(order)))
+}
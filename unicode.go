@@ -0,0 +1,26 @@
+package main
+
+import "golang.org/x/text/unicode/norm"
+
+// unicodeForms maps the values of a config file's unicode key to
+// normalization forms. macOS hands out file names in NFD, while patterns are
+// usually typed in NFC.
+var unicodeForms = map[string]*norm.Form{
+	"":     nil,
+	"none": nil,
+	"nfc":  formPtr(norm.NFC),
+	"nfd":  formPtr(norm.NFD),
+	"nfkc": formPtr(norm.NFKC),
+	"nfkd": formPtr(norm.NFKD),
+}
+
+func formPtr(f norm.Form) *norm.Form {
+	return &f
+}
+
+func normalizeUnicode(s, form string) string {
+	if f := unicodeForms[form]; f != nil {
+		return f.String(s)
+	}
+	return s
+}
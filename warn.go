@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Levels of warnings: errors skipped a config or rule, warnings only mean
+// something is likely not what was meant.
+const (
+	levelError   = "error"
+	levelWarning = "warning"
+)
+
+// warnLevels are the values of --warn-level, by the levels they show.
+var warnLevels = map[string][]string{
+	"warning": {levelError, levelWarning},
+	"error":   {levelError},
+	"none":    nil,
+}
+
+// A warning is a problem with the configs that apporte works around. Its kind
+// tells what is wrong, e.g. "invalid_rule" or "unknown_key", for tools to
+// tell warnings apart without parsing the message. Warnings are errors, so
+// that strict mode can fail with them.
+type warning struct {
+	Level   string `json:"level"`
+	Kind    string `json:"kind"`
+	Source  string `json:"source,omitempty"`  // config file
+	Profile string `json:"profile,omitempty"` // of the rule
+	Rule    *int   `json:"rule,omitempty"`    // index of the rule in its table
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (w warning) Error() string {
+	var b strings.Builder
+	if w.Source != "" {
+		fmt.Fprintf(&b, "%s in %q: ", w.Level, w.Source)
+	}
+	if w.Line > 0 {
+		fmt.Fprintf(&b, "line %d, ", w.Line)
+	}
+	if w.Rule != nil {
+		b.WriteString(ruleLabel(w.Profile, *w.Rule) + ": ")
+	}
+	b.WriteString(w.Message)
+	return b.String()
+}
+
+// location names where the problem is, like the location of a rule.
+func (w warning) location() string {
+	switch {
+	case w.Rule != nil && w.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", w.Source, w.Line, ruleLabel(w.Profile, *w.Rule))
+	case w.Rule != nil:
+		return fmt.Sprintf("%s: %s", w.Source, ruleLabel(w.Profile, *w.Rule))
+	}
+	return w.Source
+}
+
+// ruleLabel names a rule by its table and index, e.g. "rule 2".
+func ruleLabel(profile string, i int) string {
+	if profile != "" {
+		return fmt.Sprintf("profile %q rule %d", profile, i)
+	}
+	return fmt.Sprintf("rule %d", i)
+}
+
+// warning describes a problem with the rule.
+func (r Rule) warning(level, kind, message string) warning {
+	index := r.Index
+	return warning{Level: level, Kind: kind, Source: r.Source, Profile: r.Profile, Rule: &index, Line: r.Line, Message: message}
+}
+
+// warningsOf splits an error, joined or not, into warnings. Errors that
+// aren't warnings already made the config at source be skipped.
+func warningsOf(err error, source string) []warning {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var warnings []warning
+		for _, e := range joined.Unwrap() {
+			warnings = append(warnings, warningsOf(e, source)...)
+		}
+		return warnings
+	}
+	w, ok := err.(warning)
+	if !ok {
+		w = warning{Level: levelError, Kind: "invalid_config", Message: err.Error()}
+		if errors.Is(err, errUntrusted) {
+			w.Kind = "untrusted_config"
+		}
+	}
+	if w.Source == "" {
+		w.Source = source
+	}
+	return []warning{w}
+}
+
+// joinWarnings turns warnings into an error, nil if there are none.
+func joinWarnings(warnings []warning) error {
+	errs := make([]error, len(warnings))
+	for i, w := range warnings {
+		errs[i] = w
+	}
+	return errors.Join(errs...)
+}
+
+// shownWarnings returns the warnings shown at a --warn-level.
+func shownWarnings(warnings []warning, warnLevel string) []warning {
+	var shown []warning
+	for _, item := range warnings {
+		if slices.Contains(warnLevels[warnLevel], item.Level) {
+			shown = append(shown, item)
+		}
+	}
+	return shown
+}
+
+// printWarnings writes the warnings shown at the --warn-level, under a
+// heading if there is one, or one JSON object per line with --warn-format
+// json.
+func printWarnings(w io.Writer, heading string, warnings []warning, opts options) {
+	shown := shownWarnings(warnings, opts.WarnLevel)
+	if len(shown) == 0 {
+		return
+	}
+
+	if opts.WarnFormat == "json" {
+		enc := json.NewEncoder(w)
+		for _, item := range shown {
+			enc.Encode(item)
+		}
+		return
+	}
+	if heading != "" {
+		fmt.Fprintf(w, "%s:\n", opts.Engine.tr(heading))
+	}
+	for _, item := range shown {
+		fmt.Fprintln(w, item)
+	}
+}
+
+// matchWarnings collects the warnings of match results. Every input reports
+// the same invalid patterns, they are only listed once.
+func matchWarnings(results []matchResult) []warning {
+	var warnings []warning
+	seen := map[string]bool{}
+	for _, result := range results {
+		for _, w := range warningsOf(result.Err, "") {
+			if !seen[w.Error()] {
+				seen[w.Error()] = true
+				warnings = append(warnings, w)
+			}
+		}
+	}
+	return warnings
+}
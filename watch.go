@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFlags are the flags of watch.
+type watchFlags struct {
+	debounce    time.Duration
+	include     globList
+	exclude     globList
+	metricsAddr string
+	maxChildren int
+}
+
+func (f *watchFlags) define(fs *flag.FlagSet) {
+	fs.DurationVar(&f.debounce, "debounce", time.Second, "Quiet period before a new file is dispatched")
+	fs.Var(&f.include, "include", "Only dispatch file names matching GLOB (repeatable)")
+	fs.Var(&f.exclude, "exclude", "Never dispatch file names matching GLOB (repeatable)")
+	fs.StringVar(&f.metricsAddr, "metrics", "", "Serve Prometheus metrics at /metrics of ADDR, e.g. localhost:9464")
+	fs.IntVar(&f.maxChildren, "max-children", 1, "Most dispatches running at a time")
+}
+
+// watchCommand dispatches files created in a directory, once they have been
+// left alone for the debounce period.
+func watchCommand(ctx context.Context, args []string, opts options) int {
+	var given watchFlags
+	fs := commandFlags("watch", given.define)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Invalid directory: %v", err))
+		return 1
+	}
+
+	var metrics *watchMetrics
+	if given.metricsAddr != "" {
+		metrics = newWatchMetrics()
+		if err := serveMetrics(given.metricsAddr, metrics); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to serve metrics: %v", err))
+			return 1
+		}
+	}
+
+	// commands run off the event loop, which keeps collecting files
+	queue := newDispatchQueue(given.maxChildren)
+	if err := queue.publishAs("watch " + dir); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Warning: failed to publish the queue: %v", err))
+	}
+	defer queue.stop()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to watch %s: %v", dir, err))
+		return 1
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to watch %s: %v", dir, err))
+		return 1
+	}
+
+	wanted := func(path string) bool {
+		name := filepath.Base(path)
+		if len(given.include) > 0 && !given.include.matchAny(name) {
+			return false
+		}
+		return !given.exclude.matchAny(name)
+	}
+
+	// files are tracked from creation until they've been quiet long enough,
+	// writes in between push the dispatch back
+	pending := map[string]*time.Timer{}
+	ready := make(chan string)
+	// timers still pending once watching stops don't wait for the loop
+	stopped := make(chan struct{})
+	defer close(stopped)
+	send := func(ch chan<- string, name string) func() {
+		return func() {
+			select {
+			case ch <- name:
+			case <-stopped:
+			}
+		}
+	}
+
+	// files won by a rule with a debounce wait for the rule to be quiet, and
+	// are then dispatched together
+	bursts := map[string]*burst{}
+	flush := make(chan string)
+	limits := map[string]*rateLimiter{}
+	dispatch := func(conf Config, results []matchResult) {
+		rule := results[0].Matched[0]
+		if rule.RateLimit > 0 {
+			key := rule.Source + "\x00" + rule.Label
+			if limits[key] == nil {
+				limits[key] = &rateLimiter{}
+			}
+			if !limits[key].allow(rule.RateLimit, rule.RatePeriod, time.Now()) {
+				for _, result := range results {
+					fmt.Fprintln(os.Stderr, opts.Engine.trf("Rate limit of %q reached, skipping %s", rule.menuLabel(), result.Input))
+				}
+				metrics.dispatched(rule, "rate_limited")
+				return
+			}
+		}
+		inputs := make([]string, len(results))
+		for i, result := range results {
+			inputs[i] = result.Input
+		}
+		queue.submit(rule, inputs, func() {
+			if dispatchResults(ctx, conf, results, opts, true) != 0 {
+				metrics.dispatched(rule, "failed")
+			} else {
+				metrics.dispatched(rule, "ok")
+			}
+		})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return 0
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return 0
+			}
+			if timer, ok := pending[event.Name]; ok && event.Has(fsnotify.Write) {
+				timer.Reset(given.debounce)
+				continue
+			}
+			if !event.Has(fsnotify.Create) || !wanted(event.Name) {
+				continue
+			}
+			name := event.Name
+			pending[name] = time.AfterFunc(given.debounce, send(ready, name))
+
+		case name := <-ready:
+			delete(pending, name)
+			if info, err := os.Stat(name); err != nil || info.IsDir() {
+				continue
+			}
+			conf, err := loadConfig(ctx, dir, opts)
+			metrics.configLoaded(err)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, opts.Engine.trf("Errors while loading rules, skipping %s:\n%s", name, err))
+				continue
+			}
+			start := time.Now()
+			results := matchInputs(ctx, []string{name}, conf.Rules, opts)
+			metrics.matched(time.Since(start), results)
+			if len(results[0].Matched) == 0 {
+				dispatchResults(ctx, conf, results, opts, true)
+				continue
+			}
+			rule := results[0].Matched[0]
+			if rule.Debounce == 0 {
+				dispatch(conf, results)
+				continue
+			}
+			key := rule.Source + "\x00" + rule.Label
+			b, ok := bursts[key]
+			if !ok {
+				b = &burst{timer: time.AfterFunc(rule.Debounce, send(flush, key))}
+				bursts[key] = b
+			} else {
+				b.timer.Reset(rule.Debounce)
+			}
+			b.add(conf, results[0])
+
+		case key := <-flush:
+			b := bursts[key]
+			delete(bursts, key)
+			dispatch(b.conf, b.results)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return 0
+			}
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Watch error: %v", err))
+			metrics.watchError()
+		}
+	}
+}
+
+// burst collects the files a debounced rule won while events keep coming.
+type burst struct {
+	timer   *time.Timer
+	conf    Config
+	results []matchResult
+}
+
+// add records a file, once however often it comes up again.
+func (b *burst) add(conf Config, result matchResult) {
+	b.conf = conf
+	for _, r := range b.results {
+		if r.Input == result.Input {
+			return
+		}
+	}
+	b.results = append(b.results, result)
+}
+
+// rateLimiter remembers the recent dispatches of a rule.
+type rateLimiter struct {
+	times []time.Time
+}
+
+// allow reports whether another dispatch fits in the limit of n per period,
+// and records it if so.
+func (l *rateLimiter) allow(n int, period time.Duration, now time.Time) bool {
+	recent := l.times[:0]
+	for _, t := range l.times {
+		if now.Sub(t) < period {
+			recent = append(recent, t)
+		}
+	}
+	l.times = recent
+	if len(l.times) >= n {
+		return false
+	}
+	l.times = append(l.times, now)
+	return true
+}
+
+// parseRateLimit parses a limit such as "10/1m", ten dispatches a minute.
+func parseRateLimit(limit string) (int, time.Duration, error) {
+	count, period, ok := strings.Cut(limit, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid rate_limit %q, expected COUNT/DURATION", limit)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return 0, 0, fmt.Errorf("invalid rate_limit %q, expected a positive count", limit)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate_limit %q, expected a positive duration", limit)
+	}
+	return n, d, nil
+}
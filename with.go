@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+// withRule builds the rule dispatching an input to a command given on the
+// command line. The input is appended unless the command places it itself.
+func withRule(input string, argv []string) Rule {
+	placed := false
+	for _, arg := range argv {
+		placed = placed || placeholderRe.MatchString(arg)
+	}
+	if !placed {
+		argv = append(argv[:len(argv):len(argv)], "{input}")
+	}
+	return Rule{
+		Match:   &lazyRegexp{},
+		Desc:    "Command given with --with",
+		Apporte: argv,
+		Source:  "(--with)",
+		Rank:    rank{Tier: tierBuiltin},
+		Input:   input,
+		Groups:  []string{input},
+	}
+}
+
+// saveWithRule adds the command given with --with to the nearest config, for
+// inputs with the same extension, or for this very input if it has none.
+func saveWithRule(input string, argv []string, opts options) error {
+	match := "^" + regexp.QuoteMeta(input) + "$"
+	if ext := filepath.Ext(input); ext != "" {
+		match = regexp.QuoteMeta(ext) + "$"
+	}
+	path, err := addTarget("nearest", opts)
+	if err != nil {
+		return err
+	}
+	if err := appendRule(path, "", match, "", withRule(input, argv).Apporte); err != nil {
+		return err
+	}
+	fmt.Println(opts.Engine.trf("Added rule for %s to %s", match, path))
+	return nil
+}
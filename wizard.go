@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// wizardCategory is a kind of input the setup wizard proposes a rule for,
+// with the programs it knows for it, preferred first.
+type wizardCategory struct {
+	name     string
+	desc     string
+	match    string
+	sample   string   // an input the rule must match
+	env      []string // variables naming the user's choice, e.g. BROWSER
+	programs []string
+	files    bool // the program takes all the inputs of a batch
+	options  string
+}
+
+var wizardCategories = []wizardCategory{
+	{name: "web", desc: "Web links", match: `^https?://`, sample: "https://example.org/", env: []string{"BROWSER"},
+		programs: []string{"firefox", "librewolf", "chromium", "google-chrome", "brave-browser", "epiphany"}},
+	{name: "pdf", desc: "PDFs", match: `\.pdf$`, sample: "document.pdf",
+		programs: []string{"zathura", "evince", "okular", "mupdf", "qpdfview"}},
+	{name: "image", desc: "Images", match: `\.(png|jpe?g|gif|webp)$`, sample: "picture.png", files: true,
+		programs: []string{"imv", "nsxiv", "sxiv", "feh", "eog", "gwenview", "ristretto"}},
+	{name: "media", desc: "Videos and music", match: `\.(mkv|mp4|webm|mp3|flac|ogg)$`, sample: "video.mkv", options: "background = true\n",
+		programs: []string{"mpv", "vlc", "celluloid", "totem"}},
+	{name: "text", desc: "Text and source files", match: `\.(txt|md|go|py|rs|toml|json)$`, sample: "notes.txt", env: []string{"VISUAL", "EDITOR"},
+		programs: []string{"nvim", "vim", "hx", "micro", "nano", "emacs", "code", "gedit", "kate"}},
+}
+
+// terminalPrograms need a terminal to run in.
+var terminalPrograms = map[string]bool{"nvim": true, "vim": true, "vi": true, "hx": true, "micro": true, "nano": true, "kak": true}
+
+// detect returns the programs of the category that are installed, those the
+// user's environment names first.
+func (c wizardCategory) detect() []string {
+	var found []string
+	seen := map[string]bool{}
+	candidates := c.programs
+	for i := len(c.env) - 1; i >= 0; i-- {
+		if fields := strings.Fields(os.Getenv(c.env[i])); len(fields) > 0 {
+			candidates = append([]string{fields[0]}, candidates...)
+		}
+	}
+	for _, program := range candidates {
+		if seen[program] {
+			continue
+		}
+		seen[program] = true
+		if _, err := exec.LookPath(program); err == nil {
+			found = append(found, program)
+		}
+	}
+	return found
+}
+
+// rule writes the rule of the category dispatching to program.
+func (c wizardCategory) rule(program string) string {
+	arg := "{input}"
+	if c.files {
+		arg = "{files}"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n# %s\n[[rule]]\n", c.desc)
+	fmt.Fprintf(&b, "name = %s\nmatch = '%s'\n", formatString(c.name), c.match)
+	fmt.Fprintf(&b, "apporte = [%s, %s]\n", formatString(program), formatString(arg))
+	b.WriteString(c.options)
+	if terminalPrograms[filepath.Base(program)] {
+		b.WriteString("terminal = true\n")
+	}
+	return b.String()
+}
+
+// check loads the rule of the category dispatching to program as apporte
+// would, and makes sure it passes the category's sample input on to it.
+func (c wizardCategory) check(ctx context.Context, e *engine, program string) error {
+	var tc TomlConfig
+	if _, err := toml.Decode(c.rule(program), &tc); err != nil {
+		return err
+	}
+	rule, err := e.convertRule(tc.Rules[0], tc, newRegexCache(0))
+	if err != nil {
+		return err
+	}
+	rule.Source = "setup"
+	if warnings := lintRule(rule); len(warnings) > 0 {
+		return joinWarnings(warnings)
+	}
+	matched, ok, err := matchRule(ctx, c.sample, rule, options{Engine: e})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("it doesn't match %s", c.sample)
+	}
+	if argv := expandRule(matched).Apporte; !slices.Contains(argv, c.sample) {
+		return fmt.Errorf("it runs %v for %s", argv, c.sample)
+	}
+	return nil
+}
+
+// setupWizard walks through writing the user config from the programs
+// installed, and integrating apporte with the system. Answers left empty, or
+// missing when stdin isn't a terminal, take the default.
+func setupWizard(ctx context.Context, opts options) int {
+	userConfDir, err := os.UserConfigDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("No user config directory: %v", err))
+		return 1
+	}
+	path := filepath.Join(userConfDir, ".apporte.toml")
+	if _, err := os.Stat(path); err == nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("%s already exists, edit it with apporte edit or remove it to start over", path))
+		return 1
+	}
+	in := bufio.NewReader(os.Stdin)
+	ask := func(question string) (string, error) {
+		fmt.Print(question)
+		answer, err := readAnswer(ctx, in)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil {
+			// no terminal, or it was closed: the default it is
+			fmt.Println()
+		}
+		return strings.TrimSpace(answer), nil
+	}
+	yes := func(question string, def bool) (bool, error) {
+		answer, err := ask(question)
+		if err != nil || answer == "" {
+			return def, err
+		}
+		answer = strings.ToLower(answer)
+		return strings.HasPrefix(answer, "y") || strings.HasPrefix(answer, opts.Engine.tr("y")), nil
+	}
+
+	config := "# Written by apporte setup. Rules are tried from top to bottom and the first\n# match wins, see apporte help config.\nversion = 2\n"
+	rules := 0
+	for _, category := range wizardCategories {
+		found := category.detect()
+		if len(found) == 0 {
+			fmt.Println(opts.Engine.trf("%s: nothing found, skipped", opts.Engine.tr(category.desc)) + "\n")
+			continue
+		}
+		fmt.Printf("%s (%s):\n", opts.Engine.tr(category.desc), category.match)
+		for i, program := range found {
+			fmt.Printf("  %d) %s\n", i+1, program)
+		}
+		fmt.Println("  " + opts.Engine.tr("0) none"))
+		for {
+			answer, err := ask(opts.Engine.tr("Choose [1]: "))
+			if err != nil {
+				return opts.Engine.interrupted("", err)
+			}
+			n := 1
+			if answer != "" {
+				if n, err = strconv.Atoi(answer); err != nil || n < 0 || n > len(found) {
+					continue
+				}
+			}
+			if n > 0 {
+				if err := category.check(ctx, opts.Engine, found[n-1]); err != nil {
+					fmt.Fprintln(os.Stderr, opts.Engine.trf("Not adding the rule for %s: %v", found[n-1], err))
+					break
+				}
+				config += category.rule(found[n-1])
+				rules++
+			}
+			break
+		}
+		fmt.Println()
+	}
+
+	fmt.Println(opts.Engine.trf("The config:\n\n%s", config))
+	write, err := yes(opts.Engine.trf("Write it to %s? [Y/n] ", path), true)
+	if err != nil {
+		return opts.Engine.interrupted("", err)
+	}
+	if !write {
+		return 0
+	}
+	if err := os.MkdirAll(userConfDir, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to create %s: %v", userConfDir, err))
+		return 1
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("%s already exists", path))
+		return 1
+	}
+	if err == nil {
+		_, err = f.WriteString(config)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write %s: %v", path, err))
+		return 1
+	}
+	fmt.Println(opts.Engine.trf("Created %s with %d rules", path, rules) + "\n")
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to locate apporte: %v", err))
+		return 1
+	}
+	status := 0
+	if ok, err := yes(opts.Engine.tr("Make apporte the handler of web links, sending them through the rules? [y/N] "), false); err != nil {
+		return opts.Engine.interrupted("", err)
+	} else if ok {
+		if err := opts.Engine.registerURLHandler(exe, []string{"http", "https"}); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to register the URL handler: %v", err))
+			status = 1
+		}
+	}
+	// desktop entries are how file managers on Linux and the BSDs offer apps
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" || rules == 0 {
+		return status
+	}
+	if ok, err := yes(opts.Engine.tr(`List the rules under "Open With" of file managers? [y/N] `), false); err != nil {
+		return opts.Engine.interrupted("", err)
+	} else if ok {
+		if err := setupDesktopEntries(ctx, exe, userConfDir, opts); err != nil {
+			fmt.Fprintln(os.Stderr, opts.Engine.trf("Failed to write desktop entries: %v", err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// setupDesktopEntries writes the desktop entries of the user config's rules,
+// as generate-desktop does.
+func setupDesktopEntries(ctx context.Context, exe, userConfDir string, opts options) error {
+	conf, err := loadConfig(ctx, userConfDir, opts)
+	if err != nil {
+		return err
+	}
+	dir, err := applicationsDir()
+	if err != nil {
+		return err
+	}
+	return opts.Engine.writeDesktopEntries(dir, exe, desktopEntries(conf.Rules))
+}